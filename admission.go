@@ -0,0 +1,209 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dbLatencyAlpha DB 延迟指数加权移动平均的平滑系数
+	dbLatencyAlpha = 0.2
+	// dbLatencyDecayGrace / dbLatencyHalfLife 无新样本时延迟估计的衰减参数
+	dbLatencyDecayGrace = time.Second
+	dbLatencyHalfLife   = time.Second
+)
+
+// AdmissionController 根据在途请求数、写入队列深度和数据库延迟计算负载，并按优先级进行削峰
+//
+// 负载 = max(在途请求数 / max_inflight, 各写入队列深度 / 队列容量, DB延迟EWMA / db_latency_target)
+//   - 优先级1（高）：始终放行
+//   - 优先级2（中）：负载 >= shed_medium_at 时拒绝
+//   - 优先级3（低）：负载 >= shed_low_at 时拒绝
+type AdmissionController struct {
+	maxInflight   int
+	latencyTarget time.Duration
+	shedLowAt     float64
+	shedMediumAt  float64
+	inflight      int64
+	metrics       *Metrics
+	latencyMutex  sync.Mutex
+	dbLatencyEWMA float64 // 秒
+	lastObserved  time.Time
+	queueMutex    sync.RWMutex
+	queues        []admissionQueue
+}
+
+// admissionQueue 排队深度来源（例如 MQTT 写入队列）
+type admissionQueue struct {
+	depth    func() int
+	capacity int
+}
+
+func NewAdmissionController(maxInflight int, latencyTarget time.Duration, shedLowAt, shedMediumAt float64, metrics *Metrics) *AdmissionController {
+	ac := &AdmissionController{
+		maxInflight:   maxInflight,
+		latencyTarget: latencyTarget,
+		shedLowAt:     shedLowAt,
+		shedMediumAt:  shedMediumAt,
+		metrics:       metrics,
+	}
+
+	metrics.RegisterCounter("bench_admission_decisions_total", "Admission decisions by priority and outcome.")
+	metrics.RegisterGauge("bench_admission_inflight", "Ingest requests currently in flight.", func() float64 {
+		return float64(atomic.LoadInt64(&ac.inflight))
+	})
+	metrics.RegisterGauge("bench_admission_queue_depth", "Messages waiting in ingest queues.", func() float64 {
+		return float64(ac.QueueDepth())
+	})
+	metrics.RegisterGauge("bench_admission_db_latency_seconds", "EWMA of ingest database latency.", func() float64 {
+		return ac.DBLatency().Seconds()
+	})
+	metrics.RegisterGauge("bench_admission_load", "Current load factor used for shedding (1.0 = at capacity).", ac.Load)
+
+	return ac
+}
+
+// AddQueue 注册一个写入队列，队列越满负载越高
+func (ac *AdmissionController) AddQueue(depth func() int, capacity int) {
+	if capacity <= 0 {
+		return
+	}
+	ac.queueMutex.Lock()
+	defer ac.queueMutex.Unlock()
+	ac.queues = append(ac.queues, admissionQueue{depth: depth, capacity: capacity})
+}
+
+// QueueDepth 返回所有写入队列中等待处理的条数
+func (ac *AdmissionController) QueueDepth() int {
+	ac.queueMutex.RLock()
+	defer ac.queueMutex.RUnlock()
+	depth := 0
+	for _, queue := range ac.queues {
+		depth += queue.depth()
+	}
+	return depth
+}
+
+// queueLoad 返回最满的写入队列的占用比例
+func (ac *AdmissionController) queueLoad() float64 {
+	ac.queueMutex.RLock()
+	defer ac.queueMutex.RUnlock()
+	load := 0.0
+	for _, queue := range ac.queues {
+		load = math.Max(load, float64(queue.depth())/float64(queue.capacity))
+	}
+	return load
+}
+
+// ObserveDBLatency 记录一次写入路径上的数据库耗时
+func (ac *AdmissionController) ObserveDBLatency(d time.Duration) {
+	ac.latencyMutex.Lock()
+	defer ac.latencyMutex.Unlock()
+	current := ac.decayedLatency()
+	if current == 0 {
+		ac.dbLatencyEWMA = d.Seconds()
+	} else {
+		ac.dbLatencyEWMA = dbLatencyAlpha*d.Seconds() + (1-dbLatencyAlpha)*current
+	}
+	ac.lastObserved = time.Now()
+}
+
+// decayedLatency 长时间没有新样本时（例如低优先级流量全部被拒绝）让延迟估计按半衰期衰减，
+// 避免一次延迟尖峰导致永久削峰。调用方需持有 latencyMutex
+func (ac *AdmissionController) decayedLatency() float64 {
+	idle := time.Since(ac.lastObserved) - dbLatencyDecayGrace
+	if idle <= 0 {
+		return ac.dbLatencyEWMA
+	}
+	return ac.dbLatencyEWMA * math.Pow(0.5, idle.Seconds()/dbLatencyHalfLife.Seconds())
+}
+
+// DBLatency 返回数据库延迟的 EWMA
+func (ac *AdmissionController) DBLatency() time.Duration {
+	ac.latencyMutex.Lock()
+	defer ac.latencyMutex.Unlock()
+	return time.Duration(ac.decayedLatency() * float64(time.Second))
+}
+
+// Load 返回当前负载系数
+func (ac *AdmissionController) Load() float64 {
+	load := 0.0
+	if ac.maxInflight > 0 {
+		load = float64(atomic.LoadInt64(&ac.inflight)) / float64(ac.maxInflight)
+	}
+	load = math.Max(load, ac.queueLoad())
+	if ac.latencyTarget > 0 {
+		load = math.Max(load, float64(ac.DBLatency())/float64(ac.latencyTarget))
+	}
+	return load
+}
+
+// Admit 判断给定优先级的请求是否放行；拒绝时返回建议的重试间隔
+func (ac *AdmissionController) Admit(priority int) (bool, time.Duration) {
+	load := ac.Load()
+
+	admitted := true
+	switch priority {
+	case 1:
+	case 3:
+		admitted = load < ac.shedLowAt
+	default:
+		admitted = load < ac.shedMediumAt
+	}
+
+	decision := "admitted"
+	if !admitted {
+		decision = "shed"
+	}
+	ac.metrics.IncCounter("bench_admission_decisions_total", map[string]string{
+		"priority": strconv.Itoa(priority),
+		"decision": decision,
+	})
+
+	if admitted {
+		return true, 0
+	}
+
+	// 负载越高建议的重试间隔越长，至少1秒
+	retryAfter := time.Duration(math.Ceil(load)) * time.Second
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return false, retryAfter
+}
+
+// trackInflight 统计写入类接口的在途请求数
+func (ac *AdmissionController) trackInflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&ac.inflight, 1)
+		defer atomic.AddInt64(&ac.inflight, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// admit 对写入请求做准入判断，被削峰时写入 429 响应并返回 false
+func (s *Server) admit(w http.ResponseWriter, priority int) bool {
+	if s.admission == nil {
+		return true
+	}
+
+	admitted, retryAfter := s.admission.Admit(priority)
+	if admitted {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	http.Error(w, "Server overloaded, low priority traffic shed", http.StatusTooManyRequests)
+	return false
+}
+
+// observeDBLatency 记录写入路径上的数据库耗时
+func (s *Server) observeDBLatency(start time.Time) {
+	if s.admission != nil {
+		s.admission.ObserveDBLatency(time.Since(start))
+	}
+}
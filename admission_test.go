@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmissionShedsOnQueueDepth(t *testing.T) {
+	ac := NewAdmissionController(100, time.Second, 0.7, 1.0, NewMetrics())
+	depth := 0
+	ac.AddQueue(func() int { return depth }, 10)
+
+	tests := []struct {
+		depth int
+		admit map[int]bool
+	}{
+		{0, map[int]bool{1: true, 2: true, 3: true}},
+		{7, map[int]bool{1: true, 2: true, 3: false}},
+		{10, map[int]bool{1: true, 2: false, 3: false}},
+	}
+	for _, tt := range tests {
+		depth = tt.depth
+		if got := ac.QueueDepth(); got != tt.depth {
+			t.Fatalf("QueueDepth() = %d, want %d", got, tt.depth)
+		}
+		for priority, want := range tt.admit {
+			admitted, retryAfter := ac.Admit(priority)
+			if admitted != want {
+				t.Errorf("depth %d: Admit(%d) = %v, want %v", tt.depth, priority, admitted, want)
+			}
+			if !admitted && retryAfter < time.Second {
+				t.Errorf("depth %d: Retry-After %v, want at least 1s", tt.depth, retryAfter)
+			}
+		}
+	}
+}
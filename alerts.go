@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 告警类型
+const (
+	alertKindThreshold = "threshold" // 数值超过告警阈值
+	alertKindSilent    = "silent"    // 设备超过预期间隔未上报
+)
+
+// Alert 告警事件，阈值告警和设备静默告警走同一出口
+type Alert struct {
+	Kind       string  `json:"kind" msgpack:"kind"`
+	DeviceID   string  `json:"device_id" msgpack:"device_id"`
+	MetricName string  `json:"metric_name" msgpack:"metric_name"`
+	Value      float64 `json:"value,omitempty" msgpack:"value,omitempty"`
+	Message    string  `json:"message" msgpack:"message"`
+	Resolved   bool    `json:"resolved,omitempty" msgpack:"resolved,omitempty"` // 为 true 表示告警解除
+	Timestamp  string  `json:"timestamp" msgpack:"timestamp"`
+}
+
+// thresholdAlert 数值超过告警阈值时返回告警，否则返回 nil
+func thresholdAlert(deviceID, metricName string, value float64, timestamp string) *Alert {
+	if value <= alertThreshold {
+		return nil
+	}
+	return &Alert{
+		Kind:       alertKindThreshold,
+		DeviceID:   deviceID,
+		MetricName: metricName,
+		Value:      value,
+		Message:    fmt.Sprintf("High value alert: %.2f exceeds threshold", value),
+		Timestamp:  timestamp,
+	}
+}
+
+// raiseAlerts 告警统一出口：记录日志和指标、推送给订阅者，并累加 device_status.alert_count
+// 阈值告警的 alert_count 已在写入事务中累加，这里只处理其他类型
+func (s *Server) raiseAlerts(alerts []*Alert) {
+	for _, alert := range alerts {
+		state := "raised"
+		if alert.Resolved {
+			state = "resolved"
+		}
+		s.metrics.IncCounter("bench_alerts_total", map[string]string{"kind": alert.Kind, "state": state})
+
+		entry := s.logger.WithFields(logrus.Fields{
+			"kind":        alert.Kind,
+			"device_id":   alert.DeviceID,
+			"metric_name": alert.MetricName,
+		})
+		if alert.Resolved {
+			entry.Info(alert.Message)
+			continue
+		}
+		entry.Warn(alert.Message)
+
+		if alert.Kind != alertKindThreshold {
+			if _, err := s.db.Exec("UPDATE device_status SET alert_count = alert_count + 1 WHERE device_id = ?", alert.DeviceID); err != nil {
+				s.logger.WithError(err).Warn("Failed to update device status alert count")
+			}
+		}
+	}
+	if s.bus != nil {
+		s.bus.PublishAlerts(alerts)
+	}
+}
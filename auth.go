@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// API Key 权限范围，admin 包含所有权限
+const (
+	scopeIngest = "ingest"
+	scopeQuery  = "query"
+	scopeAdmin  = "admin"
+)
+
+const (
+	// apiKeyPrefix 生成的密钥前缀，便于在日志和代码仓库中识别泄露的密钥
+	apiKeyPrefix = "bsk_"
+	// apiKeyDisplayLength 保存在表中用于识别密钥的明文前缀长度
+	apiKeyDisplayLength = 12
+	// apiKeyCacheTTL 密钥校验结果的缓存时间，吊销后最多经过该时间生效
+	apiKeyCacheTTL = 30 * time.Second
+	// apiKeyLastUsedResolution last_used_at 的更新粒度，避免每个请求都写库
+	apiKeyLastUsedResolution = time.Minute
+)
+
+var validScopes = map[string]bool{scopeIngest: true, scopeQuery: true, scopeAdmin: true}
+
+// errAPIKeyInvalid 密钥不存在或已吊销
+var errAPIKeyInvalid = errors.New("invalid or revoked API key")
+
+// initAuthStorage 创建 api_keys 表，密钥只保存 SHA-256 摘要
+func initAuthStorage(db *sql.DB) error {
+	createAPIKeysTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		key_prefix VARCHAR(20) NOT NULL,
+		key_hash CHAR(64) NOT NULL,
+		scopes VARCHAR(100) NOT NULL,
+		factory_prefixes TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME NULL,
+		revoked_at DATETIME NULL,
+		UNIQUE KEY uk_key_hash (key_hash)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+	if _, err := db.Exec(createAPIKeysTable); err != nil {
+		return fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+	return nil
+}
+
+// APIKey 一个已校验的 API Key
+type APIKey struct {
+	ID        int64
+	Name      string
+	Prefix    string
+	Scopes    []string
+	Factories []string // 允许访问的工厂前缀，为空表示不限制
+}
+
+// HasScope 判断密钥是否具有指定权限
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsDevice 判断密钥是否可以访问指定设备（按工厂前缀限制）
+func (k *APIKey) AllowsDevice(deviceID string) bool {
+	if len(k.Factories) == 0 {
+		return true
+	}
+	prefix := factoryPrefix(deviceID)
+	for _, f := range k.Factories {
+		if prefix == f {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey 计算密钥摘要；密钥为32字节随机数，无需加盐慢哈希
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitList 解析逗号分隔的列表，去除空白和空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// apiKeyCacheEntry 缓存的校验结果，只缓存有效密钥（无效密钥不缓存，避免随机令牌使缓存无限增长）
+type apiKeyCacheEntry struct {
+	key      *APIKey
+	expires  time.Time
+	lastUsed time.Time
+}
+
+// APIKeyStore 密钥的存储、校验缓存和最近使用时间记录
+type APIKeyStore struct {
+	db    *sql.DB
+	mutex sync.Mutex
+	cache map[string]*apiKeyCacheEntry // key_hash -> 校验结果
+}
+
+func NewAPIKeyStore(db *sql.DB) *APIKeyStore {
+	return &APIKeyStore{db: db, cache: make(map[string]*apiKeyCacheEntry)}
+}
+
+// Authenticate 校验明文密钥，并按 apiKeyLastUsedResolution 粒度异步更新 last_used_at
+func (ks *APIKeyStore) Authenticate(rawKey string) (*APIKey, error) {
+	hash := hashAPIKey(rawKey)
+	now := time.Now()
+
+	ks.mutex.Lock()
+	entry, ok := ks.cache[hash]
+	if ok && now.After(entry.expires) {
+		delete(ks.cache, hash)
+		ok = false
+	}
+	ks.mutex.Unlock()
+
+	if !ok {
+		key, err := ks.lookup(hash)
+		if err != nil {
+			return nil, err
+		}
+		entry = &apiKeyCacheEntry{key: key, expires: now.Add(apiKeyCacheTTL)}
+		ks.mutex.Lock()
+		ks.cache[hash] = entry
+		ks.mutex.Unlock()
+	}
+
+	ks.mutex.Lock()
+	touch := now.Sub(entry.lastUsed) >= apiKeyLastUsedResolution
+	if touch {
+		entry.lastUsed = now
+	}
+	ks.mutex.Unlock()
+	if touch {
+		go ks.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now, entry.key.ID)
+	}
+
+	return entry.key, nil
+}
+
+// lookup 按摘要查询未吊销的密钥
+func (ks *APIKeyStore) lookup(hash string) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var factories sql.NullString
+	err := ks.db.QueryRow(`
+		SELECT id, name, key_prefix, scopes, factory_prefixes
+		FROM api_keys
+		WHERE key_hash = ? AND revoked_at IS NULL
+	`, hash).Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &factories)
+	if err == sql.ErrNoRows {
+		return nil, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up API key: %w", err)
+	}
+	key.Scopes = splitList(scopes)
+	key.Factories = splitList(factories.String)
+	return &key, nil
+}
+
+// Create 生成新密钥并保存其摘要，返回明文密钥（只在创建时可见）
+func (ks *APIKeyStore) Create(name string, scopes, factories []string) (int64, string, error) {
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return 0, "", fmt.Errorf("invalid scope %q (expected ingest, query or admin)", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return 0, "", fmt.Errorf("at least one scope is required")
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return 0, "", err
+	}
+	rawKey := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	result, err := ks.db.Exec(`
+		INSERT INTO api_keys (name, key_prefix, key_hash, scopes, factory_prefixes)
+		VALUES (?, ?, ?, ?, ?)
+	`, name, rawKey[:apiKeyDisplayLength], hashAPIKey(rawKey), strings.Join(scopes, ","), strings.Join(factories, ","))
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create API key: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	return id, rawKey, nil
+}
+
+// Revoke 吊销密钥
+func (ks *APIKeyStore) Revoke(id int64) error {
+	result, err := ks.db.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("API key %d not found or already revoked", id)
+	}
+	return nil
+}
+
+// 浏览器客户端传递密钥的查询参数和 Cookie 名
+const (
+	apiKeyQueryParam = "api_key"
+	apiKeyCookie     = "bench_api_key"
+)
+
+// apiKeyContextKey 请求上下文中保存已校验密钥的键
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext 返回请求携带的已校验密钥，未启用认证时为空
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// requestAPIKey 从 Authorization: Bearer 或 X-API-Key 头中读取密钥
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// browserAPIKey 从 api_key 查询参数或 bench_api_key Cookie 中读取密钥
+// 浏览器的 EventSource / WebSocket 无法设置请求头，只用于实时推送接口
+func (s *Server) browserAPIKey(r *http.Request) string {
+	if key := r.URL.Query().Get(apiKeyQueryParam); key != "" {
+		return key
+	}
+	if !s.cookieOriginAllowed(r) {
+		return ""
+	}
+	if cookie, err := r.Cookie(apiKeyCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// cookieOriginAllowed 判断是否接受请求携带的 Cookie 密钥：浏览器跨站发起的请求也会带上 Cookie，
+// 只接受同源和 stream.websocket.allowed_origins 中明确列出的 Origin（"*" 不算），防止跨站劫持推送连接
+func (s *Server) cookieOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return containsString(s.config.StreamWebSocketOrigins, origin)
+}
+
+// requireScope 校验 API Key 及其权限范围，未启用认证时直接放行
+func (s *Server) requireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.apiKeys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 签名有效的请求或已校验的客户端证书可作为写入凭证
+		if scope == scopeIngest && (signedDeviceFromContext(r.Context()) != "" || s.clientCertPrefixes(r) != nil) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rawKey := requestAPIKey(r)
+		if rawKey == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bench-server"`)
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+
+		key, err := s.apiKeys.Authenticate(rawKey)
+		if err == errAPIKeyInvalid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bench-server", error="invalid_token"`)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to authenticate API key")
+			http.Error(w, "Authentication unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !key.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("API key lacks %s scope", scope), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+// authorizeDevice 检查请求的凭证是否可以访问这些设备，不允许时返回 403 和 false
+// API Key 按工厂前缀限制；签名请求只能访问签名的设备；客户端证书按映射的设备ID前缀限制
+func (s *Server) authorizeDevice(w http.ResponseWriter, r *http.Request, deviceIDs ...string) bool {
+	key := apiKeyFromContext(r.Context())
+	access := s.requestDeviceAccess(r)
+	for _, deviceID := range deviceIDs {
+		if (key != nil && !key.AllowsDevice(deviceID)) || !access.allows(deviceID) {
+			http.Error(w, fmt.Sprintf("Credentials are not allowed to access device %s", deviceID), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// runAPIKeyCommand API Key 管理
+// 用法：
+//
+//	bench-server apikey create -name gateway-01 -scopes ingest -factories factory_001,factory_002
+//	bench-server apikey list
+//	bench-server apikey revoke -id 3
+func runAPIKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: apikey <create|list|revoke> [flags]")
+	}
+
+	config := NewConfig()
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := initAuthStorage(db); err != nil {
+		return err
+	}
+	store := NewAPIKeyStore(db)
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := fs.String("name", "", "key name (required)")
+		scopes := fs.String("scopes", scopeIngest, "comma separated scopes: ingest, query, admin")
+		factories := fs.String("factories", "", "comma separated factory prefixes the key is restricted to (empty = all)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" {
+			return fmt.Errorf("-name is required")
+		}
+
+		id, rawKey, err := store.Create(*name, splitList(*scopes), splitList(*factories))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %d (%s)\n", id, *name)
+		fmt.Printf("Key: %s\n", rawKey)
+		fmt.Println("Store this key now; it cannot be retrieved again.")
+		return nil
+
+	case "list":
+		rows, err := db.Query(`
+			SELECT id, name, key_prefix, scopes, factory_prefixes, created_at, last_used_at, revoked_at
+			FROM api_keys ORDER BY id
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to list API keys: %w", err)
+		}
+		defer rows.Close()
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "id\tname\tprefix\tscopes\tfactories\tcreated\tlast_used\tstatus")
+		for rows.Next() {
+			var id int64
+			var name, prefix, scopes string
+			var factories sql.NullString
+			var createdAt time.Time
+			var lastUsed, revokedAt sql.NullTime
+			if err := rows.Scan(&id, &name, &prefix, &scopes, &factories, &createdAt, &lastUsed, &revokedAt); err != nil {
+				return err
+			}
+
+			factoryList := splitList(factories.String)
+			sort.Strings(factoryList)
+			factoryText := strings.Join(factoryList, ",")
+			if factoryText == "" {
+				factoryText = "*"
+			}
+			lastUsedText := "never"
+			if lastUsed.Valid {
+				lastUsedText = lastUsed.Time.Format(time.RFC3339)
+			}
+			status := "active"
+			if revokedAt.Valid {
+				status = "revoked " + revokedAt.Time.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s...\t%s\t%s\t%s\t%s\t%s\n", id, name, prefix, scopes, factoryText,
+				createdAt.Format(time.RFC3339), lastUsedText, status)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return tw.Flush()
+
+	case "revoke":
+		fs := flag.NewFlagSet("apikey revoke", flag.ContinueOnError)
+		id := fs.Int64("id", 0, "id of the key to revoke (required)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *id <= 0 {
+			return fmt.Errorf("-id is required")
+		}
+		if err := store.Revoke(*id); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %d\n", *id)
+		return nil
+	}
+
+	return fmt.Errorf("unknown apikey command %q (available: create, list, revoke)", args[0])
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authTestDB 测试用的 database/sql 驱动：按 key_hash 返回 api_keys 中的行，并记录查询次数
+type authTestDB struct {
+	mutex   sync.Mutex
+	keys    map[string][]driver.Value // key_hash -> id, name, key_prefix, scopes, factory_prefixes
+	lookups int
+}
+
+var authTestState = &authTestDB{}
+
+func init() {
+	sql.Register("authtest", authTestDriver{})
+}
+
+type authTestDriver struct{}
+
+func (authTestDriver) Open(string) (driver.Conn, error) { return authTestConn{}, nil }
+
+type authTestConn struct{}
+
+func (authTestConn) Prepare(query string) (driver.Stmt, error) {
+	return authTestStmt{query: query}, nil
+}
+func (authTestConn) Close() error              { return nil }
+func (authTestConn) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+type authTestStmt struct {
+	query string
+}
+
+func (authTestStmt) Close() error  { return nil }
+func (authTestStmt) NumInput() int { return -1 }
+
+func (authTestStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (st authTestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	authTestState.mutex.Lock()
+	defer authTestState.mutex.Unlock()
+	rows := &authTestRows{}
+	if strings.Contains(st.query, "FROM api_keys") {
+		authTestState.lookups++
+		if row, ok := authTestState.keys[args[0].(string)]; ok {
+			rows.rows = [][]driver.Value{row}
+		}
+	}
+	return rows, nil
+}
+
+type authTestRows struct {
+	rows [][]driver.Value
+}
+
+func (*authTestRows) Columns() []string {
+	return []string{"id", "name", "key_prefix", "scopes", "factory_prefixes"}
+}
+func (*authTestRows) Close() error { return nil }
+
+func (r *authTestRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newAuthTestStore 返回使用测试驱动的密钥存储，keys 为明文密钥到 scopes、factory_prefixes 的映射
+func newAuthTestStore(t *testing.T, keys map[string][2]string) *APIKeyStore {
+	t.Helper()
+	*authTestState = authTestDB{keys: make(map[string][]driver.Value)}
+	t.Cleanup(func() { *authTestState = authTestDB{} })
+	id := int64(0)
+	for rawKey, key := range keys {
+		id++
+		authTestState.keys[hashAPIKey(rawKey)] = []driver.Value{id, "test", rawKey[:4], key[0], key[1]}
+	}
+
+	db, err := sql.Open("authtest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewAPIKeyStore(db)
+}
+
+func authTestLookups() int {
+	authTestState.mutex.Lock()
+	defer authTestState.mutex.Unlock()
+	return authTestState.lookups
+}
+
+func TestRequireScope(t *testing.T) {
+	s := &Server{apiKeys: newAuthTestStore(t, map[string][2]string{
+		"bsk_ingest": {"ingest", ""},
+		"bsk_query":  {"query", ""},
+		"bsk_admin":  {"admin", ""},
+		"bsk_both":   {"ingest,query", "factory_001"},
+	})}
+
+	tests := []struct {
+		name   string
+		scope  string
+		header string
+		value  string
+		status int
+	}{
+		{"missing key", scopeIngest, "", "", http.StatusUnauthorized},
+		{"unknown key", scopeIngest, "X-API-Key", "bsk_unknown", http.StatusUnauthorized},
+		{"ingest key", scopeIngest, "X-API-Key", "bsk_ingest", http.StatusOK},
+		{"bearer token", scopeIngest, "Authorization", "Bearer bsk_ingest", http.StatusOK},
+		{"query key on ingest", scopeIngest, "X-API-Key", "bsk_query", http.StatusForbidden},
+		{"ingest key on query", scopeQuery, "X-API-Key", "bsk_ingest", http.StatusForbidden},
+		{"admin key on ingest", scopeIngest, "X-API-Key", "bsk_admin", http.StatusOK},
+		{"admin key on query", scopeQuery, "X-API-Key", "bsk_admin", http.StatusOK},
+		{"query key on admin", scopeAdmin, "X-API-Key", "bsk_query", http.StatusForbidden},
+		{"multiple scopes", scopeQuery, "X-API-Key", "bsk_both", http.StatusOK},
+	}
+	for _, tt := range tests {
+		var key *APIKey
+		handler := s.requireScope(tt.scope, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key = apiKeyFromContext(r.Context())
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && (key == nil || !key.HasScope(tt.scope)) {
+			t.Errorf("%s: handler got key %+v", tt.name, key)
+		}
+		if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate", tt.name)
+		}
+	}
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	store := newAuthTestStore(t, map[string][2]string{"bsk_cached": {"ingest", "factory_001,factory_002"}})
+
+	for i := 0; i < 3; i++ {
+		key, err := store.Authenticate("bsk_cached")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.HasScope(scopeIngest) || len(key.Factories) != 2 {
+			t.Fatalf("Authenticate = %+v", key)
+		}
+	}
+	if n := authTestLookups(); n != 1 {
+		t.Fatalf("lookups = %d, want 1 for a cached key", n)
+	}
+
+	// 吊销后缓存在 TTL 内仍然有效，过期后重新查询并拒绝
+	authTestState.mutex.Lock()
+	delete(authTestState.keys, hashAPIKey("bsk_cached"))
+	authTestState.mutex.Unlock()
+	if _, err := store.Authenticate("bsk_cached"); err != nil {
+		t.Fatalf("cached key rejected before TTL: %v", err)
+	}
+	store.mutex.Lock()
+	store.cache[hashAPIKey("bsk_cached")].expires = time.Now().Add(-time.Second)
+	store.mutex.Unlock()
+	if _, err := store.Authenticate("bsk_cached"); err != errAPIKeyInvalid {
+		t.Fatalf("revoked key after TTL: err = %v, want errAPIKeyInvalid", err)
+	}
+
+	// 无效密钥不缓存
+	before := authTestLookups()
+	for i := 0; i < 2; i++ {
+		if _, err := store.Authenticate("bsk_random"); err != errAPIKeyInvalid {
+			t.Fatalf("err = %v, want errAPIKeyInvalid", err)
+		}
+	}
+	if n := authTestLookups() - before; n != 2 {
+		t.Fatalf("lookups for invalid keys = %d, want 2", n)
+	}
+	store.mutex.Lock()
+	cached := len(store.cache)
+	store.mutex.Unlock()
+	if cached != 0 {
+		t.Fatalf("cache holds %d entries, want 0", cached)
+	}
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+	s := &Server{config: &Config{}}
+	key := &APIKey{Scopes: []string{scopeIngest}, Factories: []string{"factory_001"}}
+
+	tests := []struct {
+		name    string
+		key     *APIKey
+		signed  string
+		devices []string
+		allowed bool
+	}{
+		{"unrestricted key", &APIKey{Scopes: []string{scopeIngest}}, "", []string{"factory_002_device_0001"}, true},
+		{"factory key", key, "", []string{"factory_001_device_0001", "factory_001_device_0002"}, true},
+		{"other factory", key, "", []string{"factory_001_device_0001", "factory_002_device_0001"}, false},
+		{"signed device", nil, "factory_001_device_0001", []string{"factory_001_device_0001"}, true},
+		{"signed other device", nil, "factory_001_device_0001", []string{"factory_001_device_0002"}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		ctx := r.Context()
+		if tt.key != nil {
+			ctx = context.WithValue(ctx, apiKeyContextKey{}, tt.key)
+		}
+		if tt.signed != "" {
+			ctx = context.WithValue(ctx, signedDeviceContextKey{}, tt.signed)
+		}
+		w := httptest.NewRecorder()
+		if got := s.authorizeDevice(w, r.WithContext(ctx), tt.devices...); got != tt.allowed {
+			t.Errorf("%s: authorizeDevice = %v, want %v", tt.name, got, tt.allowed)
+			continue
+		}
+		if !tt.allowed {
+			if w.Code != http.StatusForbidden || !strings.HasPrefix(w.Body.String(), "Credentials are not allowed to access device ") {
+				t.Errorf("%s: response %d %q", tt.name, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestBrowserAPIKeyCookieOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		want    string
+	}{
+		{"no origin", nil, "", "cookie-key"},
+		{"same origin", nil, "https://bench.example.com", "cookie-key"},
+		{"cross-site", nil, "https://evil.example.net", ""},
+		{"wildcard does not allow cookies", []string{"*"}, "https://evil.example.net", ""},
+		{"explicitly allowed", []string{"https://dashboard.example.com"}, "https://dashboard.example.com", "cookie-key"},
+	}
+	for _, tt := range tests {
+		s := &Server{config: &Config{StreamWebSocketOrigins: tt.origins}}
+		r := httptest.NewRequest("GET", "https://bench.example.com/api/ws", nil)
+		r.AddCookie(&http.Cookie{Name: apiKeyCookie, Value: "cookie-key"})
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := s.browserAPIKey(r); got != tt.want {
+			t.Errorf("%s: browserAPIKey = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// 查询参数不受 Origin 限制
+	s := &Server{config: &Config{}}
+	r := httptest.NewRequest("GET", "https://bench.example.com/api/ws?api_key=query-key", nil)
+	r.Header.Set("Origin", "https://evil.example.net")
+	if got := s.browserAPIKey(r); got != "query-key" {
+		t.Errorf("browserAPIKey = %q, want query-key", got)
+	}
+}
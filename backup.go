@@ -0,0 +1,1049 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 备份格式
+//
+// 备份为一个目录：manifest.json 记录各表的分块文件、行数、时间范围和 SHA-256，
+// 每个分块为 zstd 压缩的 NDJSON（<表名>/000001.ndjson.zst），manifest 最后写出，存在即表示备份完整。
+// 时序数据按逻辑列备份（压缩负载已解压），与存储布局无关，可以恢复到任一布局的环境。
+const (
+	backupFormatVersion = 1
+	backupManifestFile  = "manifest.json"
+	backupSeriesTable   = "time_series_data"
+	// backupMetadataBatch 恢复元数据表时每条 INSERT 的行数
+	backupMetadataBatch = 500
+)
+
+// backupTable 随时序数据一起备份的元数据表，恢复时按主键 upsert（可重复执行）
+type backupTable struct {
+	name        string
+	columns     []string
+	timeColumns map[string]bool
+	orderBy     string
+	upsert      string // ON DUPLICATE KEY UPDATE 子句
+}
+
+var backupTables = []backupTable{
+	{
+		name:        "device_registry",
+		columns:     []string{"device_id", "factory", "location", "device_type", "metric_units", "created_at"},
+		timeColumns: map[string]bool{"created_at": true},
+		orderBy:     "device_id",
+		upsert:      "factory = VALUES(factory), location = VALUES(location), device_type = VALUES(device_type), metric_units = VALUES(metric_units)",
+	},
+	{
+		name:    "device_labels",
+		columns: []string{"device_id", "label_key", "label_value"},
+		orderBy: "device_id, label_key",
+		upsert:  "label_value = VALUES(label_value)",
+	},
+	{
+		// 保留较新的状态；ON DUPLICATE KEY UPDATE 按顺序求值，last_update 最后更新
+		name:        "device_status",
+		columns:     []string{"device_id", "current_value", "last_update", "alert_count"},
+		timeColumns: map[string]bool{"last_update": true},
+		orderBy:     "device_id",
+		upsert: `current_value = IF(VALUES(last_update) > last_update, VALUES(current_value), current_value),
+			alert_count = GREATEST(alert_count, VALUES(alert_count)),
+			last_update = GREATEST(last_update, VALUES(last_update))`,
+	},
+}
+
+// BackupChunk 备份中的一个分块文件
+type BackupChunk struct {
+	File   string     `json:"file"`
+	Rows   int64      `json:"rows"`
+	Bytes  int64      `json:"bytes"`
+	SHA256 string     `json:"sha256"`
+	Start  *time.Time `json:"start,omitempty"` // 时序数据分块中最早 / 最晚的时间戳
+	End    *time.Time `json:"end,omitempty"`
+}
+
+// BackupTableManifest 一个表的备份
+type BackupTableManifest struct {
+	Name   string        `json:"name"`
+	Rows   int64         `json:"rows"`
+	Chunks []BackupChunk `json:"chunks"`
+}
+
+// BackupManifest 备份清单
+type BackupManifest struct {
+	Version       int                   `json:"version"`
+	ID            string                `json:"id"`
+	CreatedAt     time.Time             `json:"created_at"`
+	StorageLayout string                `json:"storage_layout"`
+	Start         *time.Time            `json:"start,omitempty"` // 时序数据的时间范围，为空表示不限
+	End           *time.Time            `json:"end,omitempty"`
+	Tables        []BackupTableManifest `json:"tables"`
+}
+
+// table 按名称查找表的备份，不存在时返回 nil
+func (m *BackupManifest) table(name string) *BackupTableManifest {
+	for i := range m.Tables {
+		if m.Tables[i].Name == name {
+			return &m.Tables[i]
+		}
+	}
+	return nil
+}
+
+// parseBackupTables 解析 -tables 参数：all 或 time_series_data / device_status / registry（device_registry 和 device_labels）
+func parseBackupTables(value string) (map[string]bool, error) {
+	selected := make(map[string]bool)
+	for _, name := range splitList(value) {
+		switch name {
+		case "all":
+			selected[backupSeriesTable] = true
+			for _, table := range backupTables {
+				selected[table.name] = true
+			}
+		case "registry":
+			selected["device_registry"] = true
+			selected["device_labels"] = true
+		case backupSeriesTable, "device_status", "device_registry", "device_labels":
+			selected[name] = true
+		default:
+			return nil, fmt.Errorf("unknown table %q (expected all, %s, device_status or registry)", name, backupSeriesTable)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("no tables selected")
+	}
+	return selected, nil
+}
+
+// parseBackupRange 解析 -start / -end（RFC3339，可为空）
+func parseBackupRange(start, end string) (*time.Time, *time.Time, error) {
+	var startTime, endTime *time.Time
+	if start != "" {
+		t, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid -start %q (RFC3339 required)", start)
+		}
+		startTime = &t
+	}
+	if end != "" {
+		t, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid -end %q (RFC3339 required)", end)
+		}
+		endTime = &t
+	}
+	if startTime != nil && endTime != nil && startTime.After(*endTime) {
+		return nil, nil, errors.New("-start must be before -end")
+	}
+	return startTime, endTime, nil
+}
+
+// rangesOverlap 判断时间范围是否有交集，nil 表示不限
+func rangesOverlap(aStart, aEnd, bStart, bEnd *time.Time) bool {
+	if aStart != nil && bEnd != nil && aStart.After(*bEnd) {
+		return false
+	}
+	if bStart != nil && aEnd != nil && bStart.After(*aEnd) {
+		return false
+	}
+	return true
+}
+
+// laterOf / earlierOf 取两个范围端点中较严格的一个
+func laterOf(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.After(*a)) {
+		return b
+	}
+	return a
+}
+
+func earlierOf(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.Before(*a)) {
+		return b
+	}
+	return a
+}
+
+// backupChunkWriter 写出一个分块文件并计算校验和
+type backupChunkWriter struct {
+	file    *os.File
+	hash    hash.Hash
+	zw      *zstd.Encoder
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+	chunk   BackupChunk
+}
+
+func createBackupChunk(dir, table string, index int) (*backupChunkWriter, error) {
+	name := filepath.ToSlash(filepath.Join(table, fmt.Sprintf("%06d.ndjson.zst", index)))
+	if err := os.MkdirAll(filepath.Join(dir, table), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	cw := &backupChunkWriter{file: file, hash: sha256.New(), chunk: BackupChunk{File: name}}
+	if cw.zw, err = zstd.NewWriter(io.MultiWriter(file, cw.hash), zstd.WithEncoderConcurrency(1)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	cw.buffer = bufio.NewWriterSize(cw.zw, 256<<10)
+	cw.encoder = json.NewEncoder(cw.buffer)
+	return cw, nil
+}
+
+func (cw *backupChunkWriter) Write(v interface{}) error {
+	cw.chunk.Rows++
+	return cw.encoder.Encode(v)
+}
+
+// Close 写完并落盘，返回分块信息
+func (cw *backupChunkWriter) Close() (BackupChunk, error) {
+	defer cw.file.Close()
+	if err := cw.buffer.Flush(); err != nil {
+		return cw.chunk, err
+	}
+	if err := cw.zw.Close(); err != nil {
+		return cw.chunk, err
+	}
+	if err := cw.file.Sync(); err != nil {
+		return cw.chunk, err
+	}
+	info, err := cw.file.Stat()
+	if err != nil {
+		return cw.chunk, err
+	}
+	cw.chunk.Bytes = info.Size()
+	cw.chunk.SHA256 = hex.EncodeToString(cw.hash.Sum(nil))
+	return cw.chunk, nil
+}
+
+// backupMetadataTable 备份一个元数据表
+func backupMetadataTable(ctx context.Context, tx *sql.Tx, dir string, table backupTable, chunkRows int64) (BackupTableManifest, error) {
+	manifest := BackupTableManifest{Name: table.name, Chunks: []BackupChunk{}}
+	rows, err := tx.QueryContext(ctx, "SELECT "+strings.Join(table.columns, ", ")+" FROM "+table.name+" ORDER BY "+table.orderBy)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read %s: %w", table.name, err)
+	}
+	defer rows.Close()
+
+	var writer *backupChunkWriter
+	values := make([]interface{}, len(table.columns))
+	dest := make([]interface{}, len(table.columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return manifest, fmt.Errorf("failed to read %s: %w", table.name, err)
+		}
+		record := make(map[string]interface{}, len(table.columns))
+		for i, column := range table.columns {
+			if b, ok := values[i].([]byte); ok {
+				record[column] = string(b)
+			} else {
+				record[column] = values[i]
+			}
+		}
+
+		if writer == nil {
+			if writer, err = createBackupChunk(dir, table.name, len(manifest.Chunks)+1); err != nil {
+				return manifest, err
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return manifest, err
+		}
+		if writer.chunk.Rows >= chunkRows {
+			chunk, err := writer.Close()
+			if err != nil {
+				return manifest, err
+			}
+			manifest.Chunks = append(manifest.Chunks, chunk)
+			manifest.Rows += chunk.Rows
+			writer = nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return manifest, fmt.Errorf("failed to read %s: %w", table.name, err)
+	}
+	if writer != nil {
+		chunk, err := writer.Close()
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		manifest.Rows += chunk.Rows
+	}
+	return manifest, nil
+}
+
+// backupSeries 按 (timestamp, id) 游标分页读取时序数据，每 chunkRows 行一个分块
+func backupSeries(ctx context.Context, tx *sql.Tx, dir, table string, start, end *time.Time, chunkRows int64, pageRows int,
+	dicts *PayloadDictionaryStore, progress func(rows int64)) (BackupTableManifest, error) {
+	manifest := BackupTableManifest{Name: backupSeriesTable, Chunks: []BackupChunk{}}
+
+	where := "1 = 1"
+	var args []interface{}
+	if start != nil {
+		where += " AND timestamp >= ?"
+		args = append(args, *start)
+	}
+	if end != nil {
+		where += " AND timestamp <= ?"
+		args = append(args, *end)
+	}
+
+	var writer *backupChunkWriter
+	var lastTimestamp time.Time
+	var lastID int64
+	first := true
+	row := &exportRow{}
+	for {
+		pageWhere, pageArgs := where, append([]interface{}{}, args...)
+		if !first {
+			pageWhere += " AND (timestamp > ? OR (timestamp = ? AND id > ?))"
+			pageArgs = append(pageArgs, lastTimestamp, lastTimestamp, lastID)
+		}
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id, timestamp, device_id, metric_name, value, priority, data FROM `+table+`
+			WHERE `+pageWhere+`
+			ORDER BY timestamp ASC, id ASC
+			LIMIT ?
+		`, append(pageArgs, pageRows)...)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+
+		count := 0
+		for rows.Next() {
+			var stored sql.NullString
+			if err := rows.Scan(&lastID, &lastTimestamp, &row.DeviceID, &row.MetricName, &row.Value, &row.Priority, &stored); err != nil {
+				rows.Close()
+				return manifest, fmt.Errorf("failed to read %s: %w", table, err)
+			}
+			count++
+			row.Time = lastTimestamp.UTC().Format(time.RFC3339Nano)
+			row.Data = stored.String
+			if IsCompressedPayload(stored.String) {
+				// 共享字典只在本库有效，备份中保存解压后的负载
+				if payload, err := DecompressPayload(stored.String, dicts); err != nil {
+					fmt.Fprintf(os.Stderr, "warning: failed to decompress payload of row %d, keeping stored form: %v\n", lastID, err)
+				} else {
+					row.Data = payload
+				}
+			}
+
+			if writer == nil {
+				if writer, err = createBackupChunk(dir, backupSeriesTable, len(manifest.Chunks)+1); err != nil {
+					rows.Close()
+					return manifest, err
+				}
+				chunkStart := lastTimestamp.UTC()
+				writer.chunk.Start = &chunkStart
+			}
+			if err := writer.Write(row); err != nil {
+				rows.Close()
+				return manifest, err
+			}
+			if writer.chunk.Rows >= chunkRows {
+				chunkEnd := lastTimestamp.UTC()
+				writer.chunk.End = &chunkEnd
+				chunk, err := writer.Close()
+				if err != nil {
+					rows.Close()
+					return manifest, err
+				}
+				manifest.Chunks = append(manifest.Chunks, chunk)
+				manifest.Rows += chunk.Rows
+				writer = nil
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return manifest, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		first = false
+		if progress != nil {
+			progress(int64(count))
+		}
+		if count < pageRows {
+			break
+		}
+	}
+
+	if writer != nil {
+		chunkEnd := lastTimestamp.UTC()
+		writer.chunk.End = &chunkEnd
+		chunk, err := writer.Close()
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		manifest.Rows += chunk.Rows
+	}
+	return manifest, nil
+}
+
+// runBackupCommand 备份命令：bench-server backup -out <dir> [-start] [-end] [-tables]
+// 所有表在同一个一致性快照（REPEATABLE READ 只读事务）中读取
+func runBackupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("out", "", "backup directory (must not exist or be empty)")
+	start := fs.String("start", "", "only back up readings at or after this time (RFC3339)")
+	end := fs.String("end", "", "only back up readings at or before this time (RFC3339)")
+	tables := fs.String("tables", "all", "comma separated: all, time_series_data, device_status, registry")
+	chunkRows := fs.Int64("chunk-rows", 1000000, "rows per chunk file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("usage: backup -out <dir> [-start time] [-end time] [-tables list]")
+	}
+	if *chunkRows <= 0 {
+		return errors.New("-chunk-rows must be positive")
+	}
+	selected, err := parseBackupTables(*tables)
+	if err != nil {
+		return err
+	}
+	startTime, endTime, err := parseBackupRange(*start, *end)
+	if err != nil {
+		return err
+	}
+
+	if entries, err := os.ReadDir(*out); err == nil && len(entries) > 0 {
+		return fmt.Errorf("backup directory %s is not empty", *out)
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return err
+	}
+
+	config := NewConfig()
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, initStorage := range []func(*sql.DB) error{initDatabase, initRegistryStorage} {
+		if err := initStorage(db); err != nil {
+			return err
+		}
+	}
+	seriesTable := backupSeriesTable
+	if config.StorageLayout == storageLayoutCompact {
+		seriesTable = compactViewTable
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to start snapshot transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	manifest := &BackupManifest{
+		Version:       backupFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		StorageLayout: config.StorageLayout,
+		Start:         startTime,
+		End:           endTime,
+	}
+	manifest.ID = manifest.CreatedAt.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+
+	started := time.Now()
+	for _, table := range backupTables {
+		if !selected[table.name] {
+			continue
+		}
+		tableManifest, err := backupMetadataTable(ctx, tx, *out, table, *chunkRows)
+		if err != nil {
+			return err
+		}
+		manifest.Tables = append(manifest.Tables, tableManifest)
+		fmt.Fprintf(os.Stderr, "%s: %d rows\n", table.name, tableManifest.Rows)
+	}
+	if selected[backupSeriesTable] {
+		var total int64
+		lastReport := time.Now()
+		tableManifest, err := backupSeries(ctx, tx, *out, seriesTable, startTime, endTime, *chunkRows, config.ExportChunkRows,
+			NewPayloadDictionaryStore(db), func(rows int64) {
+				total += rows
+				if time.Since(lastReport) >= importProgressInterval {
+					fmt.Fprintf(os.Stderr, "%s: %d rows\n", backupSeriesTable, total)
+					lastReport = time.Now()
+				}
+			})
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("backup interrupted, %s is incomplete (no manifest written)", *out)
+			}
+			return err
+		}
+		manifest.Tables = append(manifest.Tables, tableManifest)
+		fmt.Fprintf(os.Stderr, "%s: %d rows in %d chunks\n", backupSeriesTable, tableManifest.Rows, len(tableManifest.Chunks))
+	}
+
+	// 清单最后写出：先写临时文件再改名，存在 manifest.json 即表示备份完整
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(*out, backupManifestFile)
+	if err := os.WriteFile(manifestPath+".tmp", encoded, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(manifestPath+".tmp", manifestPath); err != nil {
+		return err
+	}
+	fmt.Printf("Backup %s written to %s in %s\n", manifest.ID, *out, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// initRestoreStorage 创建 restore_progress 表（时序数据分块的恢复进度，用于续传）
+// restored_start / restored_end 为分块实际写入的时间范围（恢复范围与分块时间范围的交集），用于跨备份检查重叠
+func initRestoreStorage(db *sql.DB) error {
+	createRestoreProgressTable := `
+	CREATE TABLE IF NOT EXISTS restore_progress (
+		snapshot_id VARCHAR(64) NOT NULL,
+		file VARCHAR(255) NOT NULL,
+		range_start VARCHAR(40) NOT NULL DEFAULT '',
+		range_end VARCHAR(40) NOT NULL DEFAULT '',
+		restored_start DATETIME(6) NULL,
+		restored_end DATETIME(6) NULL,
+		rows_done BIGINT NOT NULL DEFAULT 0,
+		completed BOOLEAN NOT NULL DEFAULT FALSE,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (snapshot_id, file, range_start, range_end)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+	if _, err := db.Exec(createRestoreProgressTable); err != nil {
+		return fmt.Errorf("failed to create restore_progress table: %w", err)
+	}
+	return nil
+}
+
+// readBackupManifest 读取并校验备份清单
+func readBackupManifest(dir string) (*BackupManifest, error) {
+	encoded, err := os.ReadFile(filepath.Join(dir, backupManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s has no %s (not a backup, or the backup did not finish)", dir, backupManifestFile)
+		}
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(encoded, manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", backupManifestFile, err)
+	}
+	if manifest.Version != backupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	for _, table := range manifest.Tables {
+		for _, chunk := range table.Chunks {
+			if !filepath.IsLocal(filepath.FromSlash(chunk.File)) {
+				return nil, fmt.Errorf("invalid chunk path %q in manifest", chunk.File)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// verifyBackupChunk 校验分块文件的大小和 SHA-256
+func verifyBackupChunk(dir string, chunk BackupChunk) error {
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(chunk.File)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return err
+	}
+	if size != chunk.Bytes || hex.EncodeToString(h.Sum(nil)) != chunk.SHA256 {
+		return fmt.Errorf("checksum mismatch for %s (backup is corrupted)", chunk.File)
+	}
+	return nil
+}
+
+// backupChunkReader 逐行解码分块文件
+type backupChunkReader struct {
+	file    *os.File
+	zr      *zstd.Decoder
+	decoder *json.Decoder
+}
+
+func openBackupChunk(dir string, chunk BackupChunk) (*backupChunkReader, error) {
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(chunk.File)))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindowSize))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &backupChunkReader{file: file, zr: zr, decoder: json.NewDecoder(zr)}, nil
+}
+
+// Next 解码下一行，结束时返回 io.EOF
+func (cr *backupChunkReader) Next(v interface{}) error {
+	if !cr.decoder.More() {
+		return io.EOF
+	}
+	return cr.decoder.Decode(v)
+}
+
+func (cr *backupChunkReader) Close() {
+	cr.zr.Close()
+	cr.file.Close()
+}
+
+// restoreMetadataTable 按主键 upsert 恢复元数据表
+func restoreMetadataTable(ctx context.Context, db *sql.DB, dir string, table backupTable, manifest *BackupTableManifest) (int64, error) {
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(table.columns)), ",") + ")"
+	var restored int64
+	var batch [][]interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var query strings.Builder
+		query.WriteString("INSERT INTO " + table.name + " (" + strings.Join(table.columns, ", ") + ") VALUES ")
+		var args []interface{}
+		for i, values := range batch {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString(placeholders)
+			args = append(args, values...)
+		}
+		query.WriteString(" ON DUPLICATE KEY UPDATE " + table.upsert)
+		if _, err := db.ExecContext(ctx, query.String(), args...); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", table.name, err)
+		}
+		restored += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, chunk := range manifest.Chunks {
+		if err := verifyBackupChunk(dir, chunk); err != nil {
+			return restored, err
+		}
+		reader, err := openBackupChunk(dir, chunk)
+		if err != nil {
+			return restored, err
+		}
+		for {
+			var record map[string]interface{}
+			if err := reader.Next(&record); err == io.EOF {
+				break
+			} else if err != nil {
+				reader.Close()
+				return restored, fmt.Errorf("invalid row in %s: %w", chunk.File, err)
+			}
+			values := make([]interface{}, len(table.columns))
+			for i, column := range table.columns {
+				values[i] = record[column]
+				if text, ok := values[i].(string); ok && table.timeColumns[column] {
+					t, err := time.Parse(time.RFC3339Nano, text)
+					if err != nil {
+						reader.Close()
+						return restored, fmt.Errorf("invalid %s %q in %s", column, text, chunk.File)
+					}
+					values[i] = t
+				}
+			}
+			batch = append(batch, values)
+			if len(batch) >= backupMetadataBatch {
+				if err := flush(); err != nil {
+					reader.Close()
+					return restored, err
+				}
+			}
+		}
+		reader.Close()
+	}
+	return restored, flush()
+}
+
+// seriesRestorer 恢复时序数据分块，每批数据与分块进度在同一事务中提交
+type seriesRestorer struct {
+	db          *sql.DB
+	dbService   *DatabaseService
+	dir         string
+	snapshotID  string
+	start, end  *time.Time
+	rangeStart  string // 进度表中的范围键，不限时为空
+	rangeEnd    string
+	batchSize   int
+	force       bool
+	record      func(rows []*SensorData)
+	restored    int64
+	lastReport  time.Time
+	reportEvery time.Duration
+}
+
+// chunkRange 分块在本次恢复中实际写入的时间范围，nil 表示不限
+func (sr *seriesRestorer) chunkRange(chunk BackupChunk) (*time.Time, *time.Time) {
+	return laterOf(sr.start, chunk.Start), earlierOf(sr.end, chunk.End)
+}
+
+// checkOverlap 检查分块的时间范围是否已被其他恢复写入过（任一备份、任一时间范围）：
+// 时序数据没有自然唯一键，重复恢复同一时间段会写入重复数据。本次恢复的其他分块按 (timestamp, id) 切分，不算重叠
+func (sr *seriesRestorer) checkOverlap(chunk BackupChunk) error {
+	start, end := sr.chunkRange(chunk)
+	where := "rows_done > 0 AND NOT (snapshot_id = ? AND range_start = ? AND range_end = ?)"
+	args := []interface{}{sr.snapshotID, sr.rangeStart, sr.rangeEnd}
+	if start != nil {
+		where += " AND (restored_end IS NULL OR restored_end >= ?)"
+		args = append(args, *start)
+	}
+	if end != nil {
+		where += " AND (restored_start IS NULL OR restored_start <= ?)"
+		args = append(args, *end)
+	}
+
+	var snapshotID, file, previousStart, previousEnd string
+	err := sr.db.QueryRow(`
+		SELECT snapshot_id, file, range_start, range_end FROM restore_progress
+		WHERE `+where+`
+		LIMIT 1
+	`, args...).Scan(&snapshotID, &file, &previousStart, &previousEnd)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s overlaps %s of backup %s, already restored for range [%s, %s]; use -force to restore anyway (rows in the overlap would be duplicated)",
+		chunk.File, file, snapshotID, rangeLabel(previousStart), rangeLabel(previousEnd))
+}
+
+// checkExistingData 首次执行恢复（没有任何进度）前检查目标库在要恢复的时间范围内是否已有数据，
+// 例如恢复到备份来源的数据库，或数据已通过其他方式写入
+func (sr *seriesRestorer) checkExistingData(chunks []BackupChunk) error {
+	var started int
+	if err := sr.db.QueryRow(`
+		SELECT COUNT(*) FROM restore_progress WHERE snapshot_id = ? AND range_start = ? AND range_end = ?
+	`, sr.snapshotID, sr.rangeStart, sr.rangeEnd).Scan(&started); err != nil {
+		return err
+	}
+	if started > 0 || len(chunks) == 0 {
+		return nil
+	}
+
+	start, _ := sr.chunkRange(chunks[0])
+	_, end := sr.chunkRange(chunks[len(chunks)-1])
+	where := "1 = 1"
+	var args []interface{}
+	if start != nil {
+		where += " AND timestamp >= ?"
+		args = append(args, *start)
+	}
+	if end != nil {
+		where += " AND timestamp <= ?"
+		args = append(args, *end)
+	}
+	var existing time.Time
+	err := sr.db.QueryRow("SELECT timestamp FROM "+sr.dbService.SeriesTable()+" WHERE "+where+" ORDER BY timestamp LIMIT 1", args...).Scan(&existing)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s already has readings in the restore range (first at %s), for example when restoring into the source database; use -force to restore anyway (existing rows would be duplicated)",
+		backupSeriesTable, existing.UTC().Format(time.RFC3339))
+}
+
+func rangeLabel(bound string) string {
+	if bound == "" {
+		return "*"
+	}
+	return bound
+}
+
+// restoreChunk 恢复一个时序数据分块，从进度表中记录的位置继续
+func (sr *seriesRestorer) restoreChunk(ctx context.Context, chunk BackupChunk) error {
+	var rowsDone int64
+	var completed bool
+	err := sr.db.QueryRow(`
+		SELECT rows_done, completed FROM restore_progress
+		WHERE snapshot_id = ? AND file = ? AND range_start = ? AND range_end = ?
+	`, sr.snapshotID, chunk.File, sr.rangeStart, sr.rangeEnd).Scan(&rowsDone, &completed)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if completed {
+		return nil
+	}
+	if rowsDone == 0 && !sr.force {
+		if err := sr.checkOverlap(chunk); err != nil {
+			return err
+		}
+	}
+	if err := verifyBackupChunk(sr.dir, chunk); err != nil {
+		return err
+	}
+	restoredStart, restoredEnd := sr.chunkRange(chunk)
+
+	reader, err := openBackupChunk(sr.dir, chunk)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	var skip json.RawMessage
+	for i := int64(0); i < rowsDone; i++ {
+		if err := reader.Next(&skip); err != nil {
+			return fmt.Errorf("failed to skip restored rows of %s: %w", chunk.File, err)
+		}
+	}
+
+	batch := make([]*SensorData, 0, sr.batchSize)
+	position := rowsDone
+	commit := func(done bool) error {
+		tx, err := sr.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := sr.dbService.BulkInsertRows(tx, batch); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO restore_progress (snapshot_id, file, range_start, range_end, restored_start, restored_end, rows_done, completed)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE rows_done = VALUES(rows_done), completed = VALUES(completed)
+		`, sr.snapshotID, chunk.File, sr.rangeStart, sr.rangeEnd, restoredStart, restoredEnd, position, done); err != nil {
+			return fmt.Errorf("failed to save restore progress: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if sr.record != nil {
+			sr.record(batch)
+		}
+		sr.restored += int64(len(batch))
+		batch = batch[:0]
+		if time.Since(sr.lastReport) >= sr.reportEvery {
+			fmt.Fprintf(os.Stderr, "%s: %d readings restored (%s row %d/%d)\n", backupSeriesTable, sr.restored, chunk.File, position, chunk.Rows)
+			sr.lastReport = time.Now()
+		}
+		return nil
+	}
+
+	for {
+		// 中断时已提交的批次保留，重新执行同一命令从进度处继续
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		row := &SensorData{}
+		if err := reader.Next(row); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid row in %s: %w", chunk.File, err)
+		}
+		position++
+		timestamp, err := time.Parse(time.RFC3339Nano, row.Timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q in %s", row.Timestamp, chunk.File)
+		}
+		if (sr.start != nil && timestamp.Before(*sr.start)) || (sr.end != nil && timestamp.After(*sr.end)) {
+			continue
+		}
+		batch = append(batch, row)
+		if len(batch) >= sr.batchSize {
+			if err := commit(false); err != nil {
+				return err
+			}
+		}
+	}
+	return commit(true)
+}
+
+// runRestoreCommand 恢复命令：bench-server restore [-start] [-end] [-tables] <dir>
+// 元数据表按主键 upsert；时序数据追加写入，按分块记录进度，中断后重新执行同一命令即可续传
+func runRestoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	start := fs.String("start", "", "only restore readings at or after this time (RFC3339)")
+	end := fs.String("end", "", "only restore readings at or before this time (RFC3339)")
+	tables := fs.String("tables", "all", "comma separated: all, time_series_data, device_status, registry")
+	batchSize := fs.Int("batch-size", 0, "readings per transaction (default import.batch_size)")
+	verifyOnly := fs.Bool("verify", false, "only verify checksums of the backup")
+	force := fs.Bool("force", false, "restore even if the time range was already restored or already has readings")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: restore [-start time] [-end time] [-tables list] [-verify] <backup dir>")
+	}
+	dir := fs.Arg(0)
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	if *verifyOnly {
+		var files int
+		for _, table := range manifest.Tables {
+			for _, chunk := range table.Chunks {
+				if err := verifyBackupChunk(dir, chunk); err != nil {
+					return err
+				}
+				files++
+			}
+		}
+		fmt.Printf("Backup %s OK (%d files verified)\n", manifest.ID, files)
+		return nil
+	}
+
+	selected, err := parseBackupTables(*tables)
+	if err != nil {
+		return err
+	}
+	startTime, endTime, err := parseBackupRange(*start, *end)
+	if err != nil {
+		return err
+	}
+
+	config := NewConfig()
+	catalogPolicy, err := newMetricCatalogPolicy(config)
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, initStorage := range []func(*sql.DB) error{initDatabase, initRegistryStorage, initSeriesStorage, initTenantStorage, initRestoreStorage} {
+		if err := initStorage(db); err != nil {
+			return err
+		}
+	}
+	compact, err := openCompactStore(db, config, catalogPolicy)
+	if err != nil {
+		return err
+	}
+	payloadCompressor, err := openPayloadCompressor(config, NewPayloadDictionaryStore(db))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 先恢复设备注册表，时序数据之后再恢复设备状态（保留较新的状态）
+	restoreMetadata := func(name string) error {
+		tableManifest := manifest.table(name)
+		if !selected[name] || tableManifest == nil {
+			return nil
+		}
+		for _, table := range backupTables {
+			if table.name == name {
+				restored, err := restoreMetadataTable(ctx, db, dir, table, tableManifest)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "%s: %d rows restored\n", name, restored)
+			}
+		}
+		return nil
+	}
+	for _, name := range []string{"device_registry", "device_labels"} {
+		if err := restoreMetadata(name); err != nil {
+			return err
+		}
+	}
+
+	if tableManifest := manifest.table(backupSeriesTable); selected[backupSeriesTable] && tableManifest != nil {
+		if *batchSize <= 0 {
+			*batchSize = config.ImportBatchSize
+		}
+		seriesIndex := NewSeriesIndex(db)
+		tenantUsage := NewTenantUsage(db, config.TenantDefaultQuota, config.TenantQuotas)
+		defer seriesIndex.Flush()
+		defer tenantUsage.Flush()
+
+		restorer := &seriesRestorer{
+			db:          db,
+			dbService:   &DatabaseService{db: db, compact: compact, payload: payloadCompressor},
+			dir:         dir,
+			snapshotID:  manifest.ID,
+			start:       startTime,
+			end:         endTime,
+			rangeStart:  *start,
+			rangeEnd:    *end,
+			batchSize:   *batchSize,
+			force:       *force,
+			reportEvery: importProgressInterval,
+			lastReport:  time.Now(),
+			record: func(rows []*SensorData) {
+				seriesIndex.Record(rows)
+				tenantUsage.RecordStorage(rows)
+			},
+		}
+		if startTime != nil {
+			restorer.rangeStart = startTime.UTC().Format(time.RFC3339)
+		}
+		if endTime != nil {
+			restorer.rangeEnd = endTime.UTC().Format(time.RFC3339)
+		}
+		var selectedChunks []BackupChunk
+		for _, chunk := range tableManifest.Chunks {
+			if rangesOverlap(chunk.Start, chunk.End, startTime, endTime) {
+				selectedChunks = append(selectedChunks, chunk)
+			}
+		}
+		if !*force {
+			if err := restorer.checkExistingData(selectedChunks); err != nil {
+				return err
+			}
+		}
+		var chunks int
+		for _, chunk := range selectedChunks {
+			if err := restorer.restoreChunk(ctx, chunk); err != nil {
+				if ctx.Err() != nil {
+					fmt.Fprintf(os.Stderr, "Restore interrupted after %d readings; run the same command again to resume\n", restorer.restored)
+				}
+				return err
+			}
+			chunks++
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d readings restored from %d chunks\n", backupSeriesTable, restorer.restored, chunks)
+	}
+
+	if err := restoreMetadata("device_status"); err != nil {
+		return err
+	}
+	fmt.Printf("Backup %s restored\n", manifest.ID)
+	return nil
+}
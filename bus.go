@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// 推送事件类型
+const (
+	eventTypeReading = "reading"
+	eventTypeAlert   = "alert"
+)
+
+// 订阅被服务端关闭的原因
+const (
+	closeReasonSlow     = "slow" // 消费过慢，缓冲区已满
+	closeReasonShutdown = "shutdown"
+)
+
+var errTooManySubscribers = errors.New("too many stream subscribers")
+
+// StreamEvent 推送给订阅者的事件，ID 在进程内单调递增（重启后从 1 开始）
+type StreamEvent struct {
+	ID         uint64      `json:"id" msgpack:"id"`
+	Type       string      `json:"type" msgpack:"type"`
+	DeviceID   string      `json:"device_id" msgpack:"device_id"`
+	MetricName string      `json:"metric_name" msgpack:"metric_name"`
+	Priority   int         `json:"priority" msgpack:"priority"`
+	Data       interface{} `json:"data" msgpack:"data"` // *StreamReading 或 *Alert
+}
+
+// StreamReading 推送的一条写入数据（不含负载）
+type StreamReading struct {
+	Timestamp  string  `json:"timestamp" msgpack:"timestamp"`
+	DeviceID   string  `json:"device_id" msgpack:"device_id"`
+	MetricName string  `json:"metric_name" msgpack:"metric_name"`
+	Value      float64 `json:"value" msgpack:"value"`
+	Priority   int     `json:"priority" msgpack:"priority"`
+}
+
+// StreamFilter 订阅条件，各条件之间为 AND 关系
+type StreamFilter struct {
+	DevicePrefix string
+	Metrics      []string // 为空表示不限制
+	MinPriority  int      // 只推送优先级数值不大于该值的事件（1 为最高），0 表示不限制
+	Types        []string // reading / alert，为空表示都推送
+	Tenants      []string // nil 表示不限制
+}
+
+// validate 校验订阅条件
+func (f *StreamFilter) validate() error {
+	if f.MinPriority < 0 || f.MinPriority > 3 {
+		return fmt.Errorf("invalid min_priority %d (expected 1, 2 or 3)", f.MinPriority)
+	}
+	for _, t := range f.Types {
+		if t != eventTypeReading && t != eventTypeAlert {
+			return fmt.Errorf("invalid types %q (expected reading and/or alert)", t)
+		}
+	}
+	return nil
+}
+
+func (f *StreamFilter) match(e *StreamEvent) bool {
+	if f.DevicePrefix != "" && !strings.HasPrefix(e.DeviceID, f.DevicePrefix) {
+		return false
+	}
+	if len(f.Metrics) > 0 && !containsString(f.Metrics, e.MetricName) {
+		return false
+	}
+	if f.MinPriority > 0 && e.Priority > f.MinPriority {
+		return false
+	}
+	if len(f.Types) > 0 && !containsString(f.Types, e.Type) {
+		return false
+	}
+	if f.Tenants != nil && !containsString(f.Tenants, tenantOf(e.DeviceID)) {
+		return false
+	}
+	return true
+}
+
+// Subscription 一个订阅，匹配任一订阅条件的事件从 Events 读取；服务端关闭订阅时关闭 Events，原因见 CloseReason
+type Subscription struct {
+	filters []StreamFilter // 由总线的锁保护
+	afterID uint64         // 订阅时的最后事件ID，之前的事件只通过 backlog 返回
+
+	mutex       sync.Mutex // 保护向 events 发送与关闭 events
+	closed      bool
+	events      chan *StreamEvent
+	closeReason string
+}
+
+func (sub *Subscription) match(e *StreamEvent) bool {
+	return matchAny(sub.filters, e)
+}
+
+// matchAny 事件是否匹配任一订阅条件
+func matchAny(filters []StreamFilter, e *StreamEvent) bool {
+	for i := range filters {
+		if filters[i].match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Events 订阅的事件通道
+func (sub *Subscription) Events() <-chan *StreamEvent {
+	return sub.events
+}
+
+// CloseReason 事件通道被关闭后返回关闭原因
+func (sub *Subscription) CloseReason() string {
+	return sub.closeReason
+}
+
+// EventBus 写入路径上的进程内发布/订阅总线，保留最近的事件用于断线续传
+// 发布只把事件放入环形缓冲区，由单独的分发协程按订阅条件匹配并推送，写入请求的耗时与订阅者数量无关；
+// 推送不会阻塞：订阅者的缓冲区满时断开该订阅，客户端可以用最后收到的事件ID重新订阅
+type EventBus struct {
+	mutex          sync.Mutex
+	ring           []*StreamEvent // 按 ID % len(ring) 存放最近的事件
+	lastID         uint64
+	dispatchedID   uint64 // 已分发的最后事件ID，只由分发协程修改
+	subscribers    map[*Subscription]struct{}
+	bufferSize     int
+	maxSubscribers int
+	metrics        *Metrics
+
+	notify chan struct{} // 有新事件待分发
+	done   chan struct{} // Close 后分发协程退出
+}
+
+func NewEventBus(ringSize, bufferSize, maxSubscribers int, metrics *Metrics) *EventBus {
+	bus := &EventBus{
+		ring:           make([]*StreamEvent, ringSize),
+		subscribers:    make(map[*Subscription]struct{}),
+		bufferSize:     bufferSize,
+		maxSubscribers: maxSubscribers,
+		metrics:        metrics,
+		notify:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	metrics.RegisterCounter("bench_stream_events_total", "Events published to the stream bus, by type.")
+	metrics.RegisterCounter("bench_stream_slow_disconnects_total", "Stream subscriptions closed because the subscriber fell behind.")
+	metrics.RegisterGauge("bench_stream_subscribers", "Active stream subscriptions.", func() float64 {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		return float64(len(bus.subscribers))
+	})
+	go bus.dispatchLoop()
+	return bus
+}
+
+// PublishReadings 发布写入成功的数据
+func (bus *EventBus) PublishReadings(rows []*SensorData) {
+	events := make([]*StreamEvent, 0, len(rows))
+	for _, row := range rows {
+		events = append(events, &StreamEvent{
+			Type:       eventTypeReading,
+			DeviceID:   row.DeviceID,
+			MetricName: row.MetricName,
+			Priority:   row.Priority,
+			Data: &StreamReading{
+				Timestamp:  row.Timestamp,
+				DeviceID:   row.DeviceID,
+				MetricName: row.MetricName,
+				Value:      row.Value,
+				Priority:   row.Priority,
+			},
+		})
+	}
+	bus.publish(eventTypeReading, events)
+}
+
+// PublishAlerts 发布告警（按最高优先级推送）
+func (bus *EventBus) PublishAlerts(alerts []*Alert) {
+	events := make([]*StreamEvent, 0, len(alerts))
+	for _, alert := range alerts {
+		events = append(events, &StreamEvent{
+			Type:       eventTypeAlert,
+			DeviceID:   alert.DeviceID,
+			MetricName: alert.MetricName,
+			Priority:   1,
+			Data:       alert,
+		})
+	}
+	bus.publish(eventTypeAlert, events)
+}
+
+// publish 分配事件ID并放入环形缓冲区，通知分发协程
+func (bus *EventBus) publish(eventType string, events []*StreamEvent) {
+	if len(events) == 0 {
+		return
+	}
+	bus.mutex.Lock()
+	for _, event := range events {
+		bus.lastID++
+		event.ID = bus.lastID
+		bus.ring[event.ID%uint64(len(bus.ring))] = event
+	}
+	bus.mutex.Unlock()
+	bus.metrics.AddCounter("bench_stream_events_total", map[string]string{"type": eventType}, float64(len(events)))
+
+	select {
+	case bus.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchLoop 分发协程：按 ID 顺序把新事件推送给匹配的订阅者
+func (bus *EventBus) dispatchLoop() {
+	for {
+		select {
+		case <-bus.notify:
+			bus.dispatch()
+		case <-bus.done:
+			return
+		}
+	}
+}
+
+// dispatch 在锁内取出待分发的事件和订阅者快照，在锁外匹配和推送
+func (bus *EventBus) dispatch() {
+	bus.mutex.Lock()
+	var events []*StreamEvent
+	lost := false
+	size := uint64(len(bus.ring))
+	if bus.lastID-bus.dispatchedID > size {
+		// 分发落后超过缓冲区大小，部分事件已被覆盖：断开所有订阅，客户端续传时会得知有缺失
+		lost = true
+		bus.dispatchedID = bus.lastID - size
+	}
+	for id := bus.dispatchedID + 1; id <= bus.lastID; id++ {
+		events = append(events, bus.ring[id%size])
+	}
+	bus.dispatchedID = bus.lastID
+	subscribers := make([]*Subscription, 0, len(bus.subscribers))
+	filters := make([][]StreamFilter, 0, len(bus.subscribers))
+	for sub := range bus.subscribers {
+		subscribers = append(subscribers, sub)
+		filters = append(filters, sub.filters)
+	}
+	bus.mutex.Unlock()
+
+	for i, sub := range subscribers {
+		if lost {
+			bus.closeSlow(sub)
+			continue
+		}
+		for _, event := range events {
+			if event.ID <= sub.afterID || !matchAny(filters[i], event) {
+				continue
+			}
+			if !sub.send(event) {
+				bus.closeSlow(sub)
+				break
+			}
+		}
+	}
+}
+
+// send 非阻塞推送，缓冲区已满时返回 false；订阅已关闭时丢弃事件
+func (sub *Subscription) send(event *StreamEvent) bool {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if sub.closed {
+		return true
+	}
+	select {
+	case sub.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSlow 断开消费过慢的订阅
+func (bus *EventBus) closeSlow(sub *Subscription) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if _, ok := bus.subscribers[sub]; ok {
+		bus.closeLocked(sub, closeReasonSlow)
+		bus.metrics.IncCounter("bench_stream_slow_disconnects_total", nil)
+	}
+}
+
+// Subscribe 新建订阅。resume 为 true 时同时返回 ID 大于 lastEventID 且仍在缓冲区中的匹配事件，
+// 有事件已被覆盖（或服务重启过）时 gap 为 true
+func (bus *EventBus) Subscribe(filters []StreamFilter, lastEventID uint64, resume bool) (sub *Subscription, backlog []*StreamEvent, gap bool, err error) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if len(bus.subscribers) >= bus.maxSubscribers {
+		return nil, nil, false, errTooManySubscribers
+	}
+
+	sub = &Subscription{filters: filters, afterID: bus.lastID, events: make(chan *StreamEvent, bus.bufferSize)}
+	if resume {
+		oldest := uint64(1)
+		if size := uint64(len(bus.ring)); bus.lastID > size {
+			oldest = bus.lastID - size + 1
+		}
+		from := lastEventID + 1
+		if lastEventID > bus.lastID || from < oldest {
+			gap = true
+			from = oldest
+		}
+		for id := from; id <= bus.lastID; id++ {
+			if event := bus.ring[id%uint64(len(bus.ring))]; event != nil && sub.match(event) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	bus.subscribers[sub] = struct{}{}
+	return sub, backlog, gap, nil
+}
+
+// SetFilters 替换订阅条件，订阅本身（及已缓冲的事件）保持不变
+func (bus *EventBus) SetFilters(sub *Subscription, filters []StreamFilter) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	sub.filters = filters
+}
+
+// Unsubscribe 取消订阅
+func (bus *EventBus) Unsubscribe(sub *Subscription) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.closeLocked(sub, "")
+}
+
+// Close 关闭所有订阅并停止分发（服务停止时调用）
+func (bus *EventBus) Close() {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	for sub := range bus.subscribers {
+		bus.closeLocked(sub, closeReasonShutdown)
+	}
+	select {
+	case <-bus.done:
+	default:
+		close(bus.done)
+	}
+}
+
+func (bus *EventBus) closeLocked(sub *Subscription, reason string) {
+	if _, ok := bus.subscribers[sub]; !ok {
+		return
+	}
+	delete(bus.subscribers, sub)
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	sub.closed = true
+	sub.closeReason = reason
+	close(sub.events)
+}
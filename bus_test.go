@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// receive 在超时前读取一个事件，通道关闭时返回 nil
+func receive(t *testing.T, sub *Subscription) *StreamEvent {
+	t.Helper()
+	select {
+	case event := <-sub.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return nil
+	}
+}
+
+func TestEventBusDispatch(t *testing.T) {
+	bus := NewEventBus(16, 4, 10, NewMetrics())
+	defer bus.Close()
+
+	bus.PublishReadings([]*SensorData{{DeviceID: "factory_001_device_0001", MetricName: "temperature"}})
+	sub, _, _, err := bus.Subscribe([]StreamFilter{{DevicePrefix: "factory_001_"}}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 订阅前的事件不推送，之后的事件按条件推送
+	bus.PublishReadings([]*SensorData{
+		{DeviceID: "factory_002_device_0001", MetricName: "temperature"},
+		{DeviceID: "factory_001_device_0002", MetricName: "temperature"},
+	})
+	if event := receive(t, sub); event == nil || event.ID != 3 || event.DeviceID != "factory_001_device_0002" {
+		t.Fatalf("event = %+v, want ID 3 from factory_001_device_0002", event)
+	}
+
+	// 续传订阅：缓冲区中的事件只通过 backlog 返回，不重复推送
+	resumed, backlog, gap, err := bus.Subscribe([]StreamFilter{{}}, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gap || len(backlog) != 2 {
+		t.Fatalf("backlog = %d events, gap = %v, want 2 events without gap", len(backlog), gap)
+	}
+	bus.PublishReadings([]*SensorData{{DeviceID: "factory_003_device_0001", MetricName: "temperature"}})
+	if event := receive(t, resumed); event == nil || event.ID != 4 {
+		t.Fatalf("resumed event = %+v, want ID 4", event)
+	}
+}
+
+func TestEventBusClosesSlowSubscriber(t *testing.T) {
+	bus := NewEventBus(16, 2, 10, NewMetrics())
+	defer bus.Close()
+
+	sub, _, _, err := bus.Subscribe([]StreamFilter{{}}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]*SensorData, 3)
+	for i := range rows {
+		rows[i] = &SensorData{DeviceID: "factory_001_device_0001", MetricName: "temperature"}
+	}
+	bus.PublishReadings(rows)
+
+	// 不读取事件，等待分发协程发现缓冲区已满
+	deadline := time.Now().Add(time.Second)
+	for {
+		bus.mutex.Lock()
+		remaining := len(bus.subscribers)
+		bus.mutex.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow subscriber not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if event := receive(t, sub); event == nil {
+			t.Fatalf("event %d missing", i)
+		}
+	}
+	if event := receive(t, sub); event != nil {
+		t.Fatalf("got %+v, want closed subscription", event)
+	}
+	if sub.CloseReason() != closeReasonSlow {
+		t.Fatalf("close reason = %q, want %q", sub.CloseReason(), closeReasonSlow)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// 未在目录中定义的指标的处理方式
+const (
+	unknownMetricAllow  = "allow"
+	unknownMetricReject = "reject"
+)
+
+// 数值不符合指标定义时的处理方式
+const (
+	invalidValueReject = "reject" // 拒绝该条数据
+	invalidValueClamp  = "clamp"  // 截断到合法范围后写入
+	invalidValueFlag   = "flag"   // 原样写入，在响应和指标中标记
+)
+
+// 指标数值类型
+const (
+	metricTypeFloat = "float"
+	metricTypeInt   = "int"
+	metricTypeBool  = "bool"
+)
+
+// MetricDefinition 指标目录中的一项
+type MetricDefinition struct {
+	Unit        string   `yaml:"unit"`
+	Type        string   `yaml:"type"`      // float（默认）/ int / bool
+	Min         *float64 `yaml:"min"`       // 为空表示不限制
+	Max         *float64 `yaml:"max"`       // 为空表示不限制
+	Precision   *int     `yaml:"precision"` // 小数位数，写入时四舍五入
+	Description string   `yaml:"description"`
+}
+
+// MetricValidationError 数值不符合指标目录
+type MetricValidationError struct {
+	Metric string
+	Reason string
+}
+
+func (e *MetricValidationError) Error() string {
+	return fmt.Sprintf("metric %s: %s", e.Metric, e.Reason)
+}
+
+// metricCatalogPolicy 指标目录配置，运行时重新加载时整体替换
+type metricCatalogPolicy struct {
+	enabled   bool
+	unknown   string // allow / reject
+	onInvalid string
+	metrics   map[string]MetricDefinition
+}
+
+func newMetricCatalogPolicy(config *Config) (metricCatalogPolicy, error) {
+	policy := metricCatalogPolicy{
+		enabled:   config.MetricCatalogEnabled,
+		unknown:   config.MetricCatalogUnknown,
+		onInvalid: config.MetricCatalogOnInvalid,
+		metrics:   make(map[string]MetricDefinition, len(config.MetricCatalog)),
+	}
+
+	if policy.unknown != unknownMetricAllow && policy.unknown != unknownMetricReject {
+		return policy, fmt.Errorf("invalid metric_catalog unknown_metrics %q (expected allow or reject)", policy.unknown)
+	}
+	switch policy.onInvalid {
+	case invalidValueReject, invalidValueClamp, invalidValueFlag:
+	default:
+		return policy, fmt.Errorf("invalid metric_catalog on_invalid %q (expected reject, clamp or flag)", policy.onInvalid)
+	}
+
+	for name, def := range config.MetricCatalog {
+		if name == "" || len(name) > 50 {
+			return policy, fmt.Errorf("metric_catalog: invalid metric name %q (max 50 characters)", name)
+		}
+		if def.Type == "" {
+			def.Type = metricTypeFloat
+		}
+		if def.Type != metricTypeFloat && def.Type != metricTypeInt && def.Type != metricTypeBool {
+			return policy, fmt.Errorf("metric_catalog %s: invalid type %q (expected float, int or bool)", name, def.Type)
+		}
+		if def.Min != nil && def.Max != nil && *def.Min > *def.Max {
+			return policy, fmt.Errorf("metric_catalog %s: min is greater than max", name)
+		}
+		if def.Precision != nil && (*def.Precision < 0 || *def.Precision > 9) {
+			return policy, fmt.Errorf("metric_catalog %s: precision must be between 0 and 9", name)
+		}
+		policy.metrics[name] = def
+	}
+	return policy, nil
+}
+
+// check 按指标定义校验数值，返回应写入的数值和不合法的原因（clamp / flag 模式）
+func (p *metricCatalogPolicy) check(metricName string, value float64) (float64, string, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return value, "", &MetricValidationError{Metric: metricName, Reason: "value is NaN or Inf"}
+	}
+
+	def, ok := p.metrics[metricName]
+	if !ok {
+		if p.unknown == unknownMetricReject {
+			return value, "", &MetricValidationError{Metric: metricName, Reason: "unknown metric (not in catalog)"}
+		}
+		return value, "", nil
+	}
+
+	// 依次检查类型和范围，clamp 模式下修正后继续检查
+	var reason string
+	adjusted := value
+	switch def.Type {
+	case metricTypeInt:
+		if adjusted != math.Trunc(adjusted) {
+			reason = "value must be an integer"
+			adjusted = math.Round(adjusted)
+		}
+	case metricTypeBool:
+		if adjusted != 0 && adjusted != 1 {
+			reason = "value must be 0 or 1"
+			adjusted = 1
+		}
+	}
+	if def.Min != nil && adjusted < *def.Min {
+		reason = fmt.Sprintf("value %g is below min %g", value, *def.Min)
+		adjusted = *def.Min
+	}
+	if def.Max != nil && adjusted > *def.Max {
+		reason = fmt.Sprintf("value %g is above max %g", value, *def.Max)
+		adjusted = *def.Max
+	}
+
+	if reason != "" {
+		switch p.onInvalid {
+		case invalidValueReject:
+			return value, "", &MetricValidationError{Metric: metricName, Reason: reason}
+		case invalidValueFlag:
+			adjusted = value
+		}
+	}
+
+	if def.Precision != nil && def.Type == metricTypeFloat {
+		scale := math.Pow10(*def.Precision)
+		adjusted = math.Round(adjusted*scale) / scale
+	}
+	return adjusted, reason, nil
+}
+
+// MetricCatalog 指标目录：写入时校验指标名和数值
+type MetricCatalog struct {
+	mutex   sync.RWMutex
+	policy  metricCatalogPolicy
+	metrics *Metrics
+}
+
+func NewMetricCatalog(policy metricCatalogPolicy, metrics *Metrics) *MetricCatalog {
+	metrics.RegisterCounter("bench_metric_validation_total", "Ingested values that did not match the metric catalog, by outcome.")
+	return &MetricCatalog{policy: policy, metrics: metrics}
+}
+
+// SetPolicy 替换指标目录配置
+func (mc *MetricCatalog) SetPolicy(policy metricCatalogPolicy) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	mc.policy = policy
+}
+
+// Check 校验一条数据，返回应写入的数值；flag 为非空时表示数值不合法但按配置原样写入（标记只返回给调用方，不持久化）
+// 未启用指标目录时原样返回
+func (mc *MetricCatalog) Check(metricName string, value float64) (float64, string, error) {
+	mc.mutex.RLock()
+	policy := mc.policy
+	mc.mutex.RUnlock()
+
+	if !policy.enabled {
+		return value, "", nil
+	}
+
+	adjusted, reason, err := policy.check(metricName, value)
+	switch {
+	case err != nil:
+		mc.metrics.IncCounter("bench_metric_validation_total", map[string]string{"outcome": "rejected"})
+	case reason == "":
+	case policy.onInvalid == invalidValueFlag:
+		mc.metrics.IncCounter("bench_metric_validation_total", map[string]string{"outcome": "flagged"})
+		return adjusted, reason, nil
+	default:
+		mc.metrics.IncCounter("bench_metric_validation_total", map[string]string{"outcome": "clamped"})
+	}
+	return adjusted, "", err
+}
+
+// Definitions 返回当前的指标定义
+func (mc *MetricCatalog) Definitions() map[string]MetricDefinition {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	return mc.policy.metrics
+}
+
+// metricsHandler 列出指标目录中的指标以及实际写入过的指标，附带各指标的序列（设备）数
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := s.seriesIndex.MetricSeriesCounts(s.requestTenants(r))
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to count metric series")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	definitions := s.catalog.Definitions()
+	names := make([]string, 0, len(definitions)+len(counts))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	for name := range counts {
+		if _, ok := definitions[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	metrics := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		item := map[string]interface{}{
+			"name":         name,
+			"cataloged":    false,
+			"series_count": counts[name],
+		}
+		if def, ok := definitions[name]; ok {
+			item["cataloged"] = true
+			item["unit"] = def.Unit
+			item["type"] = def.Type
+			if def.Description != "" {
+				item["description"] = def.Description
+			}
+			if def.Min != nil {
+				item["min"] = *def.Min
+			}
+			if def.Max != nil {
+				item["max"] = *def.Max
+			}
+			if def.Precision != nil {
+				item["precision"] = *def.Precision
+			}
+		}
+		metrics = append(metrics, item)
+	}
+
+	s.writeResponse(w, r, map[string]interface{}{
+		"status":  "success",
+		"count":   len(metrics),
+		"metrics": metrics,
+	})
+}
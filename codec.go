@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// 支持的请求/响应编码
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeMsgpack  = "application/msgpack"
+)
+
+// protoMessage 可按 sensor.proto 中定义的 schema 编解码的结构
+type protoMessage interface {
+	marshalProto(b []byte) []byte
+	unmarshalProto(b []byte) error
+}
+
+// normalizeMediaType 解析 Content-Type / Accept 中的媒体类型并归一化别名
+func normalizeMediaType(value string) string {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		return contentTypeProtobuf
+	case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+		return contentTypeMsgpack
+	case "application/json", "text/json":
+		return contentTypeJSON
+	}
+	return mediaType
+}
+
+// requestContentType 返回请求体编码，未声明或无法识别时按 JSON 处理（兼容已有客户端）
+func requestContentType(r *http.Request) string {
+	switch ct := normalizeMediaType(r.Header.Get("Content-Type")); ct {
+	case contentTypeProtobuf, contentTypeMsgpack:
+		return ct
+	}
+	return contentTypeJSON
+}
+
+// responseContentType 根据 Accept 头（含 q 值）选择响应编码，默认 JSON
+func responseContentType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return contentTypeJSON
+	}
+
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		candidates = append(candidates, candidate{mediaType: mediaType, q: q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		if c.q <= 0 {
+			continue
+		}
+		switch normalizeMediaType(c.mediaType) {
+		case contentTypeJSON:
+			return contentTypeJSON
+		case contentTypeProtobuf:
+			return contentTypeProtobuf
+		case contentTypeMsgpack:
+			return contentTypeMsgpack
+		}
+		if c.mediaType == "*/*" || c.mediaType == "application/*" {
+			return contentTypeJSON
+		}
+	}
+	return contentTypeJSON
+}
+
+// decodeBody 按指定编码解码请求体
+func decodeBody(contentType string, body []byte, v interface{}) error {
+	switch contentType {
+	case contentTypeProtobuf:
+		msg, ok := v.(protoMessage)
+		if !ok {
+			return fmt.Errorf("type %T has no protobuf schema", v)
+		}
+		return msg.unmarshalProto(body)
+	case contentTypeMsgpack:
+		return msgpack.Unmarshal(body, v)
+	default:
+		return json.Unmarshal(body, v)
+	}
+}
+
+// encodeBody 按指定编码序列化响应
+// protobuf 响应使用 google.protobuf.Struct 承载与 JSON 响应相同的字段
+func encodeBody(contentType string, v interface{}) ([]byte, error) {
+	switch contentType {
+	case contentTypeProtobuf:
+		if msg, ok := v.(protoMessage); ok {
+			return msg.marshalProto(nil), nil
+		}
+		jsonData, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var st structpb.Struct
+		if err := st.UnmarshalJSON(jsonData); err != nil {
+			return nil, err
+		}
+		return proto.Marshal(&st)
+	case contentTypeMsgpack:
+		return msgpack.Marshal(v)
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// decodeRequest 读取并按 Content-Type 解码请求体，失败时直接写入错误响应并返回 false
+func (s *Server) decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if errors.Is(err, errDecompressedTooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return false
+	}
+	defer r.Body.Close()
+
+	contentType := requestContentType(r)
+	if err := decodeBody(contentType, body, v); err != nil {
+		switch contentType {
+		case contentTypeProtobuf:
+			http.Error(w, "Invalid protobuf format", http.StatusBadRequest)
+		case contentTypeMsgpack:
+			http.Error(w, "Invalid msgpack format", http.StatusBadRequest)
+		default:
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		}
+		return false
+	}
+	return true
+}
+
+// writeResponse 按 Accept 协商的编码写出响应
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	s.writeResponseStatus(w, r, http.StatusOK, v)
+}
+
+// writeResponseStatus 与 writeResponse 相同，使用指定的状态码（响应头在 WriteHeader 之前设置）
+func (s *Server) writeResponseStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	contentType := responseContentType(r)
+	payload, err := encodeBody(contentType, v)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to encode response")
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	s.writeBody(w, r, status, contentType, payload)
+}
+
+// ---- protobuf 编解码（与 sensor.proto 保持一致） ----
+
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendDoubleField(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendInt32Field(b []byte, num protowire.Number, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int64(v)))
+}
+
+// protoFieldReader 从字段值中读取标量，wire type 不符时跳过该字段值
+type protoFieldReader struct {
+	num protowire.Number
+	typ protowire.Type
+	b   []byte
+}
+
+func (f protoFieldReader) string() (string, int) {
+	if f.typ != protowire.BytesType {
+		return "", protowire.ConsumeFieldValue(f.num, f.typ, f.b)
+	}
+	v, n := protowire.ConsumeString(f.b)
+	return v, n
+}
+
+func (f protoFieldReader) double() (float64, int) {
+	if f.typ != protowire.Fixed64Type {
+		return 0, protowire.ConsumeFieldValue(f.num, f.typ, f.b)
+	}
+	v, n := protowire.ConsumeFixed64(f.b)
+	return math.Float64frombits(v), n
+}
+
+func (f protoFieldReader) int32() (int, int) {
+	if f.typ != protowire.VarintType {
+		return 0, protowire.ConsumeFieldValue(f.num, f.typ, f.b)
+	}
+	v, n := protowire.ConsumeVarint(f.b)
+	return int(int32(v)), n
+}
+
+func (d *SensorData) marshalProto(b []byte) []byte {
+	b = appendStringField(b, 1, d.Timestamp)
+	b = appendStringField(b, 2, d.DeviceID)
+	b = appendStringField(b, 3, d.MetricName)
+	b = appendDoubleField(b, 4, d.Value)
+	b = appendInt32Field(b, 5, d.Priority)
+	b = appendStringField(b, 6, d.Data)
+	return b
+}
+
+func (d *SensorData) unmarshalProto(b []byte) error {
+	*d = SensorData{}
+	return walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		f := protoFieldReader{num: num, typ: typ, b: b}
+		var n int
+		switch num {
+		case 1:
+			d.Timestamp, n = f.string()
+		case 2:
+			d.DeviceID, n = f.string()
+		case 3:
+			d.MetricName, n = f.string()
+		case 4:
+			d.Value, n = f.double()
+		case 5:
+			d.Priority, n = f.int32()
+		case 6:
+			d.Data, n = f.string()
+		}
+		return n, nil
+	})
+}
+
+func (req *SensorRWRequest) marshalProto(b []byte) []byte {
+	b = appendStringField(b, 1, req.DeviceID)
+	b = appendStringField(b, 2, req.MetricName)
+	b = appendDoubleField(b, 3, req.NewValue)
+	b = appendStringField(b, 4, req.Timestamp)
+	b = appendInt32Field(b, 5, req.Priority)
+	b = appendStringField(b, 6, req.Data)
+	return b
+}
+
+func (req *SensorRWRequest) unmarshalProto(b []byte) error {
+	*req = SensorRWRequest{}
+	return walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		f := protoFieldReader{num: num, typ: typ, b: b}
+		var n int
+		switch num {
+		case 1:
+			req.DeviceID, n = f.string()
+		case 2:
+			req.MetricName, n = f.string()
+		case 3:
+			req.NewValue, n = f.double()
+		case 4:
+			req.Timestamp, n = f.string()
+		case 5:
+			req.Priority, n = f.int32()
+		case 6:
+			req.Data, n = f.string()
+		}
+		return n, nil
+	})
+}
+
+func (req *BatchSensorRWRequest) marshalProto(b []byte) []byte {
+	var item []byte
+	for i := range req.Data {
+		item = req.Data[i].marshalProto(item[:0])
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, item)
+	}
+	return b
+}
+
+func (req *BatchSensorRWRequest) unmarshalProto(b []byte) error {
+	*req = BatchSensorRWRequest{}
+	return walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 || typ != protowire.BytesType {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		var item SensorRWRequest
+		if err := item.unmarshalProto(v); err != nil {
+			return 0, err
+		}
+		req.Data = append(req.Data, item)
+		return n, nil
+	})
+}
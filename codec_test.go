@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 对比 JSON / protobuf / msgpack 对传感器请求的编解码性能
+// 用法：go test -run '^$' -bench Codec -benchmem
+
+func codecBenchMessages() []struct {
+	name string
+	msg  interface{}
+	new  func() interface{}
+} {
+	payload := GenerateLargePayload()
+	now := time.Now().Format(time.RFC3339)
+	single := &SensorData{
+		Timestamp:  now,
+		DeviceID:   "factory_001_device_001",
+		MetricName: "temperature",
+		Value:      23.57,
+		Priority:   2,
+		Data:       payload,
+	}
+	batch := &BatchSensorRWRequest{}
+	for i := 0; i < 100; i++ {
+		batch.Data = append(batch.Data, SensorRWRequest{
+			DeviceID:   fmt.Sprintf("factory_001_device_%03d", i),
+			MetricName: "temperature",
+			NewValue:   float64(i) + 0.25,
+			Timestamp:  now,
+			Priority:   2,
+			Data:       payload,
+		})
+	}
+	return []struct {
+		name string
+		msg  interface{}
+		new  func() interface{}
+	}{
+		{"sensor-data", single, func() interface{} { return &SensorData{} }},
+		{"batch-sensor-rw", batch, func() interface{} { return &BatchSensorRWRequest{} }},
+	}
+}
+
+var codecBenchContentTypes = []string{contentTypeJSON, contentTypeProtobuf, contentTypeMsgpack}
+
+func BenchmarkCodecEncode(b *testing.B) {
+	for _, c := range codecBenchMessages() {
+		for _, ct := range codecBenchContentTypes {
+			b.Run(c.name+"/"+ct, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := encodeBody(ct, c.msg); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkCodecDecode(b *testing.B) {
+	for _, c := range codecBenchMessages() {
+		for _, ct := range codecBenchContentTypes {
+			encoded, err := encodeBody(ct, c.msg)
+			if err != nil {
+				b.Fatalf("%s/%s: %v", c.name, ct, err)
+			}
+			b.Run(c.name+"/"+ct, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(encoded)))
+				for i := 0; i < b.N; i++ {
+					if err := decodeBody(ct, encoded, c.new()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestCodecRoundTrip 三种编码解码后与原消息一致
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range codecBenchMessages() {
+		for _, ct := range codecBenchContentTypes {
+			encoded, err := encodeBody(ct, c.msg)
+			if err != nil {
+				t.Fatalf("%s/%s: encode: %v", c.name, ct, err)
+			}
+			decoded := c.new()
+			if err := decodeBody(ct, encoded, decoded); err != nil {
+				t.Fatalf("%s/%s: decode: %v", c.name, ct, err)
+			}
+			want, _ := encodeBody(contentTypeJSON, c.msg)
+			got, _ := encodeBody(contentTypeJSON, decoded)
+			if string(want) != string(got) {
+				t.Errorf("%s/%s: round trip mismatch", c.name, ct)
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands 命令行子命令，用法：bench-server <command> [flags]
+// 不带子命令时启动HTTP服务
+var commands = map[string]func(args []string) error{
+	"apikey":         runAPIKeyCommand,
+	"backup":         runBackupCommand,
+	"device-secret":  runDeviceSecretCommand,
+	"import":         runImportCommand,
+	"migrate":        runMigrateCommand,
+	"restore":        runRestoreCommand,
+	"series-index":   runSeriesIndexCommand,
+	"storage-report": runStorageReport,
+}
+
+// runCommand 执行子命令
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
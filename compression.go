@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMaxWindowSize 限制 zstd 帧声明的窗口大小，避免恶意请求迫使解码器分配大块内存
+const zstdMaxWindowSize = 8 << 20
+
+// errDecompressedTooLarge 解压后的请求体超过限制（防止 zip bomb）
+var errDecompressedTooLarge = errors.New("decompressed request body too large")
+
+// 响应压缩使用的编码器（EncodeAll / 池化 Writer 均可并发使用）
+var (
+	zstdResponseEncoder, _ = zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithEncoderConcurrency(1))
+
+	gzipWriterPool = sync.Pool{New: func() interface{} {
+		gw, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return gw
+	}}
+)
+
+// limitedReader 超过上限时返回 errDecompressedTooLarge，而不是像 io.LimitReader 那样静默截断
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// 探测是否还有剩余数据
+		var probe [1]byte
+		if n, _ := l.r.Read(probe[:]); n > 0 {
+			return 0, errDecompressedTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// decompressedBody 包装解压后的请求体，关闭时同时释放解码器和原始请求体
+type decompressedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decompressedBody) Close() error {
+	var firstErr error
+	for _, c := range d.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// zstdReadCloser 适配 zstd.Decoder 的 Close（无返回值）
+type zstdReadCloser struct{ *zstd.Decoder }
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// newDecompressingReader 根据 Content-Encoding 构造解压读取器
+func newDecompressingReader(encoding string, body io.ReadCloser, maxBytes int64) (io.ReadCloser, error) {
+	var decoder io.Reader
+	closers := []io.Closer{}
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		decoder = gr
+		closers = append(closers, gr)
+	case "deflate":
+		// HTTP 规范中的 deflate 为 zlib 格式，但不少客户端发送裸 deflate 流，这里根据头部自动识别
+		br := bufio.NewReader(body)
+		header, _ := br.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			decoder = zr
+			closers = append(closers, zr)
+		} else {
+			fr := flate.NewReader(br)
+			decoder = fr
+			closers = append(closers, fr)
+		}
+	case "zstd":
+		zr, err := zstd.NewReader(body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(zstdMaxWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		decoder = zr
+		closers = append(closers, zstdReadCloser{zr})
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	closers = append(closers, body)
+	return &decompressedBody{
+		Reader:  &limitedReader{r: decoder, remaining: maxBytes},
+		closers: closers,
+	}, nil
+}
+
+// decompressionMiddleware 透明处理 Content-Encoding 为 gzip / deflate / zstd 的请求体
+// snappy 由 remote_write 处理函数自行解码，这里直接放行
+func (s *Server) decompressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" || encoding == "snappy" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch encoding {
+		case "gzip", "x-gzip", "deflate", "zstd":
+		default:
+			w.Header().Set("Accept-Encoding", "gzip, deflate, zstd")
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// 导入接口上传的是整个文件，使用单独的上限
+		limit := s.config.MaxDecompressedBytes
+		if r.URL.Path == "/api/import" {
+			limit = s.config.ImportMaxUploadBytes
+		}
+		body, err := newDecompressingReader(encoding, r.Body, limit)
+		if err != nil {
+			http.Error(w, "Invalid compressed body", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = body
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// negotiateEncoding 根据 Accept-Encoding（含 q 值）选择响应压缩算法，不压缩时返回空串
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	// 同等 q 值时优先 zstd，其次 gzip
+	preference := map[string]int{"zstd": 3, "gzip": 2, "deflate": 1}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		name = strings.ToLower(name)
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		if _, ok := preference[name]; !ok || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && preference[name] > preference[best]) {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressPayload 使用指定算法压缩响应体
+func compressPayload(encoding string, payload []byte) ([]byte, error) {
+	switch encoding {
+	case "zstd":
+		return zstdResponseEncoder.EncodeAll(payload, make([]byte, 0, len(payload)/4)), nil
+	case "gzip":
+		var buf bytes.Buffer
+		gw := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(gw)
+		gw.Reset(&buf)
+		if _, err := gw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "deflate":
+		var buf bytes.Buffer
+		zw, err := zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return payload, nil
+}
+
+// flushWriteCloser 流式压缩的 Writer，Flush 将已写入的数据压缩输出
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newStreamCompressor 为流式响应创建压缩 Writer（导出等无法预知大小的响应）
+func newStreamCompressor(encoding string, w io.Writer) (flushWriteCloser, error) {
+	switch encoding {
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	case "gzip":
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	case "deflate":
+		return zlib.NewWriterLevel(w, zlib.BestSpeed)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// writeBody 写出响应体，超过阈值且客户端支持时按 Accept-Encoding 压缩
+func (s *Server) writeBody(w http.ResponseWriter, r *http.Request, status int, contentType string, payload []byte) {
+	w.Header().Set("Content-Type", contentType)
+
+	if s.config.CompressionMinResponseBytes > 0 && len(payload) >= s.config.CompressionMinResponseBytes {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding")); encoding != "" {
+			compressed, err := compressPayload(encoding, payload)
+			if err != nil {
+				s.logger.WithError(err).Warn("Failed to compress response, sending uncompressed")
+			} else {
+				w.Header().Set("Content-Encoding", encoding)
+				payload = compressed
+			}
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	w.WriteHeader(status)
+	w.Write(payload)
+}
@@ -3,17 +3,36 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 )
 
+// bulkInsertChunkSize 多行INSERT每条语句包含的最大行数
+const bulkInsertChunkSize = 500
+
 // SensorData 表示传感器数据结构
 type SensorData struct {
-	Timestamp  string  `json:"timestamp"`
-	DeviceID   string  `json:"device_id"`
-	MetricName string  `json:"metric_name"`
-	Value      float64 `json:"value"`
-	Priority   int     `json:"priority"` // 1:高 2:中 3:低
-	Data       string  `json:"data"`     // 随机负载数据，用于增大传输量
+	Timestamp  string  `json:"timestamp" msgpack:"timestamp"`
+	DeviceID   string  `json:"device_id" msgpack:"device_id"`
+	MetricName string  `json:"metric_name" msgpack:"metric_name"`
+	Value      float64 `json:"value" msgpack:"value"`
+	Priority   int     `json:"priority" msgpack:"priority"` // 1:高 2:中 3:低
+	Data       string  `json:"data" msgpack:"data"`         // 随机负载数据，用于增大传输量
+}
+
+// SensorRWRequest 传感器读写请求（/api/sensor-rw 以及批量接口中的单项）
+type SensorRWRequest struct {
+	DeviceID   string  `json:"device_id" msgpack:"device_id"`
+	MetricName string  `json:"metric_name" msgpack:"metric_name"`
+	NewValue   float64 `json:"new_value" msgpack:"new_value"`
+	Timestamp  string  `json:"timestamp" msgpack:"timestamp"`
+	Priority   int     `json:"priority" msgpack:"priority"`
+	Data       string  `json:"data" msgpack:"data"`
+}
+
+// BatchSensorRWRequest 批量传感器读写请求（/api/batch-sensor-rw）
+type BatchSensorRWRequest struct {
+	Data []SensorRWRequest `json:"data" msgpack:"data"`
 }
 
 // initDatabase 初始化数据库表结构
@@ -30,7 +49,8 @@ func initDatabase(db *sql.DB) error {
 		data TEXT,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		INDEX idx_timestamp (timestamp),
-		INDEX idx_device_metric (device_id, metric_name),
+		INDEX idx_device_metric_time (device_id, metric_name, timestamp, id),
+		INDEX idx_device_time (device_id, timestamp, id),
 		INDEX idx_priority (priority)
 	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 	`
@@ -49,6 +69,15 @@ func initDatabase(db *sql.DB) error {
 	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 	`
 
+	// 创建负载压缩共享字典表
+	createPayloadDictionariesTable := `
+	CREATE TABLE IF NOT EXISTS payload_dictionaries (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		dict BLOB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+
 	// 执行建表语句
 	if _, err := db.Exec(createTimeSeriesTable); err != nil {
 		return fmt.Errorf("failed to create time_series_data table: %w", err)
@@ -58,33 +87,76 @@ func initDatabase(db *sql.DB) error {
 		return fmt.Errorf("failed to create device_status table: %w", err)
 	}
 
+	if _, err := db.Exec(createPayloadDictionariesTable); err != nil {
+		return fmt.Errorf("failed to create payload_dictionaries table: %w", err)
+	}
+
 	return nil
 }
 
 // DatabaseService 提供数据库操作服务
 type DatabaseService struct {
-	db *sql.DB
+	db      *sql.DB
+	compact *CompactStore      // 非空时使用紧凑存储布局
+	payload *PayloadCompressor // 非空时压缩 data 列
 }
 
 func NewDatabaseService(db *sql.DB) *DatabaseService {
 	return &DatabaseService{db: db}
 }
 
-// InsertSensorData 插入传感器数据
-func (ds *DatabaseService) InsertSensorData(data *SensorData) error {
-	query := `
+// execer 由 *sql.DB 和 *sql.Tx 实现
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// SeriesTable 返回用于读取时序数据的表（紧凑布局下为还原列的视图）
+func (ds *DatabaseService) SeriesTable() string {
+	if ds.compact != nil {
+		return compactViewTable
+	}
+	return "time_series_data"
+}
+
+// InsertRow 按当前存储布局插入一行时序数据，可在事务中使用
+func (ds *DatabaseService) InsertRow(exec execer, timestamp time.Time, deviceID, metricName string, value float64, priority int, data string) error {
+	data, err := ds.payload.Compress(data)
+	if err != nil {
+		return err
+	}
+	return ds.insertStoredRow(exec, timestamp, deviceID, metricName, value, priority, data)
+}
+
+// insertStoredRow 插入一行 data 列已按存储格式编码（压缩）的时序数据
+func (ds *DatabaseService) insertStoredRow(exec execer, timestamp time.Time, deviceID, metricName string, value float64, priority int, data string) error {
+	if ds.compact != nil {
+		deviceRef, metricRef, scaled, err := ds.compact.encode(deviceID, metricName, value)
+		if err != nil {
+			return err
+		}
+		_, err = exec.Exec(`
+		INSERT INTO time_series_compact (timestamp, device_ref, metric_ref, value_scaled, priority, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+		`, timestamp, deviceRef, metricRef, scaled, priority, data)
+		return err
+	}
+
+	_, err := exec.Exec(`
 	INSERT INTO time_series_data (timestamp, device_id, metric_name, value, priority, data)
 	VALUES (?, ?, ?, ?, ?, ?)
-	`
+	`, timestamp, deviceID, metricName, value, priority, data)
+	return err
+}
 
+// InsertSensorData 插入传感器数据
+func (ds *DatabaseService) InsertSensorData(data *SensorData) error {
 	// 解析时间戳
 	timestamp, err := time.Parse(time.RFC3339, data.Timestamp)
 	if err != nil {
 		return fmt.Errorf("invalid timestamp format: %w", err)
 	}
 
-	_, err = ds.db.Exec(query, timestamp, data.DeviceID, data.MetricName, data.Value, data.Priority, data.Data)
-	return err
+	return ds.InsertRow(ds.db, timestamp, data.DeviceID, data.MetricName, data.Value, data.Priority, data.Data)
 }
 
 // InsertSensorDataBatch 批量插入传感器数据
@@ -99,6 +171,24 @@ func (ds *DatabaseService) InsertSensorDataBatch(data []*SensorData) error {
 	}
 	defer tx.Rollback()
 
+	data, err = ds.payload.CompressBatch(data)
+	if err != nil {
+		return err
+	}
+
+	if ds.compact != nil {
+		for _, item := range data {
+			timestamp, err := time.Parse(time.RFC3339, item.Timestamp)
+			if err != nil {
+				return fmt.Errorf("invalid timestamp format: %w", err)
+			}
+			if err := ds.insertStoredRow(tx, timestamp, item.DeviceID, item.MetricName, item.Value, item.Priority, item.Data); err != nil {
+				return fmt.Errorf("failed to insert data: %w", err)
+			}
+		}
+		return tx.Commit()
+	}
+
 	query := `
 	INSERT INTO time_series_data (timestamp, device_id, metric_name, value, priority, data)
 	VALUES (?, ?, ?, ?, ?, ?)
@@ -125,13 +215,89 @@ func (ds *DatabaseService) InsertSensorDataBatch(data []*SensorData) error {
 	return tx.Commit()
 }
 
+// BulkInsertSensorData 使用多行INSERT批量写入，适用于大批量导入场景
+func (ds *DatabaseService) BulkInsertSensorData(data []*SensorData) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := ds.BulkInsertRows(tx, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BulkInsertRows 按当前存储布局分块多行插入，可在事务中使用（导入时与进度记录在同一事务中提交）
+func (ds *DatabaseService) BulkInsertRows(exec execer, data []*SensorData) error {
+	data, err := ds.payload.CompressBatch(data)
+	if err != nil {
+		return err
+	}
+
+	insertPrefix := "INSERT INTO time_series_data (timestamp, device_id, metric_name, value, priority, data) VALUES "
+	if ds.compact != nil {
+		insertPrefix = "INSERT INTO time_series_compact (timestamp, device_ref, metric_ref, value_scaled, priority, data) VALUES "
+	}
+
+	for start := 0; start < len(data); start += bulkInsertChunkSize {
+		end := start + bulkInsertChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[start:end]
+
+		var query strings.Builder
+		query.WriteString(insertPrefix)
+		args := make([]interface{}, 0, len(chunk)*6)
+		for i, item := range chunk {
+			timestamp, err := time.Parse(time.RFC3339, item.Timestamp)
+			if err != nil {
+				return fmt.Errorf("invalid timestamp format: %w", err)
+			}
+			if i > 0 {
+				query.WriteString(",")
+			}
+			query.WriteString("(?, ?, ?, ?, ?, ?)")
+
+			if ds.compact != nil {
+				deviceRef, metricRef, scaled, err := ds.compact.encode(item.DeviceID, item.MetricName, item.Value)
+				if err != nil {
+					return err
+				}
+				args = append(args, timestamp, deviceRef, metricRef, scaled, item.Priority, item.Data)
+			} else {
+				args = append(args, timestamp, item.DeviceID, item.MetricName, item.Value, item.Priority, item.Data)
+			}
+		}
+
+		if _, err := exec.Exec(query.String(), args...); err != nil {
+			return fmt.Errorf("failed to insert data: %w", err)
+		}
+	}
+	return nil
+}
+
 // GetStats 获取数据库统计信息
-func (ds *DatabaseService) GetStats() (map[string]interface{}, error) {
+// tenants 不为 nil 时只统计这些租户的设备
+func (ds *DatabaseService) GetStats(tenants []string) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
+	where, args := tenantFilter("device_id", tenants)
+	and := ""
+	if where != "" {
+		and = " AND " + where
+		where = " WHERE " + where
+	}
+
 	// 总记录数
 	var totalCount int64
-	err := ds.db.QueryRow("SELECT COUNT(*) FROM time_series_data").Scan(&totalCount)
+	err := ds.db.QueryRow("SELECT COUNT(*) FROM "+ds.SeriesTable()+where, args...).Scan(&totalCount)
 	if err != nil {
 		return nil, err
 	}
@@ -140,10 +306,10 @@ func (ds *DatabaseService) GetStats() (map[string]interface{}, error) {
 	// 按优先级统计
 	priorityQuery := `
 	SELECT priority, COUNT(*) as count 
-	FROM time_series_data 
+	FROM ` + ds.SeriesTable() + where + ` 
 	GROUP BY priority
 	`
-	rows, err := ds.db.Query(priorityQuery)
+	rows, err := ds.db.Query(priorityQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -162,7 +328,7 @@ func (ds *DatabaseService) GetStats() (map[string]interface{}, error) {
 
 	// 最近24小时的数据量
 	var recentCount int64
-	err = ds.db.QueryRow("SELECT COUNT(*) FROM time_series_data WHERE created_at >= DATE_SUB(NOW(), INTERVAL 24 HOUR)").Scan(&recentCount)
+	err = ds.db.QueryRow("SELECT COUNT(*) FROM "+ds.SeriesTable()+" WHERE created_at >= DATE_SUB(NOW(), INTERVAL 24 HOUR)"+and, args...).Scan(&recentCount)
 	if err != nil {
 		return nil, err
 	}
@@ -170,7 +336,7 @@ func (ds *DatabaseService) GetStats() (map[string]interface{}, error) {
 
 	// 设备状态统计
 	var deviceCount int64
-	err = ds.db.QueryRow("SELECT COUNT(*) FROM device_status").Scan(&deviceCount)
+	err = ds.db.QueryRow("SELECT COUNT(*) FROM device_status"+where, args...).Scan(&deviceCount)
 	if err != nil {
 		return nil, err
 	}
@@ -178,11 +344,15 @@ func (ds *DatabaseService) GetStats() (map[string]interface{}, error) {
 
 	// 告警总数
 	var totalAlerts int64
-	err = ds.db.QueryRow("SELECT SUM(alert_count) FROM device_status").Scan(&totalAlerts)
+	err = ds.db.QueryRow("SELECT COALESCE(SUM(alert_count), 0) FROM device_status"+where, args...).Scan(&totalAlerts)
 	if err != nil {
 		return nil, err
 	}
 	stats["total_alerts"] = totalAlerts
 
+	if tenants != nil {
+		stats["tenants"] = tenants
+	}
+
 	return stats, nil
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultStaleAfter 默认的失联判定时间：超过该时间没有更新的设备视为 stale
+	defaultStaleAfter = 5 * time.Minute
+	// deviceStatusFlushInterval 设备状态写回 device_status 表的间隔
+	deviceStatusFlushInterval = 2 * time.Second
+	// deviceStatusChunkSize 每条 upsert 语句包含的设备数
+	deviceStatusChunkSize = 500
+)
+
+// deviceStatusUpdate 一个设备尚未写回的最新值
+type deviceStatusUpdate struct {
+	value     float64
+	timestamp time.Time
+}
+
+// DeviceStatusTracker 维护所有写入路径的 device_status（读写接口之外的写入、MQTT、导入）
+// 写入成功的数据先在内存中按设备保留最新值，定期批量写回；alert_count 只由告警路径累加
+type DeviceStatusTracker struct {
+	db *sql.DB
+
+	mutex   sync.Mutex
+	pending map[string]deviceStatusUpdate
+}
+
+func NewDeviceStatusTracker(db *sql.DB) *DeviceStatusTracker {
+	return &DeviceStatusTracker{
+		db:      db,
+		pending: make(map[string]deviceStatusUpdate),
+	}
+}
+
+// Record 记录写入成功的数据
+func (t *DeviceStatusTracker) Record(rows []*SensorData) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, row := range rows {
+		timestamp, err := time.Parse(time.RFC3339, row.Timestamp)
+		if err != nil {
+			continue
+		}
+		t.merge(row.DeviceID, deviceStatusUpdate{value: row.Value, timestamp: timestamp})
+	}
+}
+
+// merge 保留时间戳较新的值，调用方需持有 mutex
+func (t *DeviceStatusTracker) merge(deviceID string, update deviceStatusUpdate) {
+	if existing, ok := t.pending[deviceID]; ok && existing.timestamp.After(update.timestamp) {
+		return
+	}
+	t.pending[deviceID] = update
+}
+
+// Flush 将未写回的最新值写入 device_status 表，写回失败的部分保留到下次
+func (t *DeviceStatusTracker) Flush() {
+	t.mutex.Lock()
+	pending := t.pending
+	t.pending = make(map[string]deviceStatusUpdate)
+	t.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	deviceIDs := make([]string, 0, len(pending))
+	for deviceID := range pending {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	for start := 0; start < len(deviceIDs); start += deviceStatusChunkSize {
+		end := start + deviceStatusChunkSize
+		if end > len(deviceIDs) {
+			end = len(deviceIDs)
+		}
+		chunk := deviceIDs[start:end]
+		if err := t.upsert(chunk, pending); err != nil {
+			t.mutex.Lock()
+			for _, deviceID := range chunk {
+				t.merge(deviceID, pending[deviceID])
+			}
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// upsert 批量写回一组设备，较旧的数据不覆盖已有的最新值
+// ON DUPLICATE KEY UPDATE 按顺序求值，current_value 需在 last_update 之前更新
+func (t *DeviceStatusTracker) upsert(deviceIDs []string, updates map[string]deviceStatusUpdate) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO device_status (device_id, current_value, last_update, alert_count) VALUES ")
+	args := make([]interface{}, 0, len(deviceIDs)*3)
+	for i, deviceID := range deviceIDs {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString("(?, ?, ?, 0)")
+		u := updates[deviceID]
+		args = append(args, deviceID, u.value, u.timestamp)
+	}
+	query.WriteString(`
+		ON DUPLICATE KEY UPDATE
+			current_value = IF(VALUES(last_update) >= last_update, VALUES(current_value), current_value),
+			last_update = GREATEST(last_update, VALUES(last_update))
+	`)
+	_, err := t.db.Exec(query.String(), args...)
+	return err
+}
+
+// Run 定期写回，stop 关闭时做最后一次写回
+func (t *DeviceStatusTracker) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Flush()
+		case <-stop:
+			t.Flush()
+			return
+		}
+	}
+}
+
+// pageSilentDevices 静默状态只在内存中，需要以 IN 条件传给查询：按本页的选择条件筛选后，
+// 只返回排序最小的 max 个，占位符数量不随设备规模增长；截断时 bound 为返回的最后一个设备
+func pageSilentDevices(silent map[string]bool, match func(deviceID string) bool, max int) (ids []string, bound string) {
+	for deviceID := range silent {
+		if match(deviceID) {
+			ids = append(ids, deviceID)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > max {
+		ids = ids[:max]
+		bound = ids[max-1]
+	}
+	return ids, bound
+}
+
+// latestDevicesHandler 设备最新值快照（来自 device_status）：
+// alert 按当前告警状态过滤：最新值超过阈值或有序列处于静默状态；alert_count 为累计告警次数
+// GET /api/devices/latest?prefix=&device_ids=a,b&alert=true|false&stale=true|false&stale_after=5m&limit=&cursor=
+func (s *Server) latestDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := pageLimit(r, 100, 1000)
+
+	staleAfter := defaultStaleAfter
+	if v := query.Get("stale_after"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid stale_after (duration such as 5m required)", http.StatusBadRequest)
+			return
+		}
+		staleAfter = d
+	}
+	staleBefore := time.Now().Add(-staleAfter)
+
+	var afterDevice string
+	if cursor := query.Get("cursor"); cursor != "" {
+		if err := decodeCursor(cursor, &afterDevice); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	prefix := query.Get("prefix")
+	if prefix != "" {
+		conditions = append(conditions, "device_id LIKE ?")
+		args = append(args, escapeLike(prefix)+"%")
+	}
+	deviceIDs := splitList(query.Get("device_ids"))
+	if len(deviceIDs) > 0 {
+		if len(deviceIDs) > maxQueryDeviceIDs {
+			http.Error(w, "Too many device_ids", http.StatusBadRequest)
+			return
+		}
+		if !s.authorizeDevice(w, r, deviceIDs...) {
+			return
+		}
+		conditions = append(conditions, "device_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(deviceIDs)), ",")+")")
+		for _, deviceID := range deviceIDs {
+			args = append(args, deviceID)
+		}
+	}
+	access := s.requestDeviceAccess(r)
+	silent := make(map[string]bool)
+	for _, series := range s.watchdog.Silent(s.requestTenants(r)) {
+		silent[series.DeviceID] = true
+	}
+
+	// 截断后 alert=true 本页最多 limit+1 行，被截掉的静默设备排在它们之后，不影响本页；
+	// alert=false 要排除所有静默设备，只能查到最后一个列入条件的静默设备为止（pageBound）
+	silentIDs, silentBound := pageSilentDevices(silent, func(deviceID string) bool {
+		return strings.HasPrefix(deviceID, prefix) && deviceID > afterDevice &&
+			(len(deviceIDs) == 0 || containsString(deviceIDs, deviceID)) && access.allows(deviceID)
+	}, limit+1)
+	var pageBound string
+	silentCondition, silentArgs := "1 = 0", []interface{}(nil)
+	if len(silentIDs) > 0 {
+		silentCondition = "device_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(silentIDs)), ",") + ")"
+		for _, deviceID := range silentIDs {
+			silentArgs = append(silentArgs, deviceID)
+		}
+	}
+	switch query.Get("alert") {
+	case "":
+	case "true":
+		conditions = append(conditions, "(current_value > ? OR "+silentCondition+")")
+		args = append(append(args, alertThreshold), silentArgs...)
+	case "false":
+		conditions = append(conditions, "current_value <= ? AND NOT ("+silentCondition+")")
+		args = append(append(args, alertThreshold), silentArgs...)
+		if silentBound != "" {
+			pageBound = silentBound
+			conditions = append(conditions, "device_id < ?")
+			args = append(args, pageBound)
+		}
+	default:
+		http.Error(w, "Invalid alert (expected true or false)", http.StatusBadRequest)
+		return
+	}
+	switch query.Get("stale") {
+	case "":
+	case "true":
+		conditions = append(conditions, "last_update < ?")
+		args = append(args, staleBefore)
+	case "false":
+		conditions = append(conditions, "last_update >= ?")
+		args = append(args, staleBefore)
+	default:
+		http.Error(w, "Invalid stale (expected true or false)", http.StatusBadRequest)
+		return
+	}
+	if clause, clauseArgs := tenantFilter("device_id", s.requestTenants(r)); clause != "" {
+		conditions = append(conditions, clause)
+		args = append(args, clauseArgs...)
+	}
+	if clause, clauseArgs := access.filter("device_id"); clause != "" {
+		conditions = append(conditions, clause)
+		args = append(args, clauseArgs...)
+	}
+	if afterDevice != "" {
+		conditions = append(conditions, "device_id > ?")
+		args = append(args, afterDevice)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT device_id, current_value, last_update, alert_count
+		FROM device_status
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY device_id
+		LIMIT ?
+	`, append(args, limit+1)...)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to query device status")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	devices := make([]map[string]interface{}, 0, limit)
+	var nextCursor string
+	for rows.Next() {
+		var deviceID string
+		var currentValue float64
+		var lastUpdate time.Time
+		var alertCount int64
+		if err := rows.Scan(&deviceID, &currentValue, &lastUpdate, &alertCount); err != nil {
+			s.logger.WithError(err).Error("Failed to scan device status row")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(devices) == limit {
+			nextCursor = encodeCursor(devices[len(devices)-1]["device_id"])
+			break
+		}
+		thresholdActive := currentValue > alertThreshold
+		devices = append(devices, map[string]interface{}{
+			"device_id":        deviceID,
+			"current_value":    currentValue,
+			"last_update":      lastUpdate.Format(time.RFC3339Nano),
+			"alert_count":      alertCount,
+			"threshold_active": thresholdActive,
+			"silent":           silent[deviceID],
+			"alert_active":     thresholdActive || silent[deviceID],
+			"age_seconds":      now.Sub(lastUpdate).Seconds(),
+			"stale":            lastUpdate.Before(staleBefore),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.WithError(err).Error("Error iterating over device status rows")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if nextCursor == "" && pageBound != "" {
+		// 本页查到截断处为止，下一页从截断处继续
+		nextCursor = encodeCursor(pageBound)
+	}
+
+	response := map[string]interface{}{
+		"status":      "success",
+		"count":       len(devices),
+		"stale_after": staleAfter.String(),
+		"devices":     devices,
+	}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	s.writeResponse(w, r, response)
+}
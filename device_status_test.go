@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPageSilentDevices(t *testing.T) {
+	silent := make(map[string]bool)
+	for i := 0; i < 70000; i++ {
+		silent[fmt.Sprintf("factory_%03d_device_%05d", i%2, i)] = true
+	}
+	match := func(deviceID string) bool {
+		return strings.HasPrefix(deviceID, "factory_001_") && deviceID > "factory_001_device_00010"
+	}
+
+	ids, bound := pageSilentDevices(silent, match, 3)
+	if want := []string{"factory_001_device_00011", "factory_001_device_00013", "factory_001_device_00015"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	if bound != "factory_001_device_00015" {
+		t.Fatalf("bound = %q", bound)
+	}
+
+	ids, bound = pageSilentDevices(silent, func(deviceID string) bool { return deviceID == "factory_000_device_00002" }, 3)
+	if len(ids) != 1 || bound != "" {
+		t.Fatalf("ids = %v, bound = %q, want one device and no bound", ids, bound)
+	}
+}
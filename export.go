@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 导出格式
+const (
+	exportFormatCSV     = "csv"
+	exportFormatNDJSON  = "ndjson"
+	exportFormatParquet = "parquet"
+)
+
+// exportRow 导出的一行，列名与导入字段一致，导出的文件可以直接用 import 导入
+type exportRow struct {
+	Timestamp  time.Time `json:"-"`
+	Time       string    `json:"timestamp"`
+	DeviceID   string    `json:"device_id"`
+	MetricName string    `json:"metric_name"`
+	Value      float64   `json:"value"`
+	Priority   int       `json:"priority"`
+	Data       string    `json:"data,omitempty"`
+}
+
+// exportWriter 按格式写出导出行
+type exportWriter interface {
+	Write(row *exportRow) error
+	// Flush 每个分块结束时调用，把缓冲的数据写给客户端
+	Flush() error
+	// Close 写出格式尾部（Parquet 文件元数据）
+	Close() error
+}
+
+// csvExportWriter 带表头的 CSV
+type csvExportWriter struct {
+	w           *csv.Writer
+	includeData bool
+	record      []string
+}
+
+func newCSVExportWriter(w io.Writer, includeData bool) (*csvExportWriter, error) {
+	header := []string{"timestamp", "device_id", "metric_name", "value", "priority"}
+	if includeData {
+		header = append(header, "data")
+	}
+	cw := &csvExportWriter{w: csv.NewWriter(w), includeData: includeData, record: make([]string, len(header))}
+	return cw, cw.w.Write(header)
+}
+
+func (cw *csvExportWriter) Write(row *exportRow) error {
+	cw.record[0] = row.Time
+	cw.record[1] = row.DeviceID
+	cw.record[2] = row.MetricName
+	cw.record[3] = strconv.FormatFloat(row.Value, 'f', -1, 64)
+	cw.record[4] = strconv.Itoa(row.Priority)
+	if cw.includeData {
+		cw.record[5] = row.Data
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvExportWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvExportWriter) Close() error {
+	return cw.Flush()
+}
+
+// ndjsonExportWriter 每行一个 JSON 对象
+type ndjsonExportWriter struct {
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newNDJSONExportWriter(w io.Writer) *ndjsonExportWriter {
+	buffer := bufio.NewWriterSize(w, 64<<10)
+	return &ndjsonExportWriter{buffer: buffer, encoder: json.NewEncoder(buffer)}
+}
+
+func (nw *ndjsonExportWriter) Write(row *exportRow) error {
+	return nw.encoder.Encode(row)
+}
+
+func (nw *ndjsonExportWriter) Flush() error {
+	return nw.buffer.Flush()
+}
+
+func (nw *ndjsonExportWriter) Close() error {
+	return nw.buffer.Flush()
+}
+
+// parquetExportWriter Parquet 文件，按行组写出
+type parquetExportWriter struct {
+	pw          *parquetWriter
+	includeData bool
+}
+
+func newParquetExportWriter(w io.Writer, includeData bool) (*parquetExportWriter, error) {
+	columns := []parquetWriterColumn{
+		{Name: "timestamp", Type: parquetInt64, Converted: parquetConvertedTimestampMillis},
+		{Name: "device_id", Type: parquetByteArray, Converted: parquetConvertedUTF8, Dictionary: true},
+		{Name: "metric_name", Type: parquetByteArray, Converted: parquetConvertedUTF8, Dictionary: true},
+		{Name: "value", Type: parquetDouble, Converted: -1},
+		{Name: "priority", Type: parquetInt32, Converted: -1},
+	}
+	if includeData {
+		columns = append(columns, parquetWriterColumn{Name: "data", Type: parquetByteArray, Converted: parquetConvertedUTF8, Optional: true})
+	}
+	pw, err := newParquetWriter(w, columns)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetExportWriter{pw: pw, includeData: includeData}, nil
+}
+
+func (pw *parquetExportWriter) Write(row *exportRow) error {
+	if !pw.includeData {
+		return pw.pw.WriteRow(row.Timestamp, row.DeviceID, row.MetricName, row.Value, row.Priority)
+	}
+	var data interface{}
+	if row.Data != "" {
+		data = row.Data
+	}
+	return pw.pw.WriteRow(row.Timestamp, row.DeviceID, row.MetricName, row.Value, row.Priority, data)
+}
+
+func (pw *parquetExportWriter) Flush() error {
+	return nil // 行组攒满后才写出
+}
+
+func (pw *parquetExportWriter) Close() error {
+	return pw.pw.Close()
+}
+
+// exportHandler 流式导出时序数据：GET /api/export?start_time=&end_time=&format=csv|ndjson|parquet
+// 设备选择：device（设备ID，逗号分隔）、prefix、label=key=value，可按 metric、min_priority 过滤；include_data=true 时包含完整负载
+// 按 (timestamp, id) 游标分块查询，内存占用与导出行数无关；客户端断开时停止查询
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = exportFormatCSV
+	case exportFormatCSV, exportFormatNDJSON, exportFormatParquet:
+	default:
+		http.Error(w, "Invalid format (expected csv, ndjson or parquet)", http.StatusBadRequest)
+		return
+	}
+	if query.Get("start_time") == "" || query.Get("end_time") == "" {
+		http.Error(w, "Missing required parameters: start_time, end_time", http.StatusBadRequest)
+		return
+	}
+	startTime, err := time.Parse(time.RFC3339, query.Get("start_time"))
+	if err != nil {
+		http.Error(w, "Invalid start_time format (RFC3339 required)", http.StatusBadRequest)
+		return
+	}
+	endTime, err := time.Parse(time.RFC3339, query.Get("end_time"))
+	if err != nil {
+		http.Error(w, "Invalid end_time format (RFC3339 required)", http.StatusBadRequest)
+		return
+	}
+	if startTime.After(endTime) {
+		http.Error(w, "start_time must be before end_time", http.StatusBadRequest)
+		return
+	}
+	includeData := false
+	if v := query.Get("include_data"); v != "" {
+		if includeData, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid include_data", http.StatusBadRequest)
+			return
+		}
+	}
+	minPriority := 0
+	if v := query.Get("min_priority"); v != "" {
+		if minPriority, err = strconv.Atoi(v); err != nil || minPriority < 1 || minPriority > 3 {
+			http.Error(w, fmt.Sprintf("Invalid min_priority %q (expected 1, 2 or 3)", v), http.StatusBadRequest)
+			return
+		}
+	}
+	labels, err := parseLabelSelector(query["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deviceIDs := splitList(query.Get("device"))
+	if len(deviceIDs) > maxQueryDeviceIDs {
+		http.Error(w, fmt.Sprintf("Too many devices (max %d)", maxQueryDeviceIDs), http.StatusBadRequest)
+		return
+	}
+	if len(deviceIDs) > 0 && !s.authorizeDevice(w, r, deviceIDs...) {
+		return
+	}
+
+	// 设备选择条件，与 /api/query-series 相同
+	tenants := s.requestTenants(r)
+	access := s.requestDeviceAccess(r)
+	filter := seriesFilter{devicePrefix: query.Get("prefix"), tenants: tenants, access: access}
+	if len(deviceIDs) > 0 {
+		filter.deviceIDs = deviceIDs
+	}
+	if len(labels) > 0 {
+		labeled, err := s.registry.SelectDeviceIDs(DeviceFilter{Labels: labels, Tenants: tenants, Access: access})
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to select devices by labels")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if filter.deviceIDs != nil {
+			var both []string
+			for _, deviceID := range labeled {
+				if containsString(filter.deviceIDs, deviceID) {
+					both = append(both, deviceID)
+				}
+			}
+			labeled = both
+		}
+		filter.deviceIDs = append([]string{}, labeled...)
+	}
+	where, args := filter.where()
+	if metrics := splitList(query.Get("metric")); len(metrics) > 0 {
+		where += " AND metric_name IN (" + strings.TrimSuffix(strings.Repeat("?,", len(metrics)), ",") + ")"
+		for _, metric := range metrics {
+			args = append(args, metric)
+		}
+	}
+	if minPriority > 0 {
+		where += " AND priority <= ?"
+		args = append(args, minPriority)
+	}
+	where += " AND timestamp >= ? AND timestamp <= ?"
+	args = append(args, startTime, endTime)
+
+	columns := "id, timestamp, device_id, metric_name, value, priority"
+	if includeData {
+		columns += ", data"
+	}
+	chunkQuery := `
+		SELECT ` + columns + ` FROM ` + s.databaseService().SeriesTable() + `
+		WHERE ` + where + ` AND (timestamp > ? OR (timestamp = ? AND id > ?))
+		ORDER BY timestamp ASC, id ASC
+		LIMIT ?
+	`
+
+	ctx := r.Context()
+	chunkRows := s.config.ExportChunkRows
+	lastTimestamp, lastID := startTime, int64(0)
+	queryChunk := func() (*sql.Rows, error) {
+		return s.db.QueryContext(ctx, chunkQuery, append(args, lastTimestamp, lastTimestamp, lastID, chunkRows)...)
+	}
+
+	// 第一个分块查询成功后才开始响应，之前的错误仍可返回状态码
+	rows, err := queryChunk()
+	if err != nil {
+		if ctx.Err() == nil {
+			s.logger.WithError(err).Error("Failed to query export data")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	contentType, extension := "text/csv; charset=utf-8", "csv"
+	switch format {
+	case exportFormatNDJSON:
+		contentType, extension = "application/x-ndjson", "ndjson"
+	case exportFormatParquet:
+		contentType, extension = "application/vnd.apache.parquet", "parquet"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.%s"`, startTime.UTC().Format("20060102T150405Z"), extension))
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// CSV / NDJSON 按 Accept-Encoding 流式压缩；Parquet 的页已经压缩
+	var out io.Writer = w
+	var compressor flushWriteCloser
+	if format != exportFormatParquet && s.config.CompressionMinResponseBytes > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding")); encoding != "" {
+			if compressor, err = newStreamCompressor(encoding, w); err != nil {
+				rows.Close()
+				s.logger.WithError(err).Error("Failed to create response compressor")
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Encoding", encoding)
+			out = compressor
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+
+	var writer exportWriter
+	switch format {
+	case exportFormatCSV:
+		writer, err = newCSVExportWriter(out, includeData)
+	case exportFormatNDJSON:
+		writer = newNDJSONExportWriter(out)
+	case exportFormatParquet:
+		writer, err = newParquetExportWriter(out, includeData)
+	}
+
+	logger := s.logger.WithFields(logrus.Fields{"format": format, "start_time": startTime, "end_time": endTime})
+	started := time.Now()
+	var exported int64
+	// abort 中途出错时中断连接（不发送结束分块），客户端据此得知导出不完整
+	abort := func(err error, message string) {
+		if rows != nil {
+			rows.Close()
+		}
+		if ctx.Err() != nil {
+			logger.WithField("rows", exported).Info("Export cancelled by client")
+			return
+		}
+		logger.WithError(err).WithField("rows", exported).Error(message)
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		abort(err, "Failed to write export")
+		return
+	}
+
+	row := &exportRow{}
+	for {
+		count := 0
+		for rows.Next() {
+			var stored sql.NullString
+			dest := []interface{}{&lastID, &row.Timestamp, &row.DeviceID, &row.MetricName, &row.Value, &row.Priority}
+			if includeData {
+				dest = append(dest, &stored)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				abort(err, "Failed to scan export row")
+				return
+			}
+			lastTimestamp = row.Timestamp
+			row.Time = row.Timestamp.UTC().Format(time.RFC3339Nano)
+			row.Data = stored.String
+			if includeData && IsCompressedPayload(stored.String) {
+				if payload, err := DecompressPayload(stored.String, s.payloadDicts); err != nil {
+					logger.WithError(err).WithField("id", lastID).Warn("Failed to decompress payload, exporting stored form")
+				} else {
+					row.Data = payload
+				}
+			}
+			if err := writer.Write(row); err != nil {
+				abort(err, "Failed to write export")
+				return
+			}
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		rows = nil
+		if err != nil {
+			abort(err, "Failed to read export rows")
+			return
+		}
+		exported += int64(count)
+
+		if err := writer.Flush(); err != nil {
+			abort(err, "Failed to write export")
+			return
+		}
+		if compressor != nil {
+			if err := compressor.Flush(); err != nil {
+				abort(err, "Failed to write export")
+				return
+			}
+		}
+		rc.Flush()
+
+		if count < chunkRows {
+			break
+		}
+		if rows, err = queryChunk(); err != nil {
+			abort(err, "Failed to query export data")
+			return
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		abort(err, "Failed to write export")
+		return
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			abort(err, "Failed to write export")
+			return
+		}
+	}
+	logger.WithFields(logrus.Fields{"rows": exported, "duration": time.Since(started).String()}).Info("Export completed")
+}
@@ -6,9 +6,24 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// alertThreshold 数值超过该阈值时触发高优先级告警
+const alertThreshold = 100.0
+
+// effectivePriority 返回用于准入控制的优先级：超过告警阈值的数据视为高优先级
+func effectivePriority(value float64, priority int) int {
+	if value > alertThreshold {
+		return 1
+	}
+	if priority < 1 || priority > 3 {
+		return 2
+	}
+	return priority
+}
+
 // sensorDataHandler 处理传感器数据上报（扩展功能）
 func (s *Server) sensorDataHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -16,16 +31,8 @@ func (s *Server) sensorDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
 	var data SensorData
-	if err := json.Unmarshal(body, &data); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+	if !s.decodeRequest(w, r, &data) {
 		return
 	}
 
@@ -40,18 +47,43 @@ func (s *Server) sensorDataHandler(w http.ResponseWriter, r *http.Request) {
 		data.Priority = 2 // 默认中等优先级
 	}
 
-	dbService := NewDatabaseService(s.db)
-	if err := dbService.InsertSensorData(&data); err != nil {
+	// 按指标目录校验数值
+	value, flag, err := s.catalog.Check(data.MetricName, data.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.Value = value
+
+	if !s.checkPayload(data.Data) {
+		http.Error(w, invalidPayloadMessage, http.StatusBadRequest)
+		return
+	}
+
+	// 授权、限流与准入控制：过载时优先拒绝低优先级流量
+	if !s.checkIngest(w, r, []string{data.DeviceID}, data.Priority) {
+		return
+	}
+
+	dbService := s.databaseService()
+	start := time.Now()
+	err = dbService.InsertSensorData(&data)
+	s.observeDBLatency(start)
+	if err != nil {
 		s.logger.WithError(err).Error("Failed to insert sensor data")
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	s.afterIngest([]*SensorData{&data})
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	response := map[string]interface{}{
 		"status":  "success",
 		"message": "Data inserted successfully",
-	})
+	}
+	if flag != "" {
+		response["flag"] = flag
+	}
+	s.writeResponse(w, r, response)
 }
 
 // sensorReadWriteHandler 处理传感器数据的读写操作（开启事务）
@@ -61,24 +93,8 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	var request struct {
-		DeviceID   string  `json:"device_id"`
-		MetricName string  `json:"metric_name"`
-		NewValue   float64 `json:"new_value"`
-		Timestamp  string  `json:"timestamp"`
-		Priority   int     `json:"priority"`
-		Data       string  `json:"data"`
-	}
-
-	if err := json.Unmarshal(body, &request); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+	var request SensorRWRequest
+	if !s.decodeRequest(w, r, &request) {
 		return
 	}
 
@@ -93,6 +109,28 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 		request.Priority = 2
 	}
 
+	// 按指标目录校验数值
+	value, flag, err := s.catalog.Check(request.MetricName, request.NewValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.NewValue = value
+
+	if !s.checkPayload(request.Data) {
+		http.Error(w, invalidPayloadMessage, http.StatusBadRequest)
+		return
+	}
+
+	// 授权、限流与准入控制：超过阈值的数值会触发告警，按高优先级处理
+	if !s.checkIngest(w, r, []string{request.DeviceID}, effectivePriority(request.NewValue, request.Priority)) {
+		return
+	}
+
+	dbService := s.databaseService()
+	start := time.Now()
+	defer s.observeDBLatency(start)
+
 	// 开启事务进行读写操作
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -107,7 +145,7 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 	var currentPriority int
 	readQuery := `
 		SELECT value, priority 
-		FROM time_series_data 
+		FROM ` + dbService.SeriesTable() + ` 
 		WHERE device_id = ? AND metric_name = ? 
 		ORDER BY timestamp DESC 
 		LIMIT 1
@@ -121,24 +159,14 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// 2. 计算新值（这里实现一个简单的业务逻辑：如果新值超过阈值，则记录告警）
-	var newValue float64
-	var alertMessage string
-
-	if request.NewValue > 100.0 { // 假设100是阈值
-		newValue = request.NewValue
-		alertMessage = fmt.Sprintf("High value alert: %.2f exceeds threshold", request.NewValue)
+	newValue := request.NewValue
+	alert := thresholdAlert(request.DeviceID, request.MetricName, newValue, request.Timestamp)
+	if alert != nil {
 		// 高优先级告警
 		request.Priority = 1
-	} else {
-		newValue = request.NewValue
 	}
 
 	// 3. 插入新记录
-	insertQuery := `
-		INSERT INTO time_series_data (timestamp, device_id, metric_name, value, priority, data)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`
-
 	timestamp, err := time.Parse(time.RFC3339, request.Timestamp)
 	if err != nil {
 		s.logger.WithError(err).Error("Invalid timestamp format")
@@ -146,7 +174,7 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	_, err = tx.Exec(insertQuery, timestamp, request.DeviceID, request.MetricName, newValue, request.Priority, request.Data)
+	err = dbService.InsertRow(tx, timestamp, request.DeviceID, request.MetricName, newValue, request.Priority, request.Data)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to insert new sensor data")
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -164,7 +192,7 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 	`
 
 	alertCount := 0
-	if alertMessage != "" {
+	if alert != nil {
 		alertCount = 1
 	}
 
@@ -180,6 +208,17 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	s.afterIngest([]*SensorData{{
+		Timestamp:  request.Timestamp,
+		DeviceID:   request.DeviceID,
+		MetricName: request.MetricName,
+		Value:      newValue,
+		Priority:   request.Priority,
+		Data:       request.Data,
+	}})
+	if alert != nil {
+		s.raiseAlerts([]*Alert{alert})
+	}
 
 	// 6. 返回结果
 	response := map[string]interface{}{
@@ -192,12 +231,14 @@ func (s *Server) sensorReadWriteHandler(w http.ResponseWriter, r *http.Request)
 		"timestamp":      request.Timestamp,
 	}
 
-	if alertMessage != "" {
-		response["alert"] = alertMessage
+	if alert != nil {
+		response["alert"] = alert.Message
+	}
+	if flag != "" {
+		response["flag"] = flag
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	s.writeResponse(w, r, response)
 }
 
 // batchSensorReadWriteHandler 处理批量传感器数据读写操作（开启事务）
@@ -207,26 +248,8 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	var request struct {
-		Data []struct {
-			DeviceID   string  `json:"device_id"`
-			MetricName string  `json:"metric_name"`
-			NewValue   float64 `json:"new_value"`
-			Timestamp  string  `json:"timestamp"`
-			Priority   int     `json:"priority"`
-			Data       string  `json:"data"`
-		} `json:"data"`
-	}
-
-	if err := json.Unmarshal(body, &request); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+	var request BatchSensorRWRequest
+	if !s.decodeRequest(w, r, &request) {
 		return
 	}
 
@@ -240,6 +263,23 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// 授权、限流与准入控制：每条数据消耗一个令牌，按批次中最高的优先级判断
+	deviceIDs := make([]string, 0, len(request.Data))
+	batchPriority := 3
+	for _, item := range request.Data {
+		deviceIDs = append(deviceIDs, item.DeviceID)
+		if p := effectivePriority(item.NewValue, item.Priority); p < batchPriority {
+			batchPriority = p
+		}
+	}
+	if !s.checkIngest(w, r, deviceIDs, batchPriority) {
+		return
+	}
+
+	dbService := s.databaseService()
+	start := time.Now()
+	defer s.observeDBLatency(start)
+
 	// 开启事务进行批量读写操作
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -250,22 +290,19 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 	defer tx.Rollback()
 
 	var results []map[string]interface{}
-	var totalAlerts int
+	var rejected []map[string]interface{}
+	var written []*SensorData
+	var alerts []*Alert
 
 	// 准备语句
 	readQuery := `
 		SELECT value, priority 
-		FROM time_series_data 
+		FROM ` + dbService.SeriesTable() + ` 
 		WHERE device_id = ? AND metric_name = ? 
 		ORDER BY timestamp DESC 
 		LIMIT 1
 	`
 
-	insertQuery := `
-		INSERT INTO time_series_data (timestamp, device_id, metric_name, value, priority, data)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`
-
 	statusQuery := `
 		INSERT INTO device_status (device_id, current_value, last_update, alert_count)
 		VALUES (?, ?, ?, ?)
@@ -287,6 +324,23 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 			item.Priority = 2
 		}
 
+		// 按指标目录校验数值，并按配置校验负载
+		value, flag, err := s.catalog.Check(item.MetricName, item.NewValue)
+		if err == nil && !s.checkPayload(item.Data) {
+			err = fmt.Errorf(invalidPayloadMessage)
+		}
+		if err != nil {
+			rejected = append(rejected, map[string]interface{}{
+				"device_id":   item.DeviceID,
+				"metric_name": item.MetricName,
+				"timestamp":   item.Timestamp,
+				"status":      "rejected",
+				"error":       err.Error(),
+			})
+			continue
+		}
+		item.NewValue = value
+
 		// 1. 读取当前值
 		var currentValue float64
 		var currentPriority int
@@ -297,18 +351,12 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 		}
 
 		// 2. 计算新值和业务逻辑
-		var newValue float64
-		var alertMessage string
-		var alertCount int
-
-		if item.NewValue > 100.0 { // 阈值检查
-			newValue = item.NewValue
-			alertMessage = fmt.Sprintf("High value alert: %.2f exceeds threshold", item.NewValue)
+		newValue := item.NewValue
+		alert := thresholdAlert(item.DeviceID, item.MetricName, newValue, item.Timestamp) // 阈值检查
+		alertCount := 0
+		if alert != nil {
 			item.Priority = 1
 			alertCount = 1
-			totalAlerts++
-		} else {
-			newValue = item.NewValue
 		}
 
 		// 3. 插入新记录
@@ -318,7 +366,7 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 			continue
 		}
 
-		_, err = tx.Exec(insertQuery, timestamp, item.DeviceID, item.MetricName, newValue, item.Priority, item.Data)
+		err = dbService.InsertRow(tx, timestamp, item.DeviceID, item.MetricName, newValue, item.Priority, item.Data)
 		if err != nil {
 			s.logger.WithError(err).Error("Failed to insert new sensor data")
 			continue
@@ -331,6 +379,17 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 		}
 
 		// 5. 记录结果
+		if alert != nil {
+			alerts = append(alerts, alert)
+		}
+		written = append(written, &SensorData{
+			Timestamp:  item.Timestamp,
+			DeviceID:   item.DeviceID,
+			MetricName: item.MetricName,
+			Value:      newValue,
+			Priority:   item.Priority,
+			Data:       item.Data,
+		})
 		result := map[string]interface{}{
 			"device_id":      item.DeviceID,
 			"metric_name":    item.MetricName,
@@ -341,8 +400,11 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 			"status":         "success",
 		}
 
-		if alertMessage != "" {
-			result["alert"] = alertMessage
+		if alert != nil {
+			result["alert"] = alert.Message
+		}
+		if flag != "" {
+			result["flag"] = flag
 		}
 
 		results = append(results, result)
@@ -354,23 +416,38 @@ func (s *Server) batchSensorReadWriteHandler(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	s.afterIngest(written)
+	s.raiseAlerts(alerts)
 
 	// 7. 返回批量处理结果
 	response := map[string]interface{}{
 		"status":          "success",
 		"total_processed": len(results),
-		"total_alerts":    totalAlerts,
+		"total_alerts":    len(alerts),
 		"results":         results,
 	}
+	if len(rejected) > 0 {
+		response["total_rejected"] = len(rejected)
+		response["rejected"] = rejected
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	s.writeResponse(w, r, response)
 }
 
 // statsHandler 处理统计信息请求
 func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
-	dbService := NewDatabaseService(s.db)
-	stats, err := dbService.GetStats()
+	// 统计范围限定为请求可访问的租户，可用 ?tenant= 进一步指定
+	tenants := s.requestTenants(r)
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		if tenants != nil && !containsString(tenants, tenant) {
+			http.Error(w, fmt.Sprintf("Not allowed to access tenant %s", tenant), http.StatusForbidden)
+			return
+		}
+		tenants = []string{tenant}
+	}
+
+	dbService := s.databaseService()
+	stats, err := dbService.GetStats(tenants)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to get stats")
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -396,12 +473,17 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	var request struct {
-		DeviceID   string `json:"device_id"`
-		MetricName string `json:"metric_name,omitempty"`
-		StartTime  string `json:"start_time"`
-		EndTime    string `json:"end_time"`
-		Limit      int    `json:"limit,omitempty"`
-		Offset     int    `json:"offset,omitempty"`
+		DeviceID   string            `json:"device_id"`
+		Labels     map[string]string `json:"labels,omitempty"` // 未指定 device_id 时按设备标签选择设备
+		MetricName string            `json:"metric_name,omitempty"`
+		StartTime  string            `json:"start_time"`
+		EndTime    string            `json:"end_time"`
+		Limit      int               `json:"limit,omitempty"`
+		Offset     int               `json:"offset,omitempty"`
+		Pagination string            `json:"pagination,omitempty"` // offset（默认）/ cursor
+		Cursor     string            `json:"cursor,omitempty"`     // 上一页返回的 next_cursor，非空时使用游标分页
+		Order      string            `json:"order,omitempty"`      // desc（默认）/ asc，按 (timestamp, id) 排序
+		SkipCount  bool              `json:"skip_count,omitempty"` // 不计算 total_count
 	}
 
 	if err := json.Unmarshal(body, &request); err != nil {
@@ -410,11 +492,36 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 数据验证
-	if request.DeviceID == "" || request.StartTime == "" || request.EndTime == "" {
-		http.Error(w, "Missing required fields: device_id, start_time, end_time", http.StatusBadRequest)
+	if (request.DeviceID == "" && len(request.Labels) == 0) || request.StartTime == "" || request.EndTime == "" {
+		http.Error(w, "Missing required fields: device_id (or labels), start_time, end_time", http.StatusBadRequest)
 		return
 	}
 
+	// 设备条件：指定 device_id 时精确匹配，否则按标签从设备注册表中选择
+	var deviceIDs []string
+	if request.DeviceID != "" {
+		if !s.authorizeDevice(w, r, request.DeviceID) {
+			return
+		}
+		deviceIDs = []string{request.DeviceID}
+	} else {
+		deviceIDs, err = s.registry.SelectDeviceIDs(DeviceFilter{
+			Labels:  request.Labels,
+			Tenants: s.requestTenants(r),
+		})
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to select devices by labels")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if deviceIDs == nil {
+			deviceIDs = []string{}
+		}
+		if len(deviceIDs) > 0 && !s.authorizeDevice(w, r, deviceIDs...) {
+			return
+		}
+	}
+
 	// 验证时间格式
 	startTime, err := time.Parse(time.RFC3339, request.StartTime)
 	if err != nil {
@@ -443,37 +550,84 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 		request.Offset = 0
 	}
 
-	// 构建查询SQL
-	var query string
-	var args []interface{}
+	if request.Order == "" {
+		request.Order = "desc"
+	}
+	if request.Order != "desc" && request.Order != "asc" {
+		http.Error(w, "Invalid order (expected asc or desc)", http.StatusBadRequest)
+		return
+	}
+	if request.Cursor != "" {
+		request.Pagination = "cursor"
+	}
+	if request.Pagination == "" {
+		request.Pagination = "offset"
+	}
+	if request.Pagination != "offset" && request.Pagination != "cursor" {
+		http.Error(w, "Invalid pagination (expected offset or cursor)", http.StatusBadRequest)
+		return
+	}
 
+	// 构建查询SQL
+	seriesTable := s.databaseService().SeriesTable()
+	where := "device_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(deviceIDs)), ",") + ")"
+	var whereArgs []interface{}
+	for _, deviceID := range deviceIDs {
+		whereArgs = append(whereArgs, deviceID)
+	}
+	if len(deviceIDs) == 0 {
+		// 没有匹配标签的设备
+		where = "1 = 0"
+	}
 	if request.MetricName != "" {
 		// 查询特定指标
-		query = `
-			SELECT id, timestamp, device_id, metric_name, value, priority, 
-				   SUBSTRING(data, 1, 100) as data_preview, LENGTH(data) as data_length,
-				   created_at
-			FROM time_series_data 
-			WHERE device_id = ? AND metric_name = ? 
-			  AND timestamp >= ? AND timestamp <= ?
-			ORDER BY timestamp DESC
-			LIMIT ? OFFSET ?
-		`
-		args = []interface{}{request.DeviceID, request.MetricName, startTime, endTime, request.Limit, request.Offset}
+		where += " AND metric_name = ?"
+		whereArgs = append(whereArgs, request.MetricName)
+	}
+	where += " AND timestamp >= ? AND timestamp <= ?"
+	whereArgs = append(whereArgs, startTime, endTime)
+
+	// 按 (timestamp, id) 排序保证顺序稳定；游标分页从上一页最后一行之后继续，不受新写入数据影响
+	pageWhere := where
+	args := append([]interface{}{}, whereArgs...)
+	direction, compare := "DESC", "<"
+	if request.Order == "asc" {
+		direction, compare = "ASC", ">"
+	}
+	pagination := "LIMIT ? OFFSET ?"
+	if request.Pagination == "cursor" {
+		if request.Cursor != "" {
+			var cursorTimestamp, cursorOrder string
+			var cursorID int64
+			if err := decodeCursor(request.Cursor, &cursorTimestamp, &cursorID, &cursorOrder); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			afterTime, err := time.Parse(time.RFC3339Nano, cursorTimestamp)
+			if err != nil || cursorOrder != request.Order {
+				http.Error(w, "Invalid cursor (order or position mismatch)", http.StatusBadRequest)
+				return
+			}
+			pageWhere += " AND (timestamp " + compare + " ? OR (timestamp = ? AND id " + compare + " ?))"
+			args = append(args, afterTime, afterTime, cursorID)
+		}
+		// 多查一行用于判断是否还有下一页
+		pagination = "LIMIT ?"
+		args = append(args, request.Limit+1)
 	} else {
-		// 查询所有指标
-		query = `
-			SELECT id, timestamp, device_id, metric_name, value, priority, 
-				   SUBSTRING(data, 1, 100) as data_preview, LENGTH(data) as data_length,
-				   created_at
-			FROM time_series_data 
-			WHERE device_id = ? 
-			  AND timestamp >= ? AND timestamp <= ?
-			ORDER BY timestamp DESC
-			LIMIT ? OFFSET ?
-		`
-		args = []interface{}{request.DeviceID, startTime, endTime, request.Limit, request.Offset}
-	}
+		args = append(args, request.Limit, request.Offset)
+	}
+
+	query := `
+		SELECT id, timestamp, device_id, metric_name, value, priority, 
+			   SUBSTRING(data, 1, 100) as data_preview, LENGTH(data) as data_length,
+			   CASE WHEN data LIKE '~z1%' THEN data END as packed_data,
+			   created_at
+		FROM ` + seriesTable + ` 
+		WHERE ` + pageWhere + `
+		ORDER BY timestamp ` + direction + `, id ` + direction + `
+		` + pagination + `
+	`
 
 	// 执行查询
 	rows, err := s.db.Query(query, args...)
@@ -486,7 +640,15 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 解析查询结果
 	var results []map[string]interface{}
+	var nextCursor string
+	var lastTimestamp time.Time
+	var lastID int64
 	for rows.Next() {
+		if request.Pagination == "cursor" && len(results) == request.Limit {
+			nextCursor = encodeCursor(lastTimestamp.Format(time.RFC3339Nano), lastID, request.Order)
+			break
+		}
+
 		var id int64
 		var timestamp time.Time
 		var deviceID, metricName string
@@ -494,14 +656,26 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 		var priority int
 		var dataPreview string
 		var dataLength int
+		var packedData sql.NullString
 		var createdAt time.Time
 
-		err := rows.Scan(&id, &timestamp, &deviceID, &metricName, &value, &priority, &dataPreview, &dataLength, &createdAt)
+		err := rows.Scan(&id, &timestamp, &deviceID, &metricName, &value, &priority, &dataPreview, &dataLength, &packedData, &createdAt)
 		if err != nil {
 			s.logger.WithError(err).Error("Failed to scan sensor data row")
 			continue
 		}
 
+		// 压缩存储的负载透明解压，预览和长度均按原始负载计算
+		if packedData.Valid {
+			payload, err := DecompressPayload(packedData.String, s.payloadDicts)
+			if err != nil {
+				s.logger.WithError(err).WithField("id", id).Warn("Failed to decompress payload")
+			} else {
+				dataLength = len(payload)
+				dataPreview = truncateRunes(payload, 100)
+			}
+		}
+
 		result := map[string]interface{}{
 			"id":           id,
 			"timestamp":    timestamp.Format(time.RFC3339),
@@ -515,6 +689,7 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		results = append(results, result)
+		lastTimestamp, lastID = timestamp, id
 	}
 
 	if err := rows.Err(); err != nil {
@@ -523,31 +698,18 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取总记录数（用于分页）
+	// 获取总记录数（用于分页）；游标分页只在第一页计算
 	var totalCount int64
-	var countQuery string
-	var countArgs []interface{}
-
-	if request.MetricName != "" {
-		countQuery = `
-			SELECT COUNT(*) FROM time_series_data 
-			WHERE device_id = ? AND metric_name = ? 
-			  AND timestamp >= ? AND timestamp <= ?
-		`
-		countArgs = []interface{}{request.DeviceID, request.MetricName, startTime, endTime}
-	} else {
-		countQuery = `
-			SELECT COUNT(*) FROM time_series_data 
-			WHERE device_id = ? 
-			  AND timestamp >= ? AND timestamp <= ?
-		`
-		countArgs = []interface{}{request.DeviceID, startTime, endTime}
-	}
+	countTotal := !request.SkipCount && request.Cursor == ""
+	if countTotal {
+		countQuery := "SELECT COUNT(*) FROM " + seriesTable + " WHERE " + where
+		countArgs := whereArgs
 
-	err = s.db.QueryRow(countQuery, countArgs...).Scan(&totalCount)
-	if err != nil {
-		s.logger.WithError(err).Warn("Failed to get total count")
-		totalCount = int64(len(results)) // 降级处理
+		err = s.db.QueryRow(countQuery, countArgs...).Scan(&totalCount)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to get total count")
+			totalCount = int64(len(results)) // 降级处理
+		}
 	}
 
 	// 构建响应
@@ -557,13 +719,24 @@ func (s *Server) getSensorDataHandler(w http.ResponseWriter, r *http.Request) {
 		"metric_name": request.MetricName,
 		"start_time":  request.StartTime,
 		"end_time":    request.EndTime,
-		"total_count": totalCount,
 		"limit":       request.Limit,
-		"offset":      request.Offset,
+		"order":       request.Order,
+		"pagination":  request.Pagination,
 		"count":       len(results),
 		"data":        results,
 	}
+	if countTotal {
+		response["total_count"] = totalCount
+	}
+	if request.Pagination == "offset" {
+		response["offset"] = request.Offset
+	} else if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	if request.DeviceID == "" {
+		response["labels"] = request.Labels
+		response["device_ids"] = deviceIDs
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	s.writeResponse(w, r, response)
 }
@@ -0,0 +1,1334 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// 导入文件格式
+const (
+	importFormatCSV     = "csv"
+	importFormatParquet = "parquet"
+)
+
+// 导入任务状态
+const (
+	importStatusRunning     = "running"
+	importStatusCompleted   = "completed"
+	importStatusFailed      = "failed"
+	importStatusInterrupted = "interrupted"
+)
+
+const (
+	// importStaleAfter 运行中的任务超过该时间没有心跳时视为进程已退出，允许续传
+	importStaleAfter = time.Minute
+	// importHeartbeatInterval 运行中的任务更新 updated_at 的间隔，与批次提交无关
+	importHeartbeatInterval = 15 * time.Second
+	// importFingerprintHead 源文件指纹计算摘要的开头字节数
+	importFingerprintHead = 1 << 20
+	// importMaxErrorSamples 每次运行保留的出错行数
+	importMaxErrorSamples = 20
+	// importProgressInterval 进度输出间隔
+	importProgressInterval = 2 * time.Second
+)
+
+var (
+	errImportJobNotFound = errors.New("import job not found")
+	errImportJobClaimed  = errors.New("import job was claimed by another process")
+)
+
+// importFields 可映射的字段
+var importFields = []string{"timestamp", "device_id", "metric_name", "value", "priority", "data"}
+
+// ImportOptions 导入选项，命令行参数和 /api/import 查询参数同名
+type ImportOptions struct {
+	Format          string `json:"format"`
+	Columns         string `json:"columns"`          // 字段=列名，逗号分隔，例如 timestamp=ts,device_id=sensor；未映射的字段使用同名列
+	Values          string `json:"values"`           // 宽表：每列一个指标，列名即指标名，可写作 列名:指标名
+	Device          string `json:"device"`           // 固定设备ID（文件中没有设备列时）
+	Metric          string `json:"metric"`           // 固定指标名（文件中没有指标列时）
+	TimestampFormat string `json:"timestamp_format"` // auto / rfc3339 / unix / unix_ms / unix_us / unix_ns / Go 时间格式
+	Timezone        string `json:"timezone"`         // 时间格式不含时区时使用
+	Delimiter       string `json:"delimiter"`        // CSV 分隔符
+	Priority        int    `json:"priority"`         // 没有优先级列或为空时使用
+	MaxErrors       int64  `json:"-"`                // 允许跳过的出错行数，超过后任务失败
+}
+
+// normalize 补全默认值并校验
+func (o *ImportOptions) normalize() error {
+	if o.Format != importFormatCSV && o.Format != importFormatParquet {
+		return fmt.Errorf("invalid format %q (expected csv or parquet)", o.Format)
+	}
+	if o.TimestampFormat == "" {
+		o.TimestampFormat = "auto"
+	}
+	if o.Timezone == "" {
+		o.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(o.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", o.Timezone)
+	}
+	switch o.Delimiter {
+	case "":
+		o.Delimiter = ","
+	case "tab", `\t`:
+		o.Delimiter = "\t"
+	}
+	if len([]rune(o.Delimiter)) != 1 {
+		return fmt.Errorf("invalid delimiter %q (single character expected)", o.Delimiter)
+	}
+	if o.Priority == 0 {
+		o.Priority = 2
+	}
+	if o.Priority < 1 || o.Priority > 3 {
+		return fmt.Errorf("invalid priority %d (expected 1, 2 or 3)", o.Priority)
+	}
+	if o.MaxErrors < 0 {
+		return fmt.Errorf("invalid max_errors %d", o.MaxErrors)
+	}
+	return nil
+}
+
+// hash 续传时校验选项与原任务一致（不含 max_errors）
+func (o *ImportOptions) hash() string {
+	encoded, _ := json.Marshal(o)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// importFingerprint 源文件指纹，续传时校验是同一个文件：大小和开头 1MB 的 SHA-256
+type importFingerprint struct {
+	size     int64 // 未知时（分块上传）为 -1
+	headHash string
+}
+
+// newImportFingerprint 计算 head（文件开头最多 importFingerprintHead 字节）的指纹
+func newImportFingerprint(size int64, head []byte) importFingerprint {
+	if len(head) > importFingerprintHead {
+		head = head[:importFingerprintHead]
+	}
+	sum := sha256.Sum256(head)
+	return importFingerprint{size: size, headHash: hex.EncodeToString(sum[:])}
+}
+
+// readImportFingerprint 从可随机读取的文件计算指纹，不改变读取位置
+func readImportFingerprint(ra io.ReaderAt, size int64) (importFingerprint, error) {
+	head := make([]byte, importFingerprintHead)
+	n, err := ra.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return importFingerprint{}, err
+	}
+	return newImportFingerprint(size, head[:n]), nil
+}
+
+// matches 判断续传的文件是否与原任务一致，任一方大小未知时只比较开头
+func (f importFingerprint) matches(other importFingerprint) bool {
+	if f.headHash != other.headHash {
+		return false
+	}
+	return f.size < 0 || other.size < 0 || f.size == other.size
+}
+
+// importValueColumn 宽表中的一个指标列
+type importValueColumn struct {
+	index  int
+	metric string
+}
+
+// importMapping 字段到列序号的映射，-1 表示文件中没有该列
+type importMapping struct {
+	timestamp, device, metric, value, priority, data int
+	values                                           []importValueColumn
+	options                                          *ImportOptions
+	location                                         *time.Location
+}
+
+// newImportMapping 按文件的列名解析映射
+func newImportMapping(columns []string, options *ImportOptions) (*importMapping, error) {
+	index := make(map[string]int, len(columns))
+	for i, name := range columns {
+		if _, ok := index[name]; !ok {
+			index[name] = i
+		}
+	}
+
+	names := make(map[string]string)
+	for _, field := range importFields {
+		names[field] = field
+	}
+	explicit := make(map[string]bool)
+	for _, pair := range splitList(options.Columns) {
+		field, column, ok := strings.Cut(pair, "=")
+		field, column = strings.TrimSpace(field), strings.TrimSpace(column)
+		if _, known := names[field]; !ok || !known || column == "" {
+			return nil, fmt.Errorf("invalid columns entry %q (expected field=column, fields: %s)", pair, strings.Join(importFields, ", "))
+		}
+		names[field] = column
+		explicit[field] = true
+	}
+
+	lookup := func(field string) (int, error) {
+		if i, ok := index[names[field]]; ok {
+			return i, nil
+		}
+		if explicit[field] {
+			return -1, fmt.Errorf("column %q (mapped to %s) not found", names[field], field)
+		}
+		return -1, nil
+	}
+
+	mapping := &importMapping{options: options}
+	mapping.location, _ = time.LoadLocation(options.Timezone)
+	var err error
+	for field, target := range map[string]*int{
+		"timestamp": &mapping.timestamp, "device_id": &mapping.device, "metric_name": &mapping.metric,
+		"value": &mapping.value, "priority": &mapping.priority, "data": &mapping.data,
+	} {
+		if *target, err = lookup(field); err != nil {
+			return nil, err
+		}
+	}
+
+	if mapping.timestamp < 0 {
+		return nil, fmt.Errorf("timestamp column %q not found", names["timestamp"])
+	}
+	if options.Device != "" {
+		mapping.device = -1
+	} else if mapping.device < 0 {
+		return nil, fmt.Errorf("device_id column %q not found (or set a fixed device)", names["device_id"])
+	}
+
+	if options.Values != "" {
+		// 宽表：每个指标列产生一条数据
+		if explicit["value"] || explicit["metric_name"] || options.Metric != "" {
+			return nil, errors.New("values cannot be combined with value / metric_name columns or a fixed metric")
+		}
+		for _, entry := range splitList(options.Values) {
+			column, metric, ok := strings.Cut(entry, ":")
+			if !ok {
+				metric = column
+			}
+			i, found := index[column]
+			if !found {
+				return nil, fmt.Errorf("value column %q not found", column)
+			}
+			mapping.values = append(mapping.values, importValueColumn{index: i, metric: metric})
+		}
+		mapping.value, mapping.metric = -1, -1
+		return mapping, nil
+	}
+
+	if mapping.value < 0 {
+		return nil, fmt.Errorf("value column %q not found (or use values for wide files)", names["value"])
+	}
+	if options.Metric != "" {
+		mapping.metric = -1
+	} else if mapping.metric < 0 {
+		return nil, fmt.Errorf("metric_name column %q not found (or set a fixed metric)", names["metric_name"])
+	}
+	return mapping, nil
+}
+
+// importString 将单元格转换为字符串
+func importString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// importFloat 将单元格转换为数值，空单元格返回 false
+func importFloat(v interface{}) (float64, bool, error) {
+	var value float64
+	switch t := v.(type) {
+	case nil:
+		return 0, false, nil
+	case float64:
+		value = t
+	case int64:
+		value = float64(t)
+	case bool:
+		if t {
+			value = 1
+		}
+	default:
+		text := importString(v)
+		if text == "" {
+			return 0, false, nil
+		}
+		switch strings.ToLower(text) {
+		case "true":
+			value = 1
+		case "false":
+			value = 0
+		default:
+			parsed, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid value %q", truncateRunes(text, 32))
+			}
+			value = parsed
+		}
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false, errors.New("value must be a finite number")
+	}
+	return value, true, nil
+}
+
+// unixUnit 数字时间戳的单位，auto 时按数量级判断秒 / 毫秒 / 微秒 / 纳秒
+func unixUnit(abs float64, format string) (time.Duration, error) {
+	switch format {
+	case "auto":
+		switch {
+		case abs < 1e11:
+			return time.Second, nil
+		case abs < 1e14:
+			return time.Millisecond, nil
+		case abs < 1e17:
+			return time.Microsecond, nil
+		}
+		return time.Nanosecond, nil
+	case "unix":
+		return time.Second, nil
+	case "unix_ms":
+		return time.Millisecond, nil
+	case "unix_us":
+		return time.Microsecond, nil
+	case "unix_ns":
+		return time.Nanosecond, nil
+	}
+	return 0, errors.New("numeric timestamp requires timestamp_format auto or unix*")
+}
+
+// unixTimestamp 将整数时间戳转换为时间
+func unixTimestamp(v int64, format string) (time.Time, error) {
+	unit, err := unixUnit(math.Abs(float64(v)), format)
+	if err != nil {
+		return time.Time{}, err
+	}
+	perSecond := int64(time.Second / unit)
+	return time.Unix(v/perSecond, v%perSecond*int64(unit)).UTC(), nil
+}
+
+// unixTimestampFloat 将带小数的时间戳转换为时间
+func unixTimestampFloat(v float64, format string) (time.Time, error) {
+	unit, err := unixUnit(math.Abs(v), format)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, frac := math.Modf(v * float64(unit) / float64(time.Second))
+	return time.Unix(int64(sec), int64(math.Round(frac*1e9))).UTC(), nil
+}
+
+// importLayouts timestamp_format 为 auto 时依次尝试的格式
+var importLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+	"2006-01-02",
+}
+
+// parseTimestamp 按 timestamp_format 解析时间戳单元格
+func (m *importMapping) parseTimestamp(v interface{}) (time.Time, error) {
+	format := m.options.TimestampFormat
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC(), nil
+	case int64:
+		return unixTimestamp(t, format)
+	case float64:
+		return unixTimestampFloat(t, format)
+	}
+
+	text := importString(v)
+	if text == "" {
+		return time.Time{}, errors.New("missing timestamp")
+	}
+	switch format {
+	case "auto":
+		if number, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return unixTimestamp(number, format)
+		}
+		if number, err := strconv.ParseFloat(text, 64); err == nil {
+			return unixTimestampFloat(number, format)
+		}
+		for _, layout := range importLayouts {
+			if ts, err := time.ParseInLocation(layout, text, m.location); err == nil {
+				return ts.UTC(), nil
+			}
+		}
+	case "rfc3339":
+		if ts, err := time.Parse(time.RFC3339Nano, text); err == nil {
+			return ts.UTC(), nil
+		}
+	case "unix", "unix_ms", "unix_us", "unix_ns":
+		if number, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return unixTimestamp(number, format)
+		}
+		if number, err := strconv.ParseFloat(text, 64); err == nil {
+			return unixTimestampFloat(number, format)
+		}
+	default:
+		if ts, err := time.ParseInLocation(format, text, m.location); err == nil {
+			return ts.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q (timestamp_format %s)", truncateRunes(text, 40), format)
+}
+
+// importSource 逐行读取导入文件
+type importSource interface {
+	Columns() []string
+	// Next 返回下一行，结束时返回 io.EOF；返回 importRowError 时该行跳过，可以继续读取
+	Next() ([]interface{}, error)
+	// Skip 跳过 n 行（续传）
+	Skip(n int64) error
+	// Progress 返回已读取和总量（字节或行数），总量未知时为 0
+	Progress() (done, total int64)
+}
+
+// importRowError 单行格式错误
+type importRowError struct{ err error }
+
+func (e *importRowError) Error() string { return e.err.Error() }
+
+// countingReader 统计已读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// csvImportSource 读取带表头的 CSV
+type csvImportSource struct {
+	reader  *csv.Reader
+	counter *countingReader
+	size    int64
+	columns []string
+}
+
+func newCSVImportSource(r io.Reader, size int64, delimiter string) (*csvImportSource, error) {
+	counter := &countingReader{r: r}
+	reader := csv.NewReader(counter)
+	reader.Comma = []rune(delimiter)[0]
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty CSV file")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+	columns := make([]string, len(header))
+	for i, name := range header {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+	}
+	return &csvImportSource{reader: reader, counter: counter, size: size, columns: columns}, nil
+}
+
+func (c *csvImportSource) Columns() []string { return c.columns }
+
+func (c *csvImportSource) Next() ([]interface{}, error) {
+	record, err := c.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &importRowError{err}
+		}
+		return nil, err
+	}
+	row := make([]interface{}, len(record))
+	for i, field := range record {
+		row[i] = field
+	}
+	return row, nil
+}
+
+func (c *csvImportSource) Skip(n int64) error {
+	for i := int64(0); i < n; i++ {
+		if _, err := c.reader.Read(); err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				continue
+			}
+			if err == io.EOF {
+				return fmt.Errorf("file has fewer rows than already imported (%d)", n)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvImportSource) Progress() (int64, int64) { return c.counter.n, c.size }
+
+// parquetImportSource 按行组读取 Parquet，只解码映射到的列
+type parquetImportSource struct {
+	file    *parquetFile
+	columns []int
+	group   int
+	values  [][]interface{}
+	row     int64 // 当前行组中的下一行
+	rows    int64 // 已读取的行数
+}
+
+func newParquetImportSource(r io.ReaderAt, size int64) (*parquetImportSource, error) {
+	file, err := openParquet(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetImportSource{file: file, group: -1}, nil
+}
+
+func (p *parquetImportSource) Columns() []string { return p.file.Columns() }
+
+// use 设置需要解码的列
+func (p *parquetImportSource) use(mapping *importMapping) {
+	for _, i := range []int{mapping.timestamp, mapping.device, mapping.metric, mapping.value, mapping.priority, mapping.data} {
+		if i >= 0 {
+			p.columns = append(p.columns, i)
+		}
+	}
+	for _, column := range mapping.values {
+		p.columns = append(p.columns, column.index)
+	}
+}
+
+func (p *parquetImportSource) Next() ([]interface{}, error) {
+	for p.group < 0 || p.row >= p.file.rowGroups[p.group].numRows {
+		if p.group+1 >= len(p.file.rowGroups) {
+			return nil, io.EOF
+		}
+		p.group++
+		p.row = 0
+		values, err := p.file.ReadRowGroup(p.group, p.columns)
+		if err != nil {
+			return nil, err
+		}
+		p.values = values
+	}
+	row := make([]interface{}, len(p.values))
+	for i, column := range p.values {
+		if column != nil {
+			row[i] = column[p.row]
+		}
+	}
+	p.row++
+	p.rows++
+	return row, nil
+}
+
+func (p *parquetImportSource) Skip(n int64) error {
+	// 整个行组都已导入时直接跳过，不解码
+	for n > 0 && p.group+1 < len(p.file.rowGroups) && p.file.rowGroups[p.group+1].numRows <= n {
+		p.group++
+		p.row = p.file.rowGroups[p.group].numRows
+		n -= p.row
+		p.rows += p.row
+	}
+	for ; n > 0; n-- {
+		if _, err := p.Next(); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("file has fewer rows than already imported")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parquetImportSource) Progress() (int64, int64) { return p.rows, p.file.numRows }
+
+// openImportSource 打开导入文件并解析列映射；CSV 顺序读取 r，Parquet 随机读取 ra
+func openImportSource(options *ImportOptions, r io.Reader, ra io.ReaderAt, size int64) (importSource, *importMapping, error) {
+	if options.Format == importFormatParquet {
+		source, err := newParquetImportSource(ra, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		mapping, err := newImportMapping(source.Columns(), options)
+		if err != nil {
+			return nil, nil, err
+		}
+		source.use(mapping)
+		return source, mapping, nil
+	}
+
+	source, err := newCSVImportSource(r, size, options.Delimiter)
+	if err != nil {
+		return nil, nil, err
+	}
+	mapping, err := newImportMapping(source.Columns(), options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, mapping, nil
+}
+
+// ImportJob 导入任务及进度
+type ImportJob struct {
+	ID               int64     `json:"id"`
+	Source           string    `json:"source"`
+	Format           string    `json:"format"`
+	Status           string    `json:"status"`
+	RowsRead         int64     `json:"rows_read"` // 已处理的源文件行数（续传位置，含跳过的行）
+	ReadingsImported int64     `json:"readings_imported"`
+	RowsSkipped      int64     `json:"rows_skipped"`
+	Percent          float64   `json:"percent,omitempty"` // 本次运行的读取进度
+	Error            string    `json:"error,omitempty"`
+	Errors           []string  `json:"errors,omitempty"` // 本次运行中跳过的行（最多 20 条）
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+
+	runID string // 本次认领的标识，提交进度时校验任务没有被其他进程认领
+}
+
+// initImportStorage 创建 import_jobs 表（导入进度，用于续传）
+func initImportStorage(db *sql.DB) error {
+	createImportJobsTable := `
+	CREATE TABLE IF NOT EXISTS import_jobs (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		source VARCHAR(255) NOT NULL,
+		format VARCHAR(16) NOT NULL,
+		options_hash CHAR(64) NOT NULL,
+		source_size BIGINT NOT NULL DEFAULT -1,
+		source_head_hash CHAR(64) NOT NULL DEFAULT '',
+		run_id CHAR(32) NOT NULL DEFAULT '',
+		status VARCHAR(16) NOT NULL,
+		rows_read BIGINT NOT NULL DEFAULT 0,
+		readings_imported BIGINT NOT NULL DEFAULT 0,
+		rows_skipped BIGINT NOT NULL DEFAULT 0,
+		error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+	if _, err := db.Exec(createImportJobsTable); err != nil {
+		return fmt.Errorf("failed to create import_jobs table: %w", err)
+	}
+	return nil
+}
+
+// getImportJob 读取导入任务及其选项摘要和源文件指纹，不存在时返回 sql.ErrNoRows
+func getImportJob(db *sql.DB, id int64) (*ImportJob, string, importFingerprint, error) {
+	job := &ImportJob{}
+	var optionsHash string
+	var fingerprint importFingerprint
+	var jobError sql.NullString
+	err := db.QueryRow(`
+		SELECT id, source, format, options_hash, source_size, source_head_hash, run_id, status,
+			rows_read, readings_imported, rows_skipped, error, created_at, updated_at
+		FROM import_jobs WHERE id = ?
+	`, id).Scan(&job.ID, &job.Source, &job.Format, &optionsHash, &fingerprint.size, &fingerprint.headHash, &job.runID, &job.Status,
+		&job.RowsRead, &job.ReadingsImported, &job.RowsSkipped, &jobError, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, "", fingerprint, err
+	}
+	job.Error = jobError.String
+	return job, optionsHash, fingerprint, nil
+}
+
+// newImportRunID 生成认领标识
+func newImportRunID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startImportJob 新建任务，或在 resumeID > 0 时认领已中断的任务从上次提交的位置继续
+// 续传时源文件的指纹须与原任务一致，否则按行数跳过的位置没有意义
+func startImportJob(db *sql.DB, source string, options *ImportOptions, fingerprint importFingerprint, resumeID int64) (*ImportJob, error) {
+	runID := newImportRunID()
+	if resumeID <= 0 {
+		result, err := db.Exec(`
+			INSERT INTO import_jobs (source, format, options_hash, source_size, source_head_hash, run_id, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, truncateRunes(source, 255), options.Format, options.hash(), fingerprint.size, fingerprint.headHash, runID, importStatusRunning)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create import job: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		job, _, _, err := getImportJob(db, id)
+		return job, err
+	}
+
+	job, optionsHash, jobFingerprint, err := getImportJob(db, resumeID)
+	if err == sql.ErrNoRows {
+		return nil, errImportJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == importStatusCompleted {
+		return nil, fmt.Errorf("import job %d is already completed", resumeID)
+	}
+	if optionsHash != options.hash() {
+		return nil, fmt.Errorf("import options do not match job %d (format and column mapping must be the same)", resumeID)
+	}
+	if !jobFingerprint.matches(fingerprint) {
+		return nil, fmt.Errorf("source file does not match job %d (size or content differs from the original file)", resumeID)
+	}
+
+	// 运行中的任务只有在长时间没有心跳（进程已退出）时才能认领；认领后原进程的提交因 run_id 不符而失败
+	result, err := db.Exec(`
+		UPDATE import_jobs SET status = ?, error = NULL, run_id = ?
+		WHERE id = ? AND (status <> ? OR updated_at < NOW() - INTERVAL ? SECOND)
+	`, importStatusRunning, runID, resumeID, importStatusRunning, int(importStaleAfter.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume import job: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, fmt.Errorf("import job %d is still running", resumeID)
+	}
+	job.Status = importStatusRunning
+	job.Error = ""
+	job.runID = runID
+	return job, nil
+}
+
+// Importer 将导入文件按批写入时序数据表，每批数据与进度在同一事务中提交，中断后可从最后提交的位置续传
+// 与 HTTP 写入一样做未知设备策略、指标目录和负载校验；不做限流和租户配额检查（导入需要 admin 权限）
+type Importer struct {
+	db              *sql.DB
+	dbService       *DatabaseService
+	registry        *DeviceRegistry
+	unknownDevices  string
+	catalog         *MetricCatalog
+	validatePayload bool
+	batchSize       int
+	key             *APIKey                  // 通过 API 导入时的 API Key，按其工厂范围授权设备
+	record          func(rows []*SensorData) // 每批提交后调用（序列索引、租户用量）
+}
+
+// newImporter 创建使用服务端组件的导入器
+func (s *Server) newImporter(key *APIKey) *Importer {
+	return &Importer{
+		db:              s.db,
+		dbService:       s.databaseService(),
+		registry:        s.registry,
+		unknownDevices:  s.config.UnknownDevicePolicy,
+		catalog:         s.catalog,
+		validatePayload: s.config.PayloadValidate,
+		batchSize:       s.config.ImportBatchSize,
+		key:             key,
+		record: func(rows []*SensorData) {
+			s.tenantUsage.RecordStorage(rows)
+			s.seriesIndex.Record(rows)
+			s.deviceStatus.Record(rows)
+		},
+	}
+}
+
+// convertRow 将一行转换为传感器数据（宽表一行可产生多条）
+func (im *Importer) convertRow(m *importMapping, row []interface{}) ([]*SensorData, error) {
+	timestamp, err := m.parseTimestamp(row[m.timestamp])
+	if err != nil {
+		return nil, err
+	}
+
+	deviceID := m.options.Device
+	if m.device >= 0 {
+		deviceID = importString(row[m.device])
+	}
+	if deviceID == "" {
+		return nil, errors.New("missing device_id")
+	}
+	if len(deviceID) > 100 {
+		return nil, errors.New("device_id too long")
+	}
+	if im.key != nil && !im.key.AllowsDevice(deviceID) {
+		return nil, fmt.Errorf("API key is not allowed to access device %s", deviceID)
+	}
+	var unknown []string
+	if im.unknownDevices != unknownDeviceAllow {
+		if unknown, err = im.registry.Unknown([]string{deviceID}); err != nil {
+			return nil, err
+		}
+		if len(unknown) > 0 && im.unknownDevices == unknownDeviceReject {
+			return nil, fmt.Errorf("unknown device %s (not registered)", deviceID)
+		}
+	}
+
+	priority := m.options.Priority
+	if m.priority >= 0 {
+		if text := importString(row[m.priority]); text != "" {
+			if priority, err = strconv.Atoi(text); err != nil || priority < 1 || priority > 3 {
+				return nil, fmt.Errorf("invalid priority %q", truncateRunes(text, 16))
+			}
+		}
+	}
+	var data string
+	if m.data >= 0 {
+		data = importString(row[m.data])
+		if IsCompressedPayload(data) || (im.validatePayload && !ValidatePayloadData(data)) {
+			return nil, errors.New(invalidPayloadMessage)
+		}
+	}
+
+	values := m.values
+	if values == nil {
+		metric := m.options.Metric
+		if m.metric >= 0 {
+			metric = importString(row[m.metric])
+		}
+		values = []importValueColumn{{index: m.value, metric: metric}}
+	}
+
+	readings := make([]*SensorData, 0, len(values))
+	for _, column := range values {
+		value, ok, err := importFloat(row[column.index])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", column.metric, err)
+		}
+		if !ok {
+			if m.values != nil {
+				continue // 宽表中的空单元格表示该时刻没有这个指标
+			}
+			return nil, errors.New("missing value")
+		}
+		if column.metric == "" || len(column.metric) > 50 {
+			return nil, errors.New("missing or too long metric_name")
+		}
+		if value, _, err = im.catalog.Check(column.metric, value); err != nil {
+			return nil, err
+		}
+		readings = append(readings, &SensorData{
+			Timestamp:  timestamp.Format(time.RFC3339Nano),
+			DeviceID:   deviceID,
+			MetricName: column.metric,
+			Value:      value,
+			Priority:   priority,
+			Data:       data,
+		})
+	}
+
+	// 新设备在整行校验通过后才登记
+	if len(unknown) > 0 && len(readings) > 0 {
+		if err := im.registry.Register(unknown); err != nil {
+			return nil, err
+		}
+	}
+	return readings, nil
+}
+
+// Run 从任务的续传位置开始导入，直到文件结束、出错行数超过 max_errors 或 ctx 取消
+// progress 在每批提交后调用；返回时任务状态已写回
+func (im *Importer) Run(ctx context.Context, job *ImportJob, source importSource, mapping *importMapping, progress func(*ImportJob)) error {
+	stopHeartbeat := make(chan struct{})
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		im.heartbeat(job.ID, job.runID, stopHeartbeat)
+	}()
+	err := im.run(ctx, job, source, mapping, progress)
+	close(stopHeartbeat)
+	<-heartbeatDone
+	switch {
+	case err == nil:
+		job.Status = importStatusCompleted
+	case ctx.Err() != nil:
+		job.Status = importStatusInterrupted
+		job.Error = "interrupted"
+		err = ctx.Err()
+	default:
+		job.Status = importStatusFailed
+		job.Error = err.Error()
+	}
+	if done, total := source.Progress(); total > 0 {
+		job.Percent = math.Round(float64(done)/float64(total)*1000) / 10
+	}
+
+	var jobError interface{}
+	if job.Error != "" {
+		jobError = job.Error
+	}
+	if err == errImportJobClaimed {
+		// 任务已由其他进程继续，状态归它所有
+		return err
+	}
+	if _, dbErr := im.db.Exec(`UPDATE import_jobs SET status = ?, error = ? WHERE id = ? AND run_id = ?`,
+		job.Status, jobError, job.ID, job.runID); dbErr != nil && err == nil {
+		err = fmt.Errorf("failed to update import job: %w", dbErr)
+	}
+	job.UpdatedAt = time.Now()
+	return err
+}
+
+// heartbeat 定期更新运行中任务的 updated_at，批次提交很慢时任务也不会被视为已退出
+func (im *Importer) heartbeat(id int64, runID string, stop <-chan struct{}) {
+	ticker := time.NewTicker(importHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			im.db.Exec(`UPDATE import_jobs SET updated_at = NOW() WHERE id = ? AND run_id = ? AND status = ?`,
+				id, runID, importStatusRunning)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (im *Importer) run(ctx context.Context, job *ImportJob, source importSource, mapping *importMapping, progress func(*ImportJob)) error {
+	if job.RowsRead > 0 {
+		if err := source.Skip(job.RowsRead); err != nil {
+			return fmt.Errorf("failed to skip %d imported rows: %w", job.RowsRead, err)
+		}
+	}
+
+	batch := make([]*SensorData, 0, im.batchSize)
+	var rowsRead, rowsSkipped int64 // 本批次
+	commit := func() error {
+		tx, err := im.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+		if err := im.dbService.BulkInsertRows(tx, batch); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`
+			UPDATE import_jobs
+			SET rows_read = rows_read + ?, readings_imported = readings_imported + ?, rows_skipped = rows_skipped + ?
+			WHERE id = ? AND run_id = ?
+		`, rowsRead, len(batch), rowsSkipped, job.ID, job.runID)
+		if err != nil {
+			return fmt.Errorf("failed to update import job: %w", err)
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+			return errImportJobClaimed
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		if im.record != nil {
+			im.record(batch)
+		}
+		job.RowsRead += rowsRead
+		job.ReadingsImported += int64(len(batch))
+		job.RowsSkipped += rowsSkipped
+		if done, total := source.Progress(); total > 0 {
+			job.Percent = math.Round(float64(done)/float64(total)*1000) / 10
+		}
+		job.UpdatedAt = time.Now()
+		batch = batch[:0]
+		rowsRead, rowsSkipped = 0, 0
+		if progress != nil {
+			progress(job)
+		}
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		row, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		var readings []*SensorData
+		var rowErr *importRowError
+		if errors.As(err, &rowErr) {
+			// 格式错误的行按出错行处理
+		} else if err != nil {
+			return err
+		} else {
+			readings, err = im.convertRow(mapping, row)
+		}
+
+		rowsRead++
+		if err != nil {
+			rowsSkipped++
+			if len(job.Errors) < importMaxErrorSamples {
+				job.Errors = append(job.Errors, fmt.Sprintf("row %d: %v", job.RowsRead+rowsRead, err))
+			}
+			if job.RowsSkipped+rowsSkipped > mapping.options.MaxErrors {
+				return fmt.Errorf("row %d: %v (more than %d rows skipped, see max_errors)", job.RowsRead+rowsRead, err, mapping.options.MaxErrors)
+			}
+			continue
+		}
+		batch = append(batch, readings...)
+		if len(batch) >= im.batchSize {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+	if rowsRead > 0 {
+		return commit()
+	}
+	return nil
+}
+
+// importFormatOf 按文件扩展名判断格式
+func importFormatOf(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".gz")
+	switch filepath.Ext(name) {
+	case ".parquet", ".pq":
+		return importFormatParquet
+	}
+	return importFormatCSV
+}
+
+// runImportCommand 导入命令：bench-server import [flags] <file>
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	options := &ImportOptions{}
+	fs.StringVar(&options.Format, "format", "", "csv or parquet (default: by file extension)")
+	fs.StringVar(&options.Columns, "columns", "", "field=column mappings, e.g. timestamp=ts,device_id=sensor,value=reading")
+	fs.StringVar(&options.Values, "values", "", "wide files: comma separated value columns, each a metric (column or column:metric)")
+	fs.StringVar(&options.Device, "device", "", "fixed device_id for files without a device column")
+	fs.StringVar(&options.Metric, "metric", "", "fixed metric_name for files without a metric column")
+	fs.StringVar(&options.TimestampFormat, "timestamp-format", "auto", "auto, rfc3339, unix, unix_ms, unix_us, unix_ns or a Go layout")
+	fs.StringVar(&options.Timezone, "timezone", "UTC", "time zone for timestamps without offset")
+	fs.StringVar(&options.Delimiter, "delimiter", "", "CSV delimiter (default , or tab for .tsv)")
+	fs.IntVar(&options.Priority, "priority", 2, "priority for rows without a priority column")
+	fs.Int64Var(&options.MaxErrors, "max-errors", 0, "number of invalid rows to skip before failing")
+	resume := fs.Int64("resume", 0, "id of an interrupted import job to continue")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [flags] <file.csv|file.csv.gz|file.parquet>")
+	}
+	path := fs.Arg(0)
+	if options.Format == "" {
+		options.Format = importFormatOf(path)
+	}
+	if options.Delimiter == "" && strings.HasSuffix(strings.TrimSuffix(strings.ToLower(path), ".gz"), ".tsv") {
+		options.Delimiter = "\t"
+	}
+	if err := options.normalize(); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := readImportFingerprint(file, info.Size())
+	if err != nil {
+		return err
+	}
+	var r io.Reader = file
+	size := info.Size()
+	if options.Format == importFormatCSV && strings.HasSuffix(strings.ToLower(path), ".gz") {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r, size = gr, 0 // 解压后的大小未知，不显示百分比
+	}
+	source, mapping, err := openImportSource(options, r, file, size)
+	if err != nil {
+		return err
+	}
+
+	config := NewConfig()
+	catalogPolicy, err := newMetricCatalogPolicy(config)
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, initStorage := range []func(*sql.DB) error{initDatabase, initRegistryStorage, initSeriesStorage, initTenantStorage, initImportStorage} {
+		if err := initStorage(db); err != nil {
+			return err
+		}
+	}
+	compact, err := openCompactStore(db, config, catalogPolicy)
+	if err != nil {
+		return err
+	}
+	payloadCompressor, err := openPayloadCompressor(config, NewPayloadDictionaryStore(db))
+	if err != nil {
+		return err
+	}
+
+	seriesIndex := NewSeriesIndex(db)
+	deviceStatus := NewDeviceStatusTracker(db)
+	tenantUsage := NewTenantUsage(db, config.TenantDefaultQuota, config.TenantQuotas)
+	defer seriesIndex.Flush()
+	defer deviceStatus.Flush()
+	defer tenantUsage.Flush()
+	importer := &Importer{
+		db:              db,
+		dbService:       &DatabaseService{db: db, compact: compact, payload: payloadCompressor},
+		registry:        NewDeviceRegistry(db),
+		unknownDevices:  config.UnknownDevicePolicy,
+		catalog:         NewMetricCatalog(catalogPolicy, NewMetrics()),
+		validatePayload: config.PayloadValidate,
+		batchSize:       config.ImportBatchSize,
+		record: func(rows []*SensorData) {
+			seriesIndex.Record(rows)
+			deviceStatus.Record(rows)
+			tenantUsage.RecordStorage(rows)
+		},
+	}
+
+	absolute, _ := filepath.Abs(path)
+	job, err := startImportJob(db, absolute, options, fingerprint, *resume)
+	if err != nil {
+		return err
+	}
+	if *resume > 0 {
+		fmt.Fprintf(os.Stderr, "Resuming import job %d after %d rows\n", job.ID, job.RowsRead)
+	} else {
+		fmt.Fprintf(os.Stderr, "Started import job %d\n", job.ID)
+	}
+
+	// Ctrl-C 时提交完当前批次后停止，之后可以用 -resume 继续
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start := time.Now()
+	startRows := job.RowsRead
+	lastReport := start
+	report := func(job *ImportJob) {
+		elapsed := time.Since(start).Seconds()
+		percent := ""
+		if job.Percent > 0 {
+			percent = fmt.Sprintf(" (%.1f%%)", job.Percent)
+		}
+		fmt.Fprintf(os.Stderr, "job %d: %d rows read%s, %d readings imported, %d rows skipped, %.0f rows/s\n",
+			job.ID, job.RowsRead, percent, job.ReadingsImported, job.RowsSkipped, float64(job.RowsRead-startRows)/math.Max(elapsed, 0.001))
+	}
+	err = importer.Run(ctx, job, source, mapping, func(job *ImportJob) {
+		if time.Since(lastReport) >= importProgressInterval {
+			report(job)
+			lastReport = time.Now()
+		}
+	})
+	report(job)
+	for _, sample := range job.Errors {
+		fmt.Fprintf(os.Stderr, "skipped %s\n", sample)
+	}
+	if err != nil {
+		if job.Status != importStatusCompleted {
+			fmt.Fprintf(os.Stderr, "Import %s; continue with: import -resume %d [same flags] %s\n", job.Status, job.ID, path)
+		}
+		return err
+	}
+	fmt.Printf("Import job %d completed: %d rows, %d readings imported, %d rows skipped\n",
+		job.ID, job.RowsRead, job.ReadingsImported, job.RowsSkipped)
+	return nil
+}
+
+// importHandler 上传文件导入（POST /api/import），选项通过查询参数传递，请求体为文件内容
+// 响应为 NDJSON，导入过程中约每秒输出一次任务进度，最后一行为最终状态；客户端断开时任务中断，可用 resume 续传
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	source := query.Get("source")
+	if source == "" {
+		source = "upload"
+	}
+	options := &ImportOptions{
+		Format:          query.Get("format"),
+		Columns:         query.Get("columns"),
+		Values:          query.Get("values"),
+		Device:          query.Get("device"),
+		Metric:          query.Get("metric"),
+		TimestampFormat: query.Get("timestamp_format"),
+		Timezone:        query.Get("timezone"),
+		Delimiter:       query.Get("delimiter"),
+	}
+	if options.Format == "" {
+		options.Format = importFormatOf(source)
+	}
+	var resumeID int64
+	for name, target := range map[string]*int64{"max_errors": &options.MaxErrors, "resume": &resumeID} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	if value := query.Get("priority"); value != "" {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid priority", http.StatusBadRequest)
+			return
+		}
+		options.Priority = priority
+	}
+	if err := options.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 上传大文件不受服务端读写超时限制；CSV 边读取边输出进度
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	body := http.MaxBytesReader(w, r.Body, s.config.ImportMaxUploadBytes)
+
+	var reader io.Reader = body
+	var readerAt io.ReaderAt
+	var fingerprint importFingerprint
+	size := r.ContentLength
+	if options.Format == importFormatParquet {
+		// Parquet 需要随机读取，先写入临时文件
+		spool, err := os.CreateTemp("", "bench-import-*.parquet")
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to create import spool file")
+			http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if size, err = io.Copy(spool, body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			return
+		}
+		readerAt = spool
+		if fingerprint, err = readImportFingerprint(spool, size); err != nil {
+			s.logger.WithError(err).Error("Failed to read import spool file")
+			http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		rc.EnableFullDuplex()
+		// CSV 边上传边导入，指纹取缓冲的开头部分
+		buffered := bufio.NewReaderSize(body, importFingerprintHead)
+		head, err := buffered.Peek(importFingerprintHead)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			return
+		}
+		fingerprint = newImportFingerprint(size, head)
+		reader = buffered
+	}
+
+	importSource, mapping, err := openImportSource(options, reader, readerAt, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := startImportJob(s.db, source, options, fingerprint, resumeID)
+	if err == errImportJobNotFound {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		if resumeID > 0 {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		s.logger.WithError(err).Error("Failed to start import job")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(job)
+	rc.Flush()
+
+	lastReport := time.Now()
+	err = s.newImporter(apiKeyFromContext(r.Context())).Run(r.Context(), job, importSource, mapping, func(job *ImportJob) {
+		if time.Since(lastReport) >= time.Second {
+			encoder.Encode(job)
+			rc.Flush()
+			lastReport = time.Now()
+		}
+	})
+	if err != nil {
+		s.logger.WithError(err).WithFields(logrus.Fields{"job_id": job.ID, "status": job.Status}).Warn("Import stopped")
+	} else {
+		s.logger.WithFields(logrus.Fields{"job_id": job.ID, "readings": job.ReadingsImported}).Info("Import completed")
+	}
+	encoder.Encode(job)
+	rc.Flush()
+}
+
+// getImportJobHandler 查询导入任务进度（GET /api/import/{id}）
+func (s *Server) getImportJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid import job id", http.StatusBadRequest)
+		return
+	}
+	job, _, _, err := getImportJob(s.db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get import job")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, r, job)
+}
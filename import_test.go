@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestImportFingerprint(t *testing.T) {
+	content := bytes.Repeat([]byte("2024-01-01T00:00:00Z,factory_001_device_0001,temperature,23.5\n"), 40000)
+	original, err := readImportFingerprint(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 分块上传时大小未知，只比较开头
+	if upload := newImportFingerprint(-1, content); !original.matches(upload) || !upload.matches(original) {
+		t.Error("same content with unknown size does not match")
+	}
+
+	modified := append([]byte("timestamp,device_id,metric_name,value\n"), content...)
+	if fp, _ := readImportFingerprint(bytes.NewReader(modified), int64(len(modified))); original.matches(fp) {
+		t.Error("file with a different head matches")
+	}
+
+	// 开头相同、追加了数据的文件大小不同
+	appended := append(append([]byte{}, content...), content[:100]...)
+	if fp, _ := readImportFingerprint(bytes.NewReader(appended), int64(len(appended))); original.matches(fp) {
+		t.Error("file with a different size matches")
+	}
+
+	// 小于 importFingerprintHead 的文件整体计算摘要
+	small := content[:1000]
+	fp, err := readImportFingerprint(bytes.NewReader(small), int64(len(small)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := newImportFingerprint(int64(len(small)), small); fp != want {
+		t.Errorf("fingerprint = %+v, want %+v", fp, want)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// errIngestRejected 非 HTTP 写入被策略拒绝（未知设备、限流），与数据库等内部错误区分
+var errIngestRejected = errors.New("ingest rejected")
+
+// isIngestRejection 判断 checkIngestRows 的错误是否为策略拒绝（包括租户配额），否则为内部错误
+func isIngestRejection(err error) bool {
+	var quotaErr *TenantQuotaError
+	return errors.Is(err, errIngestRejected) || errors.As(err, &quotaErr)
+}
+
+// checkIngest 写入前的统一检查，依次为：设备授权、未知设备策略、按设备/工厂限流、租户配额、准入控制，
+// 全部通过后才登记新设备（unknown_devices: register）并扣除限流令牌
+// deviceIDs 为每条数据的设备ID（可重复，用于计算消耗的令牌和配额），未通过时已写入错误响应
+func (s *Server) checkIngest(w http.ResponseWriter, r *http.Request, deviceIDs []string, priority int) bool {
+	deviceCounts := make(map[string]int)
+	unique := make([]string, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		if deviceID == "" {
+			continue // 缺少设备ID的数据由处理函数校验
+		}
+		if deviceCounts[deviceID] == 0 {
+			unique = append(unique, deviceID)
+		}
+		deviceCounts[deviceID]++
+	}
+
+	if !s.authorizeDevice(w, r, unique...) {
+		return false
+	}
+	unknown, ok := s.checkKnownDevices(w, unique)
+	if !(ok &&
+		s.rateLimit(w, deviceCounts) &&
+		s.checkTenantQuota(w, deviceCounts) &&
+		s.admit(w, priority) &&
+		s.registerDevices(w, unknown)) {
+		return false
+	}
+	// 令牌只在请求通过全部检查后扣除，被配额或准入控制拒绝的请求不消耗令牌
+	s.consumeRateLimit(w, deviceCounts)
+	return true
+}
+
+// checkIngestRows 非 HTTP 写入（MQTT 等）的统一检查：未知设备策略、按设备/工厂限流、租户配额
+// deviceCounts 为每个设备的数据条数，不通过时返回原因；策略拒绝可用 isIngestRejection 与内部错误区分
+func (s *Server) checkIngestRows(deviceCounts map[string]int) error {
+	var unknown []string
+	if s.config.UnknownDevicePolicy != unknownDeviceAllow {
+		deviceIDs := make([]string, 0, len(deviceCounts))
+		for deviceID := range deviceCounts {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+		var err error
+		if unknown, err = s.registry.Unknown(deviceIDs); err != nil {
+			return err
+		}
+		if len(unknown) > 0 && s.config.UnknownDevicePolicy == unknownDeviceReject {
+			return fmt.Errorf("%w: unknown device %s (not registered)", errIngestRejected, unknown[0])
+		}
+	}
+
+	if s.rateLimiter != nil {
+		if result := s.rateLimiter.Allow(deviceCounts); !result.Allowed {
+			return fmt.Errorf("%w: rate limit exceeded for %s %s", errIngestRejected, result.Scope, result.Key)
+		}
+	}
+
+	if s.tenantUsage != nil {
+		rows := make(map[string]int64)
+		for deviceID, n := range deviceCounts {
+			rows[tenantOf(deviceID)] += int64(n)
+		}
+		if err := s.tenantUsage.Check(rows); err != nil {
+			return err
+		}
+	}
+
+	// 新设备在全部检查通过后才登记，被限流或配额拒绝的消息不会留下登记记录
+	if len(unknown) > 0 {
+		if err := s.registry.Register(unknown); err != nil {
+			return err
+		}
+	}
+	s.consumeRateLimit(nil, deviceCounts)
+	return nil
+}
+
+// afterIngest 在写入事务提交成功后调用，rows 为实际写入的数据
+func (s *Server) afterIngest(rows []*SensorData) {
+	if len(rows) == 0 {
+		return
+	}
+	if s.tenantUsage != nil {
+		s.tenantUsage.Record(rows)
+	}
+	if s.seriesIndex != nil {
+		s.seriesIndex.Record(rows)
+	}
+	if s.deviceStatus != nil {
+		s.deviceStatus.Record(rows)
+	}
+	if s.watchdog != nil {
+		s.watchdog.Record(rows)
+	}
+	if s.bus != nil {
+		s.bus.PublishReadings(rows)
+	}
+}
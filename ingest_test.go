@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// mqttTestRegistered 返回测试驱动记录的自动登记设备
+func mqttTestRegistered() []string {
+	mqttTestState.mutex.Lock()
+	defer mqttTestState.mutex.Unlock()
+	return append([]string(nil), mqttTestState.registered...)
+}
+
+func TestIngestRegistersDevicesAfterAllChecks(t *testing.T) {
+	s := newMQTTTestIngester(t).server
+	s.config.UnknownDevicePolicy = unknownDeviceRegister
+	s.rateLimiter = NewRateLimiter(rateLimitPolicy{
+		enabled: true,
+		device:  RateLimit{Rate: 1, Burst: 2},
+	}, s.metrics)
+	s.rateLimiter.Consume(map[string]int{"factory_001_device_0001": 2, "factory_001_device_0002": 2})
+
+	// 被限流拒绝的请求不登记设备
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/sensor-data", nil)
+	if s.checkIngest(w, r, []string{"factory_001_device_0001"}, 3) {
+		t.Fatal("request over the rate limit accepted")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	if err := s.checkIngestRows(map[string]int{"factory_001_device_0002": 1}); !isIngestRejection(err) {
+		t.Fatalf("checkIngestRows = %v, want rate limit rejection", err)
+	}
+	if registered := mqttTestRegistered(); len(registered) != 0 {
+		t.Fatalf("rejected requests registered %v", registered)
+	}
+
+	// 通过全部检查后登记
+	s.rateLimiter.SetPolicy(rateLimitPolicy{})
+	w = httptest.NewRecorder()
+	if !s.checkIngest(w, r, []string{"factory_001_device_0001"}, 3) {
+		t.Fatalf("request rejected: %d %s", w.Code, w.Body.String())
+	}
+	if err := s.checkIngestRows(map[string]int{"factory_001_device_0002": 1}); err != nil {
+		t.Fatalf("checkIngestRows = %v", err)
+	}
+	if registered, want := mqttTestRegistered(), []string{"factory_001_device_0001", "factory_001_device_0002"}; !reflect.DeepEqual(registered, want) {
+		t.Fatalf("registered = %v, want %v", registered, want)
+	}
+}
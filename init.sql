@@ -17,7 +17,8 @@ CREATE TABLE IF NOT EXISTS time_series_data (
     data TEXT COMMENT '随机负载数据，用于增大传输量',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     INDEX idx_timestamp (timestamp),
-    INDEX idx_device_metric (device_id, metric_name),
+    INDEX idx_device_metric_time (device_id, metric_name, timestamp, id),
+    INDEX idx_device_time (device_id, timestamp, id),
     INDEX idx_priority (priority)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
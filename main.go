@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,10 +21,28 @@ import (
 )
 
 type Server struct {
-	db     *sql.DB
-	router *mux.Router
-	logger *logrus.Logger
-	config *Config
+	db           *sql.DB
+	router       *mux.Router
+	logger       *logrus.Logger
+	config       *Config
+	payloadDicts *PayloadDictionaryStore
+	payloads     *PayloadCompressor // storage.payload_compression 未启用时为空
+	compact      *CompactStore      // 紧凑存储布局，行布局时为空
+	metrics      *Metrics
+	admission    *AdmissionController // 准入控制，未启用时为空
+	rateLimiter  *RateLimiter
+	apiKeys      *APIKeyStore     // API Key 认证，未启用时为空
+	verifier     *RequestVerifier // 请求签名校验，未启用时为空
+	certReloader *CertReloader    // TLS 证书热加载，未启用 TLS 时为空
+	tlsConfig    *tls.Config
+	tenantUsage  *TenantUsage
+	registry     *DeviceRegistry
+	catalog      *MetricCatalog
+	seriesIndex  *SeriesIndex
+	deviceStatus *DeviceStatusTracker
+	watchdog     *Watchdog
+	bus          *EventBus     // 实时推送的发布/订阅总线
+	mqtt         *MQTTIngester // MQTT 接入，未启用时为空
 }
 
 // ConfigFile 配置文件结构
@@ -48,6 +68,116 @@ type ConfigFile struct {
 		WriteTimeout string `yaml:"write_timeout"`
 		IdleTimeout  string `yaml:"idle_timeout"`
 	} `yaml:"app"`
+	RemoteWrite struct {
+		MaxBodyBytes    int               `yaml:"max_body_bytes"`
+		DefaultPriority int               `yaml:"default_priority"`
+		LabelRules      []RemoteWriteRule `yaml:"label_rules"`
+	} `yaml:"remote_write"`
+	Compression struct {
+		MaxDecompressedBytes int64 `yaml:"max_decompressed_bytes"`
+		ResponseMinBytes     int   `yaml:"response_min_bytes"`
+	} `yaml:"compression"`
+	Payload struct {
+		Validate bool `yaml:"validate"`
+	} `yaml:"payload"`
+	Query struct {
+		MaxSeries int `yaml:"max_series"`
+		MaxPoints int `yaml:"max_points"`
+	} `yaml:"query"`
+	Storage struct {
+		Layout             string         `yaml:"layout"`
+		DefaultPrecision   *int           `yaml:"default_precision"`
+		MetricPrecision    map[string]int `yaml:"metric_precision"`
+		PayloadCompression string         `yaml:"payload_compression"`
+	} `yaml:"storage"`
+	Admission struct {
+		Enabled         *bool   `yaml:"enabled"`
+		MaxInflight     int     `yaml:"max_inflight"`
+		DBLatencyTarget string  `yaml:"db_latency_target"`
+		ShedLowAt       float64 `yaml:"shed_low_at"`
+		ShedMediumAt    float64 `yaml:"shed_medium_at"`
+	} `yaml:"admission"`
+	RateLimit struct {
+		Enabled          bool                 `yaml:"enabled"`
+		Device           RateLimit            `yaml:"device"`
+		Factory          RateLimit            `yaml:"factory"`
+		DeviceOverrides  map[string]RateLimit `yaml:"device_overrides"`
+		FactoryOverrides map[string]RateLimit `yaml:"factory_overrides"`
+	} `yaml:"rate_limit"`
+	Auth struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"auth"`
+	RequestSigning struct {
+		Enabled  bool   `yaml:"enabled"`
+		Required bool   `yaml:"required"`
+		MaxSkew  string `yaml:"max_skew"`
+	} `yaml:"request_signing"`
+	TLS struct {
+		Enabled        bool              `yaml:"enabled"`
+		CertFile       string            `yaml:"cert_file"`
+		KeyFile        string            `yaml:"key_file"`
+		MinVersion     string            `yaml:"min_version"`
+		CipherSuites   []string          `yaml:"cipher_suites"`
+		ClientAuth     string            `yaml:"client_auth"`
+		ClientCAFile   string            `yaml:"client_ca_file"`
+		ClientPrefixes map[string]string `yaml:"client_prefixes"`
+	} `yaml:"tls"`
+	Tenants struct {
+		DefaultQuota TenantQuota            `yaml:"default_quota"`
+		Quotas       map[string]TenantQuota `yaml:"quotas"`
+	} `yaml:"tenants"`
+	DeviceRegistry struct {
+		UnknownDevices string `yaml:"unknown_devices"`
+	} `yaml:"device_registry"`
+	MetricCatalog struct {
+		Enabled        bool                        `yaml:"enabled"`
+		UnknownMetrics string                      `yaml:"unknown_metrics"`
+		OnInvalid      string                      `yaml:"on_invalid"`
+		Metrics        map[string]MetricDefinition `yaml:"metrics"`
+	} `yaml:"metric_catalog"`
+	Watchdog struct {
+		Enabled       bool               `yaml:"enabled"`
+		CheckInterval string             `yaml:"check_interval"`
+		Tolerance     float64            `yaml:"tolerance"`
+		MinSamples    int                `yaml:"min_samples"`
+		MinInterval   string             `yaml:"min_interval"`
+		Intervals     []WatchdogInterval `yaml:"intervals"`
+	} `yaml:"watchdog"`
+	Stream struct {
+		RingSize         int `yaml:"ring_size"`
+		SubscriberBuffer int `yaml:"subscriber_buffer"`
+		MaxSubscribers   int `yaml:"max_subscribers"`
+		WebSocket        struct {
+			FlushInterval  string   `yaml:"flush_interval"`
+			AllowedOrigins []string `yaml:"allowed_origins"`
+		} `yaml:"websocket"`
+	} `yaml:"stream"`
+	MQTT struct {
+		Enabled         bool   `yaml:"enabled"`
+		Mode            string `yaml:"mode"`
+		Broker          string `yaml:"broker"`
+		ClientID        string `yaml:"client_id"`
+		Username        string `yaml:"username"`
+		Password        string `yaml:"password"`
+		Listen          string `yaml:"listen"`
+		TopicPattern    string `yaml:"topic_pattern"`
+		DeviceID        string `yaml:"device_id"`
+		MetricName      string `yaml:"metric_name"`
+		QoS             *int   `yaml:"qos"`
+		PayloadFormat   string `yaml:"payload_format"`
+		DefaultPriority int    `yaml:"default_priority"`
+		BatchSize       int    `yaml:"batch_size"`
+		BatchWait       string `yaml:"batch_wait"`
+		MaxPacketSize   int    `yaml:"max_packet_size"`
+		MaxConnections  int    `yaml:"max_connections"`
+	} `yaml:"mqtt"`
+	Import struct {
+		BatchSize      int   `yaml:"batch_size"`
+		MaxUploadBytes int64 `yaml:"max_upload_bytes"`
+	} `yaml:"import"`
+	Export struct {
+		ChunkRows int `yaml:"chunk_rows"`
+	} `yaml:"export"`
 }
 
 type Config struct {
@@ -64,10 +194,107 @@ type Config struct {
 	ReadTimeout  string `yaml:"read_timeout"`
 	WriteTimeout string `yaml:"write_timeout"`
 	IdleTimeout  string `yaml:"idle_timeout"`
+
+	RemoteWriteMaxBodyBytes    int               `yaml:"remote_write_max_body_bytes"`
+	RemoteWriteDefaultPriority int               `yaml:"remote_write_default_priority"`
+	RemoteWriteRules           []RemoteWriteRule `yaml:"remote_write_rules"`
+
+	MaxDecompressedBytes        int64 `yaml:"max_decompressed_bytes"`
+	CompressionMinResponseBytes int   `yaml:"compression_min_response_bytes"`
+
+	PayloadValidate bool `yaml:"payload_validate"`
+
+	QueryMaxSeries int `yaml:"query_max_series"`
+	QueryMaxPoints int `yaml:"query_max_points"`
+
+	StorageLayout         string         `yaml:"storage_layout"`
+	DefaultValuePrecision int            `yaml:"default_value_precision"`
+	MetricPrecision       map[string]int `yaml:"metric_precision"`
+	PayloadCompression    string         `yaml:"payload_compression"`
+
+	AdmissionEnabled         bool    `yaml:"admission_enabled"`
+	AdmissionMaxInflight     int     `yaml:"admission_max_inflight"`
+	AdmissionDBLatencyTarget string  `yaml:"admission_db_latency_target"`
+	AdmissionShedLowAt       float64 `yaml:"admission_shed_low_at"`
+	AdmissionShedMediumAt    float64 `yaml:"admission_shed_medium_at"`
+
+	RateLimitEnabled          bool                 `yaml:"rate_limit_enabled"`
+	RateLimitDevice           RateLimit            `yaml:"rate_limit_device"`
+	RateLimitFactory          RateLimit            `yaml:"rate_limit_factory"`
+	RateLimitDeviceOverrides  map[string]RateLimit `yaml:"rate_limit_device_overrides"`
+	RateLimitFactoryOverrides map[string]RateLimit `yaml:"rate_limit_factory_overrides"`
+
+	AuthEnabled bool `yaml:"auth_enabled"`
+
+	SigningEnabled  bool   `yaml:"signing_enabled"`
+	SigningRequired bool   `yaml:"signing_required"`
+	SigningMaxSkew  string `yaml:"signing_max_skew"`
+
+	TLSEnabled        bool              `yaml:"tls_enabled"`
+	TLSCertFile       string            `yaml:"tls_cert_file"`
+	TLSKeyFile        string            `yaml:"tls_key_file"`
+	TLSMinVersion     string            `yaml:"tls_min_version"`
+	TLSCipherSuites   []string          `yaml:"tls_cipher_suites"`
+	TLSClientAuth     string            `yaml:"tls_client_auth"`
+	TLSClientCAFile   string            `yaml:"tls_client_ca_file"`
+	TLSClientPrefixes map[string]string `yaml:"tls_client_prefixes"`
+
+	TenantDefaultQuota TenantQuota            `yaml:"tenant_default_quota"`
+	TenantQuotas       map[string]TenantQuota `yaml:"tenant_quotas"`
+
+	UnknownDevicePolicy string `yaml:"unknown_device_policy"`
+
+	MetricCatalogEnabled   bool                        `yaml:"metric_catalog_enabled"`
+	MetricCatalogUnknown   string                      `yaml:"metric_catalog_unknown"`
+	MetricCatalogOnInvalid string                      `yaml:"metric_catalog_on_invalid"`
+	MetricCatalog          map[string]MetricDefinition `yaml:"metric_catalog"`
+
+	WatchdogEnabled       bool               `yaml:"watchdog_enabled"`
+	WatchdogCheckInterval string             `yaml:"watchdog_check_interval"`
+	WatchdogTolerance     float64            `yaml:"watchdog_tolerance"`
+	WatchdogMinSamples    int                `yaml:"watchdog_min_samples"`
+	WatchdogMinInterval   string             `yaml:"watchdog_min_interval"`
+	WatchdogIntervals     []WatchdogInterval `yaml:"watchdog_intervals"`
+
+	StreamRingSize         int `yaml:"stream_ring_size"`
+	StreamSubscriberBuffer int `yaml:"stream_subscriber_buffer"`
+	StreamMaxSubscribers   int `yaml:"stream_max_subscribers"`
+
+	StreamWebSocketFlushInterval string   `yaml:"stream_websocket_flush_interval"`
+	StreamWebSocketOrigins       []string `yaml:"stream_websocket_origins"`
+
+	MQTTEnabled         bool   `yaml:"mqtt_enabled"`
+	MQTTMode            string `yaml:"mqtt_mode"`
+	MQTTBroker          string `yaml:"mqtt_broker"`
+	MQTTClientID        string `yaml:"mqtt_client_id"`
+	MQTTUsername        string `yaml:"mqtt_username"`
+	MQTTPassword        string `yaml:"mqtt_password"`
+	MQTTListen          string `yaml:"mqtt_listen"`
+	MQTTTopicPattern    string `yaml:"mqtt_topic_pattern"`
+	MQTTDeviceID        string `yaml:"mqtt_device_id"`
+	MQTTMetricName      string `yaml:"mqtt_metric_name"`
+	MQTTQoS             int    `yaml:"mqtt_qos"`
+	MQTTPayloadFormat   string `yaml:"mqtt_payload_format"`
+	MQTTDefaultPriority int    `yaml:"mqtt_default_priority"`
+	MQTTBatchSize       int    `yaml:"mqtt_batch_size"`
+	MQTTBatchWait       string `yaml:"mqtt_batch_wait"`
+	MQTTMaxPacketSize   int    `yaml:"mqtt_max_packet_size"`
+	MQTTMaxConnections  int    `yaml:"mqtt_max_connections"`
+
+	// 历史数据导入
+	ImportBatchSize      int   `yaml:"import_batch_size"`
+	ImportMaxUploadBytes int64 `yaml:"import_max_upload_bytes"`
+
+	// 数据导出
+	ExportChunkRows int `yaml:"export_chunk_rows"`
 }
 
 func NewConfig() *Config {
-	config := &Config{}
+	config := &Config{
+		DefaultValuePrecision: -1, // 0 为合法精度，用 -1 表示未配置
+		AdmissionEnabled:      true,
+		MQTTQoS:               1, // 0 为合法取值，未配置时默认 1
+	}
 
 	// 首先尝试读取配置文件
 	configPath := getEnv("CONFIG_PATH", "config.yaml")
@@ -135,6 +362,140 @@ func NewConfig() *Config {
 	if config.IdleTimeout == "" {
 		config.IdleTimeout = "60s"
 	}
+	if config.RemoteWriteMaxBodyBytes == 0 {
+		config.RemoteWriteMaxBodyBytes = 32 << 20
+	}
+	if config.RemoteWriteDefaultPriority < 1 || config.RemoteWriteDefaultPriority > 3 {
+		config.RemoteWriteDefaultPriority = 3
+	}
+	if len(config.RemoteWriteRules) == 0 {
+		config.RemoteWriteRules = defaultRemoteWriteRules()
+	}
+	if config.MaxDecompressedBytes <= 0 {
+		config.MaxDecompressedBytes = 16 << 20
+	}
+	if config.CompressionMinResponseBytes == 0 {
+		config.CompressionMinResponseBytes = 4096
+	}
+	if layout := os.Getenv("STORAGE_LAYOUT"); layout != "" {
+		config.StorageLayout = layout
+	} else if config.StorageLayout == "" {
+		config.StorageLayout = storageLayoutRow
+	}
+	if config.DefaultValuePrecision < 0 || config.DefaultValuePrecision > 9 {
+		config.DefaultValuePrecision = 2
+	}
+	if config.PayloadCompression == "" {
+		config.PayloadCompression = "none"
+	}
+	if config.AdmissionMaxInflight <= 0 {
+		config.AdmissionMaxInflight = 512
+	}
+	if config.AdmissionDBLatencyTarget == "" {
+		config.AdmissionDBLatencyTarget = "200ms"
+	}
+	if config.AdmissionShedLowAt <= 0 {
+		config.AdmissionShedLowAt = 0.7
+	}
+	if config.AdmissionShedMediumAt <= 0 {
+		config.AdmissionShedMediumAt = 1.0
+	}
+	if config.SigningMaxSkew == "" {
+		config.SigningMaxSkew = "5m"
+	}
+	if config.TLSMinVersion == "" {
+		config.TLSMinVersion = "1.2"
+	}
+	if config.TLSClientAuth == "" {
+		config.TLSClientAuth = clientAuthNone
+	}
+	if config.QueryMaxSeries <= 0 {
+		config.QueryMaxSeries = 100
+	}
+	if config.QueryMaxPoints <= 0 {
+		config.QueryMaxPoints = 100000
+	}
+	if config.UnknownDevicePolicy == "" {
+		config.UnknownDevicePolicy = unknownDeviceAllow
+	}
+	if config.MetricCatalogUnknown == "" {
+		config.MetricCatalogUnknown = unknownMetricAllow
+	}
+	if config.MetricCatalogOnInvalid == "" {
+		config.MetricCatalogOnInvalid = invalidValueReject
+	}
+	if config.WatchdogCheckInterval == "" {
+		config.WatchdogCheckInterval = "30s"
+	}
+	if config.WatchdogTolerance == 0 {
+		config.WatchdogTolerance = 3
+	}
+	if config.WatchdogMinSamples <= 0 {
+		config.WatchdogMinSamples = 5
+	}
+	if config.WatchdogMinInterval == "" {
+		config.WatchdogMinInterval = "10s"
+	}
+	if config.StreamRingSize <= 0 {
+		config.StreamRingSize = 4096
+	}
+	if config.StreamSubscriberBuffer <= 0 {
+		config.StreamSubscriberBuffer = 256
+	}
+	if config.StreamMaxSubscribers <= 0 {
+		config.StreamMaxSubscribers = 200
+	}
+	if config.StreamWebSocketFlushInterval == "" {
+		config.StreamWebSocketFlushInterval = "250ms"
+	}
+	if config.MQTTMode == "" {
+		config.MQTTMode = mqttModeClient
+	}
+	if config.MQTTBroker == "" {
+		config.MQTTBroker = "tcp://localhost:1883"
+	}
+	if config.MQTTClientID == "" {
+		config.MQTTClientID = "bench-server"
+	}
+	if config.MQTTListen == "" {
+		config.MQTTListen = ":1883"
+	}
+	if config.MQTTTopicPattern == "" {
+		config.MQTTTopicPattern = "factory/${factory}/device/${device}/${metric}"
+	}
+	if config.MQTTDeviceID == "" {
+		config.MQTTDeviceID = "factory_${factory}_device_${device}"
+	}
+	if config.MQTTMetricName == "" {
+		config.MQTTMetricName = "${metric}"
+	}
+	if config.MQTTPayloadFormat == "" {
+		config.MQTTPayloadFormat = mqttPayloadAuto
+	}
+	if config.MQTTDefaultPriority < 1 || config.MQTTDefaultPriority > 3 {
+		config.MQTTDefaultPriority = 2
+	}
+	if config.MQTTBatchSize <= 0 {
+		config.MQTTBatchSize = 500
+	}
+	if config.MQTTBatchWait == "" {
+		config.MQTTBatchWait = "50ms"
+	}
+	if config.MQTTMaxPacketSize <= 0 {
+		config.MQTTMaxPacketSize = 256 * 1024
+	}
+	if config.MQTTMaxConnections <= 0 {
+		config.MQTTMaxConnections = 10000
+	}
+	if config.ImportBatchSize <= 0 {
+		config.ImportBatchSize = 5000
+	}
+	if config.ImportMaxUploadBytes <= 0 {
+		config.ImportMaxUploadBytes = 4 << 30
+	}
+	if config.ExportChunkRows <= 0 {
+		config.ExportChunkRows = 10000
+	}
 
 	return config
 }
@@ -171,6 +532,84 @@ func loadConfigFromFile(config *Config, configPath string) error {
 	config.ReadTimeout = configFile.App.ReadTimeout
 	config.WriteTimeout = configFile.App.WriteTimeout
 	config.IdleTimeout = configFile.App.IdleTimeout
+	config.RemoteWriteMaxBodyBytes = configFile.RemoteWrite.MaxBodyBytes
+	config.RemoteWriteDefaultPriority = configFile.RemoteWrite.DefaultPriority
+	config.RemoteWriteRules = configFile.RemoteWrite.LabelRules
+	config.MaxDecompressedBytes = configFile.Compression.MaxDecompressedBytes
+	config.CompressionMinResponseBytes = configFile.Compression.ResponseMinBytes
+	config.PayloadValidate = configFile.Payload.Validate
+	config.QueryMaxSeries = configFile.Query.MaxSeries
+	config.QueryMaxPoints = configFile.Query.MaxPoints
+	config.StorageLayout = configFile.Storage.Layout
+	if configFile.Storage.DefaultPrecision != nil {
+		config.DefaultValuePrecision = *configFile.Storage.DefaultPrecision
+	}
+	config.MetricPrecision = configFile.Storage.MetricPrecision
+	config.PayloadCompression = configFile.Storage.PayloadCompression
+	if configFile.Admission.Enabled != nil {
+		config.AdmissionEnabled = *configFile.Admission.Enabled
+	}
+	config.AdmissionMaxInflight = configFile.Admission.MaxInflight
+	config.AdmissionDBLatencyTarget = configFile.Admission.DBLatencyTarget
+	config.AdmissionShedLowAt = configFile.Admission.ShedLowAt
+	config.AdmissionShedMediumAt = configFile.Admission.ShedMediumAt
+	config.RateLimitEnabled = configFile.RateLimit.Enabled
+	config.RateLimitDevice = configFile.RateLimit.Device
+	config.RateLimitFactory = configFile.RateLimit.Factory
+	config.RateLimitDeviceOverrides = configFile.RateLimit.DeviceOverrides
+	config.RateLimitFactoryOverrides = configFile.RateLimit.FactoryOverrides
+	config.AuthEnabled = configFile.Auth.Enabled
+	config.SigningEnabled = configFile.RequestSigning.Enabled
+	config.SigningRequired = configFile.RequestSigning.Required
+	config.SigningMaxSkew = configFile.RequestSigning.MaxSkew
+	config.TLSEnabled = configFile.TLS.Enabled
+	config.TLSCertFile = configFile.TLS.CertFile
+	config.TLSKeyFile = configFile.TLS.KeyFile
+	config.TLSMinVersion = configFile.TLS.MinVersion
+	config.TLSCipherSuites = configFile.TLS.CipherSuites
+	config.TLSClientAuth = configFile.TLS.ClientAuth
+	config.TLSClientCAFile = configFile.TLS.ClientCAFile
+	config.TLSClientPrefixes = configFile.TLS.ClientPrefixes
+	config.TenantDefaultQuota = configFile.Tenants.DefaultQuota
+	config.TenantQuotas = configFile.Tenants.Quotas
+	config.UnknownDevicePolicy = configFile.DeviceRegistry.UnknownDevices
+	config.MetricCatalogEnabled = configFile.MetricCatalog.Enabled
+	config.MetricCatalogUnknown = configFile.MetricCatalog.UnknownMetrics
+	config.MetricCatalogOnInvalid = configFile.MetricCatalog.OnInvalid
+	config.MetricCatalog = configFile.MetricCatalog.Metrics
+	config.WatchdogEnabled = configFile.Watchdog.Enabled
+	config.WatchdogCheckInterval = configFile.Watchdog.CheckInterval
+	config.WatchdogTolerance = configFile.Watchdog.Tolerance
+	config.WatchdogMinSamples = configFile.Watchdog.MinSamples
+	config.WatchdogMinInterval = configFile.Watchdog.MinInterval
+	config.WatchdogIntervals = configFile.Watchdog.Intervals
+	config.StreamRingSize = configFile.Stream.RingSize
+	config.StreamSubscriberBuffer = configFile.Stream.SubscriberBuffer
+	config.StreamMaxSubscribers = configFile.Stream.MaxSubscribers
+	config.StreamWebSocketFlushInterval = configFile.Stream.WebSocket.FlushInterval
+	config.StreamWebSocketOrigins = configFile.Stream.WebSocket.AllowedOrigins
+	config.MQTTEnabled = configFile.MQTT.Enabled
+	config.MQTTMode = configFile.MQTT.Mode
+	config.MQTTBroker = configFile.MQTT.Broker
+	config.MQTTClientID = configFile.MQTT.ClientID
+	config.MQTTUsername = configFile.MQTT.Username
+	config.MQTTPassword = configFile.MQTT.Password
+	config.MQTTListen = configFile.MQTT.Listen
+	config.MQTTTopicPattern = configFile.MQTT.TopicPattern
+	config.MQTTDeviceID = configFile.MQTT.DeviceID
+	config.MQTTMetricName = configFile.MQTT.MetricName
+	if configFile.MQTT.QoS != nil {
+		config.MQTTQoS = *configFile.MQTT.QoS
+	}
+	config.MQTTPayloadFormat = configFile.MQTT.PayloadFormat
+	config.MQTTDefaultPriority = configFile.MQTT.DefaultPriority
+	config.MQTTBatchSize = configFile.MQTT.BatchSize
+	config.MQTTBatchWait = configFile.MQTT.BatchWait
+	config.MQTTMaxPacketSize = configFile.MQTT.MaxPacketSize
+	config.MQTTMaxConnections = configFile.MQTT.MaxConnections
+	config.ImportBatchSize = configFile.Import.BatchSize
+	config.ImportMaxUploadBytes = configFile.Import.MaxUploadBytes
+	config.ExportChunkRows = configFile.Export.ChunkRows
 
 	return nil
 }
@@ -182,8 +621,8 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func NewServer(config *Config) (*Server, error) {
-	// 初始化数据库连接
+// openDatabase 按配置打开数据库连接池并检查连通性
+func openDatabase(config *Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=Local",
 		config.DBUser, config.DBPassword, config.DBHost, config.DBPort, config.DBName)
 
@@ -199,14 +638,92 @@ func NewServer(config *Config) (*Server, error) {
 
 	// 测试数据库连接
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
+	return db, nil
+}
+
+func NewServer(config *Config) (*Server, error) {
+	// 编译 remote_write 标签映射规则
+	if err := compileRemoteWriteRules(config.RemoteWriteRules); err != nil {
+		return nil, fmt.Errorf("invalid remote_write label rules: %w", err)
+	}
+
+	if config.StorageLayout != storageLayoutRow && config.StorageLayout != storageLayoutCompact {
+		return nil, fmt.Errorf("invalid storage layout %q (expected %s or %s)", config.StorageLayout, storageLayoutRow, storageLayoutCompact)
+	}
+
+	switch config.UnknownDevicePolicy {
+	case unknownDeviceAllow, unknownDeviceReject, unknownDeviceRegister:
+	default:
+		return nil, fmt.Errorf("invalid device_registry unknown_devices %q (expected allow, reject or register)", config.UnknownDevicePolicy)
+	}
+
+	rateLimitPolicy, err := newRateLimitPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	catalogPolicy, err := newMetricCatalogPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	watchdogPolicy, err := newWatchdogPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	if d, err := time.ParseDuration(config.WatchdogCheckInterval); err != nil {
+		return nil, fmt.Errorf("invalid watchdog check_interval %q: %w", config.WatchdogCheckInterval, err)
+	} else if d <= 0 {
+		return nil, fmt.Errorf("invalid watchdog check_interval %q: must be positive", config.WatchdogCheckInterval)
+	}
+	if _, err := time.ParseDuration(config.StreamWebSocketFlushInterval); err != nil {
+		return nil, fmt.Errorf("invalid stream websocket flush_interval %q: %w", config.StreamWebSocketFlushInterval, err)
+	}
+
+	db, err := openDatabase(config)
+	if err != nil {
+		return nil, err
+	}
+
 	// 初始化表结构
 	if err := initDatabase(db); err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
 
+	if err := initAuthStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize api_keys table: %w", err)
+	}
+	if err := initSigningStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize device_secrets table: %w", err)
+	}
+	if err := initTenantStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize tenant_usage table: %w", err)
+	}
+	if err := initRegistryStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize device registry: %w", err)
+	}
+	if err := initSeriesStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize series_index table: %w", err)
+	}
+	if err := initImportStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize import_jobs table: %w", err)
+	}
+	if err := initWatchdogStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize watchdog_state table: %w", err)
+	}
+
+	compact, err := openCompactStore(db, config, catalogPolicy)
+	if err != nil {
+		return nil, err
+	}
+	payloadDicts := NewPayloadDictionaryStore(db)
+	payloadCompressor, err := openPayloadCompressor(config, payloadDicts)
+	if err != nil {
+		return nil, err
+	}
+
 	// 初始化日志
 	logger := logrus.New()
 
@@ -225,30 +742,164 @@ func NewServer(config *Config) (*Server, error) {
 	logger.SetLevel(level)
 
 	server := &Server{
-		db:     db,
-		router: mux.NewRouter(),
-		logger: logger,
-		config: config,
+		db:           db,
+		router:       mux.NewRouter(),
+		logger:       logger,
+		config:       config,
+		payloadDicts: payloadDicts,
+		payloads:     payloadCompressor,
+		compact:      compact,
+		metrics:      NewMetrics(),
+		tenantUsage:  NewTenantUsage(db, config.TenantDefaultQuota, config.TenantQuotas),
+		registry:     NewDeviceRegistry(db),
+		seriesIndex:  NewSeriesIndex(db),
+		deviceStatus: NewDeviceStatusTracker(db),
+	}
+	if config.AuthEnabled {
+		server.apiKeys = NewAPIKeyStore(db)
+	}
+	if config.SigningEnabled {
+		server.verifier = NewRequestVerifier(db, parseDuration(config.SigningMaxSkew))
+	}
+
+	if config.TLSEnabled {
+		reloader, err := NewCertReloader(config.TLSCertFile, config.TLSKeyFile, config.TLSClientCAFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := buildTLSConfig(config, reloader)
+		if err != nil {
+			return nil, err
+		}
+		server.certReloader = reloader
+		server.tlsConfig = tlsConfig
+	}
+
+	// 限流器始终创建，未启用时直接放行，便于运行时通过重新加载配置开启
+	server.rateLimiter = NewRateLimiter(rateLimitPolicy, server.metrics)
+	server.catalog = NewMetricCatalog(catalogPolicy, server.metrics)
+	server.bus = NewEventBus(config.StreamRingSize, config.StreamSubscriberBuffer, config.StreamMaxSubscribers, server.metrics)
+	server.watchdog = NewWatchdog(db, watchdogPolicy, server.metrics, server.raiseAlerts)
+
+	if config.AdmissionEnabled {
+		server.admission = NewAdmissionController(
+			config.AdmissionMaxInflight,
+			parseDuration(config.AdmissionDBLatencyTarget),
+			config.AdmissionShedLowAt,
+			config.AdmissionShedMediumAt,
+			server.metrics,
+		)
+	}
+
+	if config.MQTTEnabled {
+		if server.mqtt, err = NewMQTTIngester(server); err != nil {
+			return nil, err
+		}
+		if server.admission != nil {
+			server.admission.AddQueue(server.mqtt.QueueDepth, server.mqtt.QueueCapacity())
+		}
 	}
 
 	server.setupRoutes()
 	return server, nil
 }
 
+// databaseService 返回按当前存储布局配置的数据库服务
+func (s *Server) databaseService() *DatabaseService {
+	return &DatabaseService{db: s.db, compact: s.compact, payload: s.payloads}
+}
+
 func (s *Server) setupRoutes() {
 	// 健康检查
 	s.router.HandleFunc("/health", s.healthHandler).Methods("GET")
 
+	// 进程指标（Prometheus 文本格式）
+	s.router.Handle("/metrics", s.requireScope(scopeAdmin, http.HandlerFunc(s.metrics.Handler))).Methods("GET")
+
 	// 传感器数据路由
-	s.router.HandleFunc("/api/sensor-data", s.sensorDataHandler).Methods("POST")
-	s.router.HandleFunc("/api/sensor-rw", s.sensorReadWriteHandler).Methods("POST")
-	s.router.HandleFunc("/api/batch-sensor-rw", s.batchSensorReadWriteHandler).Methods("POST")
-	s.router.HandleFunc("/api/stats", s.statsHandler).Methods("GET")
-	s.router.HandleFunc("/api/get-sensor-data", s.getSensorDataHandler).Methods("POST")
+	s.router.Handle("/api/sensor-data", s.signedIngestRoute(s.sensorDataHandler)).Methods("POST")
+	s.router.Handle("/api/sensor-rw", s.signedIngestRoute(s.sensorReadWriteHandler)).Methods("POST")
+	s.router.Handle("/api/batch-sensor-rw", s.signedIngestRoute(s.batchSensorReadWriteHandler)).Methods("POST")
+	s.router.Handle("/api/stats", s.queryRoute(s.statsHandler)).Methods("GET")
+	s.router.Handle("/api/get-sensor-data", s.queryRoute(s.getSensorDataHandler)).Methods("POST")
+	s.router.Handle("/api/query-series", s.queryRoute(s.querySeriesDataHandler)).Methods("POST")
+	s.router.Handle("/api/sensor-data/{id:[0-9]+}", s.queryRoute(s.getSensorRecordHandler)).Methods("GET")
+	s.router.Handle("/api/payload/inspect", s.queryRoute(s.inspectPayloadHandler)).Methods("POST")
+
+	// Prometheus remote_write 接收端
+	s.router.Handle("/api/v1/write", s.ingestRoute(s.remoteWriteHandler)).Methods("POST")
+
+	// 设备注册表：查询需要 query 权限，增删改需要 admin 权限
+	s.router.Handle("/api/devices", s.queryRoute(s.listDevicesHandler)).Methods("GET")
+	s.router.Handle("/api/devices", s.requireScope(scopeAdmin, http.HandlerFunc(s.saveDeviceHandler))).Methods("POST")
+	// /api/devices/latest 需在 /api/devices/{id} 之前注册
+	s.router.Handle("/api/devices/latest", s.queryRoute(s.latestDevicesHandler)).Methods("GET")
+	s.router.Handle("/api/devices/{id}", s.queryRoute(s.getDeviceHandler)).Methods("GET")
+	s.router.Handle("/api/devices/{id}", s.requireScope(scopeAdmin, http.HandlerFunc(s.saveDeviceHandler))).Methods("PUT")
+	s.router.Handle("/api/devices/{id}", s.requireScope(scopeAdmin, http.HandlerFunc(s.deleteDeviceHandler))).Methods("DELETE")
+
+	// 指标目录
+	s.router.Handle("/api/metrics", s.queryRoute(s.metricsHandler)).Methods("GET")
+
+	// 序列发现（由 series_index 提供）
+	s.router.Handle("/api/series", s.queryRoute(s.listSeriesHandler)).Methods("GET")
+	s.router.Handle("/api/series/devices", s.queryRoute(s.listSeriesDevicesHandler)).Methods("GET")
+	s.router.Handle("/api/series/devices/{id}/metrics", s.queryRoute(s.deviceSeriesHandler)).Methods("GET")
+
+	// 告警
+	s.router.Handle("/api/alerts/silent", s.queryRoute(s.silentSeriesHandler)).Methods("GET")
+
+	// 实时推送（SSE / WebSocket）
+	s.router.Handle("/api/stream", s.streamRoute(s.streamHandler)).Methods("GET")
+	s.router.Handle("/api/ws", s.streamRoute(s.websocketHandler)).Methods("GET")
+
+	// 管理接口
+	s.router.Handle("/api/admin/tenants", s.requireScope(scopeAdmin, http.HandlerFunc(s.tenantsHandler))).Methods("GET")
+
+	// 历史数据导入
+	s.router.Handle("/api/import", s.requireScope(scopeAdmin, http.HandlerFunc(s.importHandler))).Methods("POST")
+	s.router.Handle("/api/import/{id:[0-9]+}", s.requireScope(scopeAdmin, http.HandlerFunc(s.getImportJobHandler))).Methods("GET")
+
+	// 数据导出
+	s.router.Handle("/api/export", s.queryRoute(s.exportHandler)).Methods("GET")
 
 	// 添加中间件
 	s.router.Use(s.loggingMiddleware)
 	s.router.Use(s.recoveryMiddleware)
+	s.router.Use(s.decompressionMiddleware)
+}
+
+// ingestRoute 包装写入类接口：校验 ingest 权限，并统计在途请求数用于准入控制
+func (s *Server) ingestRoute(handler http.HandlerFunc) http.Handler {
+	if s.admission == nil {
+		return s.requireScope(scopeIngest, handler)
+	}
+	return s.requireScope(scopeIngest, s.admission.trackInflight(handler))
+}
+
+// queryRoute 包装查询类接口，校验 query 权限
+func (s *Server) queryRoute(handler http.HandlerFunc) http.Handler {
+	return s.requireScope(scopeQuery, handler)
+}
+
+// streamRoute 包装实时推送接口：请求头中没有密钥时也接受 api_key 查询参数或 bench_api_key Cookie（限同源或明确允许的 Origin）
+// 查询参数中的密钥在校验前从 URL 中移除，避免传给后续处理
+func (s *Server) streamRoute(handler http.HandlerFunc) http.Handler {
+	next := s.queryRoute(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestAPIKey(r) == "" {
+			if key := s.browserAPIKey(r); key != "" {
+				r = r.Clone(r.Context())
+				r.Header.Set("X-API-Key", key)
+			}
+		}
+		if query := r.URL.Query(); query.Has(apiKeyQueryParam) {
+			query.Del(apiKeyQueryParam)
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = query.Encode()
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
@@ -270,6 +921,9 @@ func (s *Server) recoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // 流式响应中途出错，中断连接让客户端感知响应不完整
+				}
 				s.logger.WithField("error", err).Error("Panic recovered")
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 			}
@@ -298,7 +952,19 @@ func (s *Server) Start() error {
 		ReadTimeout:  parseDuration(s.config.ReadTimeout),
 		WriteTimeout: parseDuration(s.config.WriteTimeout),
 		IdleTimeout:  parseDuration(s.config.IdleTimeout),
+		TLSConfig:    s.tlsConfig,
 	}
+	// 关闭时断开推送连接，否则 Shutdown 会等待长连接超时
+	srv.RegisterOnShutdown(s.bus.Close)
+
+	// SIGHUP 重新加载配置
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		for range hupChan {
+			s.reloadConfig()
+		}
+	}()
 
 	// 优雅关闭
 	go func() {
@@ -315,15 +981,114 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	// 静默检测载入重启前的序列及学习到的间隔
+	if s.config.WatchdogEnabled {
+		if err := s.watchdog.Seed(); err != nil {
+			s.logger.WithError(err).Warn("Failed to seed watchdog from series index")
+		}
+	}
+
+	// 后台任务：租户用量、序列索引和设备状态写回、设备静默检测、MQTT 接入；服务停止后写回剩余部分
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(4)
+	go func() {
+		defer background.Done()
+		s.tenantUsage.Run(tenantUsageFlushInterval, stop)
+	}()
+	go func() {
+		defer background.Done()
+		s.seriesIndex.Run(seriesIndexFlushInterval, stop)
+	}()
+	go func() {
+		defer background.Done()
+		s.deviceStatus.Run(deviceStatusFlushInterval, stop)
+	}()
+	go func() {
+		defer background.Done()
+		s.watchdog.Run(parseDuration(s.config.WatchdogCheckInterval), stop)
+	}()
+	if s.mqtt != nil {
+		// MQTT 接入随服务停止，停止前写入已接收的消息
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			if err := s.mqtt.Run(stop); err != nil {
+				s.logger.WithError(err).Error("MQTT ingest stopped")
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		background.Wait()
+	}()
+
+	if s.tlsConfig != nil {
+		// 证书文件变化时自动重新加载
+		go s.certReloader.Watch(tlsReloadInterval, stop)
+
+		s.logger.WithFields(logrus.Fields{
+			"port":        s.config.Port,
+			"client_auth": s.config.TLSClientAuth,
+		}).Info("Starting TLS server")
+		return srv.ListenAndServeTLS("", "")
+	}
+
 	s.logger.WithField("port", s.config.Port).Info("Starting server")
 	return srv.ListenAndServe()
 }
 
+// reloadConfig 重新读取配置文件，更新可在运行时调整的配置（限流规则、指标目录、租户配额、静默检测），并重新加载 TLS 证书
+func (s *Server) reloadConfig() {
+	if s.certReloader != nil {
+		if err := s.certReloader.Reload(); err != nil {
+			s.logger.WithError(err).Error("Failed to reload TLS certificates, keeping previous ones")
+		}
+	}
+
+	config := NewConfig()
+
+	policy, err := newRateLimitPolicy(config)
+	if err != nil {
+		s.logger.WithError(err).Error("Invalid rate limit config, keeping previous limits")
+		return
+	}
+	catalogPolicy, err := newMetricCatalogPolicy(config)
+	if err != nil {
+		s.logger.WithError(err).Error("Invalid metric catalog config, keeping previous catalog")
+		return
+	}
+	watchdogPolicy, err := newWatchdogPolicy(config)
+	if err != nil {
+		s.logger.WithError(err).Error("Invalid watchdog config, keeping previous settings")
+		return
+	}
+	s.rateLimiter.SetPolicy(policy)
+	s.catalog.SetPolicy(catalogPolicy)
+	s.watchdog.SetPolicy(watchdogPolicy)
+	s.tenantUsage.SetQuotas(config.TenantDefaultQuota, config.TenantQuotas)
+
+	s.logger.WithFields(logrus.Fields{
+		"rate_limit_enabled": policy.enabled,
+		"device_overrides":   len(policy.deviceOverrides),
+		"factory_overrides":  len(policy.factoryOverrides),
+		"catalog_metrics":    len(catalogPolicy.metrics),
+		"watchdog_enabled":   watchdogPolicy.enabled,
+	}).Info("Configuration reloaded")
+}
+
 func (s *Server) Close() error {
 	return s.db.Close()
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("Command %s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	config := NewConfig()
 
 	server, err := NewServer(config)
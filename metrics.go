@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics 进程内指标注册表，以 Prometheus 文本格式在 /metrics 导出
+type Metrics struct {
+	mutex    sync.RWMutex
+	help     map[string]string
+	counters map[string]map[string]float64 // 指标名 -> 标签串 -> 值
+	gauges   map[string]func() float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		help:     make(map[string]string),
+		counters: make(map[string]map[string]float64),
+		gauges:   make(map[string]func() float64),
+	}
+}
+
+// formatLabels 将标签按名称排序后编码为 {k="v",...}
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[name])
+		parts[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// RegisterCounter 注册计数器的说明文本
+func (m *Metrics) RegisterCounter(name, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.help[name] = help
+	if _, ok := m.counters[name]; !ok {
+		m.counters[name] = make(map[string]float64)
+	}
+}
+
+// AddCounter 计数器累加
+func (m *Metrics) AddCounter(name string, labels map[string]string, delta float64) {
+	key := formatLabels(labels)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.counters[name] = series
+	}
+	series[key] += delta
+}
+
+// IncCounter 计数器加一
+func (m *Metrics) IncCounter(name string, labels map[string]string) {
+	m.AddCounter(name, labels, 1)
+}
+
+// RegisterGauge 注册在导出时实时求值的仪表盘指标
+func (m *Metrics) RegisterGauge(name, help string, fn func() float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.help[name] = help
+	m.gauges[name] = fn
+}
+
+// Handler 以 Prometheus 文本格式导出全部指标
+func (m *Metrics) Handler(w http.ResponseWriter, r *http.Request) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var b strings.Builder
+
+	counterNames := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		counterNames = append(counterNames, name)
+	}
+	sort.Strings(counterNames)
+	for _, name := range counterNames {
+		if help := m.help[name]; help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+
+		series := m.counters[name]
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %g\n", name, key, series[key])
+		}
+	}
+
+	gaugeNames := make([]string, 0, len(m.gauges))
+	for name := range m.gauges {
+		gaugeNames = append(gaugeNames, name)
+	}
+	sort.Strings(gaugeNames)
+	for _, name := range gaugeNames {
+		if help := m.help[name]; help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&b, "%s %g\n", name, m.gauges[name]())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// 索引迁移
+//
+// 建表语句只对新表生效，已有的大表需要显式执行 `bench-server migrate indexes` 补建索引。
+// 迁移不在启动或其他命令中自动执行：在大表上加索引耗时较长，应在低峰期手动运行。
+
+// indexChange 一个表需要补建和删除的索引
+type indexChange struct {
+	table string
+	add   [][2]string // 索引名, 列
+	drop  []string    // 被新索引覆盖的冗余索引
+}
+
+// seriesIndexChanges 时序数据表的索引：
+// idx_device_metric_time 用于按指标的游标分页，idx_device_time 用于只按设备的游标分页，
+// idx_device_metric 是 idx_device_metric_time 的前缀，删除以减少写入开销
+var seriesIndexChanges = []indexChange{
+	{
+		table: "time_series_data",
+		add: [][2]string{
+			{"idx_device_metric_time", "device_id, metric_name, timestamp, id"},
+			{"idx_device_time", "device_id, timestamp, id"},
+		},
+		drop: []string{"idx_device_metric"},
+	},
+	{
+		table: compactTable,
+		add: [][2]string{
+			{"idx_device_metric_time", "device_ref, metric_ref, timestamp, id"},
+			{"idx_device_time", "device_ref, timestamp, id"},
+		},
+		drop: []string{"idx_device_metric"},
+	},
+}
+
+// tableIndexes 返回表上已有的索引名，表不存在时返回 nil
+func tableIndexes(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT INDEX_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+	`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read indexes of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var indexes map[string]bool
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if indexes == nil {
+			indexes = make(map[string]bool)
+		}
+		indexes[name] = true
+	}
+	return indexes, rows.Err()
+}
+
+// indexMigrationStatement 返回把表迁移到目标索引的 ALTER TABLE 语句，无需变更时返回空串
+// 补建和删除合并为一条在线 DDL，只重建一次
+func indexMigrationStatement(change indexChange, existing map[string]bool) string {
+	var clauses []string
+	for _, index := range change.add {
+		if !existing[index[0]] {
+			clauses = append(clauses, "ADD INDEX "+index[0]+" ("+index[1]+")")
+		}
+	}
+	for _, index := range change.drop {
+		if existing[index] {
+			clauses = append(clauses, "DROP INDEX "+index)
+		}
+	}
+	if len(clauses) == 0 {
+		return ""
+	}
+	return "ALTER TABLE " + change.table + " " + strings.Join(clauses, ", ") + ", ALGORITHM=INPLACE, LOCK=NONE"
+}
+
+// migrateIndexes 按 seriesIndexChanges 迁移已有表的索引，dryRun 时只输出语句
+func migrateIndexes(db *sql.DB, out io.Writer, dryRun bool) error {
+	for _, change := range seriesIndexChanges {
+		existing, err := tableIndexes(db, change.table)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			fmt.Fprintf(out, "%s: table does not exist, skipped\n", change.table)
+			continue
+		}
+
+		statement := indexMigrationStatement(change, existing)
+		if statement == "" {
+			fmt.Fprintf(out, "%s: indexes up to date\n", change.table)
+			continue
+		}
+		fmt.Fprintf(out, "%s: %s\n", change.table, statement)
+		if dryRun {
+			continue
+		}
+
+		start := time.Now()
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to migrate indexes of %s: %w", change.table, err)
+		}
+		fmt.Fprintf(out, "%s: done in %s\n", change.table, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// runMigrateCommand 数据库结构迁移
+// 用法：
+//
+//	bench-server migrate indexes [-dry-run]
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 || args[0] != "indexes" {
+		return fmt.Errorf("usage: migrate indexes [-dry-run]")
+	}
+	fs := flag.NewFlagSet("migrate indexes", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print the ALTER TABLE statements without running them")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	config := NewConfig()
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return migrateIndexes(db, os.Stdout, *dryRun)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestIndexMigrationStatement(t *testing.T) {
+	change := seriesIndexChanges[0]
+	tests := []struct {
+		name     string
+		existing map[string]bool
+		want     string
+	}{
+		{"table from before the migration",
+			map[string]bool{"PRIMARY": true, "idx_timestamp": true, "idx_device_metric": true, "idx_priority": true},
+			"ALTER TABLE time_series_data ADD INDEX idx_device_metric_time (device_id, metric_name, timestamp, id), " +
+				"ADD INDEX idx_device_time (device_id, timestamp, id), DROP INDEX idx_device_metric, ALGORITHM=INPLACE, LOCK=NONE"},
+		{"partially migrated",
+			map[string]bool{"PRIMARY": true, "idx_device_metric_time": true, "idx_device_metric": true},
+			"ALTER TABLE time_series_data ADD INDEX idx_device_time (device_id, timestamp, id), DROP INDEX idx_device_metric, ALGORITHM=INPLACE, LOCK=NONE"},
+		{"up to date",
+			map[string]bool{"PRIMARY": true, "idx_device_metric_time": true, "idx_device_time": true},
+			""},
+	}
+	for _, tt := range tests {
+		if got := indexMigrationStatement(change, tt.existing); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
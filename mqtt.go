@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// MQTT 接入方式
+const (
+	mqttModeClient   = "client"   // 连接外部 broker 并订阅
+	mqttModeListener = "listener" // 内嵌接入端，设备直接连接本服务发布
+)
+
+// MQTT 负载格式
+const (
+	mqttPayloadAuto = "auto" // 数字按 raw 处理，否则按 JSON 解析
+	mqttPayloadJSON = "json"
+	mqttPayloadRaw  = "raw"
+)
+
+// mqttMaxRetryWait 写入数据库失败时重试的最大间隔
+const mqttMaxRetryWait = 5 * time.Second
+
+// mqttSubmitTimeout broker 消息在写入队列满时的最长等待时间，超时后不确认，由 broker 在重连后重发
+const mqttSubmitTimeout = 5 * time.Second
+
+var mqttTopicVariable = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// mqttTopicMapping 主题到 device_id / metric_name 的映射
+// 主题模式按 / 分段，每段为字面量或 ${name} 变量，例如 factory/${factory}/device/${device}/${metric}
+type mqttTopicMapping struct {
+	segments   []string // 字面量；变量段为变量名，由 variables 标记
+	variables  []bool
+	deviceID   string // 模板，例如 factory_${factory}_device_${device}
+	metricName string // 模板，例如 ${metric}
+}
+
+func newMQTTTopicMapping(pattern, deviceID, metricName string) (*mqttTopicMapping, error) {
+	mapping := &mqttTopicMapping{deviceID: deviceID, metricName: metricName}
+	names := make(map[string]bool)
+	for _, segment := range strings.Split(pattern, "/") {
+		if m := mqttTopicVariable.FindStringSubmatch(segment); m != nil {
+			if names[m[1]] {
+				return nil, fmt.Errorf("mqtt topic_pattern: variable %s used twice", m[1])
+			}
+			names[m[1]] = true
+			mapping.segments = append(mapping.segments, m[1])
+			mapping.variables = append(mapping.variables, true)
+			continue
+		}
+		if segment == "" || strings.ContainsAny(segment, "+#$") {
+			return nil, fmt.Errorf("mqtt topic_pattern: invalid segment %q (literal or ${name} expected)", segment)
+		}
+		mapping.segments = append(mapping.segments, segment)
+		mapping.variables = append(mapping.variables, false)
+	}
+
+	// 模板只能引用主题中的变量
+	for _, tmpl := range []string{deviceID, metricName} {
+		var missing string
+		expanded := os.Expand(tmpl, func(name string) string {
+			if !names[name] {
+				missing = name
+			}
+			return "x"
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("mqtt template %q references ${%s}, which is not in topic_pattern", tmpl, missing)
+		}
+		if expanded == tmpl {
+			return nil, fmt.Errorf("mqtt template %q must reference at least one topic variable", tmpl)
+		}
+	}
+	return mapping, nil
+}
+
+// filter 返回订阅用的主题过滤器（变量段替换为 +）
+func (m *mqttTopicMapping) filter() string {
+	parts := make([]string, len(m.segments))
+	for i, segment := range m.segments {
+		if m.variables[i] {
+			parts[i] = "+"
+		} else {
+			parts[i] = segment
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// parse 将主题映射为设备ID和指标名，不匹配时返回 false
+func (m *mqttTopicMapping) parse(topic string) (string, string, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != len(m.segments) {
+		return "", "", false
+	}
+	values := make(map[string]string)
+	for i, part := range parts {
+		if !m.variables[i] {
+			if part != m.segments[i] {
+				return "", "", false
+			}
+			continue
+		}
+		if part == "" {
+			return "", "", false
+		}
+		values[m.segments[i]] = part
+	}
+	lookup := func(name string) string { return values[name] }
+	return os.Expand(m.deviceID, lookup), os.Expand(m.metricName, lookup), true
+}
+
+// mqttPayload JSON 负载，也可以直接发布数字作为数值
+type mqttPayload struct {
+	Value     *float64 `json:"value"`
+	Timestamp string   `json:"timestamp"` // RFC3339，为空时使用接收时间
+	Priority  int      `json:"priority"`
+	Data      string   `json:"data"`
+}
+
+// decodeMQTTPayload 按配置的格式解析负载
+func decodeMQTTPayload(format string, payload []byte) (*mqttPayload, error) {
+	text := strings.TrimSpace(string(payload))
+	if format == mqttPayloadRaw || (format == mqttPayloadAuto && !strings.HasPrefix(text, "{")) {
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid numeric payload %q", truncateRunes(text, 32))
+		}
+		return &mqttPayload{Value: &value}, nil
+	}
+
+	var decoded mqttPayload
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+	if decoded.Value == nil {
+		return nil, fmt.Errorf("JSON payload is missing value")
+	}
+	return &decoded, nil
+}
+
+// mqttMessage 一条待写入的消息，ack 在写入数据库后调用（QoS 0 时为空）
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	ack     func()
+	key     *APIKey // 内嵌接入端启用认证时连接使用的 API Key
+}
+
+// MQTTIngester MQTT 接入：将消息按批写入数据库，写入成功后才确认 QoS 1 消息
+type MQTTIngester struct {
+	server   *Server
+	mapping  *mqttTopicMapping
+	messages chan *mqttMessage
+	stop     chan struct{}
+}
+
+func NewMQTTIngester(server *Server) (*MQTTIngester, error) {
+	config := server.config
+	if config.MQTTMode != mqttModeClient && config.MQTTMode != mqttModeListener {
+		return nil, fmt.Errorf("invalid mqtt mode %q (expected client or listener)", config.MQTTMode)
+	}
+	switch config.MQTTPayloadFormat {
+	case mqttPayloadAuto, mqttPayloadJSON, mqttPayloadRaw:
+	default:
+		return nil, fmt.Errorf("invalid mqtt payload_format %q (expected auto, json or raw)", config.MQTTPayloadFormat)
+	}
+	if config.MQTTQoS < 0 || config.MQTTQoS > 1 {
+		return nil, fmt.Errorf("invalid mqtt qos %d (expected 0 or 1)", config.MQTTQoS)
+	}
+	if _, err := time.ParseDuration(config.MQTTBatchWait); err != nil {
+		return nil, fmt.Errorf("invalid mqtt batch_wait %q: %w", config.MQTTBatchWait, err)
+	}
+	mapping, err := newMQTTTopicMapping(config.MQTTTopicPattern, config.MQTTDeviceID, config.MQTTMetricName)
+	if err != nil {
+		return nil, err
+	}
+
+	server.metrics.RegisterCounter("bench_mqtt_messages_total", "MQTT messages received, by outcome.")
+	return &MQTTIngester{
+		server:   server,
+		mapping:  mapping,
+		messages: make(chan *mqttMessage, config.MQTTBatchSize*2),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// QueueDepth 返回等待写入的消息数
+func (mi *MQTTIngester) QueueDepth() int {
+	return len(mi.messages)
+}
+
+// QueueCapacity 返回写入队列容量
+func (mi *MQTTIngester) QueueCapacity() int {
+	return cap(mi.messages)
+}
+
+// Submit 提交一条消息，队列满时阻塞（对发布端形成背压），停止后丢弃（不确认，由发布端重发）
+func (mi *MQTTIngester) Submit(msg *mqttMessage) {
+	select {
+	case mi.messages <- msg:
+	case <-mi.stop:
+	}
+}
+
+// SubmitTimeout 提交一条消息，队列满时最多等待 timeout；超时或停止后返回 false，消息不确认
+// 用于 paho 的消息回调：回调长时间阻塞会卡住客户端的收发，心跳超时后 broker 断开连接
+func (mi *MQTTIngester) SubmitTimeout(msg *mqttMessage, timeout time.Duration) bool {
+	select {
+	case mi.messages <- msg:
+		return true
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case mi.messages <- msg:
+		return true
+	case <-timer.C:
+		return false
+	case <-mi.stop:
+		return false
+	}
+}
+
+// Run 启动接入（连接 broker 或监听端口）并处理消息，直到 stop 关闭
+func (mi *MQTTIngester) Run(stop <-chan struct{}) error {
+	config := mi.server.config
+	var shutdown func()
+	switch config.MQTTMode {
+	case mqttModeClient:
+		client := mi.connectBroker()
+		shutdown = func() { client.Disconnect(250) }
+	case mqttModeListener:
+		listener, err := NewMQTTListener(mi, mi.server.apiKeys, mi.server.logger, config.MQTTListen, config.MQTTMaxPacketSize, config.MQTTMaxConnections)
+		if err != nil {
+			return err
+		}
+		go listener.Serve()
+		shutdown = listener.Close
+	}
+
+	batchSize := config.MQTTBatchSize
+	batchWait := parseDuration(config.MQTTBatchWait)
+	batch := make([]*mqttMessage, 0, batchSize)
+	timer := time.NewTimer(batchWait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-mi.messages:
+			if len(batch) == 0 {
+				timer.Reset(batchWait)
+			}
+			batch = append(batch, msg)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-timer.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-stop:
+			// 先停止接收（阻塞在 Submit 中的消息直接放弃），再写入已排队的消息
+			close(mi.stop)
+			shutdown()
+			for drained := false; !drained; {
+				select {
+				case msg := <-mi.messages:
+					batch = append(batch, msg)
+				default:
+					drained = true
+				}
+			}
+			mi.process(batch, nil)
+			return nil
+		}
+		mi.process(batch, stop)
+		batch = batch[:0]
+	}
+}
+
+// connectBroker 连接外部 broker 并订阅映射的主题
+// 使用持久会话、手动确认：未确认的消息在重连后由 broker 重发
+// 消息回调不保证顺序（每条消息在单独的协程中处理），数据库不可用导致队列满时不会阻塞客户端的心跳；
+// 等待超过 mqttSubmitTimeout 的消息不确认，计入 deferred
+func (mi *MQTTIngester) connectBroker() mqtt.Client {
+	config := mi.server.config
+	logger := mi.server.logger
+	filter := mi.mapping.filter()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.MQTTBroker).
+		SetClientID(config.MQTTClientID).
+		SetUsername(config.MQTTUsername).
+		SetPassword(config.MQTTPassword).
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(false).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		token := client.Subscribe(filter, byte(config.MQTTQoS), func(_ mqtt.Client, m mqtt.Message) {
+			if !mi.SubmitTimeout(&mqttMessage{topic: m.Topic(), payload: m.Payload(), ack: m.Ack}, mqttSubmitTimeout) {
+				mi.server.metrics.IncCounter("bench_mqtt_messages_total", map[string]string{"outcome": "deferred"})
+			}
+		})
+		if token.Wait() && token.Error() != nil {
+			logger.WithError(token.Error()).WithField("topic", filter).Error("MQTT subscribe failed")
+			return
+		}
+		logger.WithFields(logrus.Fields{"broker": config.MQTTBroker, "topic": filter}).Info("MQTT subscribed")
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logger.WithError(err).Warn("MQTT connection lost, reconnecting")
+	})
+
+	client := mqtt.NewClient(opts)
+	client.Connect() // SetConnectRetry 时在后台重试，不阻塞启动
+	return client
+}
+
+// process 解析、检查并写入一批消息；写入成功后按接收顺序确认
+// 无效和被策略拒绝的消息确认后丢弃；检查或写入时出现内部错误按退避间隔重试直到成功或 stop 关闭，
+// 放弃时不确认，由发布端重发
+func (mi *MQTTIngester) process(batch []*mqttMessage, stop <-chan struct{}) {
+	if len(batch) == 0 {
+		return
+	}
+	s := mi.server
+
+	// 1. 解析主题和负载
+	rows := make([]*SensorData, len(batch))
+	invalid, rejected, deferred := 0, 0, 0
+	for i, msg := range batch {
+		row, err := mi.decode(msg)
+		if err != nil {
+			s.logger.WithError(err).WithField("topic", msg.topic).Debug("Dropped invalid MQTT message")
+			invalid++
+			continue
+		}
+		rows[i] = row
+	}
+
+	// 2. 按设备检查未知设备策略、限流和租户配额，被拒绝的设备的消息丢弃，检查出错的设备的消息不确认
+	deviceCounts := make(map[string]int)
+	for _, row := range rows {
+		if row != nil {
+			deviceCounts[row.DeviceID]++
+		}
+	}
+	denied := make(map[string]bool)
+	failed := make(map[string]bool)
+	for deviceID, n := range deviceCounts {
+		err := s.checkIngestRows(map[string]int{deviceID: n})
+		for attempt := 0; err != nil && !isIngestRejection(err); attempt++ {
+			s.logger.WithError(err).WithField("device_id", deviceID).Error("Failed to check MQTT messages, retrying")
+			if !mi.retryWait(attempt, stop) {
+				break
+			}
+			err = s.checkIngestRows(map[string]int{deviceID: n})
+		}
+		switch {
+		case err == nil:
+		case isIngestRejection(err):
+			s.logger.WithError(err).WithField("device_id", deviceID).Debug("Rejected MQTT messages")
+			denied[deviceID] = true
+		default:
+			failed[deviceID] = true
+		}
+	}
+	unacked := make([]bool, len(batch))
+	var accepted []*SensorData
+	for i, row := range rows {
+		if row == nil {
+			continue
+		}
+		if denied[row.DeviceID] {
+			rejected++
+			continue
+		}
+		if failed[row.DeviceID] {
+			unacked[i] = true
+			deferred++
+			continue
+		}
+		accepted = append(accepted, row)
+	}
+
+	// 3. 写入，失败时重试
+	if len(accepted) > 0 {
+		dbService := s.databaseService()
+		for attempt := 0; ; attempt++ {
+			start := time.Now()
+			err := dbService.BulkInsertSensorData(accepted)
+			s.observeDBLatency(start)
+			if err == nil {
+				break
+			}
+			s.logger.WithError(err).WithField("rows", len(accepted)).Error("Failed to insert MQTT messages, retrying")
+			if !mi.retryWait(attempt, stop) {
+				return
+			}
+		}
+		s.afterIngest(accepted)
+	}
+
+	// 4. 按接收顺序确认
+	for i, msg := range batch {
+		if msg.ack != nil && !unacked[i] {
+			msg.ack()
+		}
+	}
+
+	s.metrics.AddCounter("bench_mqtt_messages_total", map[string]string{"outcome": "stored"}, float64(len(accepted)))
+	if invalid > 0 {
+		s.metrics.AddCounter("bench_mqtt_messages_total", map[string]string{"outcome": "invalid"}, float64(invalid))
+	}
+	if rejected > 0 {
+		s.metrics.AddCounter("bench_mqtt_messages_total", map[string]string{"outcome": "rejected"}, float64(rejected))
+	}
+	if deferred > 0 {
+		s.metrics.AddCounter("bench_mqtt_messages_total", map[string]string{"outcome": "deferred"}, float64(deferred))
+	}
+}
+
+// retryWait 按退避间隔等待下一次重试，stop 为空（停止前的最后一批）或已关闭时返回 false
+func (mi *MQTTIngester) retryWait(attempt int, stop <-chan struct{}) bool {
+	if stop == nil {
+		return false
+	}
+	wait := time.Duration(100<<uint(attempt)) * time.Millisecond
+	if wait <= 0 || wait > mqttMaxRetryWait {
+		wait = mqttMaxRetryWait
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// decode 将一条消息转换为传感器数据，并做与 HTTP 写入相同的校验
+func (mi *MQTTIngester) decode(msg *mqttMessage) (*SensorData, error) {
+	config := mi.server.config
+	deviceID, metricName, ok := mi.mapping.parse(msg.topic)
+	if !ok {
+		return nil, fmt.Errorf("topic does not match topic_pattern")
+	}
+	if len(deviceID) > 100 || len(metricName) > 50 {
+		return nil, fmt.Errorf("device_id or metric_name too long")
+	}
+	if msg.key != nil && !msg.key.AllowsDevice(deviceID) {
+		return nil, fmt.Errorf("API key is not allowed to access device %s", deviceID)
+	}
+
+	payload, err := decodeMQTTPayload(config.MQTTPayloadFormat, msg.payload)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := payload.Timestamp
+	if timestamp == "" {
+		timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	} else if _, err := time.Parse(time.RFC3339, timestamp); err != nil {
+		return nil, fmt.Errorf("invalid timestamp format (RFC3339 required)")
+	}
+	priority := payload.Priority
+	if priority < 1 || priority > 3 {
+		priority = config.MQTTDefaultPriority
+	}
+
+	value, _, err := mi.server.catalog.Check(metricName, *payload.Value)
+	if err != nil {
+		return nil, err
+	}
+	if !mi.server.checkPayload(payload.Data) {
+		return nil, fmt.Errorf(invalidPayloadMessage)
+	}
+	return &SensorData{
+		Timestamp:  timestamp,
+		DeviceID:   deviceID,
+		MetricName: metricName,
+		Value:      value,
+		Priority:   priority,
+		Data:       payload.Data,
+	}, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mqttConnectTimeout 建立连接后等待 CONNECT 报文的时间
+	mqttConnectTimeout = 10 * time.Second
+	// mqttWriteWait 向设备写入一个报文的超时时间
+	mqttWriteWait = 10 * time.Second
+)
+
+// readMQTTPacket 读取一个报文，剩余长度超过 maxSize 时在分配缓冲区之前返回错误
+// （packets.ReadPacket 按报文头声明的长度直接分配，未认证的连接也可以让服务端分配 256MB）
+func readMQTTPacket(r io.Reader, maxSize int) (packets.ControlPacket, error) {
+	var header [1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	fh := packets.FixedHeader{
+		MessageType: header[0] >> 4,
+		Dup:         (header[0]>>3)&0x01 > 0,
+		Qos:         (header[0] >> 1) & 0x03,
+		Retain:      header[0]&0x01 > 0,
+	}
+
+	// 剩余长度为变长编码，最多 4 字节
+	var digit [1]byte
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, fmt.Errorf("malformed remaining length")
+		}
+		if _, err := io.ReadFull(r, digit[:]); err != nil {
+			return nil, err
+		}
+		fh.RemainingLength |= int(digit[0]&0x7f) << shift
+		if digit[0]&0x80 == 0 {
+			break
+		}
+	}
+	if fh.RemainingLength > maxSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds max_packet_size %d", fh.RemainingLength, maxSize)
+	}
+
+	packet, err := packets.NewControlPacketWithHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, fh.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if err := packet.Unpack(bytes.NewBuffer(body)); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// MQTTListener 内嵌的 MQTT 3.1.1 接入端：只接收设备发布的消息（QoS 0 / 1），不转发、不支持订阅
+// 启用 API Key 认证时，CONNECT 的密码作为 API Key（需要 ingest 权限），设备按密钥的工厂范围授权
+type MQTTListener struct {
+	ingester       *MQTTIngester
+	apiKeys        *APIKeyStore
+	logger         *logrus.Logger
+	listener       net.Listener
+	maxPacketSize  int
+	maxConnections int
+
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func NewMQTTListener(ingester *MQTTIngester, apiKeys *APIKeyStore, logger *logrus.Logger, addr string, maxPacketSize, maxConnections int) (*MQTTListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &MQTTListener{
+		ingester:       ingester,
+		apiKeys:        apiKeys,
+		logger:         logger,
+		listener:       listener,
+		maxPacketSize:  maxPacketSize,
+		maxConnections: maxConnections,
+		conns:          make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr 监听地址
+func (ml *MQTTListener) Addr() net.Addr {
+	return ml.listener.Addr()
+}
+
+// Serve 接受连接，直到 Close
+func (ml *MQTTListener) Serve() {
+	ml.logger.WithField("addr", ml.listener.Addr().String()).Info("MQTT listener started")
+	for {
+		conn, err := ml.listener.Accept()
+		if err != nil {
+			ml.mutex.Lock()
+			closed := ml.closed
+			ml.mutex.Unlock()
+			if !closed {
+				ml.logger.WithError(err).Error("MQTT accept failed")
+			}
+			return
+		}
+
+		ml.mutex.Lock()
+		if ml.closed {
+			ml.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		if len(ml.conns) >= ml.maxConnections {
+			ml.mutex.Unlock()
+			ml.logger.WithField("remote", conn.RemoteAddr().String()).Warn("MQTT connection limit reached, closing new connection")
+			conn.Close()
+			continue
+		}
+		ml.conns[conn] = struct{}{}
+		ml.mutex.Unlock()
+
+		go func() {
+			defer func() {
+				ml.mutex.Lock()
+				delete(ml.conns, conn)
+				ml.mutex.Unlock()
+				conn.Close()
+			}()
+			ml.handle(conn)
+		}()
+	}
+}
+
+// Close 停止监听并断开所有连接
+func (ml *MQTTListener) Close() {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	ml.closed = true
+	ml.listener.Close()
+	for conn := range ml.conns {
+		conn.Close()
+	}
+}
+
+// handle 处理一个连接：CONNECT 握手后循环读取报文
+func (ml *MQTTListener) handle(conn net.Conn) {
+	var writeMutex sync.Mutex
+	write := func(packet packets.ControlPacket) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(mqttWriteWait))
+		return packet.Write(conn)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	packet, err := readMQTTPacket(conn, ml.maxPacketSize)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return // 第一个报文必须是 CONNECT
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	var key *APIKey
+	if connack.ReturnCode == packets.Accepted && ml.apiKeys != nil {
+		key, err = ml.apiKeys.Authenticate(string(connect.Password))
+		if err != nil {
+			connack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+		} else if !key.HasScope(scopeIngest) {
+			connack.ReturnCode = packets.ErrRefusedNotAuthorised
+		}
+	}
+	if err := write(connack); err != nil || connack.ReturnCode != packets.Accepted {
+		return
+	}
+
+	logger := ml.logger.WithFields(logrus.Fields{"client_id": connect.ClientIdentifier, "remote": conn.RemoteAddr().String()})
+	logger.Debug("MQTT client connected")
+
+	// 超过 1.5 倍 keepalive 未收到报文时断开
+	var idleTimeout time.Duration
+	if connect.Keepalive > 0 {
+		idleTimeout = time.Duration(connect.Keepalive) * time.Second * 3 / 2
+	}
+
+	for {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := readMQTTPacket(conn, ml.maxPacketSize)
+		if err != nil {
+			logger.WithError(err).Debug("MQTT client disconnected")
+			return
+		}
+
+		switch p := packet.(type) {
+		case *packets.PublishPacket:
+			msg := &mqttMessage{topic: p.TopicName, payload: p.Payload, key: key}
+			switch p.Qos {
+			case 0:
+			case 1:
+				messageID := p.MessageID
+				msg.ack = func() {
+					puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+					puback.MessageID = messageID
+					write(puback)
+				}
+			default:
+				logger.Warn("MQTT QoS 2 is not supported, closing connection")
+				return
+			}
+			ml.ingester.Submit(msg)
+		case *packets.SubscribePacket:
+			// 只接收数据，订阅一律返回失败
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = make([]byte, len(p.Topics))
+			for i := range suback.ReturnCodes {
+				suback.ReturnCodes[i] = 0x80
+			}
+			if err := write(suback); err != nil {
+				return
+			}
+		case *packets.UnsubscribePacket:
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			if err := write(unsuback); err != nil {
+				return
+			}
+		case *packets.PingreqPacket:
+			if err := write(packets.NewControlPacket(packets.Pingresp)); err != nil {
+				return
+			}
+		case *packets.DisconnectPacket:
+			logger.Debug("MQTT client disconnected")
+			return
+		default:
+			// 接入端不发送 PUBLISH，其余报文忽略
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMQTTTopicMappingParse(t *testing.T) {
+	mapping, err := newMQTTTopicMapping("factory/${factory}/device/${device}/${metric}", "factory_${factory}_device_${device}", "${metric}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mapping.filter(); got != "factory/+/device/+/+" {
+		t.Errorf("filter() = %q", got)
+	}
+
+	tests := []struct {
+		topic      string
+		deviceID   string
+		metricName string
+		ok         bool
+	}{
+		{"factory/001/device/042/temperature", "factory_001_device_042", "temperature", true},
+		{"factory/001/device/042", "", "", false},
+		{"factory/001/device/042/temperature/extra", "", "", false},
+		{"factory/001/sensor/042/temperature", "", "", false},
+		{"factory//device/042/temperature", "", "", false},
+	}
+	for _, tt := range tests {
+		deviceID, metricName, ok := mapping.parse(tt.topic)
+		if ok != tt.ok || deviceID != tt.deviceID || metricName != tt.metricName {
+			t.Errorf("parse(%q) = %q, %q, %v; want %q, %q, %v", tt.topic, deviceID, metricName, ok, tt.deviceID, tt.metricName, tt.ok)
+		}
+	}
+}
+
+func TestMQTTTopicMappingInvalid(t *testing.T) {
+	tests := []struct {
+		pattern, deviceID, metricName string
+	}{
+		{"factory/${f}/${f}", "${f}", "${f}"},            // 变量重复
+		{"factory/+/${d}", "${d}", "${d}"},               // 通配符
+		{"factory//${d}", "${d}", "${d}"},                // 空段
+		{"factory/${d}/${m}", "${x}", "${m}"},            // 引用不存在的变量
+		{"factory/${d}/${m}", "device_001", "${m}"},      // 设备ID模板不含变量
+		{"factory/${d}/temperature", "${d}", "constant"}, // 指标名模板不含变量
+	}
+	for _, tt := range tests {
+		if _, err := newMQTTTopicMapping(tt.pattern, tt.deviceID, tt.metricName); err == nil {
+			t.Errorf("newMQTTTopicMapping(%q, %q, %q) succeeded, want error", tt.pattern, tt.deviceID, tt.metricName)
+		}
+	}
+}
+
+func TestDecodeMQTTPayload(t *testing.T) {
+	tests := []struct {
+		format    string
+		payload   string
+		value     float64
+		timestamp string
+		priority  int
+		wantErr   bool
+	}{
+		{mqttPayloadAuto, "23.5", 23.5, "", 0, false},
+		{mqttPayloadAuto, " 42\n", 42, "", 0, false},
+		{mqttPayloadAuto, `{"value": 1.5, "timestamp": "2024-01-01T12:00:00Z", "priority": 1}`, 1.5, "2024-01-01T12:00:00Z", 1, false},
+		{mqttPayloadAuto, `{"timestamp": "2024-01-01T12:00:00Z"}`, 0, "", 0, true},
+		{mqttPayloadAuto, "warm", 0, "", 0, true},
+		{mqttPayloadRaw, "7", 7, "", 0, false},
+		{mqttPayloadRaw, `{"value": 1}`, 0, "", 0, true},
+		{mqttPayloadJSON, `{"value": 0}`, 0, "", 0, false},
+		{mqttPayloadJSON, "7", 0, "", 0, true},
+		{mqttPayloadJSON, `{"value": `, 0, "", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := decodeMQTTPayload(tt.format, []byte(tt.payload))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("decodeMQTTPayload(%s, %q) succeeded, want error", tt.format, tt.payload)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("decodeMQTTPayload(%s, %q): %v", tt.format, tt.payload, err)
+			continue
+		}
+		if *got.Value != tt.value || got.Timestamp != tt.timestamp || got.Priority != tt.priority {
+			t.Errorf("decodeMQTTPayload(%s, %q) = %v, %q, %d", tt.format, tt.payload, *got.Value, got.Timestamp, got.Priority)
+		}
+	}
+}
+
+// mqttTestDB 测试用的 database/sql 驱动：记录提交的写入行数，可以阻塞写入或让查询失败
+type mqttTestDB struct {
+	mutex      sync.Mutex
+	committed  int
+	registered []string // 自动登记的设备
+	queryErr   error
+	gate       chan struct{} // 不为空时写入语句等待其关闭
+	started    chan struct{} // 写入语句开始执行时发送
+}
+
+var mqttTestState = &mqttTestDB{}
+
+func init() {
+	sql.Register("mqtttest", mqttTestDriver{})
+}
+
+type mqttTestDriver struct{}
+
+func (mqttTestDriver) Open(string) (driver.Conn, error) { return &mqttTestConn{}, nil }
+
+type mqttTestConn struct {
+	pending int // 当前事务中写入的行数
+}
+
+func (c *mqttTestConn) Prepare(query string) (driver.Stmt, error) {
+	return &mqttTestStmt{conn: c, query: query}, nil
+}
+func (c *mqttTestConn) Close() error              { return nil }
+func (c *mqttTestConn) Begin() (driver.Tx, error) { c.pending = 0; return c, nil }
+
+func (c *mqttTestConn) Commit() error {
+	mqttTestState.mutex.Lock()
+	mqttTestState.committed += c.pending
+	mqttTestState.mutex.Unlock()
+	c.pending = 0
+	return nil
+}
+
+func (c *mqttTestConn) Rollback() error { c.pending = 0; return nil }
+
+type mqttTestStmt struct {
+	conn  *mqttTestConn
+	query string
+}
+
+func (st *mqttTestStmt) Close() error  { return nil }
+func (st *mqttTestStmt) NumInput() int { return -1 }
+
+func (st *mqttTestStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(st.query, "INSERT IGNORE INTO device_registry") {
+		mqttTestState.mutex.Lock()
+		mqttTestState.registered = append(mqttTestState.registered, args[0].(string))
+		mqttTestState.mutex.Unlock()
+	}
+	if strings.HasPrefix(st.query, "INSERT INTO time_series_data") {
+		mqttTestState.mutex.Lock()
+		gate, started := mqttTestState.gate, mqttTestState.started
+		mqttTestState.mutex.Unlock()
+		if started != nil {
+			started <- struct{}{}
+		}
+		if gate != nil {
+			<-gate
+		}
+		st.conn.pending += len(args) / 6
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (st *mqttTestStmt) Query([]driver.Value) (driver.Rows, error) {
+	mqttTestState.mutex.Lock()
+	defer mqttTestState.mutex.Unlock()
+	if mqttTestState.queryErr != nil {
+		return nil, mqttTestState.queryErr
+	}
+	return mqttTestRows{}, nil
+}
+
+// mqttTestRows 空结果集
+type mqttTestRows struct{}
+
+func (mqttTestRows) Columns() []string         { return []string{"device_id"} }
+func (mqttTestRows) Close() error              { return nil }
+func (mqttTestRows) Next([]driver.Value) error { return io.EOF }
+
+// newMQTTTestIngester 使用测试驱动的服务端和接入器，state 在测试结束时重置
+func newMQTTTestIngester(t *testing.T) *MQTTIngester {
+	t.Helper()
+	*mqttTestState = mqttTestDB{}
+	t.Cleanup(func() { *mqttTestState = mqttTestDB{} })
+
+	db, err := sql.Open("mqtttest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	config := &Config{
+		UnknownDevicePolicy: unknownDeviceAllow,
+		MQTTMode:            mqttModeListener,
+		MQTTTopicPattern:    "factory/${factory}/device/${device}/${metric}",
+		MQTTDeviceID:        "factory_${factory}_device_${device}",
+		MQTTMetricName:      "${metric}",
+		MQTTQoS:             1,
+		MQTTPayloadFormat:   mqttPayloadAuto,
+		MQTTDefaultPriority: 2,
+		MQTTBatchSize:       10,
+		MQTTBatchWait:       "10ms",
+	}
+	metrics := NewMetrics()
+	server := &Server{
+		db:       db,
+		logger:   logger,
+		config:   config,
+		metrics:  metrics,
+		catalog:  NewMetricCatalog(metricCatalogPolicy{}, metrics),
+		registry: NewDeviceRegistry(db),
+	}
+	mi, err := NewMQTTIngester(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mi
+}
+
+// startMQTTTestListener 在 127.0.0.1:0 上运行接入端，逐条处理提交的消息
+func startMQTTTestListener(t *testing.T, mi *MQTTIngester, maxPacketSize int) string {
+	t.Helper()
+	listener, err := NewMQTTListener(mi, nil, mi.server.logger, "127.0.0.1:0", maxPacketSize, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go listener.Serve()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case msg := <-mi.messages:
+				mi.process([]*mqttMessage{msg}, stop)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		close(stop)
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// dialMQTT 连接接入端并完成 CONNECT 握手
+func dialMQTT(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = "test"
+	if err := connect.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	packet := readMQTTTestPacket(t, conn, 5*time.Second)
+	if connack, ok := packet.(*packets.ConnackPacket); !ok || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("expected accepted CONNACK, got %v", packet)
+	}
+	return conn
+}
+
+func readMQTTTestPacket(t *testing.T, conn net.Conn, timeout time.Duration) packets.ControlPacket {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	packet, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("read packet: %v", err)
+	}
+	return packet
+}
+
+func publishMQTT(t *testing.T, conn net.Conn, qos byte, messageID uint16, topic, payload string) {
+	t.Helper()
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.Qos = qos
+	publish.MessageID = messageID
+	publish.TopicName = topic
+	publish.Payload = []byte(payload)
+	if err := publish.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMQTTListenerPubackAfterInsert(t *testing.T) {
+	mi := newMQTTTestIngester(t)
+	gate := make(chan struct{})
+	started := make(chan struct{}, 1)
+	mqttTestState.gate, mqttTestState.started = gate, started
+	conn := dialMQTT(t, startMQTTTestListener(t, mi, 1024))
+
+	publishMQTT(t, conn, 1, 7, "factory/001/device/042/temperature", "23.5")
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("insert was not attempted")
+	}
+
+	// 写入未完成时不应确认
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if packet, err := packets.ReadPacket(conn); err == nil {
+		t.Fatalf("received %v before the insert committed", packet)
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("read: %v", err)
+	}
+
+	close(gate)
+	packet := readMQTTTestPacket(t, conn, 5*time.Second)
+	puback, ok := packet.(*packets.PubackPacket)
+	if !ok || puback.MessageID != 7 {
+		t.Fatalf("expected PUBACK for message 7, got %v", packet)
+	}
+	mqttTestState.mutex.Lock()
+	committed := mqttTestState.committed
+	mqttTestState.mutex.Unlock()
+	if committed != 1 {
+		t.Fatalf("PUBACK sent with %d committed rows, want 1", committed)
+	}
+}
+
+func TestMQTTListenerQoS0(t *testing.T) {
+	mi := newMQTTTestIngester(t)
+	conn := dialMQTT(t, startMQTTTestListener(t, mi, 1024))
+
+	publishMQTT(t, conn, 0, 0, "factory/001/device/042/temperature", `{"value": 21}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mqttTestState.mutex.Lock()
+		committed := mqttTestState.committed
+		mqttTestState.mutex.Unlock()
+		if committed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("QoS 0 message was not inserted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// QoS 0 不确认：PINGREQ 之后收到的下一个报文应是 PINGRESP
+	if err := packets.NewControlPacket(packets.Pingreq).Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if packet := readMQTTTestPacket(t, conn, 5*time.Second); packet.(*packets.PingrespPacket) == nil {
+		t.Fatalf("expected PINGRESP, got %v", packet)
+	}
+}
+
+func TestMQTTListenerRejectsOversizedPacket(t *testing.T) {
+	mi := newMQTTTestIngester(t)
+	addr := startMQTTTestListener(t, mi, 1024)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// CONNECT 报文头声明 128MB 剩余长度，接入端应在读取正文前断开
+	if _, err := conn.Write([]byte{0x10, 0x80, 0x80, 0x80, 0x40}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestReadMQTTPacketLimit(t *testing.T) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = "factory/001/device/042/temperature"
+	publish.Payload = []byte(strings.Repeat("1", 100))
+	var buf strings.Builder
+	if err := publish.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := readMQTTPacket(strings.NewReader(buf.String()), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := packet.(*packets.PublishPacket); got.TopicName != publish.TopicName || string(got.Payload) != string(publish.Payload) {
+		t.Fatalf("decoded %q %q", got.TopicName, got.Payload)
+	}
+	if _, err := readMQTTPacket(strings.NewReader(buf.String()), 64); err == nil {
+		t.Fatal("expected packet over the limit to be rejected")
+	}
+	if _, err := readMQTTPacket(strings.NewReader("\x30\xff\xff\xff\xff\x01"), 1024); err == nil {
+		t.Fatal("expected malformed remaining length to be rejected")
+	}
+}
+
+func TestMQTTProcessAcks(t *testing.T) {
+	mi := newMQTTTestIngester(t)
+	mi.server.config.UnknownDevicePolicy = unknownDeviceReject
+
+	var acked []string
+	message := func(topic, payload string) *mqttMessage {
+		return &mqttMessage{topic: topic, payload: []byte(payload), ack: func() { acked = append(acked, topic) }}
+	}
+
+	// 查询设备注册表出错：不写入也不确认，由发布端重发
+	mqttTestState.queryErr = errors.New("connection refused")
+	mi.process([]*mqttMessage{message("factory/001/device/042/temperature", "1")}, nil)
+	if len(acked) != 0 {
+		t.Fatalf("acked %v after an internal error", acked)
+	}
+
+	// 未注册设备被策略拒绝：确认后丢弃；无效消息同样确认
+	mqttTestState.queryErr = nil
+	mi.process([]*mqttMessage{
+		message("factory/001/device/042/temperature", "1"),
+		message("factory/001/temperature", "1"),
+	}, nil)
+	if len(acked) != 2 {
+		t.Fatalf("acked %v, want both messages", acked)
+	}
+	if mqttTestState.committed != 0 {
+		t.Fatalf("inserted %d rows for rejected messages", mqttTestState.committed)
+	}
+}
+
+func TestMQTTSubmitTimeout(t *testing.T) {
+	mi := newMQTTTestIngester(t)
+	for i := 0; i < cap(mi.messages); i++ {
+		if !mi.SubmitTimeout(&mqttMessage{topic: "factory/001/device/0001/temperature"}, time.Second) {
+			t.Fatalf("message %d not queued", i)
+		}
+	}
+
+	// 队列满时等待超时，消息不入队
+	start := time.Now()
+	if mi.SubmitTimeout(&mqttMessage{}, 20*time.Millisecond) {
+		t.Fatal("message queued into a full queue")
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Fatalf("returned after %s, want to wait for the timeout", waited)
+	}
+
+	// 停止后立即返回
+	close(mi.stop)
+	start = time.Now()
+	if mi.SubmitTimeout(&mqttMessage{}, time.Minute) || time.Since(start) > time.Second {
+		t.Fatal("submit after stop did not return immediately")
+	}
+}
@@ -0,0 +1,1025 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Parquet 文件的最小实现：只支持扁平 schema（无嵌套、无 repeated 列），用于导入导出时序数据
+// 元数据为 Thrift compact 编码，这里按字段编号直接解析，避免引入 Thrift 依赖
+
+var parquetMagic = []byte("PAR1")
+
+// Parquet 物理类型
+const (
+	parquetBoolean           = 0
+	parquetInt32             = 1
+	parquetInt64             = 2
+	parquetInt96             = 3
+	parquetFloat             = 4
+	parquetDouble            = 5
+	parquetByteArray         = 6
+	parquetFixedLenByteArray = 7
+)
+
+// Parquet 编码
+const (
+	parquetEncodingPlain                = 0
+	parquetEncodingPlainDictionary      = 2
+	parquetEncodingRLE                  = 3
+	parquetEncodingDeltaBinaryPacked    = 5
+	parquetEncodingDeltaLengthByteArray = 6
+	parquetEncodingDeltaByteArray       = 7
+	parquetEncodingRLEDictionary        = 8
+	parquetEncodingByteStreamSplit      = 9
+)
+
+// Parquet 压缩算法
+const (
+	parquetCodecUncompressed = 0
+	parquetCodecSnappy       = 1
+	parquetCodecGzip         = 2
+	parquetCodecZstd         = 6
+)
+
+// Parquet 页类型
+const (
+	parquetDataPage       = 0
+	parquetDictionaryPage = 2
+	parquetDataPageV2     = 3
+)
+
+// Parquet ConvertedType（旧版逻辑类型标注）
+const (
+	parquetConvertedUTF8            = 0
+	parquetConvertedDecimal         = 5
+	parquetConvertedDate            = 6
+	parquetConvertedTimestampMillis = 9
+	parquetConvertedTimestampMicros = 10
+)
+
+const (
+	// parquetMaxPageSize 单个页解压后的大小上限，防止损坏或恶意文件导致大量分配
+	parquetMaxPageSize = 256 << 20
+	// parquetMaxRowGroupRows 单个行组的行数上限：行组整体解码到内存，RLE 编码的页可以用几个字节声明任意多的值
+	parquetMaxRowGroupRows = 16 << 20
+)
+
+// ---- Thrift compact 协议（读） ----
+
+// Thrift compact 类型
+const (
+	thriftStop      = 0
+	thriftTrue      = 1
+	thriftFalse     = 2
+	thriftByte      = 3
+	thriftI16       = 4
+	thriftI32       = 5
+	thriftI64       = 6
+	thriftDouble    = 7
+	thriftBinary    = 8
+	thriftList      = 9
+	thriftSet       = 10
+	thriftMap       = 11
+	thriftStruct    = 12
+	thriftMaxDepth  = 32
+	thriftMaxLength = 64 << 20
+)
+
+// thriftFields 解码后的 Thrift 结构体：字段编号 -> 值
+// 值为 int64（所有整数）、bool、float64、[]byte、thriftFields 或 []interface{}
+type thriftFields map[int16]interface{}
+
+func (f thriftFields) int(id int16) int64 {
+	v, _ := f[id].(int64)
+	return v
+}
+
+func (f thriftFields) has(id int16) bool {
+	_, ok := f[id]
+	return ok
+}
+
+func (f thriftFields) bool(id int16) (bool, bool) {
+	v, ok := f[id].(bool)
+	return v, ok
+}
+
+func (f thriftFields) string(id int16) string {
+	v, _ := f[id].([]byte)
+	return string(v)
+}
+
+func (f thriftFields) structure(id int16) thriftFields {
+	v, _ := f[id].(thriftFields)
+	return v
+}
+
+func (f thriftFields) list(id int16) []interface{} {
+	v, _ := f[id].([]interface{})
+	return v
+}
+
+// thriftReader 从字节流中解码 Thrift compact 结构体
+// 长度和元素个数按剩余字节数检查，避免声明的长度导致大量分配
+type thriftReader struct {
+	r *bytes.Reader
+}
+
+func (tr *thriftReader) varint() (uint64, error) {
+	return binary.ReadUvarint(tr.r)
+}
+
+func (tr *thriftReader) zigzag() (int64, error) {
+	v, err := tr.varint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (tr *thriftReader) readStruct(depth int) (thriftFields, error) {
+	if depth > thriftMaxDepth {
+		return nil, errors.New("thrift: nesting too deep")
+	}
+	fields := make(thriftFields)
+	var lastID int16
+	for {
+		header, err := tr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		fieldType := header & 0x0f
+		if fieldType == thriftStop {
+			return fields, nil
+		}
+		if delta := header >> 4; delta != 0 {
+			lastID += int16(delta)
+		} else {
+			id, err := tr.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			lastID = int16(id)
+		}
+		value, err := tr.readValue(fieldType, depth)
+		if err != nil {
+			return nil, err
+		}
+		fields[lastID] = value
+	}
+}
+
+func (tr *thriftReader) readValue(fieldType byte, depth int) (interface{}, error) {
+	switch fieldType {
+	case thriftTrue:
+		return true, nil
+	case thriftFalse:
+		return false, nil
+	case thriftByte:
+		b, err := tr.r.ReadByte()
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return tr.zigzag()
+	case thriftDouble:
+		var buf [8]byte
+		if _, err := io.ReadFull(tr.r, buf[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(buf[:])), nil
+	case thriftBinary:
+		n, err := tr.varint()
+		if err != nil {
+			return nil, err
+		}
+		if n > thriftMaxLength || n > uint64(tr.r.Len()) {
+			return nil, errors.New("thrift: binary too long")
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(tr.r, buf)
+		return buf, err
+	case thriftList, thriftSet:
+		header, err := tr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = tr.varint(); err != nil {
+				return nil, err
+			}
+		}
+		// 每个元素至少占一个字节
+		if size > thriftMaxLength || size > uint64(tr.r.Len()) {
+			return nil, errors.New("thrift: list too long")
+		}
+		elemType := header & 0x0f
+		list := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			var value interface{}
+			if elemType == thriftTrue || elemType == thriftFalse {
+				// 列表中的布尔值每个占一个字节
+				b, err := tr.r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				value = b == thriftTrue
+			} else if value, err = tr.readValue(elemType, depth+1); err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case thriftMap:
+		size, err := tr.varint()
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		if size > thriftMaxLength || size > uint64(tr.r.Len()) {
+			return nil, errors.New("thrift: map too long")
+		}
+		types, err := tr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		// Parquet 元数据中不使用 map，读出后丢弃
+		for i := uint64(0); i < size; i++ {
+			if _, err := tr.readValue(types>>4, depth+1); err != nil {
+				return nil, err
+			}
+			if _, err := tr.readValue(types&0x0f, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case thriftStruct:
+		return tr.readStruct(depth + 1)
+	}
+	return nil, fmt.Errorf("thrift: unknown type %d", fieldType)
+}
+
+// ---- 文件结构 ----
+
+// parquetColumn 一个叶子列的 schema
+type parquetColumn struct {
+	Name       string
+	Type       int
+	TypeLength int
+	Optional   bool
+	Converted  int // -1 表示未标注
+	Scale      int
+	TimeUnit   time.Duration // 时间戳列的单位，非时间戳列为 0
+}
+
+// parquetChunk 行组中一列的数据位置
+type parquetChunk struct {
+	codec  int
+	offset int64
+	size   int64
+}
+
+// parquetRowGroup 一个行组
+type parquetRowGroup struct {
+	numRows int64
+	chunks  []parquetChunk // 与 parquetFile.columns 一一对应
+}
+
+// parquetFile 只读打开的 Parquet 文件
+type parquetFile struct {
+	r         io.ReaderAt
+	columns   []parquetColumn
+	rowGroups []parquetRowGroup
+	numRows   int64
+}
+
+// openParquet 读取文件尾部的元数据
+func openParquet(r io.ReaderAt, size int64) (*parquetFile, error) {
+	if size < 12 {
+		return nil, errors.New("parquet: file too small")
+	}
+	var tail [8]byte
+	if _, err := r.ReadAt(tail[:], size-8); err != nil {
+		return nil, fmt.Errorf("parquet: %w", err)
+	}
+	if !bytes.Equal(tail[4:], parquetMagic) {
+		return nil, errors.New("parquet: missing PAR1 footer (not a parquet file)")
+	}
+	metaLength := int64(binary.LittleEndian.Uint32(tail[:4]))
+	if metaLength <= 0 || metaLength > size-12 {
+		return nil, errors.New("parquet: invalid footer length")
+	}
+	metaBytes := make([]byte, metaLength)
+	if _, err := r.ReadAt(metaBytes, size-8-metaLength); err != nil {
+		return nil, fmt.Errorf("parquet: %w", err)
+	}
+	tr := &thriftReader{r: bytes.NewReader(metaBytes)}
+	meta, err := tr.readStruct(0)
+	if err != nil {
+		return nil, fmt.Errorf("parquet: invalid file metadata: %w", err)
+	}
+
+	file := &parquetFile{r: r, numRows: meta.int(3)}
+
+	// FileMetaData.schema：第一个元素为根，其余为列（扁平 schema 中均为叶子）
+	schema := meta.list(2)
+	if len(schema) == 0 {
+		return nil, errors.New("parquet: empty schema")
+	}
+	for _, item := range schema[1:] {
+		element, _ := item.(thriftFields)
+		if element == nil {
+			return nil, errors.New("parquet: invalid schema element")
+		}
+		if element.int(5) > 0 || !element.has(1) {
+			return nil, fmt.Errorf("parquet: nested column %q is not supported", element.string(4))
+		}
+		repetition := element.int(3)
+		if repetition == 2 {
+			return nil, fmt.Errorf("parquet: repeated column %q is not supported", element.string(4))
+		}
+		column := parquetColumn{
+			Name:       element.string(4),
+			Type:       int(element.int(1)),
+			TypeLength: int(element.int(2)),
+			Optional:   repetition == 1,
+			Converted:  -1,
+			Scale:      int(element.int(7)),
+		}
+		if element.has(6) {
+			column.Converted = int(element.int(6))
+		}
+		switch column.Converted {
+		case parquetConvertedTimestampMillis:
+			column.TimeUnit = time.Millisecond
+		case parquetConvertedTimestampMicros:
+			column.TimeUnit = time.Microsecond
+		}
+		// LogicalType.TIMESTAMP（8）中的 unit：1 MILLIS / 2 MICROS / 3 NANOS
+		if timestamp := element.structure(10).structure(8); timestamp != nil {
+			unit := timestamp.structure(2)
+			switch {
+			case unit.has(1):
+				column.TimeUnit = time.Millisecond
+			case unit.has(2):
+				column.TimeUnit = time.Microsecond
+			case unit.has(3):
+				column.TimeUnit = time.Nanosecond
+			}
+		}
+		if logical := element.structure(10); logical != nil && logical.has(5) {
+			column.Converted = parquetConvertedDecimal
+			column.Scale = int(logical.structure(5).int(1))
+		}
+		if column.Type == parquetInt96 {
+			column.TimeUnit = time.Nanosecond
+		}
+		for _, existing := range file.columns {
+			if existing.Name == column.Name {
+				return nil, fmt.Errorf("parquet: duplicate column %q", column.Name)
+			}
+		}
+		file.columns = append(file.columns, column)
+	}
+
+	for _, item := range meta.list(4) {
+		group, _ := item.(thriftFields)
+		chunks := group.list(1)
+		if len(chunks) != len(file.columns) {
+			return nil, errors.New("parquet: row group does not match schema")
+		}
+		rowGroup := parquetRowGroup{numRows: group.int(3)}
+		if rowGroup.numRows < 0 || rowGroup.numRows > parquetMaxRowGroupRows {
+			return nil, fmt.Errorf("parquet: row group of %d rows is not supported (at most %d)", rowGroup.numRows, parquetMaxRowGroupRows)
+		}
+		for i, c := range chunks {
+			chunk, _ := c.(thriftFields)
+			if chunk.string(1) != "" {
+				return nil, errors.New("parquet: external column chunks are not supported")
+			}
+			columnMeta := chunk.structure(3)
+			if columnMeta == nil {
+				return nil, errors.New("parquet: missing column metadata")
+			}
+			offset := columnMeta.int(9)
+			if columnMeta.has(11) && columnMeta.int(11) > 0 && columnMeta.int(11) < offset {
+				offset = columnMeta.int(11)
+			}
+			chunkSize := columnMeta.int(7)
+			if offset < 0 || chunkSize < 0 || offset+chunkSize > size {
+				return nil, fmt.Errorf("parquet: column chunk of %q out of range", file.columns[i].Name)
+			}
+			rowGroup.chunks = append(rowGroup.chunks, parquetChunk{
+				codec:  int(columnMeta.int(4)),
+				offset: offset,
+				size:   chunkSize,
+			})
+		}
+		file.rowGroups = append(file.rowGroups, rowGroup)
+	}
+	return file, nil
+}
+
+// Columns 列名
+func (f *parquetFile) Columns() []string {
+	names := make([]string, len(f.columns))
+	for i, column := range f.columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// ReadRowGroup 读取一个行组中指定列的全部值（不在 columns 中的列为 nil）
+// 值为 nil（空值）、bool、int64、float64、string 或 time.Time
+func (f *parquetFile) ReadRowGroup(index int, columns []int) ([][]interface{}, error) {
+	group := f.rowGroups[index]
+	values := make([][]interface{}, len(f.columns))
+	for _, i := range columns {
+		column, err := f.readChunk(&f.columns[i], group.chunks[i], group.numRows)
+		if err != nil {
+			return nil, fmt.Errorf("parquet: column %q in row group %d: %w", f.columns[i].Name, index, err)
+		}
+		values[i] = column
+	}
+	return values, nil
+}
+
+// readChunk 解码一个列块
+func (f *parquetFile) readChunk(column *parquetColumn, chunk parquetChunk, numRows int64) ([]interface{}, error) {
+	if chunk.size > parquetMaxPageSize*4 {
+		return nil, errors.New("column chunk too large")
+	}
+	if numRows < 0 || numRows > parquetMaxRowGroupRows {
+		return nil, fmt.Errorf("invalid row count %d", numRows)
+	}
+	raw := make([]byte, chunk.size)
+	if _, err := f.r.ReadAt(raw, chunk.offset); err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(raw)
+	tr := &thriftReader{r: reader}
+
+	// 行数来自元数据，预分配不超过列块字节数
+	var dictionary []interface{}
+	values := make([]interface{}, 0, minInt64(numRows, chunk.size))
+	for int64(len(values)) < numRows && reader.Len() > 0 {
+		header, err := tr.readStruct(0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid page header: %w", err)
+		}
+		compressedSize := header.int(3)
+		uncompressedSize := header.int(2)
+		if compressedSize < 0 || compressedSize > int64(reader.Len()) || uncompressedSize < 0 || uncompressedSize > parquetMaxPageSize {
+			return nil, errors.New("invalid page size")
+		}
+		start := len(raw) - reader.Len()
+		page := raw[start : start+int(compressedSize)]
+		reader.Seek(compressedSize, io.SeekCurrent)
+
+		switch header.int(1) {
+		case parquetDictionaryPage:
+			data, err := parquetDecompress(chunk.codec, page, uncompressedSize)
+			if err != nil {
+				return nil, err
+			}
+			dictHeader := header.structure(7)
+			dictionary, err = decodePlainValues(column, data, int(dictHeader.int(1)))
+			if err != nil {
+				return nil, fmt.Errorf("dictionary page: %w", err)
+			}
+		case parquetDataPage:
+			data, err := parquetDecompress(chunk.codec, page, uncompressedSize)
+			if err != nil {
+				return nil, err
+			}
+			pageHeader := header.structure(5)
+			numValues, err := pageValueCount(pageHeader.int(1), numRows-int64(len(values)))
+			if err != nil {
+				return nil, err
+			}
+			var defined []bool
+			if column.Optional {
+				// v1 数据页的定义级别带 4 字节长度前缀
+				if len(data) < 4 {
+					return nil, errors.New("truncated definition levels")
+				}
+				length := int(binary.LittleEndian.Uint32(data))
+				if length > len(data)-4 {
+					return nil, errors.New("truncated definition levels")
+				}
+				if defined, err = decodeDefinitionLevels(data[4:4+length], numValues); err != nil {
+					return nil, err
+				}
+				data = data[4+length:]
+			}
+			if values, err = appendPageValues(values, column, dictionary, int(pageHeader.int(2)), data, numValues, defined); err != nil {
+				return nil, err
+			}
+		case parquetDataPageV2:
+			pageHeader := header.structure(8)
+			numValues, err := pageValueCount(pageHeader.int(1), numRows-int64(len(values)))
+			if err != nil {
+				return nil, err
+			}
+			defLength := pageHeader.int(5)
+			repLength := pageHeader.int(6)
+			if defLength < 0 || repLength < 0 || defLength+repLength > int64(len(page)) {
+				return nil, errors.New("invalid level lengths")
+			}
+			var defined []bool
+			if column.Optional {
+				if defined, err = decodeDefinitionLevels(page[repLength:repLength+defLength], numValues); err != nil {
+					return nil, err
+				}
+			}
+			data := page[repLength+defLength:]
+			if compressed, ok := pageHeader.bool(7); !ok || compressed {
+				if data, err = parquetDecompress(chunk.codec, data, uncompressedSize); err != nil {
+					return nil, err
+				}
+			}
+			if values, err = appendPageValues(values, column, dictionary, int(pageHeader.int(4)), data, numValues, defined); err != nil {
+				return nil, err
+			}
+		default:
+			// 索引页等跳过
+		}
+	}
+	if int64(len(values)) != numRows {
+		return nil, fmt.Errorf("expected %d values, got %d", numRows, len(values))
+	}
+	return values, nil
+}
+
+// pageValueCount 校验页头中的值个数：不能为负，也不能超过行组中剩余的行数
+func pageValueCount(numValues, remaining int64) (int, error) {
+	if numValues < 0 || numValues > remaining {
+		return 0, fmt.Errorf("page declares %d values, %d rows remaining in row group", numValues, remaining)
+	}
+	return int(numValues), nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parquetDecompress 解压页数据
+func parquetDecompress(codec int, data []byte, uncompressedSize int64) ([]byte, error) {
+	switch codec {
+	case parquetCodecUncompressed:
+		return data, nil
+	case parquetCodecSnappy:
+		// snappy 的压缩比不超过 32 倍，声明的解压长度超出时不按其分配
+		n, err := snappy.DecodedLen(data)
+		if err != nil || int64(n) > parquetMaxPageSize || n > len(data)*32 {
+			return nil, errors.New("invalid snappy page")
+		}
+		return snappy.Decode(nil, data)
+	case parquetCodecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return io.ReadAll(io.LimitReader(gr, parquetMaxPageSize))
+	case parquetCodecZstd:
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(parquetMaxPageSize))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(data, make([]byte, 0, minInt64(uncompressedSize, int64(len(data))*8)))
+	}
+	return nil, fmt.Errorf("unsupported compression codec %d (supported: uncompressed, snappy, gzip, zstd)", codec)
+}
+
+// decodeDefinitionLevels 解码扁平可选列的定义级别（位宽 1），返回每个值是否非空
+func decodeDefinitionLevels(data []byte, numValues int) ([]bool, error) {
+	levels, err := decodeRLEHybrid(data, 1, numValues)
+	if err != nil {
+		return nil, fmt.Errorf("definition levels: %w", err)
+	}
+	defined := make([]bool, numValues)
+	for i, level := range levels {
+		defined[i] = level == 1
+	}
+	return defined, nil
+}
+
+// appendPageValues 解码数据页中的值，按定义级别补齐空值后追加到 values
+func appendPageValues(values []interface{}, column *parquetColumn, dictionary []interface{}, encoding int, data []byte, numValues int, defined []bool) ([]interface{}, error) {
+	present := numValues
+	if defined != nil {
+		present = 0
+		for _, d := range defined {
+			if d {
+				present++
+			}
+		}
+	}
+
+	var decoded []interface{}
+	var err error
+	switch encoding {
+	case parquetEncodingPlain:
+		decoded, err = decodePlainValues(column, data, present)
+	case parquetEncodingPlainDictionary, parquetEncodingRLEDictionary:
+		if dictionary == nil {
+			return nil, errors.New("dictionary encoded page without dictionary")
+		}
+		if len(data) == 0 {
+			if present > 0 {
+				return nil, errors.New("truncated dictionary indices")
+			}
+			break
+		}
+		var indices []uint64
+		if indices, err = decodeRLEHybrid(data[1:], int(data[0]), present); err != nil {
+			return nil, err
+		}
+		decoded = make([]interface{}, present)
+		for i, index := range indices {
+			if index >= uint64(len(dictionary)) {
+				return nil, errors.New("dictionary index out of range")
+			}
+			decoded[i] = dictionary[index]
+		}
+	case parquetEncodingRLE:
+		if column.Type != parquetBoolean || len(data) < 4 {
+			return nil, errors.New("unsupported RLE encoded values")
+		}
+		var bits []uint64
+		if bits, err = decodeRLEHybrid(data[4:], 1, present); err != nil {
+			return nil, err
+		}
+		decoded = make([]interface{}, present)
+		for i, bit := range bits {
+			decoded[i] = bit == 1
+		}
+	case parquetEncodingDeltaBinaryPacked:
+		var ints []int64
+		if ints, _, err = decodeDeltaBinaryPacked(data, present); err != nil {
+			return nil, err
+		}
+		decoded = make([]interface{}, present)
+		for i, v := range ints {
+			decoded[i] = convertParquetInt(column, v)
+		}
+	case parquetEncodingDeltaLengthByteArray, parquetEncodingDeltaByteArray:
+		var arrays [][]byte
+		if encoding == parquetEncodingDeltaLengthByteArray {
+			arrays, _, err = decodeDeltaLengthByteArray(data, present)
+		} else {
+			arrays, err = decodeDeltaByteArray(data, present)
+		}
+		if err != nil {
+			return nil, err
+		}
+		decoded = make([]interface{}, present)
+		for i, v := range arrays {
+			decoded[i] = convertParquetBytes(column, v)
+		}
+	case parquetEncodingByteStreamSplit:
+		decoded, err = decodeByteStreamSplit(column, data, present)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %d", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != present {
+		return nil, errors.New("page value count mismatch")
+	}
+
+	if defined == nil {
+		return append(values, decoded...), nil
+	}
+	next := 0
+	for _, d := range defined {
+		if d {
+			values = append(values, decoded[next])
+			next++
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return values, nil
+}
+
+// decodePlainValues 解码 PLAIN 编码的 n 个值
+func decodePlainValues(column *parquetColumn, data []byte, n int) ([]interface{}, error) {
+	truncated := errors.New("truncated plain values")
+	// 每个值至少占 1 位，先按数据长度检查再分配
+	if n < 0 || n/8 > len(data) {
+		return nil, truncated
+	}
+	values := make([]interface{}, 0, n)
+	switch column.Type {
+	case parquetBoolean:
+		if len(data)*8 < n {
+			return nil, truncated
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, data[i/8]>>(uint(i)%8)&1 == 1)
+		}
+	case parquetInt32:
+		if len(data) < n*4 {
+			return nil, truncated
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, convertParquetInt(column, int64(int32(binary.LittleEndian.Uint32(data[i*4:])))))
+		}
+	case parquetInt64:
+		if len(data) < n*8 {
+			return nil, truncated
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, convertParquetInt(column, int64(binary.LittleEndian.Uint64(data[i*8:]))))
+		}
+	case parquetInt96:
+		if len(data) < n*12 {
+			return nil, truncated
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, parquetInt96Time(data[i*12:]))
+		}
+	case parquetFloat:
+		if len(data) < n*4 {
+			return nil, truncated
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, float64(math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))))
+		}
+	case parquetDouble:
+		if len(data) < n*8 {
+			return nil, truncated
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:])))
+		}
+	case parquetByteArray:
+		for i := 0; i < n; i++ {
+			if len(data) < 4 {
+				return nil, truncated
+			}
+			length := int(binary.LittleEndian.Uint32(data))
+			if length > len(data)-4 {
+				return nil, truncated
+			}
+			values = append(values, convertParquetBytes(column, data[4:4+length]))
+			data = data[4+length:]
+		}
+	case parquetFixedLenByteArray:
+		size := column.TypeLength
+		if size <= 0 || len(data) < n*size {
+			return nil, truncated
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, convertParquetBytes(column, data[i*size:(i+1)*size]))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported physical type %d", column.Type)
+	}
+	return values, nil
+}
+
+// convertParquetInt 按逻辑类型转换整数：时间戳、日期、小数
+func convertParquetInt(column *parquetColumn, v int64) interface{} {
+	switch {
+	case column.TimeUnit > 0:
+		return time.Unix(0, 0).Add(time.Duration(v) * column.TimeUnit).UTC()
+	case column.Converted == parquetConvertedDate:
+		return time.Unix(v*86400, 0).UTC()
+	case column.Converted == parquetConvertedDecimal:
+		return float64(v) / math.Pow10(column.Scale)
+	}
+	return v
+}
+
+// convertParquetBytes 字节数组转换为字符串，小数按大端补码还原
+func convertParquetBytes(column *parquetColumn, v []byte) interface{} {
+	if column.Converted == parquetConvertedDecimal && len(v) <= 8 {
+		var unscaled int64
+		for _, b := range v {
+			unscaled = unscaled<<8 | int64(b)
+		}
+		if len(v) > 0 && len(v) < 8 && v[0]&0x80 != 0 {
+			unscaled -= 1 << (uint(len(v)) * 8)
+		}
+		return float64(unscaled) / math.Pow10(column.Scale)
+	}
+	return string(v)
+}
+
+// parquetInt96Time INT96 时间戳：前 8 字节为当天纳秒数，后 4 字节为儒略日
+func parquetInt96Time(b []byte) time.Time {
+	nanos := int64(binary.LittleEndian.Uint64(b))
+	julianDay := int64(binary.LittleEndian.Uint32(b[8:]))
+	const unixEpochJulianDay = 2440588
+	return time.Unix((julianDay-unixEpochJulianDay)*86400, nanos).UTC()
+}
+
+// decodeRLEHybrid 解码 RLE / bit-packed 混合编码的 n 个值
+// n 由调用方按行组剩余行数限制；RLE 段可以用几个字节表示任意多的值，预分配不超过数据位数
+func decodeRLEHybrid(data []byte, bitWidth int, n int) ([]uint64, error) {
+	if bitWidth < 0 || bitWidth > 64 {
+		return nil, errors.New("invalid bit width")
+	}
+	if n < 0 {
+		return nil, errors.New("invalid value count")
+	}
+	values := make([]uint64, 0, minInt64(int64(n), int64(len(data))*8))
+	reader := bytes.NewReader(data)
+	byteWidth := (bitWidth + 7) / 8
+	for len(values) < n {
+		header, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, errors.New("truncated RLE data")
+		}
+		if header&1 == 0 {
+			// RLE：重复 count 次（最多取到 n 个）
+			count := int(minInt64(int64(header>>1), int64(n-len(values))))
+			var value uint64
+			for i := 0; i < byteWidth; i++ {
+				b, err := reader.ReadByte()
+				if err != nil {
+					return nil, errors.New("truncated RLE data")
+				}
+				value |= uint64(b) << (8 * uint(i))
+			}
+			for i := 0; i < count && len(values) < n; i++ {
+				values = append(values, value)
+			}
+			continue
+		}
+		// bit-packed：groups × 8 个值，低位在前，占 groups × bitWidth 字节
+		groups := header >> 1
+		if bitWidth > 0 && groups > uint64(reader.Len())/uint64(bitWidth) {
+			return nil, errors.New("truncated bit-packed data")
+		}
+		start := len(data) - reader.Len()
+		packed := data[start : start+int(groups)*bitWidth]
+		reader.Seek(int64(len(packed)), io.SeekCurrent)
+		count := n - len(values)
+		if groups < uint64(count) && int(groups)*8 < count {
+			count = int(groups) * 8
+		}
+		for i := 0; i < count; i++ {
+			values = append(values, unpackBits(packed, i*bitWidth, bitWidth))
+		}
+	}
+	return values, nil
+}
+
+// unpackBits 从低位在前的位流中取出 offset 处 width 位的值
+func unpackBits(data []byte, offset, width int) uint64 {
+	var value uint64
+	for i := 0; i < width; i++ {
+		bit := offset + i
+		if data[bit/8]>>(uint(bit)%8)&1 == 1 {
+			value |= 1 << uint(i)
+		}
+	}
+	return value
+}
+
+// decodeDeltaBinaryPacked 解码 DELTA_BINARY_PACKED，返回值和消耗的字节数
+// 头部的块大小、miniblock 个数和值个数都来自数据，分配前按剩余字节数和 n 检查
+func decodeDeltaBinaryPacked(data []byte, n int) ([]int64, int, error) {
+	reader := bytes.NewReader(data)
+	truncated := errors.New("truncated delta data")
+	blockSize, err1 := binary.ReadUvarint(reader)
+	miniBlocks, err2 := binary.ReadUvarint(reader)
+	total, err3 := binary.ReadUvarint(reader)
+	first, err4 := binary.ReadVarint(reader)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return nil, 0, truncated
+	}
+	// 每个 miniblock 的位宽占一个字节；miniblock 中的值个数为 8 的倍数，位打包按字节对齐
+	if blockSize == 0 || blockSize > math.MaxInt32 || miniBlocks == 0 || miniBlocks > uint64(reader.Len()) ||
+		blockSize%miniBlocks != 0 || (blockSize/miniBlocks)%8 != 0 {
+		return nil, 0, errors.New("invalid delta header")
+	}
+	if total < uint64(n) {
+		return nil, 0, errors.New("delta data has fewer values than expected")
+	}
+	if total > uint64(n) {
+		return nil, 0, errors.New("delta data has more values than expected")
+	}
+	perMiniBlock := int(blockSize / miniBlocks)
+
+	values := make([]int64, 0, n)
+	if n > 0 {
+		values = append(values, first)
+	}
+	last := first
+	for len(values) < n {
+		minDelta, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, 0, truncated
+		}
+		if uint64(reader.Len()) < miniBlocks {
+			return nil, 0, truncated
+		}
+		widths := make([]byte, miniBlocks)
+		reader.Read(widths)
+		for _, width := range widths {
+			if len(values) >= n {
+				break // 剩余的 miniblock 不存在
+			}
+			if width > 64 {
+				return nil, 0, errors.New("invalid delta bit width")
+			}
+			size := perMiniBlock * int(width) / 8
+			if size > reader.Len() {
+				return nil, 0, truncated
+			}
+			start := len(data) - reader.Len()
+			packed := data[start : start+size]
+			reader.Seek(int64(size), io.SeekCurrent)
+			for i := 0; i < perMiniBlock && len(values) < n; i++ {
+				last += minDelta + int64(unpackBits(packed, i*int(width), int(width)))
+				values = append(values, last)
+			}
+		}
+	}
+	return values, len(data) - reader.Len(), nil
+}
+
+// decodeDeltaLengthByteArray 解码 DELTA_LENGTH_BYTE_ARRAY，返回值和消耗的字节数
+func decodeDeltaLengthByteArray(data []byte, n int) ([][]byte, int, error) {
+	lengths, used, err := decodeDeltaBinaryPacked(data, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	values := make([][]byte, n)
+	for i, length := range lengths {
+		if length < 0 || int64(len(data)-used) < length {
+			return nil, 0, errors.New("truncated byte array data")
+		}
+		values[i] = data[used : used+int(length)]
+		used += int(length)
+	}
+	return values, used, nil
+}
+
+// decodeDeltaByteArray 解码 DELTA_BYTE_ARRAY（前缀长度 + 后缀）
+func decodeDeltaByteArray(data []byte, n int) ([][]byte, error) {
+	prefixes, used, err := decodeDeltaBinaryPacked(data, n)
+	if err != nil {
+		return nil, err
+	}
+	suffixes, _, err := decodeDeltaLengthByteArray(data[used:], n)
+	if err != nil {
+		return nil, err
+	}
+	// 每个值都复制前缀，解码后的总长度可以远大于页数据，按页大小上限限制
+	values := make([][]byte, n)
+	var previous []byte
+	var total int64
+	for i := range values {
+		prefix := prefixes[i]
+		if prefix < 0 || prefix > int64(len(previous)) {
+			return nil, errors.New("invalid delta byte array prefix")
+		}
+		if total += prefix + int64(len(suffixes[i])); total > parquetMaxPageSize {
+			return nil, errors.New("delta byte array values too large")
+		}
+		value := make([]byte, 0, int(prefix)+len(suffixes[i]))
+		value = append(append(value, previous[:prefix]...), suffixes[i]...)
+		values[i] = value
+		previous = value
+	}
+	return values, nil
+}
+
+// decodeByteStreamSplit 解码 BYTE_STREAM_SPLIT（各值的第 k 个字节连续存放）
+func decodeByteStreamSplit(column *parquetColumn, data []byte, n int) ([]interface{}, error) {
+	width := 0
+	switch column.Type {
+	case parquetFloat, parquetInt32:
+		width = 4
+	case parquetDouble, parquetInt64:
+		width = 8
+	default:
+		return nil, errors.New("unsupported byte stream split type")
+	}
+	if len(data) < n*width {
+		return nil, errors.New("truncated byte stream split data")
+	}
+	plain := make([]byte, n*width)
+	for i := 0; i < n; i++ {
+		for k := 0; k < width; k++ {
+			plain[i*width+k] = data[k*n+i]
+		}
+	}
+	return decodePlainValues(column, plain, n)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// parquetTestColumns 与导出格式相同的列：时间戳、字典编码的字符串、double、int32、可空字符串
+func parquetTestColumns() []parquetWriterColumn {
+	return []parquetWriterColumn{
+		{Name: "timestamp", Type: parquetInt64, Converted: parquetConvertedTimestampMillis},
+		{Name: "device_id", Type: parquetByteArray, Converted: parquetConvertedUTF8, Dictionary: true},
+		{Name: "value", Type: parquetDouble, Converted: -1},
+		{Name: "priority", Type: parquetInt32, Converted: -1},
+		{Name: "data", Type: parquetByteArray, Converted: parquetConvertedUTF8, Optional: true},
+	}
+}
+
+// writeParquetTestFile 写出 rows 行测试数据，返回文件内容和写入的值（按读取时的类型）
+func writeParquetTestFile(t testing.TB, rows int) ([]byte, [][]interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	pw, err := newParquetWriter(&buf, parquetTestColumns())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var expected [][]interface{}
+	for i := 0; i < rows; i++ {
+		timestamp := start.Add(time.Duration(i) * time.Second)
+		deviceID := fmt.Sprintf("factory_001_device_%03d", i%7)
+		value := float64(i) * 0.5
+		priority := i%3 + 1
+		var data interface{}
+		if i%4 != 0 {
+			data = fmt.Sprintf("payload-%d", i)
+		}
+		if err := pw.WriteRow(timestamp, deviceID, value, priority, data); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, []interface{}{timestamp, deviceID, value, int64(priority), data})
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), expected
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	// 超过一个行组的行数，覆盖多行组
+	rows := parquetRowGroupRows + 100
+	content, expected := writeParquetTestFile(t, rows)
+
+	file, err := openParquet(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := file.Columns(), []string{"timestamp", "device_id", "value", "priority", "data"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Columns() = %v, want %v", got, want)
+	}
+	if file.numRows != int64(rows) || len(file.rowGroups) != 2 {
+		t.Fatalf("numRows = %d, row groups = %d", file.numRows, len(file.rowGroups))
+	}
+
+	all := []int{0, 1, 2, 3, 4}
+	row := 0
+	for g := range file.rowGroups {
+		columns, err := file.ReadRowGroup(g, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range columns[0] {
+			for c := range all {
+				got, want := columns[c][i], expected[row][c]
+				if wantTime, ok := want.(time.Time); ok {
+					if gotTime, ok := got.(time.Time); !ok || !gotTime.Equal(wantTime) {
+						t.Fatalf("row %d column %d = %v, want %v", row, c, got, want)
+					}
+					continue
+				}
+				if got != want {
+					t.Fatalf("row %d column %d = %#v, want %#v", row, c, got, want)
+				}
+			}
+			row++
+		}
+	}
+	if row != rows {
+		t.Fatalf("read %d rows, want %d", row, rows)
+	}
+}
+
+func TestDecodeRLEHybrid(t *testing.T) {
+	// RLE 段：5 个 3；bit-packed 段：1 组 8 个值 0..7（位宽 3）
+	data := []byte{5 << 1, 3, 1<<1 | 1, 0x88, 0xc6, 0xfa}
+	got, err := decodeRLEHybrid(data, 3, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{3, 3, 3, 3, 3, 0, 1, 2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("decodeRLEHybrid = %v, want %v", got, want)
+	}
+
+	// 段头声明的长度超出数据时返回错误，不按声明的长度分配
+	huge := binary.AppendUvarint(nil, 1<<62|1)
+	if _, err := decodeRLEHybrid(huge, 8, 10); err == nil {
+		t.Fatal("expected error for bit-packed run longer than the data")
+	}
+	if _, err := decodeRLEHybrid(data, 3, -1); err == nil {
+		t.Fatal("expected error for negative count")
+	}
+	// RLE 段的重复次数只取到需要的个数
+	run := append(binary.AppendUvarint(nil, 1<<62), 1)
+	if got, err := decodeRLEHybrid(run, 1, 4); err != nil || len(got) != 4 {
+		t.Fatalf("decodeRLEHybrid = %v, %v", got, err)
+	}
+}
+
+func TestDecodeDeltaBinaryPacked(t *testing.T) {
+	// 块大小 128、4 个 miniblock、5 个值，差值均为 1（位宽 0）
+	data := []byte{0x80, 0x01, 4, 5, 2, 2, 0, 0, 0, 0}
+	got, used, err := decodeDeltaBinaryPacked(data, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) || used != len(data) {
+		t.Fatalf("decodeDeltaBinaryPacked = %v, %d", got, used)
+	}
+
+	// 7 5 3 1 2 3 4 5：最小差值 -2，调整后的差值 0 0 0 3 3 3 3，位宽 2
+	data = []byte{0x80, 0x01, 4, 8, 14, 3, 2, 0, 0, 0, 0xc0, 0x3f, 0, 0, 0, 0, 0, 0}
+	got, used, err = decodeDeltaBinaryPacked(data, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{7, 5, 3, 1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) || used != len(data) {
+		t.Fatalf("decodeDeltaBinaryPacked = %v, %d", got, used)
+	}
+
+	invalid := map[string][]byte{
+		"miniblock count beyond data": {0x80, 0x01, 0xff, 0xff, 0xff, 0xff, 0x0f, 5, 2},
+		"huge block size":             append(binary.AppendUvarint(nil, 1<<40), 4, 5, 2),
+		"more values than expected":   {0x80, 0x01, 4, 6, 2, 2, 0, 0, 0, 0},
+		"fewer values than expected":  {0x80, 0x01, 4, 4, 2, 2, 0, 0, 0, 0},
+		"packed data truncated":       {0x80, 0x01, 4, 5, 2, 2, 64, 0, 0, 0},
+	}
+	for name, data := range invalid {
+		if _, _, err := decodeDeltaBinaryPacked(data, 5); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// craftedParquetChunk 由页头字段和页数据组成一个未压缩的列块
+func craftedParquetChunk(pageType int32, page []byte, fill func(tw *thriftWriter)) (*parquetFile, parquetChunk) {
+	tw := newThriftWriter()
+	tw.i32(1, pageType)
+	tw.i32(2, int32(len(page)))
+	tw.i32(3, int32(len(page)))
+	fill(tw)
+	tw.buf = append(tw.buf, thriftStop)
+	raw := append(tw.buf, page...)
+	return &parquetFile{r: bytes.NewReader(raw)}, parquetChunk{codec: parquetCodecUncompressed, size: int64(len(raw))}
+}
+
+func TestParquetReadChunkRejectsCraftedCounts(t *testing.T) {
+	column := &parquetColumn{Name: "value", Type: parquetInt64, Converted: -1}
+	optional := &parquetColumn{Name: "data", Type: parquetByteArray, Converted: -1, Optional: true}
+	dataPage := func(numValues int32) func(tw *thriftWriter) {
+		return func(tw *thriftWriter) {
+			tw.beginStruct(5)
+			tw.i32(1, numValues)
+			tw.i32(2, parquetEncodingPlain)
+			tw.endStruct()
+		}
+	}
+
+	tests := []struct {
+		name     string
+		column   *parquetColumn
+		numRows  int64
+		pageType int32
+		page     []byte
+		fill     func(tw *thriftWriter)
+	}{
+		{"huge row count", column, 1 << 40, parquetDataPage, make([]byte, 8), dataPage(1)},
+		{"negative row count", column, -1, parquetDataPage, make([]byte, 8), dataPage(1)},
+		{"negative page values", optional, 1, parquetDataPage, []byte{0, 0, 0, 0}, dataPage(-1)},
+		{"page values beyond row group", column, 1, parquetDataPage, make([]byte, 16), dataPage(2)},
+		{"dictionary larger than page", column, 1, parquetDictionaryPage, make([]byte, 8), func(tw *thriftWriter) {
+			tw.beginStruct(7)
+			tw.i32(1, 1<<30)
+			tw.endStruct()
+		}},
+		{"v2 negative page values", optional, 1, parquetDataPageV2, nil, func(tw *thriftWriter) {
+			tw.beginStruct(8)
+			tw.i32(1, -5)
+			tw.endStruct()
+		}},
+	}
+	for _, tt := range tests {
+		file, chunk := craftedParquetChunk(tt.pageType, tt.page, tt.fill)
+		if _, err := file.readChunk(tt.column, chunk, tt.numRows); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestThriftRejectsLengthsBeyondData(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"binary": {thriftBinary<<0 | 1<<4, 0xff, 0xff, 0xff, 0x1f},
+		"list":   {thriftList | 1<<4, 0xf5, 0xff, 0xff, 0xff, 0x1f},
+	} {
+		tr := &thriftReader{r: bytes.NewReader(data)}
+		if _, err := tr.readStruct(0); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// FuzzParquetReader 任意输入都只能返回错误，不能 panic 或按文件中声明的长度大量分配
+func FuzzParquetReader(f *testing.F) {
+	content, _ := writeParquetTestFile(f, 50)
+	f.Add(content)
+	f.Add(content[:len(content)/2])
+	f.Fuzz(func(t *testing.T, content []byte) {
+		file, err := openParquet(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return
+		}
+		columns := make([]int, len(file.columns))
+		for i := range columns {
+			columns[i] = i
+		}
+		for g := range file.rowGroups {
+			file.ReadRowGroup(g, columns)
+		}
+	})
+}
+
+// FuzzParquetDecoders 页数据解码器的模糊测试
+func FuzzParquetDecoders(f *testing.F) {
+	f.Add([]byte{5 << 1, 3, 1<<1 | 1, 0x88, 0xc6, 0xfa}, byte(3), uint16(13))
+	f.Add([]byte{0x80, 0x01, 4, 8, 14, 3, 2, 0, 0, 0, 0xc0, 0x3f, 0, 0, 0, 0, 0, 0}, byte(2), uint16(8))
+	f.Fuzz(func(t *testing.T, data []byte, bitWidth byte, n uint16) {
+		if values, err := decodeRLEHybrid(data, int(bitWidth), int(n)); err == nil && len(values) != int(n) {
+			t.Fatalf("decodeRLEHybrid returned %d values, want %d", len(values), n)
+		}
+		if values, used, err := decodeDeltaBinaryPacked(data, int(n)); err == nil && (len(values) != int(n) || used > len(data)) {
+			t.Fatalf("decodeDeltaBinaryPacked returned %d values using %d bytes", len(values), used)
+		}
+		decodeDeltaByteArray(data, int(n))
+		for _, column := range []*parquetColumn{
+			{Type: parquetBoolean}, {Type: parquetInt32}, {Type: parquetInt96}, {Type: parquetDouble},
+			{Type: parquetByteArray}, {Type: parquetFixedLenByteArray, TypeLength: int(bitWidth)},
+		} {
+			decodePlainValues(column, data, int(n))
+		}
+	})
+}
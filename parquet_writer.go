@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// 行组上限：行数或缓冲的字节数达到任一值时写出一个行组
+const (
+	parquetRowGroupRows  = 65536
+	parquetRowGroupBytes = 64 << 20
+)
+
+// ---- Thrift compact 协议（写） ----
+
+// thriftWriter 按字段编号写出 Thrift compact 结构体
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // 各层结构体中上一个字段的编号（字段头按差值编码）
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (tw *thriftWriter) field(id int16, fieldType byte) {
+	top := len(tw.last) - 1
+	if delta := id - tw.last[top]; delta > 0 && delta <= 15 {
+		tw.buf = append(tw.buf, byte(delta)<<4|fieldType)
+	} else {
+		tw.buf = append(tw.buf, fieldType)
+		tw.buf = binary.AppendVarint(tw.buf, int64(id))
+	}
+	tw.last[top] = id
+}
+
+func (tw *thriftWriter) i32(id int16, v int32) {
+	tw.field(id, thriftI32)
+	tw.buf = binary.AppendVarint(tw.buf, int64(v))
+}
+
+func (tw *thriftWriter) i64(id int16, v int64) {
+	tw.field(id, thriftI64)
+	tw.buf = binary.AppendVarint(tw.buf, v)
+}
+
+func (tw *thriftWriter) binary(id int16, v string) {
+	tw.field(id, thriftBinary)
+	tw.appendBinary(v)
+}
+
+func (tw *thriftWriter) appendBinary(v string) {
+	tw.buf = binary.AppendUvarint(tw.buf, uint64(len(v)))
+	tw.buf = append(tw.buf, v...)
+}
+
+// list 写出列表头，随后由调用方写出 n 个元素
+func (tw *thriftWriter) list(id int16, elemType byte, n int) {
+	tw.field(id, thriftList)
+	if n < 15 {
+		tw.buf = append(tw.buf, byte(n)<<4|elemType)
+	} else {
+		tw.buf = append(tw.buf, 0xf0|elemType)
+		tw.buf = binary.AppendUvarint(tw.buf, uint64(n))
+	}
+}
+
+// beginStruct 开始结构体字段；id 为 0 时开始列表中的结构体元素（没有字段头）
+func (tw *thriftWriter) beginStruct(id int16) {
+	if id != 0 {
+		tw.field(id, thriftStruct)
+	}
+	tw.last = append(tw.last, 0)
+}
+
+func (tw *thriftWriter) endStruct() {
+	tw.buf = append(tw.buf, thriftStop)
+	tw.last = tw.last[:len(tw.last)-1]
+}
+
+// ---- Parquet 写出 ----
+
+// parquetWriterColumn 写出的列
+type parquetWriterColumn struct {
+	Name       string
+	Type       int // parquetInt32 / parquetInt64 / parquetDouble / parquetByteArray
+	Converted  int // ConvertedType，-1 表示没有
+	Optional   bool
+	Dictionary bool // 字符串列使用字典编码（设备ID、指标名重复度高）
+}
+
+// parquetColumnBuffer 当前行组中一列的缓冲
+type parquetColumnBuffer struct {
+	values    []byte // PLAIN 编码的非空值（非字典列）
+	defined   []uint32
+	dict      map[string]uint32
+	dictPlain []byte // PLAIN 编码的字典
+	indices   []uint32
+}
+
+// parquetWrittenChunk 已写出的列块
+type parquetWrittenChunk struct {
+	offset, dictionaryOffset, dataOffset int64
+	compressedSize, uncompressedSize     int64
+	numValues                            int64
+	encodings                            []int32
+}
+
+// parquetWrittenRowGroup 已写出的行组
+type parquetWrittenRowGroup struct {
+	numRows int64
+	size    int64
+	chunks  []parquetWrittenChunk
+}
+
+// parquetWriter 流式写出 Parquet 文件：缓冲一个行组后写出（每列一个 snappy 压缩的 v1 数据页），Close 时写出文件尾元数据
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	columns   []parquetWriterColumn
+	buffers   []parquetColumnBuffer
+	rows      int64 // 当前行组的行数
+	bytes     int   // 当前行组缓冲的字节数
+	numRows   int64
+	rowGroups []parquetWrittenRowGroup
+}
+
+func newParquetWriter(w io.Writer, columns []parquetWriterColumn) (*parquetWriter, error) {
+	pw := &parquetWriter{w: w, columns: columns, buffers: make([]parquetColumnBuffer, len(columns))}
+	pw.resetBuffers()
+	if err := pw.write(parquetMagic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *parquetWriter) write(p []byte) error {
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	return err
+}
+
+func (pw *parquetWriter) resetBuffers() {
+	for i := range pw.buffers {
+		buffer := &pw.buffers[i]
+		buffer.values = buffer.values[:0]
+		buffer.defined = buffer.defined[:0]
+		buffer.indices = buffer.indices[:0]
+		buffer.dictPlain = buffer.dictPlain[:0]
+		if pw.columns[i].Dictionary {
+			buffer.dict = make(map[string]uint32)
+		}
+	}
+	pw.rows, pw.bytes = 0, 0
+}
+
+// WriteRow 写入一行，值依次对应各列：int32 列为 int，int64 列为 int64 或 time.Time（毫秒），
+// double 列为 float64，byte array 列为 string；可空列可以为 nil
+func (pw *parquetWriter) WriteRow(values ...interface{}) error {
+	if len(values) != len(pw.columns) {
+		return fmt.Errorf("parquet: %d values for %d columns", len(values), len(pw.columns))
+	}
+	for i, v := range values {
+		column := &pw.columns[i]
+		buffer := &pw.buffers[i]
+		if v == nil {
+			if !column.Optional {
+				return fmt.Errorf("parquet: column %s is required", column.Name)
+			}
+			buffer.defined = append(buffer.defined, 0)
+			continue
+		}
+		if column.Optional {
+			buffer.defined = append(buffer.defined, 1)
+		}
+
+		size := len(buffer.values)
+		switch t := v.(type) {
+		case int:
+			buffer.values = binary.LittleEndian.AppendUint32(buffer.values, uint32(int32(t)))
+		case int64:
+			buffer.values = binary.LittleEndian.AppendUint64(buffer.values, uint64(t))
+		case time.Time:
+			buffer.values = binary.LittleEndian.AppendUint64(buffer.values, uint64(t.UnixMilli()))
+		case float64:
+			buffer.values = binary.LittleEndian.AppendUint64(buffer.values, math.Float64bits(t))
+		case string:
+			if column.Dictionary {
+				index, ok := buffer.dict[t]
+				if !ok {
+					index = uint32(len(buffer.dict))
+					buffer.dict[t] = index
+					buffer.dictPlain = binary.LittleEndian.AppendUint32(buffer.dictPlain, uint32(len(t)))
+					buffer.dictPlain = append(buffer.dictPlain, t...)
+					pw.bytes += len(t) + 4
+				}
+				buffer.indices = append(buffer.indices, index)
+				pw.bytes += 4
+				continue
+			}
+			buffer.values = binary.LittleEndian.AppendUint32(buffer.values, uint32(len(t)))
+			buffer.values = append(buffer.values, t...)
+		default:
+			return fmt.Errorf("parquet: unsupported value %T for column %s", v, column.Name)
+		}
+		pw.bytes += len(buffer.values) - size
+	}
+
+	pw.rows++
+	if pw.rows >= parquetRowGroupRows || pw.bytes >= parquetRowGroupBytes {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// flushRowGroup 写出缓冲的行组
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rows == 0 {
+		return nil
+	}
+	rowGroup := parquetWrittenRowGroup{numRows: pw.rows}
+	for i := range pw.columns {
+		chunk, err := pw.writeChunk(&pw.columns[i], &pw.buffers[i])
+		if err != nil {
+			return err
+		}
+		rowGroup.size += chunk.uncompressedSize
+		rowGroup.chunks = append(rowGroup.chunks, chunk)
+	}
+	pw.rowGroups = append(pw.rowGroups, rowGroup)
+	pw.numRows += pw.rows
+	pw.resetBuffers()
+	return nil
+}
+
+// writeChunk 写出一个列块：字典页（字典列）+ 一个数据页
+func (pw *parquetWriter) writeChunk(column *parquetWriterColumn, buffer *parquetColumnBuffer) (parquetWrittenChunk, error) {
+	chunk := parquetWrittenChunk{offset: pw.offset, numValues: pw.rows, encodings: []int32{parquetEncodingRLE}}
+
+	emit := func(pageType int32, page []byte, fill func(tw *thriftWriter)) error {
+		compressed := snappy.Encode(nil, page)
+		tw := newThriftWriter()
+		tw.i32(1, pageType)
+		tw.i32(2, int32(len(page)))
+		tw.i32(3, int32(len(compressed)))
+		fill(tw)
+		tw.buf = append(tw.buf, thriftStop)
+		chunk.uncompressedSize += int64(len(tw.buf) + len(page))
+		chunk.compressedSize += int64(len(tw.buf) + len(compressed))
+		if err := pw.write(tw.buf); err != nil {
+			return err
+		}
+		return pw.write(compressed)
+	}
+
+	var page []byte
+	if column.Optional {
+		levels := encodeRLEHybrid(buffer.defined, 1)
+		page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+		page = append(page, levels...)
+	}
+
+	encoding := int32(parquetEncodingPlain)
+	if column.Dictionary {
+		chunk.dictionaryOffset = pw.offset
+		err := emit(parquetDictionaryPage, buffer.dictPlain, func(tw *thriftWriter) {
+			tw.beginStruct(7)
+			tw.i32(1, int32(len(buffer.dict)))
+			tw.i32(2, parquetEncodingPlain)
+			tw.endStruct()
+		})
+		if err != nil {
+			return chunk, err
+		}
+		bitWidth := bitsFor(uint32(max(len(buffer.dict), 1) - 1))
+		page = append(page, byte(bitWidth))
+		page = append(page, encodeRLEHybrid(buffer.indices, bitWidth)...)
+		encoding = parquetEncodingRLEDictionary
+		chunk.encodings = append(chunk.encodings, parquetEncodingPlain, parquetEncodingRLEDictionary)
+	} else {
+		page = append(page, buffer.values...)
+		chunk.encodings = append(chunk.encodings, parquetEncodingPlain)
+	}
+
+	chunk.dataOffset = pw.offset
+	err := emit(parquetDataPage, page, func(tw *thriftWriter) {
+		tw.beginStruct(5)
+		tw.i32(1, int32(pw.rows))
+		tw.i32(2, encoding)
+		tw.i32(3, parquetEncodingRLE)
+		tw.i32(4, parquetEncodingRLE)
+		tw.endStruct()
+	})
+	return chunk, err
+}
+
+// Close 写出剩余的行组和文件尾元数据（不关闭底层 Writer）
+func (pw *parquetWriter) Close() error {
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	tw := newThriftWriter()
+	tw.i32(1, 1)
+	tw.list(2, thriftStruct, len(pw.columns)+1)
+	tw.beginStruct(0)
+	tw.binary(4, "schema")
+	tw.i32(5, int32(len(pw.columns)))
+	tw.endStruct()
+	for _, column := range pw.columns {
+		tw.beginStruct(0)
+		tw.i32(1, int32(column.Type))
+		repetition := int32(0)
+		if column.Optional {
+			repetition = 1
+		}
+		tw.i32(3, repetition)
+		tw.binary(4, column.Name)
+		if column.Converted >= 0 {
+			tw.i32(6, int32(column.Converted))
+		}
+		tw.endStruct()
+	}
+	tw.i64(3, pw.numRows)
+
+	tw.list(4, thriftStruct, len(pw.rowGroups))
+	for _, rowGroup := range pw.rowGroups {
+		tw.beginStruct(0)
+		tw.list(1, thriftStruct, len(rowGroup.chunks))
+		for i, chunk := range rowGroup.chunks {
+			column := pw.columns[i]
+			tw.beginStruct(0)
+			tw.i64(2, chunk.offset)
+			tw.beginStruct(3)
+			tw.i32(1, int32(column.Type))
+			tw.list(2, thriftI32, len(chunk.encodings))
+			for _, encoding := range chunk.encodings {
+				tw.buf = binary.AppendVarint(tw.buf, int64(encoding))
+			}
+			tw.list(3, thriftBinary, 1)
+			tw.appendBinary(column.Name)
+			tw.i32(4, parquetCodecSnappy)
+			tw.i64(5, chunk.numValues)
+			tw.i64(6, chunk.uncompressedSize)
+			tw.i64(7, chunk.compressedSize)
+			tw.i64(9, chunk.dataOffset)
+			if column.Dictionary {
+				tw.i64(11, chunk.dictionaryOffset)
+			}
+			tw.endStruct()
+			tw.endStruct()
+		}
+		tw.i64(2, rowGroup.size)
+		tw.i64(3, rowGroup.numRows)
+		tw.endStruct()
+	}
+	tw.binary(6, "bench-server")
+	tw.buf = append(tw.buf, thriftStop)
+
+	if err := pw.write(tw.buf); err != nil {
+		return err
+	}
+	if err := pw.write(binary.LittleEndian.AppendUint32(nil, uint32(len(tw.buf)))); err != nil {
+		return err
+	}
+	return pw.write(parquetMagic)
+}
+
+// bitsFor 表示 0..max 所需的位数（至少 1 位）
+func bitsFor(max uint32) int {
+	bits := 1
+	for max >= 1<<bits {
+		bits++
+	}
+	return bits
+}
+
+// encodeRLEHybrid 按 RLE / 位打包混合编码：连续 8 个以上相同的值用 RLE 段，其余按 8 个一组位打包
+func encodeRLEHybrid(values []uint32, bitWidth int) []byte {
+	var out []byte
+	repeats := func(i int) int {
+		n := 1
+		for i+n < len(values) && values[i+n] == values[i] {
+			n++
+		}
+		return n
+	}
+	byteWidth := (bitWidth + 7) / 8
+
+	for i := 0; i < len(values); {
+		if run := repeats(i); run >= 8 {
+			out = binary.AppendUvarint(out, uint64(run)<<1)
+			for b := 0; b < byteWidth; b++ {
+				out = append(out, byte(values[i]>>(8*b)))
+			}
+			i += run
+			continue
+		}
+
+		// 位打包段一直延续到下一个足够长的重复段，末尾不足 8 个时补 0
+		start := i
+		for i < len(values) && repeats(i) < 8 {
+			i += 8
+		}
+		if i > len(values) {
+			i = len(values)
+		}
+		groups := (i - start + 7) / 8
+		out = binary.AppendUvarint(out, uint64(groups)<<1|1)
+		packed := make([]byte, groups*bitWidth)
+		for j, v := range values[start:i] {
+			bit := j * bitWidth
+			for b := 0; b < bitWidth; b++ {
+				if v&(1<<b) != 0 {
+					packed[(bit+b)/8] |= 1 << ((bit + b) % 8)
+				}
+			}
+		}
+		out = append(out, packed...)
+	}
+	return out
+}
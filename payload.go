@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// checkPayload 拒绝以压缩格式标记开头的负载（否则读取时会被当作压缩数据解压），
+// 开启 payload.validate 时再校验负载（合法 base64、解码后不超过 64KB）
+func (s *Server) checkPayload(data string) bool {
+	return !IsCompressedPayload(data) && (!s.config.PayloadValidate || ValidatePayloadData(data))
+}
+
+// invalidPayloadMessage 负载校验失败时的错误信息
+const invalidPayloadMessage = "Invalid payload data (base64 required, max 65535 bytes decoded, must not start with " + payloadMarkerPrefix + ")"
+
+// getSensorRecordHandler 按ID读取一条记录及完整负载：GET /api/sensor-data/{id}?encoding=raw|decoded
+// raw（默认）返回上报时的负载原文（压缩存储的负载透明解压），decoded 返回 base64 解码后的内容
+func (s *Server) getSensorRecordHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	encoding := r.URL.Query().Get("encoding")
+	if encoding == "" {
+		encoding = "raw"
+	}
+	if encoding != "raw" && encoding != "decoded" {
+		http.Error(w, "Invalid encoding (expected raw or decoded)", http.StatusBadRequest)
+		return
+	}
+
+	var timestamp, createdAt time.Time
+	var deviceID, metricName string
+	var value float64
+	var priority int
+	var stored sql.NullString
+	err = s.db.QueryRow(`
+		SELECT timestamp, device_id, metric_name, value, priority, data, created_at
+		FROM `+s.databaseService().SeriesTable()+`
+		WHERE id = ?
+	`, id).Scan(&timestamp, &deviceID, &metricName, &value, &priority, &stored, &createdAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get sensor record")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+
+	payload, err := DecompressPayload(stored.String, s.payloadDicts)
+	if err != nil {
+		s.logger.WithError(err).WithField("id", id).Error("Failed to decompress payload")
+		http.Error(w, "Failed to decompress payload", http.StatusInternalServerError)
+		return
+	}
+
+	data := payload
+	if encoding == "decoded" && payload != "" {
+		decoded, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			http.Error(w, "Payload is not valid base64, use encoding=raw", http.StatusUnprocessableEntity)
+			return
+		}
+		data = string(decoded)
+	}
+
+	s.writeResponse(w, r, map[string]interface{}{
+		"id":                id,
+		"timestamp":         timestamp.Format(time.RFC3339Nano),
+		"device_id":         deviceID,
+		"metric_name":       metricName,
+		"value":             value,
+		"priority":          priority,
+		"created_at":        createdAt.Format(time.RFC3339),
+		"encoding":          encoding,
+		"data":              data,
+		"data_length":       len(data),
+		"stored_compressed": IsCompressedPayload(stored.String),
+		"stored_length":     len(stored.String),
+		"payload_info":      GetPayloadInfo(payload),
+	})
+}
+
+// inspectPayloadHandler 分析负载结构：POST /api/payload/inspect，请求体 {"data": "..."}
+func (s *Server) inspectPayloadHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Data string `json:"data" msgpack:"data"`
+	}
+	if !s.decodeRequest(w, r, &request) {
+		return
+	}
+
+	info := GetPayloadInfo(request.Data)
+	info["valid_for_ingest"] = !IsCompressedPayload(request.Data) && ValidatePayloadData(request.Data)
+	s.writeResponse(w, r, info)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+)
+
+// 压缩负载格式
+//
+// data 列为 TEXT 类型，压缩后的字节以 base64 存储，并带有格式标记前缀：
+//
+//	~z1g<form>~<base64>          gzip 压缩
+//	~z1d<form><dictID>~<base64>  使用共享字典的 raw deflate 压缩，字典存储在 payload_dictionaries 表
+//
+// form 为 'b' 时表示压缩前先对原始负载做了 base64 解码（读取时重新编码还原），
+// 为 's' 时表示直接压缩原始字符串。未压缩的负载（base64 文本）不会以 '~' 开头。
+const (
+	payloadMarkerPrefix = "~z1"
+
+	payloadAlgGzip = 'g'
+	payloadAlgDict = 'd'
+
+	payloadFormBase64 = 'b'
+	payloadFormString = 's'
+
+	// maxDictionarySize deflate 预置字典的最大长度
+	maxDictionarySize = 32 << 10
+	// dictionarySampleSize 构建字典时从每条负载中采样的字节数
+	dictionarySampleSize = 4 << 10
+	// maxPayloadDecompressedSize 单条负载解压后的上限（原始负载受 TEXT 列限制）
+	maxPayloadDecompressedSize = 1 << 20
+	// payloadDictionaryRotateRows 共享字典压缩该行数后用新数据重建
+	payloadDictionaryRotateRows = 1000000
+	// maxCachedDictionaries 读取时缓存的字典数
+	maxCachedDictionaries = 64
+)
+
+// PayloadCompressionMode 负载压缩模式
+type PayloadCompressionMode int
+
+const (
+	PayloadCompressionNone            PayloadCompressionMode = iota
+	PayloadCompressionGzip                                   // 每条记录独立 gzip
+	PayloadCompressionDictionary                             // 多个批次共用的共享字典
+	PayloadCompressionBatchDictionary                        // 每个批次单独构建的共享字典
+)
+
+// parsePayloadCompressionMode 解析 storage.payload_compression：none、gzip、dictionary 或 batch_dictionary
+func parsePayloadCompressionMode(value string) (PayloadCompressionMode, error) {
+	switch value {
+	case "", "none":
+		return PayloadCompressionNone, nil
+	case "gzip":
+		return PayloadCompressionGzip, nil
+	case "dictionary":
+		return PayloadCompressionDictionary, nil
+	case "batch_dictionary":
+		return PayloadCompressionBatchDictionary, nil
+	}
+	return PayloadCompressionNone, fmt.Errorf("invalid storage payload_compression %q (expected none, gzip, dictionary or batch_dictionary)", value)
+}
+
+// IsCompressedPayload 判断 data 列的值是否为压缩格式
+func IsCompressedPayload(stored string) bool {
+	return strings.HasPrefix(stored, payloadMarkerPrefix)
+}
+
+// payloadBytes 返回待压缩的字节及其形式：可无损往返的 base64 负载先解码，压缩率更高
+func payloadBytes(data string) ([]byte, byte) {
+	if decoded, err := base64.StdEncoding.DecodeString(data); err == nil &&
+		base64.StdEncoding.EncodeToString(decoded) == data {
+		return decoded, payloadFormBase64
+	}
+	return []byte(data), payloadFormString
+}
+
+// CompressPayloadGzip 使用 gzip 压缩单条负载
+func CompressPayloadGzip(data string) (string, error) {
+	if data == "" {
+		return data, nil
+	}
+	raw, form := payloadBytes(data)
+
+	var buf bytes.Buffer
+	gw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(gw)
+	gw.Reset(&buf)
+	if _, err := gw.Write(raw); err != nil {
+		return "", err
+	}
+	if err := gw.Close(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%c%c~%s", payloadMarkerPrefix, payloadAlgGzip, form,
+		base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// CompressPayloadWithDictionary 使用共享字典压缩单条负载
+func CompressPayloadWithDictionary(data string, dictID int64, dict []byte) (string, error) {
+	if data == "" {
+		return data, nil
+	}
+	raw, form := payloadBytes(data)
+
+	var buf bytes.Buffer
+	fw, err := flate.NewWriterDict(&buf, flate.BestSpeed, dict)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(raw); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%c%c%d~%s", payloadMarkerPrefix, payloadAlgDict, form, dictID,
+		base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// BuildPayloadDictionary 从一批负载中采样构建 deflate 预置字典
+// 负载之间重复的结构（JSON 字段名、填充串等）越多，字典效果越好
+func BuildPayloadDictionary(payloads []string) []byte {
+	var dict []byte
+	for _, p := range payloads {
+		if p == "" {
+			continue
+		}
+		raw, _ := payloadBytes(p)
+		if len(raw) > dictionarySampleSize {
+			raw = raw[:dictionarySampleSize]
+		}
+		dict = append(dict, raw...)
+		if len(dict) >= maxDictionarySize {
+			break
+		}
+	}
+	// deflate 只使用字典末尾的 32KB
+	if len(dict) > maxDictionarySize {
+		dict = dict[len(dict)-maxDictionarySize:]
+	}
+	return dict
+}
+
+// PayloadDictionaryStore 共享字典的存储与缓存
+type PayloadDictionaryStore struct {
+	db    *sql.DB
+	mutex sync.RWMutex
+	cache map[int64][]byte
+}
+
+func NewPayloadDictionaryStore(db *sql.DB) *PayloadDictionaryStore {
+	return &PayloadDictionaryStore{db: db, cache: make(map[int64][]byte)}
+}
+
+// Save 保存字典并返回其ID
+func (ps *PayloadDictionaryStore) Save(dict []byte) (int64, error) {
+	result, err := ps.db.Exec("INSERT INTO payload_dictionaries (dict) VALUES (?)", dict)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save payload dictionary: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	ps.put(id, dict)
+	return id, nil
+}
+
+// Latest 读取最近保存的字典，没有时返回 sql.ErrNoRows
+func (ps *PayloadDictionaryStore) Latest() (int64, []byte, error) {
+	var id int64
+	var dict []byte
+	if err := ps.db.QueryRow("SELECT id, dict FROM payload_dictionaries ORDER BY id DESC LIMIT 1").Scan(&id, &dict); err != nil {
+		return 0, nil, err
+	}
+	ps.put(id, dict)
+	return id, dict, nil
+}
+
+// put 写入缓存，缓存已满时随机淘汰一项
+func (ps *PayloadDictionaryStore) put(id int64, dict []byte) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if _, ok := ps.cache[id]; !ok && len(ps.cache) >= maxCachedDictionaries {
+		for evict := range ps.cache {
+			delete(ps.cache, evict)
+			break
+		}
+	}
+	ps.cache[id] = dict
+}
+
+// Get 读取字典（优先使用缓存）
+func (ps *PayloadDictionaryStore) Get(id int64) ([]byte, error) {
+	ps.mutex.RLock()
+	dict, ok := ps.cache[id]
+	ps.mutex.RUnlock()
+	if ok {
+		return dict, nil
+	}
+
+	if err := ps.db.QueryRow("SELECT dict FROM payload_dictionaries WHERE id = ?", id).Scan(&dict); err != nil {
+		return nil, fmt.Errorf("failed to load payload dictionary %d: %w", id, err)
+	}
+
+	ps.put(id, dict)
+	return dict, nil
+}
+
+// PayloadCompressor 写入时压缩 data 列
+// dictionary 模式下共享字典在多个批次间复用（启动时沿用最近保存的字典），每压缩 payloadDictionaryRotateRows 行后用新数据重建；
+// batch_dictionary 模式下每个批次用自身的负载构建并保存一个字典
+type PayloadCompressor struct {
+	mode  PayloadCompressionMode
+	dicts *PayloadDictionaryStore
+
+	mutex    sync.Mutex
+	dictID   int64
+	dict     []byte
+	dictRows int64
+}
+
+// NewPayloadCompressor 创建负载压缩器，mode 为 PayloadCompressionNone 时返回 nil
+func NewPayloadCompressor(mode PayloadCompressionMode, dicts *PayloadDictionaryStore) (*PayloadCompressor, error) {
+	if mode == PayloadCompressionNone {
+		return nil, nil
+	}
+	pc := &PayloadCompressor{mode: mode, dicts: dicts}
+	if mode == PayloadCompressionDictionary {
+		id, dict, err := dicts.Latest()
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to load payload dictionary: %w", err)
+		}
+		pc.dictID, pc.dict = id, dict
+	}
+	return pc, nil
+}
+
+// openPayloadCompressor 按 storage.payload_compression 创建负载压缩器，未启用时返回 nil
+func openPayloadCompressor(config *Config, dicts *PayloadDictionaryStore) (*PayloadCompressor, error) {
+	mode, err := parsePayloadCompressionMode(config.PayloadCompression)
+	if err != nil {
+		return nil, err
+	}
+	return NewPayloadCompressor(mode, dicts)
+}
+
+// dictionary 返回当前共享字典，没有或需要轮换时从 samples 构建并保存新字典
+func (pc *PayloadCompressor) dictionary(samples []string) (int64, []byte, error) {
+	if pc.mode == PayloadCompressionBatchDictionary {
+		dict := BuildPayloadDictionary(samples)
+		id, err := pc.dicts.Save(dict)
+		if err != nil {
+			return 0, nil, err
+		}
+		return id, dict, nil
+	}
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.dict == nil || pc.dictRows >= payloadDictionaryRotateRows {
+		dict := BuildPayloadDictionary(samples)
+		id, err := pc.dicts.Save(dict)
+		if err != nil {
+			return 0, nil, err
+		}
+		pc.dictID, pc.dict, pc.dictRows = id, dict, 0
+	}
+	pc.dictRows += int64(len(samples))
+	return pc.dictID, pc.dict, nil
+}
+
+// CompressBatch 返回压缩后的数据（不修改 data 中的原始记录），压缩无收益的负载保留原文
+func (pc *PayloadCompressor) CompressBatch(data []*SensorData) ([]*SensorData, error) {
+	if pc == nil {
+		return data, nil
+	}
+	payloads := make([]string, 0, len(data))
+	for _, item := range data {
+		if item.Data != "" {
+			payloads = append(payloads, item.Data)
+		}
+	}
+	if len(payloads) == 0 {
+		return data, nil
+	}
+
+	var dictID int64
+	var dict []byte
+	if pc.mode != PayloadCompressionGzip {
+		var err error
+		if dictID, dict, err = pc.dictionary(payloads); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*SensorData, len(data))
+	for i, item := range data {
+		result[i] = item
+		if item.Data == "" {
+			continue
+		}
+		var compressed string
+		var err error
+		if pc.mode != PayloadCompressionGzip {
+			compressed, err = CompressPayloadWithDictionary(item.Data, dictID, dict)
+		} else {
+			compressed, err = CompressPayloadGzip(item.Data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress payload: %w", err)
+		}
+		if len(compressed) >= len(item.Data) {
+			continue
+		}
+		compressedItem := *item
+		compressedItem.Data = compressed
+		result[i] = &compressedItem
+	}
+	return result, nil
+}
+
+// Compress 压缩单条负载；batch_dictionary 模式下单条负载不值得单独建字典，改用 gzip
+func (pc *PayloadCompressor) Compress(data string) (string, error) {
+	if pc == nil || data == "" {
+		return data, nil
+	}
+	if pc.mode == PayloadCompressionBatchDictionary {
+		compressed, err := CompressPayloadGzip(data)
+		if err != nil || len(compressed) >= len(data) {
+			return data, err
+		}
+		return compressed, nil
+	}
+	result, err := pc.CompressBatch([]*SensorData{{Data: data}})
+	if err != nil {
+		return "", err
+	}
+	return result[0].Data, nil
+}
+
+// DecompressPayload 还原 data 列中的负载，未压缩的值原样返回
+func DecompressPayload(stored string, dicts *PayloadDictionaryStore) (string, error) {
+	if !IsCompressedPayload(stored) {
+		return stored, nil
+	}
+
+	header, encoded, ok := strings.Cut(stored[len(payloadMarkerPrefix):], "~")
+	if !ok || len(header) < 2 {
+		return "", fmt.Errorf("malformed compressed payload header")
+	}
+	alg, form := header[0], header[1]
+
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed compressed payload: %w", err)
+	}
+
+	var reader io.ReadCloser
+	switch alg {
+	case payloadAlgGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return "", err
+		}
+		reader = gr
+	case payloadAlgDict:
+		dictID, err := strconv.ParseInt(header[2:], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("malformed dictionary id: %w", err)
+		}
+		if dicts == nil {
+			return "", fmt.Errorf("payload dictionary store not available")
+		}
+		dict, err := dicts.Get(dictID)
+		if err != nil {
+			return "", err
+		}
+		reader = flate.NewReaderDict(bytes.NewReader(compressed), dict)
+	default:
+		return "", fmt.Errorf("unknown payload compression %q", alg)
+	}
+	defer reader.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(reader, maxPayloadDecompressedSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(raw) > maxPayloadDecompressedSize {
+		return "", fmt.Errorf("decompressed payload exceeds %d bytes", maxPayloadDecompressedSize)
+	}
+
+	if form == payloadFormBase64 {
+		return base64.StdEncoding.EncodeToString(raw), nil
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxQueryDeviceIDs 一次查询中显式指定的设备ID数上限
+const maxQueryDeviceIDs = 1000
+
+// SeriesQueryRequest 多设备查询请求，设备选择条件（device_ids / device_prefix / labels）之间为 AND 关系
+type SeriesQueryRequest struct {
+	DeviceIDs      []string          `json:"device_ids,omitempty" msgpack:"device_ids,omitempty"`
+	DevicePrefix   string            `json:"device_prefix,omitempty" msgpack:"device_prefix,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty" msgpack:"labels,omitempty"`
+	MetricName     string            `json:"metric_name,omitempty" msgpack:"metric_name,omitempty"`
+	StartTime      string            `json:"start_time" msgpack:"start_time"`
+	EndTime        string            `json:"end_time" msgpack:"end_time"`
+	LimitPerSeries int               `json:"limit_per_series,omitempty" msgpack:"limit_per_series,omitempty"`
+	Order          string            `json:"order,omitempty" msgpack:"order,omitempty"` // desc（默认）/ asc
+}
+
+// querySeriesDataHandler 多设备 / 前缀 / 标签查询，结果按序列（设备+指标）分组：POST /api/query-series
+// 序列由 series_index 解析，序列数和总点数受 query.max_series / query.max_points 限制
+func (s *Server) querySeriesDataHandler(w http.ResponseWriter, r *http.Request) {
+	var request SeriesQueryRequest
+	if !s.decodeRequest(w, r, &request) {
+		return
+	}
+
+	if len(request.DeviceIDs) == 0 && request.DevicePrefix == "" && len(request.Labels) == 0 {
+		http.Error(w, "At least one of device_ids, device_prefix, labels is required", http.StatusBadRequest)
+		return
+	}
+	if len(request.DeviceIDs) > maxQueryDeviceIDs {
+		http.Error(w, fmt.Sprintf("Too many device_ids (max %d)", maxQueryDeviceIDs), http.StatusBadRequest)
+		return
+	}
+	if request.StartTime == "" || request.EndTime == "" {
+		http.Error(w, "Missing required fields: start_time, end_time", http.StatusBadRequest)
+		return
+	}
+	startTime, err := time.Parse(time.RFC3339, request.StartTime)
+	if err != nil {
+		http.Error(w, "Invalid start_time format (RFC3339 required)", http.StatusBadRequest)
+		return
+	}
+	endTime, err := time.Parse(time.RFC3339, request.EndTime)
+	if err != nil {
+		http.Error(w, "Invalid end_time format (RFC3339 required)", http.StatusBadRequest)
+		return
+	}
+	if startTime.After(endTime) {
+		http.Error(w, "start_time must be before end_time", http.StatusBadRequest)
+		return
+	}
+	direction := "DESC"
+	switch request.Order {
+	case "", "desc":
+		request.Order = "desc"
+	case "asc":
+		direction = "ASC"
+	default:
+		http.Error(w, "Invalid order (expected asc or desc)", http.StatusBadRequest)
+		return
+	}
+	if len(request.DeviceIDs) > 0 && !s.authorizeDevice(w, r, request.DeviceIDs...) {
+		return
+	}
+
+	// 1. 解析设备选择条件
+	// 前缀和标签选择的设备同样要受签名设备和客户端证书前缀的限制，不能只按租户过滤
+	tenants := s.requestTenants(r)
+	access := s.requestDeviceAccess(r)
+	filter := seriesFilter{
+		devicePrefix: request.DevicePrefix,
+		metricName:   request.MetricName,
+		tenants:      tenants,
+		access:       access,
+	}
+	if len(request.DeviceIDs) > 0 {
+		filter.deviceIDs = request.DeviceIDs
+	}
+	if len(request.Labels) > 0 {
+		labeled, err := s.registry.SelectDeviceIDs(DeviceFilter{Labels: request.Labels, Tenants: tenants, Access: access})
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to select devices by labels")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if filter.deviceIDs != nil {
+			// 显式设备列表与标签选择取交集
+			var both []string
+			for _, deviceID := range labeled {
+				if containsString(filter.deviceIDs, deviceID) {
+					both = append(both, deviceID)
+				}
+			}
+			labeled = both
+		}
+		filter.deviceIDs = append([]string{}, labeled...)
+	}
+
+	// 2. 从序列索引中找出时间范围内有数据的序列
+	maxSeries := s.config.QueryMaxSeries
+	where, args := filter.where()
+	rows, err := s.db.Query(`
+		SELECT device_id, metric_name FROM series_index
+		WHERE `+where+` AND last_timestamp >= ? AND first_timestamp <= ?
+		ORDER BY device_id, metric_name
+		LIMIT ?
+	`, append(args, startTime, endTime, maxSeries+1)...)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to resolve series")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var keys []seriesKey
+	for rows.Next() {
+		var key seriesKey
+		if err := rows.Scan(&key.deviceID, &key.metricName); err != nil {
+			rows.Close()
+			s.logger.WithError(err).Error("Failed to scan series row")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		s.logger.WithError(err).Error("Error iterating over series rows")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(keys) > maxSeries {
+		http.Error(w, fmt.Sprintf("Query matches more than %d series, narrow the selector or set metric_name", maxSeries), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// 3. 每个序列的点数上限：不超过 limit_per_series，且总点数不超过 max_points
+	limit := request.LimitPerSeries
+	if limit <= 0 || limit > 10000 {
+		limit = 1000
+	}
+	if len(keys) > 0 && limit*len(keys) > s.config.QueryMaxPoints {
+		limit = s.config.QueryMaxPoints / len(keys)
+		if limit < 1 {
+			limit = 1
+		}
+	}
+
+	// 4. 逐个序列查询（走 device_id + metric_name 索引）
+	query := `
+		SELECT id, timestamp, value, priority FROM ` + s.databaseService().SeriesTable() + `
+		WHERE device_id = ? AND metric_name = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp ` + direction + `, id ` + direction + `
+		LIMIT ?
+	`
+	series := make([]map[string]interface{}, 0, len(keys))
+	totalPoints := 0
+	for _, key := range keys {
+		pointRows, err := s.db.Query(query, key.deviceID, key.metricName, startTime, endTime, limit+1)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to query series data")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		points := make([]map[string]interface{}, 0)
+		truncated := false
+		for pointRows.Next() {
+			if len(points) == limit {
+				truncated = true
+				break
+			}
+			var id int64
+			var timestamp time.Time
+			var value float64
+			var priority int
+			if err := pointRows.Scan(&id, &timestamp, &value, &priority); err != nil {
+				s.logger.WithError(err).Error("Failed to scan series data row")
+				continue
+			}
+			points = append(points, map[string]interface{}{
+				"id":        id,
+				"timestamp": timestamp.Format(time.RFC3339Nano),
+				"value":     value,
+				"priority":  priority,
+			})
+		}
+		err = pointRows.Err()
+		pointRows.Close()
+		if err != nil {
+			s.logger.WithError(err).Error("Error iterating over series data rows")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		totalPoints += len(points)
+		series = append(series, map[string]interface{}{
+			"device_id":   key.deviceID,
+			"metric_name": key.metricName,
+			"count":       len(points),
+			"truncated":   truncated,
+			"points":      points,
+		})
+	}
+
+	s.writeResponse(w, r, map[string]interface{}{
+		"status":           "success",
+		"start_time":       request.StartTime,
+		"end_time":         request.EndTime,
+		"order":            request.Order,
+		"limit_per_series": limit,
+		"series_count":     len(series),
+		"point_count":      totalPoints,
+		"series":           series,
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval 清理空闲令牌桶的间隔
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit 令牌桶限流参数
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`  // 每秒补充的令牌数（每条数据消耗一个令牌），<= 0 表示不限流
+	Burst int     `yaml:"burst"` // 桶容量，为空时等于 rate（至少为1）
+}
+
+// burst 返回生效的桶容量
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// rateLimitPolicy 一组限流配置，运行时重新加载时整体替换
+type rateLimitPolicy struct {
+	enabled          bool
+	device           RateLimit
+	factory          RateLimit
+	deviceOverrides  map[string]RateLimit
+	factoryOverrides map[string]RateLimit
+}
+
+func newRateLimitPolicy(config *Config) (rateLimitPolicy, error) {
+	policy := rateLimitPolicy{
+		enabled:          config.RateLimitEnabled,
+		device:           config.RateLimitDevice,
+		factory:          config.RateLimitFactory,
+		deviceOverrides:  config.RateLimitDeviceOverrides,
+		factoryOverrides: config.RateLimitFactoryOverrides,
+	}
+
+	check := func(name string, l RateLimit) error {
+		if l.Rate < 0 || l.Burst < 0 {
+			return fmt.Errorf("rate limit %s: rate and burst must not be negative", name)
+		}
+		return nil
+	}
+	if err := check("device", policy.device); err != nil {
+		return policy, err
+	}
+	if err := check("factory", policy.factory); err != nil {
+		return policy, err
+	}
+	for deviceID, l := range policy.deviceOverrides {
+		if err := check("device "+deviceID, l); err != nil {
+			return policy, err
+		}
+	}
+	for prefix, l := range policy.factoryOverrides {
+		if err := check("factory "+prefix, l); err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// limitFor 返回某个设备或工厂生效的限流参数（覆盖配置优先）
+func (p *rateLimitPolicy) limitFor(scope, key string) RateLimit {
+	if scope == "factory" {
+		if l, ok := p.factoryOverrides[key]; ok {
+			return l
+		}
+		return p.factory
+	}
+	if l, ok := p.deviceOverrides[key]; ok {
+		return l
+	}
+	return p.device
+}
+
+// tokenBucket 单个设备或工厂的令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimitResult 一次限流判断的结果，对应最受限的令牌桶
+type RateLimitResult struct {
+	Allowed    bool
+	Scope      string // device / factory
+	Key        string
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // 桶补满所需时间
+	RetryAfter time.Duration // 被拒绝时建议的重试间隔
+}
+
+// RateLimiter 按设备ID和工厂前缀（factory_XXX）进行令牌桶限流
+type RateLimiter struct {
+	mutex     sync.Mutex
+	policy    rateLimitPolicy
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	metrics   *Metrics
+}
+
+func NewRateLimiter(policy rateLimitPolicy, metrics *Metrics) *RateLimiter {
+	metrics.RegisterCounter("bench_rate_limited_total", "Ingest requests rejected by per-device / per-factory rate limits.")
+
+	rl := &RateLimiter{
+		policy:    policy,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		metrics:   metrics,
+	}
+	metrics.RegisterGauge("bench_rate_limit_buckets", "Active rate limit token buckets.", func() float64 {
+		rl.mutex.Lock()
+		defer rl.mutex.Unlock()
+		return float64(len(rl.buckets))
+	})
+	return rl
+}
+
+// SetPolicy 替换限流配置；已有令牌桶保留，下次补充时按新的容量截断
+func (rl *RateLimiter) SetPolicy(policy rateLimitPolicy) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.policy = policy
+}
+
+// rateLimitDemand 一个令牌桶在本次请求中需要消耗的令牌
+type rateLimitDemand struct {
+	scope string
+	key   string
+	limit RateLimit
+	cost  float64
+}
+
+// demands 汇总每个令牌桶的消耗，同一工厂下多个设备的数据累加到工厂桶。调用方需持有 mutex
+func (rl *RateLimiter) demands(counts map[string]int) map[string]*rateLimitDemand {
+	demands := make(map[string]*rateLimitDemand)
+	addDemand := func(scope, key string, n int) {
+		limit := rl.policy.limitFor(scope, key)
+		if limit.Rate <= 0 {
+			return
+		}
+		bucketKey := scope + ":" + key
+		d, ok := demands[bucketKey]
+		if !ok {
+			d = &rateLimitDemand{scope: scope, key: key, limit: limit}
+			demands[bucketKey] = d
+		}
+		d.cost += float64(n)
+	}
+	for deviceID, n := range counts {
+		addDemand("device", deviceID, n)
+		if prefix := factoryPrefix(deviceID); prefix != "" {
+			addDemand("factory", prefix, n)
+		}
+	}
+	return demands
+}
+
+// refill 按经过的时间补充令牌并返回令牌桶。调用方需持有 mutex
+func (rl *RateLimiter) refill(bucketKey string, d *rateLimitDemand, now time.Time) *tokenBucket {
+	burst := d.limit.burst()
+	bucket, ok := rl.buckets[bucketKey]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[bucketKey] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*d.limit.Rate)
+	bucket.last = now
+	return bucket
+}
+
+// Allow 判断一次请求能否写入（不扣除令牌，请求最终被接受后再调用 Consume）：counts 为每个设备的数据条数
+// 所有相关的设备桶和工厂桶都有足够令牌时放行。超过桶容量的批次在桶满时放行，
+// 扣除后令牌为负（欠账），之后的请求需等待欠账补足，长期速率不会超过 rate
+func (rl *RateLimiter) Allow(counts map[string]int) RateLimitResult {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if !rl.policy.enabled {
+		return RateLimitResult{Allowed: true}
+	}
+
+	now := time.Now()
+	rl.sweep(now)
+
+	result := RateLimitResult{Allowed: true}
+	for bucketKey, d := range rl.demands(counts) {
+		burst := d.limit.burst()
+		bucket := rl.refill(bucketKey, d, now)
+
+		required := math.Min(d.cost, burst)
+		if bucket.tokens < required {
+			retryAfter := time.Duration((required - bucket.tokens) / d.limit.Rate * float64(time.Second))
+			if result.Allowed || retryAfter > result.RetryAfter {
+				result = RateLimitResult{
+					Scope:      d.scope,
+					Key:        d.key,
+					Limit:      int(burst),
+					Remaining:  int(math.Max(0, bucket.tokens)),
+					Reset:      time.Duration((burst - bucket.tokens) / d.limit.Rate * float64(time.Second)),
+					RetryAfter: retryAfter,
+				}
+			}
+		}
+	}
+
+	if !result.Allowed {
+		rl.metrics.IncCounter("bench_rate_limited_total", map[string]string{"scope": result.Scope})
+	}
+	return result
+}
+
+// Consume 扣除已接受请求消耗的令牌，返回剩余令牌最少的桶用于响应头
+func (rl *RateLimiter) Consume(counts map[string]int) RateLimitResult {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if !rl.policy.enabled {
+		return RateLimitResult{Allowed: true}
+	}
+
+	now := time.Now()
+	result := RateLimitResult{Allowed: true, Remaining: math.MaxInt32}
+	for bucketKey, d := range rl.demands(counts) {
+		burst := d.limit.burst()
+		bucket := rl.refill(bucketKey, d, now)
+		bucket.tokens -= d.cost
+		if remaining := int(math.Max(0, bucket.tokens)); remaining < result.Remaining || result.Scope == "" {
+			result.Scope = d.scope
+			result.Key = d.key
+			result.Limit = int(burst)
+			result.Remaining = remaining
+			result.Reset = time.Duration((burst - bucket.tokens) / d.limit.Rate * float64(time.Second))
+		}
+	}
+	if result.Remaining == math.MaxInt32 {
+		result.Remaining = 0
+	}
+	return result
+}
+
+// sweep 删除已补满的令牌桶（与新建的桶等价），防止设备ID过多时内存无限增长
+// 调用方需持有 mutex
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+
+	for bucketKey, bucket := range rl.buckets {
+		scope, key := "device", bucketKey[len("device:"):]
+		if bucketKey[0] == 'f' {
+			scope, key = "factory", bucketKey[len("factory:"):]
+		}
+		limit := rl.policy.limitFor(scope, key)
+		if limit.Rate <= 0 || bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(rl.buckets, bucketKey)
+		}
+	}
+}
+
+// rateLimit 对写入请求按设备/工厂限流（只检查，不扣除令牌）；超限时返回 429 和 false
+// counts 为每个设备的数据条数
+func (s *Server) rateLimit(w http.ResponseWriter, counts map[string]int) bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+
+	result := s.rateLimiter.Allow(counts)
+	if result.Allowed {
+		return true
+	}
+
+	setRateLimitHeaders(w, result)
+	retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, fmt.Sprintf("Rate limit exceeded for %s %s", result.Scope, result.Key), http.StatusTooManyRequests)
+	return false
+}
+
+// consumeRateLimit 请求通过全部写入检查后扣除令牌，并写入 RateLimit-* 响应头
+func (s *Server) consumeRateLimit(w http.ResponseWriter, counts map[string]int) {
+	if s.rateLimiter == nil {
+		return
+	}
+	if result := s.rateLimiter.Consume(counts); result.Scope != "" && w != nil {
+		setRateLimitHeaders(w, result)
+	}
+}
+
+// setRateLimitHeaders 写入 RateLimit-* 响应头
+func setRateLimitHeaders(w http.ResponseWriter, result RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter 每个设备每秒 1 个令牌、容量 10，工厂不限流
+func newTestRateLimiter() *RateLimiter {
+	return NewRateLimiter(rateLimitPolicy{
+		enabled: true,
+		device:  RateLimit{Rate: 1, Burst: 10},
+	}, NewMetrics())
+}
+
+func TestRateLimiterAllowThenConsume(t *testing.T) {
+	rl := newTestRateLimiter()
+	counts := map[string]int{"factory_001_device_0001": 6}
+
+	// Allow 不扣除令牌，被拒绝的请求不消耗配额
+	for i := 0; i < 3; i++ {
+		if result := rl.Allow(counts); !result.Allowed {
+			t.Fatalf("Allow #%d rejected: %+v", i, result)
+		}
+	}
+
+	result := rl.Consume(counts)
+	if result.Scope != "device" || result.Key != "factory_001_device_0001" || result.Limit != 10 || result.Remaining != 4 {
+		t.Fatalf("Consume = %+v, want device bucket with 4 of 10 remaining", result)
+	}
+
+	result = rl.Allow(counts)
+	if result.Allowed {
+		t.Fatal("Allow after consuming 6 of 10 tokens accepted another 6")
+	}
+	if result.Scope != "device" || result.Remaining != 4 || result.RetryAfter < time.Second {
+		t.Fatalf("rejected result = %+v", result)
+	}
+
+	// 其他设备使用独立的令牌桶
+	if result := rl.Allow(map[string]int{"factory_001_device_0002": 6}); !result.Allowed {
+		t.Fatalf("other device rejected: %+v", result)
+	}
+}
+
+func TestRateLimiterFactoryBucketSumsDevices(t *testing.T) {
+	rl := NewRateLimiter(rateLimitPolicy{
+		enabled: true,
+		factory: RateLimit{Rate: 1, Burst: 10},
+	}, NewMetrics())
+
+	rl.Consume(map[string]int{"factory_001_device_0001": 4, "factory_001_device_0002": 4})
+	result := rl.Allow(map[string]int{"factory_001_device_0003": 4})
+	if result.Allowed || result.Scope != "factory" || result.Key != "factory_001" {
+		t.Fatalf("Allow = %+v, want rejection by factory_001 bucket", result)
+	}
+	if result := rl.Allow(map[string]int{"factory_002_device_0001": 4}); !result.Allowed {
+		t.Fatalf("other factory rejected: %+v", result)
+	}
+}
+
+func TestRateLimiterOversizedBatchDebt(t *testing.T) {
+	rl := newTestRateLimiter()
+	counts := map[string]int{"factory_001_device_0001": 25}
+
+	// 超过桶容量的批次在桶满时放行
+	if result := rl.Allow(counts); !result.Allowed {
+		t.Fatalf("oversized batch rejected with a full bucket: %+v", result)
+	}
+	result := rl.Consume(counts)
+	if result.Remaining != 0 {
+		t.Fatalf("Remaining = %d, want 0 while in debt", result.Remaining)
+	}
+	if result.Reset < 24*time.Second {
+		t.Fatalf("Reset = %v, want time to repay the debt and refill", result.Reset)
+	}
+
+	// 欠账 15 个令牌，补足前连一条数据也不能写入
+	result = rl.Allow(map[string]int{"factory_001_device_0001": 1})
+	if result.Allowed {
+		t.Fatal("request accepted while the bucket is in debt")
+	}
+	if result.RetryAfter < 15*time.Second {
+		t.Fatalf("RetryAfter = %v, want at least 15s to repay the debt", result.RetryAfter)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newTestRateLimiter()
+	rl.Consume(map[string]int{"factory_001_device_0001": 1, "factory_001_device_0002": 10})
+	if len(rl.buckets) != 2 {
+		t.Fatalf("buckets = %d, want 2", len(rl.buckets))
+	}
+
+	// 5 秒后第一个桶已补满（与新建的桶等价），第二个桶仍缺 5 个令牌
+	now := time.Now().Add(5 * time.Second)
+	rl.mutex.Lock()
+	rl.lastSweep = now.Add(-rateLimitSweepInterval)
+	rl.sweep(now)
+	_, full := rl.buckets["device:factory_001_device_0001"]
+	_, partial := rl.buckets["device:factory_001_device_0002"]
+	rl.mutex.Unlock()
+	if full || !partial {
+		t.Fatalf("after sweep: refilled bucket kept = %v, partial bucket kept = %v", full, partial)
+	}
+
+	// 第二个桶 30 秒后已补满，但未到清理间隔时不清理
+	rl.mutex.Lock()
+	rl.sweep(now.Add(30 * time.Second))
+	kept := len(rl.buckets)
+	rl.sweep(now.Add(rateLimitSweepInterval))
+	remaining := len(rl.buckets)
+	rl.mutex.Unlock()
+	if kept != 1 || remaining != 0 {
+		t.Fatalf("buckets = %d before and %d after the sweep interval, want 1 and 0", kept, remaining)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	s := &Server{rateLimiter: newTestRateLimiter()}
+	counts := map[string]int{"factory_001_device_0001": 7}
+
+	w := httptest.NewRecorder()
+	if !s.rateLimit(w, counts) {
+		t.Fatalf("first request rejected: %d", w.Code)
+	}
+	s.consumeRateLimit(w, counts)
+	want := map[string]string{"RateLimit-Limit": "10", "RateLimit-Remaining": "3", "RateLimit-Reset": "7"}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	if s.rateLimit(w, counts) {
+		t.Fatal("second request accepted")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "4" {
+		t.Errorf("Retry-After = %q, want 4", got)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "3" {
+		t.Errorf("RateLimit-Remaining = %q, want 3", got)
+	}
+
+	// 未启用限流时放行且不写入响应头
+	s.rateLimiter.SetPolicy(rateLimitPolicy{})
+	w = httptest.NewRecorder()
+	if !s.rateLimit(w, counts) {
+		t.Fatal("request rejected with rate limiting disabled")
+	}
+	s.consumeRateLimit(w, counts)
+	if got := w.Header().Get("RateLimit-Limit"); got != "" {
+		t.Errorf("RateLimit-Limit = %q with rate limiting disabled", got)
+	}
+}
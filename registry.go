@@ -0,0 +1,653 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 未知设备（未在设备注册表中登记）的写入策略
+const (
+	unknownDeviceAllow    = "allow"    // 直接写入
+	unknownDeviceReject   = "reject"   // 拒绝写入
+	unknownDeviceRegister = "register" // 自动登记后写入
+)
+
+const (
+	// unknownDeviceCacheTTL 未登记设备的否定缓存时间，避免大量未知设备请求反复查库
+	unknownDeviceCacheTTL = 10 * time.Second
+	// maxLabelSelectorDevices 按标签选择设备时的最大设备数
+	maxLabelSelectorDevices = 1000
+)
+
+var (
+	errDeviceNotFound = errors.New("device not found")
+	errDeviceExists   = errors.New("device already exists")
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-]{0,63}$`)
+
+// Device 设备注册信息
+type Device struct {
+	DeviceID  string            `json:"device_id" msgpack:"device_id"`
+	Factory   string            `json:"factory" msgpack:"factory"`
+	Location  string            `json:"location,omitempty" msgpack:"location,omitempty"`
+	Type      string            `json:"type,omitempty" msgpack:"type,omitempty"`
+	Units     map[string]string `json:"units,omitempty" msgpack:"units,omitempty"` // 指标名 -> 单位
+	Labels    map[string]string `json:"labels,omitempty" msgpack:"labels,omitempty"`
+	CreatedAt string            `json:"created_at,omitempty" msgpack:"created_at,omitempty"`
+	UpdatedAt string            `json:"updated_at,omitempty" msgpack:"updated_at,omitempty"`
+}
+
+// validate 校验并补全设备信息
+func (d *Device) validate() error {
+	if d.DeviceID == "" || len(d.DeviceID) > 100 {
+		return fmt.Errorf("device_id is required (max 100 characters)")
+	}
+	if d.Factory == "" {
+		d.Factory = tenantOf(d.DeviceID)
+	}
+	if len(d.Factory) > 100 || len(d.Location) > 200 || len(d.Type) > 100 {
+		return fmt.Errorf("factory / type max 100 characters, location max 200 characters")
+	}
+	for key, value := range d.Labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if len(value) > 255 {
+			return fmt.Errorf("label %s value too long (max 255)", key)
+		}
+	}
+	for metric, unit := range d.Units {
+		if metric == "" || len(metric) > 50 || len(unit) > 32 {
+			return fmt.Errorf("invalid unit for metric %q", metric)
+		}
+	}
+	return nil
+}
+
+// initRegistryStorage 创建设备注册表和标签表
+// 紧凑存储布局已使用 devices 表作为字典表，注册表使用 device_registry
+func initRegistryStorage(db *sql.DB) error {
+	statements := []struct {
+		name  string
+		query string
+	}{
+		{"device_registry", `
+		CREATE TABLE IF NOT EXISTS device_registry (
+			device_id VARCHAR(100) PRIMARY KEY,
+			factory VARCHAR(100) NOT NULL,
+			location VARCHAR(200) NOT NULL DEFAULT '',
+			device_type VARCHAR(100) NOT NULL DEFAULT '',
+			metric_units TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_factory (factory),
+			INDEX idx_device_type (device_type)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+		`},
+		{"device_labels", `
+		CREATE TABLE IF NOT EXISTS device_labels (
+			device_id VARCHAR(100) NOT NULL,
+			label_key VARCHAR(64) NOT NULL,
+			label_value VARCHAR(255) NOT NULL,
+			PRIMARY KEY (device_id, label_key),
+			INDEX idx_label (label_key, label_value)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+		`},
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt.query); err != nil {
+			return fmt.Errorf("failed to create %s: %w", stmt.name, err)
+		}
+	}
+	return nil
+}
+
+// DeviceRegistry 设备注册表
+type DeviceRegistry struct {
+	db *sql.DB
+
+	mutex   sync.RWMutex
+	known   map[string]bool      // 已登记的设备
+	unknown map[string]time.Time // 未登记设备的否定缓存，值为过期时间
+}
+
+func NewDeviceRegistry(db *sql.DB) *DeviceRegistry {
+	return &DeviceRegistry{
+		db:      db,
+		known:   make(map[string]bool),
+		unknown: make(map[string]time.Time),
+	}
+}
+
+// setLabels 替换设备的全部标签
+func setLabels(tx *sql.Tx, deviceID string, labels map[string]string) error {
+	if _, err := tx.Exec("DELETE FROM device_labels WHERE device_id = ?", deviceID); err != nil {
+		return err
+	}
+	for key, value := range labels {
+		if _, err := tx.Exec(
+			"INSERT INTO device_labels (device_id, label_key, label_value) VALUES (?, ?, ?)",
+			deviceID, key, value,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save 新建或替换设备信息；create 为 true 时设备已存在返回 errDeviceExists
+func (dr *DeviceRegistry) Save(d *Device, create bool) error {
+	units, err := json.Marshal(d.Units)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if create {
+		var result sql.Result
+		result, err = tx.Exec(`
+			INSERT IGNORE INTO device_registry (device_id, factory, location, device_type, metric_units)
+			VALUES (?, ?, ?, ?, ?)
+		`, d.DeviceID, d.Factory, d.Location, d.Type, string(units))
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				return errDeviceExists
+			}
+		}
+	} else {
+		var result sql.Result
+		result, err = tx.Exec(`
+			UPDATE device_registry SET factory = ?, location = ?, device_type = ?, metric_units = ?
+			WHERE device_id = ?
+		`, d.Factory, d.Location, d.Type, string(units), d.DeviceID)
+		if err == nil {
+			var exists int
+			if n, _ := result.RowsAffected(); n == 0 {
+				// 内容未变化时 RowsAffected 也为0，需要再确认设备是否存在
+				if tx.QueryRow("SELECT 1 FROM device_registry WHERE device_id = ?", d.DeviceID).Scan(&exists) == sql.ErrNoRows {
+					return errDeviceNotFound
+				}
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+
+	if err := setLabels(tx, d.DeviceID, d.Labels); err != nil {
+		return fmt.Errorf("failed to save device labels: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	dr.markKnown(d.DeviceID)
+	return nil
+}
+
+// Get 读取设备信息
+func (dr *DeviceRegistry) Get(deviceID string) (*Device, error) {
+	devices, err := dr.load("WHERE r.device_id = ?", []interface{}{deviceID})
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, errDeviceNotFound
+	}
+	return devices[0], nil
+}
+
+// Delete 删除设备及其标签（不删除已写入的时序数据）
+func (dr *DeviceRegistry) Delete(deviceID string) error {
+	tx, err := dr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM device_registry WHERE device_id = ?", deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to delete device: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errDeviceNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM device_labels WHERE device_id = ?", deviceID); err != nil {
+		return fmt.Errorf("failed to delete device labels: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	dr.mutex.Lock()
+	delete(dr.known, deviceID)
+	dr.mutex.Unlock()
+	return nil
+}
+
+// DeviceFilter 设备列表的过滤条件
+type DeviceFilter struct {
+	Factory string
+	Type    string
+	Labels  map[string]string
+	Tenants []string // 请求可访问的租户，nil 表示不限制
+	Access  deviceAccess
+	Limit   int
+	Offset  int
+}
+
+// where 构造过滤条件，r 为 device_registry 的别名
+func (f *DeviceFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.Factory != "" {
+		conditions = append(conditions, "r.factory = ?")
+		args = append(args, f.Factory)
+	}
+	if f.Type != "" {
+		conditions = append(conditions, "r.device_type = ?")
+		args = append(args, f.Type)
+	}
+	if len(f.Labels) > 0 {
+		// 所有标签都匹配的设备
+		keys := make([]string, 0, len(f.Labels))
+		for key := range f.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = "(label_key = ? AND label_value = ?)"
+			args = append(args, key, f.Labels[key])
+		}
+		conditions = append(conditions, `r.device_id IN (
+			SELECT device_id FROM device_labels WHERE `+strings.Join(pairs, " OR ")+`
+			GROUP BY device_id HAVING COUNT(*) = ?)`)
+		args = append(args, len(keys))
+	}
+	if clause, clauseArgs := tenantFilter("r.device_id", f.Tenants); clause != "" {
+		conditions = append(conditions, clause)
+		args = append(args, clauseArgs...)
+	}
+	if clause, clauseArgs := f.Access.filter("r.device_id"); clause != "" {
+		conditions = append(conditions, clause)
+		args = append(args, clauseArgs...)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// List 按条件列出设备
+func (dr *DeviceRegistry) List(filter DeviceFilter) ([]*Device, error) {
+	where, args := filter.where()
+	return dr.load(where+" ORDER BY r.device_id LIMIT ? OFFSET ?", append(args, filter.Limit, filter.Offset))
+}
+
+// SelectDeviceIDs 返回匹配条件的设备ID，用于按标签查询时序数据
+func (dr *DeviceRegistry) SelectDeviceIDs(filter DeviceFilter) ([]string, error) {
+	where, args := filter.where()
+	rows, err := dr.db.Query("SELECT r.device_id FROM device_registry r "+where+" ORDER BY r.device_id LIMIT ?",
+		append(args, maxLabelSelectorDevices)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select devices: %w", err)
+	}
+	defer rows.Close()
+
+	var deviceIDs []string
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, err
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, rows.Err()
+}
+
+// load 查询设备及其标签
+func (dr *DeviceRegistry) load(clause string, args []interface{}) ([]*Device, error) {
+	rows, err := dr.db.Query(`
+		SELECT r.device_id, r.factory, r.location, r.device_type, r.metric_units, r.created_at, r.updated_at
+		FROM device_registry r `+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %w", err)
+	}
+	defer rows.Close()
+
+	var devices []*Device
+	byID := make(map[string]*Device)
+	for rows.Next() {
+		var d Device
+		var units sql.NullString
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&d.DeviceID, &d.Factory, &d.Location, &d.Type, &units, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		if units.Valid && units.String != "" {
+			if err := json.Unmarshal([]byte(units.String), &d.Units); err != nil {
+				return nil, fmt.Errorf("invalid metric_units for device %s: %w", d.DeviceID, err)
+			}
+		}
+		d.CreatedAt = createdAt.Format(time.RFC3339)
+		d.UpdatedAt = updatedAt.Format(time.RFC3339)
+		devices = append(devices, &d)
+		byID[d.DeviceID] = &d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return devices, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(devices)), ",")
+	labelArgs := make([]interface{}, len(devices))
+	for i, d := range devices {
+		labelArgs[i] = d.DeviceID
+	}
+	labelRows, err := dr.db.Query(
+		"SELECT device_id, label_key, label_value FROM device_labels WHERE device_id IN ("+placeholders+")", labelArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device labels: %w", err)
+	}
+	defer labelRows.Close()
+	for labelRows.Next() {
+		var deviceID, key, value string
+		if err := labelRows.Scan(&deviceID, &key, &value); err != nil {
+			return nil, err
+		}
+		d := byID[deviceID]
+		if d.Labels == nil {
+			d.Labels = make(map[string]string)
+		}
+		d.Labels[key] = value
+	}
+	return devices, labelRows.Err()
+}
+
+// markKnown 记录设备已登记
+func (dr *DeviceRegistry) markKnown(deviceID string) {
+	dr.mutex.Lock()
+	dr.known[deviceID] = true
+	delete(dr.unknown, deviceID)
+	dr.mutex.Unlock()
+}
+
+// Unknown 返回未登记的设备（使用缓存）
+func (dr *DeviceRegistry) Unknown(deviceIDs []string) ([]string, error) {
+	now := time.Now()
+	var unknown, lookup []string
+
+	dr.mutex.RLock()
+	for _, deviceID := range deviceIDs {
+		if dr.known[deviceID] {
+			continue
+		}
+		if expires, ok := dr.unknown[deviceID]; ok && now.Before(expires) {
+			unknown = append(unknown, deviceID)
+			continue
+		}
+		lookup = append(lookup, deviceID)
+	}
+	dr.mutex.RUnlock()
+
+	if len(lookup) == 0 {
+		return unknown, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(lookup)), ",")
+	args := make([]interface{}, len(lookup))
+	for i, deviceID := range lookup {
+		args[i] = deviceID
+	}
+	rows, err := dr.db.Query("SELECT device_id FROM device_registry WHERE device_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up devices: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, err
+		}
+		found[deviceID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	dr.mutex.Lock()
+	for _, deviceID := range lookup {
+		if found[deviceID] {
+			dr.known[deviceID] = true
+		} else {
+			dr.unknown[deviceID] = now.Add(unknownDeviceCacheTTL)
+			unknown = append(unknown, deviceID)
+		}
+	}
+	dr.mutex.Unlock()
+	return unknown, nil
+}
+
+// Register 自动登记设备（只填写设备ID和工厂）
+func (dr *DeviceRegistry) Register(deviceIDs []string) error {
+	for _, deviceID := range deviceIDs {
+		if _, err := dr.db.Exec(
+			"INSERT IGNORE INTO device_registry (device_id, factory) VALUES (?, ?)",
+			deviceID, tenantOf(deviceID),
+		); err != nil {
+			return fmt.Errorf("failed to register device %s: %w", deviceID, err)
+		}
+		dr.markKnown(deviceID)
+	}
+	return nil
+}
+
+// checkKnownDevices 按 unknown_devices 策略检查未登记的设备，拒绝时写入错误响应并返回 false
+// register 策略下返回需要登记的设备，由调用方在全部写入检查通过后调用 registerDevices
+func (s *Server) checkKnownDevices(w http.ResponseWriter, deviceIDs []string) ([]string, bool) {
+	if s.config.UnknownDevicePolicy == unknownDeviceAllow || len(deviceIDs) == 0 {
+		return nil, true
+	}
+
+	unknown, err := s.registry.Unknown(deviceIDs)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to check device registry")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(unknown) > 0 && s.config.UnknownDevicePolicy == unknownDeviceReject {
+		http.Error(w, fmt.Sprintf("Unknown device %s (not registered)", unknown[0]), http.StatusForbidden)
+		return nil, false
+	}
+	return unknown, true
+}
+
+// registerDevices 登记 checkKnownDevices 返回的新设备，失败时写入错误响应并返回 false
+func (s *Server) registerDevices(w http.ResponseWriter, deviceIDs []string) bool {
+	if len(deviceIDs) == 0 {
+		return true
+	}
+	if err := s.registry.Register(deviceIDs); err != nil {
+		s.logger.WithError(err).Error("Failed to register devices")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// parseLabelSelector 解析 key=value 形式的标签选择器
+func parseLabelSelector(selectors []string) (map[string]string, error) {
+	if len(selectors) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, selector := range selectors {
+		for _, pair := range splitList(selector) {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok || !labelKeyPattern.MatchString(key) {
+				return nil, fmt.Errorf("invalid label selector %q (expected key=value)", pair)
+			}
+			labels[key] = value
+		}
+	}
+	return labels, nil
+}
+
+// listDevicesHandler 列出设备：GET /api/devices?factory=&type=&label=key=value&limit=&offset=
+func (s *Server) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	labels, err := parseLabelSelector(query["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := DeviceFilter{
+		Factory: query.Get("factory"),
+		Type:    query.Get("type"),
+		Labels:  labels,
+		Tenants: s.requestTenants(r),
+		Access:  s.requestDeviceAccess(r),
+		Limit:   100,
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 && limit <= 1000 {
+		filter.Limit = limit
+	}
+	if offset, err := strconv.Atoi(query.Get("offset")); err == nil && offset > 0 {
+		filter.Offset = offset
+	}
+
+	devices, err := s.registry.List(filter)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list devices")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if devices == nil {
+		devices = []*Device{}
+	}
+
+	s.writeResponse(w, r, map[string]interface{}{
+		"status":  "success",
+		"count":   len(devices),
+		"limit":   filter.Limit,
+		"offset":  filter.Offset,
+		"devices": devices,
+	})
+}
+
+// getDeviceHandler 读取设备：GET /api/devices/{id}
+func (s *Server) getDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	if !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+
+	device, err := s.registry.Get(deviceID)
+	if err == errDeviceNotFound {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get device")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, r, device)
+}
+
+// saveDeviceHandler 新建设备（POST /api/devices）或替换设备信息（PUT /api/devices/{id}）
+func (s *Server) saveDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var device Device
+	if !s.decodeRequest(w, r, &device) {
+		return
+	}
+
+	create := r.Method == http.MethodPost
+	if !create {
+		deviceID := mux.Vars(r)["id"]
+		if device.DeviceID != "" && device.DeviceID != deviceID {
+			http.Error(w, "device_id in body does not match URL", http.StatusBadRequest)
+			return
+		}
+		device.DeviceID = deviceID
+	}
+
+	if err := device.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeDevice(w, r, device.DeviceID) {
+		return
+	}
+
+	err := s.registry.Save(&device, create)
+	switch err {
+	case nil:
+	case errDeviceExists:
+		http.Error(w, "Device already exists", http.StatusConflict)
+		return
+	case errDeviceNotFound:
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	default:
+		s.logger.WithError(err).Error("Failed to save device")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	saved, err := s.registry.Get(device.DeviceID)
+	if err != nil {
+		saved = &device
+	}
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	s.writeResponseStatus(w, r, status, saved)
+}
+
+// deleteDeviceHandler 删除设备：DELETE /api/devices/{id}
+func (s *Server) deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	if !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+
+	err := s.registry.Delete(deviceID)
+	if err == errDeviceNotFound {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to delete device")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteRule 描述如何将 Prometheus 标签映射为 device_id / metric_name
+// device_id 和 metric_name 为模板，使用 ${label} 引用标签值
+type RemoteWriteRule struct {
+	Match      map[string]string `yaml:"match"`       // 标签正则匹配条件（全匹配），为空表示匹配所有
+	DeviceID   string            `yaml:"device_id"`   // 例如 "${instance}"
+	MetricName string            `yaml:"metric_name"` // 例如 "${__name__}"
+	Priority   int               `yaml:"priority"`    // 0 表示使用默认优先级
+
+	matchers map[string]*regexp.Regexp
+}
+
+// defaultRemoteWriteRules 默认规则：instance 作为设备ID，__name__ 作为指标名
+func defaultRemoteWriteRules() []RemoteWriteRule {
+	return []RemoteWriteRule{
+		{DeviceID: "${instance}", MetricName: "${__name__}"},
+	}
+}
+
+// compileRemoteWriteRules 预编译规则中的正则表达式
+func compileRemoteWriteRules(rules []RemoteWriteRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.DeviceID == "" || rule.MetricName == "" {
+			return fmt.Errorf("rule %d: device_id and metric_name templates are required", i)
+		}
+		rule.matchers = make(map[string]*regexp.Regexp, len(rule.Match))
+		for label, pattern := range rule.Match {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("rule %d: invalid pattern for label %s: %w", i, label, err)
+			}
+			rule.matchers[label] = re
+		}
+	}
+	return nil
+}
+
+// matches 判断标签集合是否满足规则的匹配条件
+func (rule *RemoteWriteRule) matches(labels map[string]string) bool {
+	for label, re := range rule.matchers {
+		if !re.MatchString(labels[label]) {
+			return false
+		}
+	}
+	return true
+}
+
+// promLabel / promSample / promTimeSeries 对应 prometheus prompb 中的消息定义
+type promLabel struct {
+	Name  string
+	Value string
+}
+
+type promSample struct {
+	Value     float64
+	Timestamp int64 // 毫秒时间戳
+}
+
+type promTimeSeries struct {
+	Labels  []promLabel
+	Samples []promSample
+}
+
+// decodeWriteRequest 解析 prometheus.WriteRequest 的 protobuf 编码
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; ... }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; ... }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+func decodeWriteRequest(b []byte) ([]promTimeSeries, error) {
+	var series []promTimeSeries
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 || typ != protowire.BytesType {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		ts, err := decodeTimeSeries(v)
+		if err != nil {
+			return 0, err
+		}
+		series = append(series, ts)
+		return n, nil
+	})
+	return series, err
+}
+
+func decodeTimeSeries(b []byte) (promTimeSeries, error) {
+	var ts promTimeSeries
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == 1 {
+			label, err := decodeLabel(v)
+			if err != nil {
+				return 0, err
+			}
+			ts.Labels = append(ts.Labels, label)
+		} else {
+			sample, err := decodeSample(v)
+			if err != nil {
+				return 0, err
+			}
+			ts.Samples = append(ts.Samples, sample)
+		}
+		return n, nil
+	})
+	return ts, err
+}
+
+func decodeLabel(b []byte) (promLabel, error) {
+	var label promLabel
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == 1 {
+			label.Name = string(v)
+		} else {
+			label.Value = string(v)
+		}
+		return n, nil
+	})
+	return label, err
+}
+
+func decodeSample(b []byte) (promSample, error) {
+	var sample promSample
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			sample.Value = math.Float64frombits(v)
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			sample.Timestamp = int64(v)
+			return n, nil
+		}
+		return 0, nil
+	})
+	return sample, err
+}
+
+// walkFields 遍历 protobuf 消息中的字段
+// fn 返回已消费的字节数；返回 0 表示跳过该字段，负数为 protowire 解析错误码
+func walkFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := fn(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// mapRemoteWriteSeries 根据标签规则将时间序列转换为传感器数据
+// 返回转换后的记录和被丢弃的样本数
+func (s *Server) mapRemoteWriteSeries(series []promTimeSeries) ([]*SensorData, int) {
+	var records []*SensorData
+	dropped := 0
+
+	for _, ts := range series {
+		labels := make(map[string]string, len(ts.Labels))
+		for _, label := range ts.Labels {
+			labels[label.Name] = label.Value
+		}
+
+		var rule *RemoteWriteRule
+		for i := range s.config.RemoteWriteRules {
+			if s.config.RemoteWriteRules[i].matches(labels) {
+				rule = &s.config.RemoteWriteRules[i]
+				break
+			}
+		}
+		if rule == nil {
+			dropped += len(ts.Samples)
+			continue
+		}
+
+		lookup := func(name string) string { return labels[name] }
+		deviceID := os.Expand(rule.DeviceID, lookup)
+		metricName := os.Expand(rule.MetricName, lookup)
+
+		// 字段长度需符合表结构：device_id VARCHAR(100)，metric_name VARCHAR(50)
+		if deviceID == "" || metricName == "" || len(deviceID) > 100 || len(metricName) > 50 {
+			dropped += len(ts.Samples)
+			continue
+		}
+
+		priority := rule.Priority
+		if priority < 1 || priority > 3 {
+			priority = s.config.RemoteWriteDefaultPriority
+		}
+
+		for _, sample := range ts.Samples {
+			// staleness marker 等 NaN/Inf 值无法写入 DOUBLE 列
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				dropped++
+				continue
+			}
+			// 不符合指标目录的样本按 on_invalid 配置丢弃或修正
+			value, _, err := s.catalog.Check(metricName, sample.Value)
+			if err != nil {
+				dropped++
+				continue
+			}
+			records = append(records, &SensorData{
+				Timestamp:  time.UnixMilli(sample.Timestamp).UTC().Format(time.RFC3339Nano),
+				DeviceID:   deviceID,
+				MetricName: metricName,
+				Value:      value,
+				Priority:   priority,
+			})
+		}
+	}
+
+	return records, dropped
+}
+
+// remoteWriteHandler 处理 Prometheus remote_write 请求（snappy 压缩的 protobuf WriteRequest）
+func (s *Server) remoteWriteHandler(w http.ResponseWriter, r *http.Request) {
+	maxBytes := s.config.RemoteWriteMaxBodyBytes
+
+	compressed, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+	if err != nil {
+		if errors.Is(err, errDecompressedTooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(compressed) > maxBytes {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	decodedLen, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		http.Error(w, "Invalid snappy payload", http.StatusBadRequest)
+		return
+	}
+	if decodedLen > maxBytes {
+		http.Error(w, "Decoded body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "Invalid snappy payload", http.StatusBadRequest)
+		return
+	}
+
+	series, err := decodeWriteRequest(raw)
+	if err != nil {
+		http.Error(w, "Invalid protobuf WriteRequest", http.StatusBadRequest)
+		return
+	}
+
+	records, dropped := s.mapRemoteWriteSeries(series)
+
+	// 授权、限流与准入控制：按请求中最高的优先级判断
+	deviceIDs := make([]string, 0, len(records))
+	priority := 3
+	for _, record := range records {
+		deviceIDs = append(deviceIDs, record.DeviceID)
+		if record.Priority < priority {
+			priority = record.Priority
+		}
+	}
+	if len(records) > 0 && !s.checkIngest(w, r, deviceIDs, priority) {
+		return
+	}
+
+	dbService := s.databaseService()
+	start := time.Now()
+	err = dbService.BulkInsertSensorData(records)
+	s.observeDBLatency(start)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to insert remote_write samples")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.afterIngest(records)
+
+	s.logger.WithFields(logrus.Fields{
+		"series":  len(series),
+		"samples": len(records),
+		"dropped": dropped,
+	}).Debug("Remote write completed")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// seriesIndexFlushInterval 序列索引写回 series_index 表的间隔
+	seriesIndexFlushInterval = 2 * time.Second
+	// seriesIndexChunkSize 每条 upsert 语句包含的序列数
+	seriesIndexChunkSize = 500
+)
+
+// initSeriesStorage 创建 series_index 表：每个序列（设备+指标）一行，写入时维护
+func initSeriesStorage(db *sql.DB) error {
+	createSeriesIndexTable := `
+	CREATE TABLE IF NOT EXISTS series_index (
+		device_id VARCHAR(100) NOT NULL,
+		metric_name VARCHAR(50) NOT NULL,
+		first_timestamp DATETIME(3) NOT NULL,
+		last_timestamp DATETIME(3) NOT NULL,
+		last_value DOUBLE NOT NULL,
+		sample_count BIGINT NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (device_id, metric_name),
+		INDEX idx_metric_device (metric_name, device_id)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+	if _, err := db.Exec(createSeriesIndexTable); err != nil {
+		return fmt.Errorf("failed to create series_index table: %w", err)
+	}
+	return nil
+}
+
+// seriesKey 序列标识
+type seriesKey struct {
+	deviceID   string
+	metricName string
+}
+
+// seriesUpdate 一个序列尚未写回的变化
+type seriesUpdate struct {
+	first     time.Time
+	last      time.Time
+	lastValue float64
+	count     int64
+}
+
+// merge 合并另一批变化
+func (u *seriesUpdate) merge(other *seriesUpdate) {
+	if other.first.Before(u.first) {
+		u.first = other.first
+	}
+	if !other.last.Before(u.last) {
+		u.last = other.last
+		u.lastValue = other.lastValue
+	}
+	u.count += other.count
+}
+
+// SeriesIndex 维护 series_index 表
+// 写入成功的数据先在内存中按序列合并，定期批量写回
+type SeriesIndex struct {
+	db *sql.DB
+
+	mutex   sync.Mutex
+	pending map[seriesKey]*seriesUpdate
+}
+
+func NewSeriesIndex(db *sql.DB) *SeriesIndex {
+	return &SeriesIndex{
+		db:      db,
+		pending: make(map[seriesKey]*seriesUpdate),
+	}
+}
+
+// Record 记录写入成功的数据
+func (si *SeriesIndex) Record(rows []*SensorData) {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	for _, row := range rows {
+		timestamp, err := time.Parse(time.RFC3339, row.Timestamp)
+		if err != nil {
+			continue
+		}
+		update := &seriesUpdate{first: timestamp, last: timestamp, lastValue: row.Value, count: 1}
+		key := seriesKey{deviceID: row.DeviceID, metricName: row.MetricName}
+		if existing, ok := si.pending[key]; ok {
+			existing.merge(update)
+		} else {
+			si.pending[key] = update
+		}
+	}
+}
+
+// Flush 将未写回的变化写入 series_index 表，写回失败的部分保留到下次
+func (si *SeriesIndex) Flush() {
+	si.mutex.Lock()
+	pending := si.pending
+	si.pending = make(map[seriesKey]*seriesUpdate)
+	si.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	keys := make([]seriesKey, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+
+	for start := 0; start < len(keys); start += seriesIndexChunkSize {
+		end := start + seriesIndexChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunk := keys[start:end]
+		if err := si.upsert(chunk, pending); err != nil {
+			si.requeue(chunk, pending)
+		}
+	}
+}
+
+// upsert 批量写回一组序列
+// ON DUPLICATE KEY UPDATE 按顺序求值，last_value 需在 last_timestamp 之前更新
+func (si *SeriesIndex) upsert(keys []seriesKey, updates map[seriesKey]*seriesUpdate) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO series_index (device_id, metric_name, first_timestamp, last_timestamp, last_value, sample_count) VALUES ")
+	args := make([]interface{}, 0, len(keys)*6)
+	for i, key := range keys {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString("(?, ?, ?, ?, ?, ?)")
+		u := updates[key]
+		args = append(args, key.deviceID, key.metricName, u.first, u.last, u.lastValue, u.count)
+	}
+	query.WriteString(`
+		ON DUPLICATE KEY UPDATE
+			last_value = IF(VALUES(last_timestamp) >= last_timestamp, VALUES(last_value), last_value),
+			first_timestamp = LEAST(first_timestamp, VALUES(first_timestamp)),
+			last_timestamp = GREATEST(last_timestamp, VALUES(last_timestamp)),
+			sample_count = sample_count + VALUES(sample_count)
+	`)
+	_, err := si.db.Exec(query.String(), args...)
+	return err
+}
+
+// requeue 将写回失败的变化合并回待写队列
+func (si *SeriesIndex) requeue(keys []seriesKey, updates map[seriesKey]*seriesUpdate) {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	for _, key := range keys {
+		if existing, ok := si.pending[key]; ok {
+			existing.merge(updates[key])
+		} else {
+			si.pending[key] = updates[key]
+		}
+	}
+}
+
+// Run 定期写回，stop 关闭时做最后一次写回
+func (si *SeriesIndex) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			si.Flush()
+		case <-stop:
+			si.Flush()
+			return
+		}
+	}
+}
+
+// seriesFilter 序列查询条件
+type seriesFilter struct {
+	deviceID     string   // 精确匹配
+	deviceIDs    []string // 为 nil 时不限制，为空切片时不匹配任何设备
+	devicePrefix string
+	deviceGlob   string
+	metricGlob   string
+	metricName   string // 精确匹配
+	tenants      []string
+	access       deviceAccess
+}
+
+// parseSeriesFilter 从查询参数解析过滤条件：prefix（设备ID前缀）、device（设备ID glob）、metric（指标名 glob）
+// 结果限定在请求凭证可访问的租户和设备内
+func (s *Server) parseSeriesFilter(r *http.Request) seriesFilter {
+	query := r.URL.Query()
+	return seriesFilter{
+		devicePrefix: query.Get("prefix"),
+		deviceGlob:   query.Get("device"),
+		metricGlob:   query.Get("metric"),
+		tenants:      s.requestTenants(r),
+		access:       s.requestDeviceAccess(r),
+	}
+}
+
+// where 构造 SQL 条件（不含 WHERE 关键字）
+func (f *seriesFilter) where() (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	if f.deviceID != "" {
+		conditions = append(conditions, "device_id = ?")
+		args = append(args, f.deviceID)
+	}
+	if f.deviceIDs != nil {
+		if len(f.deviceIDs) == 0 {
+			conditions = append(conditions, "1 = 0")
+		} else {
+			conditions = append(conditions, "device_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(f.deviceIDs)), ",")+")")
+			for _, deviceID := range f.deviceIDs {
+				args = append(args, deviceID)
+			}
+		}
+	}
+	if f.devicePrefix != "" {
+		conditions = append(conditions, "device_id LIKE ?")
+		args = append(args, escapeLike(f.devicePrefix)+"%")
+	}
+	if f.deviceGlob != "" {
+		conditions = append(conditions, "device_id LIKE ?")
+		args = append(args, globToLike(f.deviceGlob))
+	}
+	if f.metricGlob != "" {
+		conditions = append(conditions, "metric_name LIKE ?")
+		args = append(args, globToLike(f.metricGlob))
+	}
+	if f.metricName != "" {
+		conditions = append(conditions, "metric_name = ?")
+		args = append(args, f.metricName)
+	}
+	if clause, clauseArgs := tenantFilter("device_id", f.tenants); clause != "" {
+		conditions = append(conditions, clause)
+		args = append(args, clauseArgs...)
+	}
+	if clause, clauseArgs := f.access.filter("device_id"); clause != "" {
+		conditions = append(conditions, clause)
+		args = append(args, clauseArgs...)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// seriesCardinality 统计匹配条件的设备数、指标数和序列数
+func (s *Server) seriesCardinality(filter seriesFilter) (map[string]interface{}, error) {
+	where, args := filter.where()
+	var devices, metrics, series int64
+	err := s.db.QueryRow(
+		"SELECT COUNT(DISTINCT device_id), COUNT(DISTINCT metric_name), COUNT(*) FROM series_index WHERE "+where, args...,
+	).Scan(&devices, &metrics, &series)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"devices": devices,
+		"metrics": metrics,
+		"series":  series,
+	}, nil
+}
+
+// pageLimit 解析 limit 参数
+func pageLimit(r *http.Request, defaultLimit, maxLimit int) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return defaultLimit
+	}
+	if limit > maxLimit {
+		return maxLimit
+	}
+	return limit
+}
+
+// listSeriesHandler 按条件列出序列：GET /api/series?prefix=&device=&metric=&limit=&cursor=
+func (s *Server) listSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeSeries(w, r, s.parseSeriesFilter(r))
+}
+
+// deviceSeriesHandler 列出设备的所有指标：GET /api/series/devices/{id}/metrics?metric=&limit=&cursor=
+func (s *Server) deviceSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["id"]
+	if !s.authorizeDevice(w, r, deviceID) {
+		return
+	}
+	filter := seriesFilter{deviceID: deviceID, metricGlob: r.URL.Query().Get("metric")}
+	s.writeSeries(w, r, filter)
+}
+
+// writeSeries 按 (device_id, metric_name) 顺序分页返回序列
+func (s *Server) writeSeries(w http.ResponseWriter, r *http.Request, filter seriesFilter) {
+	limit := pageLimit(r, 100, 1000)
+	where, args := filter.where()
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var afterDevice, afterMetric string
+		if err := decodeCursor(cursor, &afterDevice, &afterMetric); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		where += " AND (device_id > ? OR (device_id = ? AND metric_name > ?))"
+		args = append(args, afterDevice, afterDevice, afterMetric)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT device_id, metric_name, first_timestamp, last_timestamp, last_value, sample_count
+		FROM series_index WHERE `+where+`
+		ORDER BY device_id, metric_name
+		LIMIT ?
+	`, append(args, limit+1)...)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to query series index")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	series := make([]map[string]interface{}, 0, limit)
+	var nextCursor string
+	for rows.Next() {
+		var deviceID, metricName string
+		var first, last time.Time
+		var lastValue float64
+		var count int64
+		if err := rows.Scan(&deviceID, &metricName, &first, &last, &lastValue, &count); err != nil {
+			s.logger.WithError(err).Error("Failed to scan series row")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(series) == limit {
+			// 多查的一行只用于判断是否还有下一页
+			prev := series[len(series)-1]
+			nextCursor = encodeCursor(prev["device_id"], prev["metric_name"])
+			break
+		}
+		series = append(series, map[string]interface{}{
+			"device_id":       deviceID,
+			"metric_name":     metricName,
+			"first_timestamp": first.Format(time.RFC3339Nano),
+			"last_timestamp":  last.Format(time.RFC3339Nano),
+			"last_value":      lastValue,
+			"sample_count":    count,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.WithError(err).Error("Error iterating over series rows")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"count":  len(series),
+		"series": series,
+	}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	if r.URL.Query().Get("cursor") == "" {
+		// 只在第一页返回基数统计
+		cardinality, err := s.seriesCardinality(filter)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to count series cardinality")
+		} else {
+			response["cardinality"] = cardinality
+		}
+	}
+	s.writeResponse(w, r, response)
+}
+
+// listSeriesDevicesHandler 列出设备及其指标数：GET /api/series/devices?prefix=&device=&metric=&limit=&cursor=
+func (s *Server) listSeriesDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	filter := s.parseSeriesFilter(r)
+	limit := pageLimit(r, 100, 1000)
+	where, args := filter.where()
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var afterDevice string
+		if err := decodeCursor(cursor, &afterDevice); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		where += " AND device_id > ?"
+		args = append(args, afterDevice)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT device_id, COUNT(*), MIN(first_timestamp), MAX(last_timestamp), SUM(sample_count)
+		FROM series_index WHERE `+where+`
+		GROUP BY device_id
+		ORDER BY device_id
+		LIMIT ?
+	`, append(args, limit+1)...)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to query series index")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := make([]map[string]interface{}, 0, limit)
+	var nextCursor string
+	for rows.Next() {
+		var deviceID string
+		var metricCount, sampleCount int64
+		var first, last time.Time
+		if err := rows.Scan(&deviceID, &metricCount, &first, &last, &sampleCount); err != nil {
+			s.logger.WithError(err).Error("Failed to scan series device row")
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(devices) == limit {
+			nextCursor = encodeCursor(devices[len(devices)-1]["device_id"])
+			break
+		}
+		devices = append(devices, map[string]interface{}{
+			"device_id":       deviceID,
+			"metric_count":    metricCount,
+			"first_timestamp": first.Format(time.RFC3339Nano),
+			"last_timestamp":  last.Format(time.RFC3339Nano),
+			"sample_count":    sampleCount,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.WithError(err).Error("Error iterating over series device rows")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"count":   len(devices),
+		"devices": devices,
+	}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	if r.URL.Query().Get("cursor") == "" {
+		cardinality, err := s.seriesCardinality(filter)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to count series cardinality")
+		} else {
+			response["cardinality"] = cardinality
+		}
+	}
+	s.writeResponse(w, r, response)
+}
+
+// runSeriesIndexCommand series-index 子命令：从已有数据重建序列索引
+// 升级前写入的数据不在索引中，需要执行一次 rebuild（会全表扫描，建议在低峰期执行）
+func runSeriesIndexCommand(args []string) error {
+	if len(args) == 0 || args[0] != "rebuild" {
+		return fmt.Errorf("usage: series-index rebuild [-device-prefix prefix]")
+	}
+	fs := flag.NewFlagSet("series-index rebuild", flag.ContinueOnError)
+	prefix := fs.String("device-prefix", "", "only rebuild series of devices with this ID prefix")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	config := NewConfig()
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := initSeriesStorage(db); err != nil {
+		return err
+	}
+
+	table := "time_series_data"
+	if config.StorageLayout == storageLayoutCompact {
+		table = compactViewTable
+	}
+
+	// 最新值取按时间倒序拼接后的第一个（GROUP_CONCAT 截断不影响第一个元素）
+	result, err := db.Exec(`
+		INSERT INTO series_index (device_id, metric_name, first_timestamp, last_timestamp, last_value, sample_count)
+		SELECT device_id, metric_name, MIN(timestamp), MAX(timestamp),
+			   SUBSTRING_INDEX(GROUP_CONCAT(value ORDER BY timestamp DESC, id DESC), ',', 1) + 0,
+			   COUNT(*)
+		FROM `+table+`
+		WHERE device_id LIKE ?
+		GROUP BY device_id, metric_name
+		ON DUPLICATE KEY UPDATE
+			first_timestamp = VALUES(first_timestamp),
+			last_timestamp = VALUES(last_timestamp),
+			last_value = VALUES(last_value),
+			sample_count = VALUES(sample_count)
+	`, escapeLike(*prefix)+"%")
+	if err != nil {
+		return fmt.Errorf("failed to rebuild series index: %w", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	fmt.Printf("Series index rebuilt (%d rows affected)\n", affected)
+	return nil
+}
+
+// MetricSeriesCounts 按 series_index 统计每个指标的序列（设备）数，不扫描时序数据表
+// tenants 不为 nil 时只统计这些租户的设备
+func (si *SeriesIndex) MetricSeriesCounts(tenants []string) (map[string]int64, error) {
+	where, args := tenantFilter("device_id", tenants)
+	if where != "" {
+		where = " WHERE " + where
+	}
+
+	rows, err := si.db.Query("SELECT metric_name, COUNT(*) FROM series_index"+where+" GROUP BY metric_name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var metricName string
+		var count int64
+		if err := rows.Scan(&metricName, &count); err != nil {
+			return nil, err
+		}
+		counts[metricName] = count
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 请求签名
+//
+// 无法使用 TLS 客户端证书的网关可以用设备密钥对请求做 HMAC-SHA256 签名：
+//
+//	X-Device-ID:           设备ID
+//	X-Signature-Timestamp: Unix 时间戳（秒）
+//	X-Signature-Nonce:     每个请求唯一的随机串
+//	X-Signature:           hex(HMAC-SHA256(secret, canonical))
+//
+// canonical = METHOD \n PATH(含查询串) \n hex(SHA256(未压缩的请求体)) \n TIMESTAMP \n NONCE
+//
+// 时间戳超出允许的时钟偏差或 nonce 在窗口内重复出现的请求会被拒绝（防重放）。
+const (
+	headerDeviceID           = "X-Device-ID"
+	headerSignature          = "X-Signature"
+	headerSignatureTimestamp = "X-Signature-Timestamp"
+	headerSignatureNonce     = "X-Signature-Nonce"
+
+	// maxNonceLength nonce 最大长度，防止用超长 nonce 占用内存
+	maxNonceLength = 64
+	// deviceSecretCacheTTL 设备密钥的缓存时间，吊销后最多经过该时间生效
+	deviceSecretCacheTTL = 30 * time.Second
+)
+
+// errDeviceSecretNotFound 设备未配置签名密钥或已吊销
+var errDeviceSecretNotFound = errors.New("device secret not found")
+
+// initSigningStorage 创建 device_secrets 表
+// HMAC 校验需要原始密钥，因此密钥无法像 API Key 那样只保存摘要
+func initSigningStorage(db *sql.DB) error {
+	createDeviceSecretsTable := `
+	CREATE TABLE IF NOT EXISTS device_secrets (
+		device_id VARCHAR(100) PRIMARY KEY,
+		secret VARBINARY(64) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		revoked_at DATETIME NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+	if _, err := db.Exec(createDeviceSecretsTable); err != nil {
+		return fmt.Errorf("failed to create device_secrets table: %w", err)
+	}
+	return nil
+}
+
+// canonicalRequest 构造待签名的规范化请求串
+func canonicalRequest(method, path string, body []byte, timestamp, nonce string) string {
+	bodyHash := sha256.Sum256(body)
+	return method + "\n" + path + "\n" + hex.EncodeToString(bodyHash[:]) + "\n" + timestamp + "\n" + nonce
+}
+
+// signRequest 计算请求签名
+func signRequest(secret []byte, canonical string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deviceSecretCacheEntry 缓存的设备密钥，只缓存存在的密钥（任意 X-Device-ID 不会写入缓存）
+type deviceSecretCacheEntry struct {
+	secret  []byte
+	expires time.Time
+}
+
+// RequestVerifier 校验请求签名，并在时间窗口内记录已使用的 nonce
+type RequestVerifier struct {
+	db      *sql.DB
+	maxSkew time.Duration
+
+	secretMutex sync.Mutex
+	secrets     map[string]*deviceSecretCacheEntry
+	secretSweep time.Time
+
+	nonceMutex sync.Mutex
+	nonces     map[string]time.Time // device_id + nonce -> 过期时间
+	lastPurge  time.Time
+}
+
+func NewRequestVerifier(db *sql.DB, maxSkew time.Duration) *RequestVerifier {
+	return &RequestVerifier{
+		db:          db,
+		maxSkew:     maxSkew,
+		secrets:     make(map[string]*deviceSecretCacheEntry),
+		secretSweep: time.Now(),
+		nonces:      make(map[string]time.Time),
+		lastPurge:   time.Now(),
+	}
+}
+
+// secret 读取设备密钥（优先使用缓存）
+func (rv *RequestVerifier) secret(deviceID string) ([]byte, error) {
+	now := time.Now()
+	rv.secretMutex.Lock()
+	entry, ok := rv.secrets[deviceID]
+	rv.secretMutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.secret, nil
+	}
+
+	var secret []byte
+	err := rv.db.QueryRow(
+		"SELECT secret FROM device_secrets WHERE device_id = ? AND revoked_at IS NULL", deviceID,
+	).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return nil, errDeviceSecretNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device secret: %w", err)
+	}
+
+	rv.secretMutex.Lock()
+	defer rv.secretMutex.Unlock()
+	// 定期清理过期项（例如已吊销或不再上报的设备）
+	if now.Sub(rv.secretSweep) >= deviceSecretCacheTTL {
+		for id, cached := range rv.secrets {
+			if now.After(cached.expires) {
+				delete(rv.secrets, id)
+			}
+		}
+		rv.secretSweep = now
+	}
+	rv.secrets[deviceID] = &deviceSecretCacheEntry{secret: secret, expires: now.Add(deviceSecretCacheTTL)}
+	return secret, nil
+}
+
+// useNonce 记录 nonce，窗口内重复出现时返回 false
+// nonce 只需保留 2*maxSkew：更早的请求会因时间戳过期被拒绝
+func (rv *RequestVerifier) useNonce(deviceID, nonce string, now time.Time) bool {
+	rv.nonceMutex.Lock()
+	defer rv.nonceMutex.Unlock()
+
+	if now.Sub(rv.lastPurge) >= rv.maxSkew {
+		for key, expires := range rv.nonces {
+			if now.After(expires) {
+				delete(rv.nonces, key)
+			}
+		}
+		rv.lastPurge = now
+	}
+
+	key := deviceID + "\x00" + nonce
+	if expires, ok := rv.nonces[key]; ok && now.Before(expires) {
+		return false
+	}
+	rv.nonces[key] = now.Add(2 * rv.maxSkew)
+	return true
+}
+
+// Verify 校验签名，成功时返回签名的设备ID；body 为未压缩的请求体
+func (rv *RequestVerifier) Verify(r *http.Request, body []byte) (string, error) {
+	deviceID := r.Header.Get(headerDeviceID)
+	signature := r.Header.Get(headerSignature)
+	timestamp := r.Header.Get(headerSignatureTimestamp)
+	nonce := r.Header.Get(headerSignatureNonce)
+	if deviceID == "" || timestamp == "" || nonce == "" {
+		return "", fmt.Errorf("missing %s, %s or %s header", headerDeviceID, headerSignatureTimestamp, headerSignatureNonce)
+	}
+	if len(nonce) > maxNonceLength {
+		return "", fmt.Errorf("nonce too long (max %d)", maxNonceLength)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature timestamp")
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > rv.maxSkew || skew < -rv.maxSkew {
+		return "", fmt.Errorf("signature timestamp outside allowed window")
+	}
+
+	secret, err := rv.secret(deviceID)
+	if err != nil {
+		return "", err
+	}
+
+	expected := signRequest(secret, canonicalRequest(r.Method, r.URL.RequestURI(), body, timestamp, nonce))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", fmt.Errorf("signature mismatch")
+	}
+
+	// 签名正确后再记录 nonce，避免伪造请求占用合法设备的 nonce
+	if !rv.useNonce(deviceID, nonce, now) {
+		return "", fmt.Errorf("replayed nonce")
+	}
+	return deviceID, nil
+}
+
+// signedDeviceContextKey 请求上下文中保存已验证签名设备ID的键
+type signedDeviceContextKey struct{}
+
+// signedDeviceFromContext 返回请求签名对应的设备ID，未签名时为空串
+func signedDeviceFromContext(ctx context.Context) string {
+	deviceID, _ := ctx.Value(signedDeviceContextKey{}).(string)
+	return deviceID
+}
+
+// signatureMiddleware 校验携带签名的请求；required 为 true 时拒绝未签名的请求
+// 签名有效的请求视为该设备的 ingest 凭证，且只能写入该设备的数据
+func (s *Server) signatureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.verifier == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Header.Get(headerSignature) == "" {
+			if s.config.SigningRequired {
+				http.Error(w, "Request signature required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(&limitedReader{r: r.Body, remaining: s.config.MaxDecompressedBytes})
+		r.Body.Close()
+		if err != nil {
+			if errors.Is(err, errDecompressedTooLarge) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		deviceID, err := s.verifier.Verify(r, body)
+		if err != nil {
+			s.logger.WithError(err).WithField("device_id", r.Header.Get(headerDeviceID)).Warn("Rejected signed request")
+			http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signedDeviceContextKey{}, deviceID)))
+	})
+}
+
+// signedIngestRoute 在 ingestRoute 之前校验请求签名
+func (s *Server) signedIngestRoute(handler http.HandlerFunc) http.Handler {
+	return s.signatureMiddleware(s.ingestRoute(handler))
+}
+
+// runDeviceSecretCommand 设备签名密钥管理
+// 用法：
+//
+//	bench-server device-secret create -device factory_001_device_001
+//	bench-server device-secret revoke -device factory_001_device_001
+func runDeviceSecretCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "create" && args[0] != "revoke") {
+		return fmt.Errorf("usage: device-secret <create|revoke> -device <device_id>")
+	}
+
+	fs := flag.NewFlagSet("device-secret "+args[0], flag.ContinueOnError)
+	deviceID := fs.String("device", "", "device id (required)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *deviceID == "" {
+		return fmt.Errorf("-device is required")
+	}
+
+	config := NewConfig()
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := initSigningStorage(db); err != nil {
+		return err
+	}
+
+	if args[0] == "revoke" {
+		result, err := db.Exec("UPDATE device_secrets SET revoked_at = NOW() WHERE device_id = ? AND revoked_at IS NULL", *deviceID)
+		if err != nil {
+			return fmt.Errorf("failed to revoke device secret: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("no active secret for device %s", *deviceID)
+		}
+		fmt.Printf("Revoked secret of device %s\n", *deviceID)
+		return nil
+	}
+
+	// 重新创建会轮换密钥，旧密钥立即失效（服务端缓存最多30秒）
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`
+		INSERT INTO device_secrets (device_id, secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), created_at = CURRENT_TIMESTAMP, revoked_at = NULL
+	`, *deviceID, secret); err != nil {
+		return fmt.Errorf("failed to save device secret: %w", err)
+	}
+
+	fmt.Printf("Device: %s\n", *deviceID)
+	fmt.Printf("Secret: %s\n", hex.EncodeToString(secret))
+	fmt.Println("The HMAC key is the raw bytes of the hex secret above.")
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCanonicalRequest(t *testing.T) {
+	tests := []struct {
+		method, path string
+		body         string
+		timestamp    string
+		nonce        string
+		want         string
+	}{
+		{"POST", "/api/sensor-data", "", "1700000000", "abc",
+			"POST\n/api/sensor-data\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n1700000000\nabc"},
+		{"POST", "/api/sensor-data?async=1", "abc", "1700000001", "n-1",
+			"POST\n/api/sensor-data?async=1\nba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad\n1700000001\nn-1"},
+	}
+	for _, tt := range tests {
+		if got := canonicalRequest(tt.method, tt.path, []byte(tt.body), tt.timestamp, tt.nonce); got != tt.want {
+			t.Errorf("canonicalRequest(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	// RFC 4231 测试用例 2
+	if got := signRequest([]byte("Jefe"), "what do ya want for nothing?"); got != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Errorf("signRequest = %s", got)
+	}
+}
+
+// newSigningTestVerifier 返回已缓存 factory_001_device_0001 密钥的校验器，其他设备查询测试驱动（无密钥）
+func newSigningTestVerifier(t *testing.T) *RequestVerifier {
+	t.Helper()
+	db, err := sql.Open("authtest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	rv := NewRequestVerifier(db, time.Minute)
+	rv.secrets["factory_001_device_0001"] = &deviceSecretCacheEntry{secret: []byte("secret-1"), expires: time.Now().Add(time.Hour)}
+	return rv
+}
+
+// signedTestRequest 构造用 secret 对 body 签名的请求
+func signedTestRequest(secret, deviceID, target, body string, timestamp time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	r.Header.Set(headerDeviceID, deviceID)
+	r.Header.Set(headerSignatureTimestamp, ts)
+	r.Header.Set(headerSignatureNonce, nonce)
+	r.Header.Set(headerSignature, signRequest([]byte(secret), canonicalRequest("POST", r.URL.RequestURI(), []byte(body), ts, nonce)))
+	return r
+}
+
+func TestRequestVerifierVerify(t *testing.T) {
+	now := time.Now()
+	device := "factory_001_device_0001"
+	body := `{"device_id":"factory_001_device_0001","value":1}`
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		body    string // 服务端收到的请求体，为空时与签名的一致
+		ok      bool
+	}{
+		{"valid", func() *http.Request {
+			return signedTestRequest("secret-1", device, "/api/sensor-data?x=1", body, now, "n-valid")
+		}, "", true},
+		{"wrong secret", func() *http.Request {
+			return signedTestRequest("secret-2", device, "/api/sensor-data", body, now, "n-secret")
+		}, "", false},
+		{"tampered body", func() *http.Request {
+			return signedTestRequest("secret-1", device, "/api/sensor-data", body, now, "n-body")
+		}, `{"device_id":"factory_001_device_0001","value":2}`, false},
+		{"tampered query", func() *http.Request {
+			r := signedTestRequest("secret-1", device, "/api/sensor-data?x=1", body, now, "n-query")
+			r.URL.RawQuery = "x=2"
+			return r
+		}, "", false},
+		{"other device header", func() *http.Request {
+			r := signedTestRequest("secret-1", device, "/api/sensor-data", body, now, "n-device")
+			r.Header.Set(headerDeviceID, "factory_001_device_0002")
+			return r
+		}, "", false},
+		{"timestamp too old", func() *http.Request {
+			return signedTestRequest("secret-1", device, "/api/sensor-data", body, now.Add(-2*time.Minute), "n-old")
+		}, "", false},
+		{"timestamp in the future", func() *http.Request {
+			return signedTestRequest("secret-1", device, "/api/sensor-data", body, now.Add(2*time.Minute), "n-future")
+		}, "", false},
+		{"timestamp within skew", func() *http.Request {
+			return signedTestRequest("secret-1", device, "/api/sensor-data", body, now.Add(-50*time.Second), "n-skew")
+		}, "", true},
+		{"invalid timestamp", func() *http.Request {
+			r := signedTestRequest("secret-1", device, "/api/sensor-data", body, now, "n-ts")
+			r.Header.Set(headerSignatureTimestamp, "yesterday")
+			return r
+		}, "", false},
+		{"missing nonce", func() *http.Request {
+			r := signedTestRequest("secret-1", device, "/api/sensor-data", body, now, "n-missing")
+			r.Header.Del(headerSignatureNonce)
+			return r
+		}, "", false},
+		{"nonce too long", func() *http.Request {
+			return signedTestRequest("secret-1", device, "/api/sensor-data", body, now, strings.Repeat("n", maxNonceLength+1))
+		}, "", false},
+		{"unknown device", func() *http.Request {
+			return signedTestRequest("secret-1", "factory_001_device_0009", "/api/sensor-data", body, now, "n-unknown")
+		}, "", false},
+	}
+
+	rv := newSigningTestVerifier(t)
+	for _, tt := range tests {
+		received := tt.body
+		if received == "" {
+			received = body
+		}
+		deviceID, err := rv.Verify(tt.request(), []byte(received))
+		if tt.ok && (err != nil || deviceID != device) {
+			t.Errorf("%s: Verify = %q, %v", tt.name, deviceID, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: Verify accepted the request", tt.name)
+		}
+	}
+}
+
+func TestRequestVerifierRejectsReplayedNonce(t *testing.T) {
+	rv := newSigningTestVerifier(t)
+	rv.secrets["factory_001_device_0002"] = &deviceSecretCacheEntry{secret: []byte("secret-2"), expires: time.Now().Add(time.Hour)}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		secret string
+		device string
+		nonce  string
+		ok     bool
+	}{
+		{"first use", "secret-1", "factory_001_device_0001", "nonce-1", true},
+		{"replay", "secret-1", "factory_001_device_0001", "nonce-1", false},
+		{"same nonce, other device", "secret-2", "factory_001_device_0002", "nonce-1", true},
+		{"new nonce", "secret-1", "factory_001_device_0001", "nonce-2", true},
+		// 签名错误的请求不占用 nonce
+		{"forged", "wrong", "factory_001_device_0001", "nonce-3", false},
+		{"after forged", "secret-1", "factory_001_device_0001", "nonce-3", true},
+	}
+	for _, tt := range tests {
+		_, err := rv.Verify(signedTestRequest(tt.secret, tt.device, "/api/sensor-data", "{}", now, tt.nonce), []byte("{}"))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// nonce 在 2*maxSkew 后过期并被清理
+	later := now.Add(3 * time.Minute)
+	if !rv.useNonce("factory_001_device_0001", "nonce-1", later) {
+		t.Error("nonce still rejected after the replay window")
+	}
+	rv.nonceMutex.Lock()
+	remaining := len(rv.nonces)
+	rv.nonceMutex.Unlock()
+	if remaining != 1 {
+		t.Errorf("nonces = %d after purge, want 1", remaining)
+	}
+}
+
+func TestSignatureMiddlewareHashesDecompressedBody(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s := &Server{
+		logger:   logger,
+		config:   &Config{MaxDecompressedBytes: 1 << 20},
+		verifier: newSigningTestVerifier(t),
+	}
+	var received string
+	handler := s.decompressionMiddleware(s.signatureMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = string(data)
+		if signedDeviceFromContext(r.Context()) == "" {
+			t.Error("signed device missing from context")
+		}
+	})))
+
+	body := `{"device_id":"factory_001_device_0001","value":1}`
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte(body))
+	gw.Close()
+
+	tests := []struct {
+		name       string
+		signedBody string
+		status     int
+	}{
+		{"signature over uncompressed body", body, http.StatusOK},
+		{"signature over compressed bytes", compressed.String(), http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		r := signedTestRequest("secret-1", "factory_001_device_0001", "/api/sensor-data", tt.signedBody, time.Now(), "nonce-"+strconv.Itoa(i))
+		r.Body = io.NopCloser(bytes.NewReader(compressed.Bytes()))
+		r.Header.Set("Content-Encoding", "gzip")
+		received = ""
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && received != body {
+			t.Errorf("%s: handler received %q", tt.name, received)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"text/tabwriter"
+)
+
+// 紧凑存储布局
+//
+// device_id / metric_name 通过 devices / metrics 字典表映射为整数ID，数值按指标精度
+// 存储为放大后的整数（value_scaled = round(value * 10^precision)）。
+// 读取统一通过视图 time_series_compact_view 还原为与 time_series_data 相同的列，
+// 因此查询接口无需区分存储布局。
+const (
+	storageLayoutRow     = "row"
+	storageLayoutCompact = "compact"
+
+	compactTable     = "time_series_compact"
+	compactViewTable = "time_series_compact_view"
+
+	// maxScaledValue 放大后的整数超过 2^53 时 float64 无法精确还原
+	maxScaledValue = 1 << 53
+)
+
+// initCompactStorage 创建紧凑布局所需的字典表、数据表和读取视图
+func initCompactStorage(db *sql.DB) error {
+	statements := []struct {
+		name  string
+		query string
+	}{
+		{"devices", `
+		CREATE TABLE IF NOT EXISTS devices (
+			id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+			device_id VARCHAR(100) NOT NULL,
+			factory_prefix VARCHAR(100) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_device_id (device_id),
+			INDEX idx_factory_prefix (factory_prefix)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+		`},
+		{"metrics", `
+		CREATE TABLE IF NOT EXISTS metrics (
+			id SMALLINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+			metric_name VARCHAR(50) NOT NULL,
+			value_precision TINYINT UNSIGNED NOT NULL DEFAULT 2,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uk_metric_name (metric_name)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+		`},
+		{compactTable, `
+		CREATE TABLE IF NOT EXISTS time_series_compact (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			timestamp DATETIME(3) NOT NULL,
+			device_ref INT UNSIGNED NOT NULL,
+			metric_ref SMALLINT UNSIGNED NOT NULL,
+			value_scaled BIGINT NOT NULL,
+			priority TINYINT NOT NULL DEFAULT 2,
+			data TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_timestamp (timestamp),
+			INDEX idx_device_metric_time (device_ref, metric_ref, timestamp, id),
+			INDEX idx_device_time (device_ref, timestamp, id),
+			INDEX idx_priority (priority)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+		`},
+		{compactViewTable, `
+		CREATE OR REPLACE ALGORITHM=MERGE VIEW time_series_compact_view AS
+		SELECT c.id, c.timestamp, d.device_id, m.metric_name,
+			   c.value_scaled / POW(10, m.value_precision) AS value,
+			   c.priority, c.data, c.created_at
+		FROM time_series_compact c
+		JOIN devices d ON d.id = c.device_ref
+		JOIN metrics m ON m.id = c.metric_ref
+		`},
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt.query); err != nil {
+			return fmt.Errorf("failed to create %s: %w", stmt.name, err)
+		}
+	}
+	return nil
+}
+
+// compactMetric 指标字典项
+type compactMetric struct {
+	id        uint16
+	precision int
+}
+
+// CompactStore 维护字典表的内存缓存，并将传感器数据编码为紧凑行
+type CompactStore struct {
+	db               *sql.DB
+	defaultPrecision int
+	metricPrecision  map[string]int
+
+	mutex   sync.RWMutex
+	devices map[string]uint32
+	metrics map[string]compactMetric
+}
+
+func NewCompactStore(db *sql.DB, defaultPrecision int, metricPrecision map[string]int) *CompactStore {
+	return &CompactStore{
+		db:               db,
+		defaultPrecision: defaultPrecision,
+		metricPrecision:  metricPrecision,
+		devices:          make(map[string]uint32),
+		metrics:          make(map[string]compactMetric),
+	}
+}
+
+// openCompactStore 按配置的存储布局创建紧凑存储，行布局时返回 nil
+// 启用指标目录时，目录中的精度作为紧凑存储的指标精度（storage.metric_precision 优先）
+func openCompactStore(db *sql.DB, config *Config, catalogPolicy metricCatalogPolicy) (*CompactStore, error) {
+	if config.StorageLayout != storageLayoutCompact {
+		return nil, nil
+	}
+	if err := initCompactStorage(db); err != nil {
+		return nil, fmt.Errorf("failed to initialize compact storage: %w", err)
+	}
+	metricPrecision := make(map[string]int)
+	if catalogPolicy.enabled {
+		for name, def := range catalogPolicy.metrics {
+			if def.Precision != nil {
+				metricPrecision[name] = *def.Precision
+			}
+		}
+	}
+	for name, precision := range config.MetricPrecision {
+		metricPrecision[name] = precision
+	}
+	return NewCompactStore(db, config.DefaultValuePrecision, metricPrecision), nil
+}
+
+// deviceRef 返回设备的整数ID，不存在时写入字典表
+func (cs *CompactStore) deviceRef(deviceID string) (uint32, error) {
+	cs.mutex.RLock()
+	id, ok := cs.devices[deviceID]
+	cs.mutex.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	// LAST_INSERT_ID(id) 使重复插入时也能取回已有ID
+	result, err := cs.db.Exec(`
+		INSERT INTO devices (device_id, factory_prefix) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)
+	`, deviceID, factoryPrefix(deviceID))
+	if err != nil {
+		return 0, fmt.Errorf("failed to register device %s: %w", deviceID, err)
+	}
+	lastID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	id = uint32(lastID)
+	cs.mutex.Lock()
+	cs.devices[deviceID] = id
+	cs.mutex.Unlock()
+	return id, nil
+}
+
+// metricRef 返回指标的整数ID和精度，不存在时按配置精度写入字典表
+// 指标精度在首次写入时确定，之后修改配置不会影响已存储的数据
+func (cs *CompactStore) metricRef(metricName string) (compactMetric, error) {
+	cs.mutex.RLock()
+	metric, ok := cs.metrics[metricName]
+	cs.mutex.RUnlock()
+	if ok {
+		return metric, nil
+	}
+
+	precision, ok := cs.metricPrecision[metricName]
+	if !ok {
+		precision = cs.defaultPrecision
+	}
+
+	if _, err := cs.db.Exec(`
+		INSERT IGNORE INTO metrics (metric_name, value_precision) VALUES (?, ?)
+	`, metricName, precision); err != nil {
+		return metric, fmt.Errorf("failed to register metric %s: %w", metricName, err)
+	}
+
+	var id uint16
+	if err := cs.db.QueryRow(
+		"SELECT id, value_precision FROM metrics WHERE metric_name = ?", metricName,
+	).Scan(&id, &precision); err != nil {
+		return metric, fmt.Errorf("failed to load metric %s: %w", metricName, err)
+	}
+
+	metric = compactMetric{id: id, precision: precision}
+	cs.mutex.Lock()
+	cs.metrics[metricName] = metric
+	cs.mutex.Unlock()
+	return metric, nil
+}
+
+// encode 将一行数据编码为紧凑表的列值：device_ref, metric_ref, value_scaled
+func (cs *CompactStore) encode(deviceID, metricName string, value float64) (uint32, uint16, int64, error) {
+	deviceRef, err := cs.deviceRef(deviceID)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	metric, err := cs.metricRef(metricName)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	scaled := math.Round(value * math.Pow10(metric.precision))
+	if math.IsNaN(scaled) || math.Abs(scaled) >= maxScaledValue {
+		return 0, 0, 0, fmt.Errorf("value %v of metric %s out of range for compact storage", value, metricName)
+	}
+	return deviceRef, metric.id, int64(scaled), nil
+}
+
+// runStorageReport 统计两种存储布局的每行字节数，评估紧凑布局节省的空间
+// 用法：bench-server storage-report
+func runStorageReport(args []string) error {
+	fs := flag.NewFlagSet("storage-report", flag.ContinueOnError)
+	sampleSize := fs.Int("sample", 100000, "number of recent rows sampled for logical size estimate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config := NewConfig()
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	// 1. InnoDB 物理占用（information_schema 中的行数为估算值）
+	fmt.Fprintln(tw, "table\trows(est)\tdata_bytes\tindex_bytes\tbytes/row")
+	physical := make(map[string]float64)
+	for _, table := range []string{"time_series_data", compactTable, "devices", "metrics"} {
+		var rows, dataLength, indexLength sql.NullInt64
+		err := db.QueryRow(`
+			SELECT TABLE_ROWS, DATA_LENGTH, INDEX_LENGTH
+			FROM information_schema.TABLES
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+		`, table).Scan(&rows, &dataLength, &indexLength)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read table status of %s: %w", table, err)
+		}
+		perRow := 0.0
+		if rows.Int64 > 0 {
+			perRow = float64(dataLength.Int64+indexLength.Int64) / float64(rows.Int64)
+		}
+		physical[table] = perRow
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\n", table, rows.Int64, dataLength.Int64, indexLength.Int64, perRow)
+	}
+	fmt.Fprintln(tw)
+
+	// 2. 逻辑估算：行布局中 device_id / metric_name / value 的平均字节数与紧凑布局对比
+	//    紧凑布局：INT device_ref(4) + SMALLINT metric_ref(2) + BIGINT value_scaled(8)
+	var avgRowBytes sql.NullFloat64
+	var sampled int64
+	err = db.QueryRow(`
+		SELECT AVG(LENGTH(device_id) + 1 + LENGTH(metric_name) + 1 + 8), COUNT(*)
+		FROM (SELECT device_id, metric_name FROM time_series_data ORDER BY id DESC LIMIT ?) t
+	`, *sampleSize).Scan(&avgRowBytes, &sampled)
+	if err != nil {
+		return fmt.Errorf("failed to sample time_series_data: %w", err)
+	}
+
+	const compactRowBytes = 4 + 2 + 8
+	fmt.Fprintln(tw, "layout\tsampled_rows\tkey+value bytes/row")
+	fmt.Fprintf(tw, "row\t%d\t%.1f\n", sampled, avgRowBytes.Float64)
+	fmt.Fprintf(tw, "compact\t-\t%d\n", compactRowBytes)
+	if avgRowBytes.Valid {
+		fmt.Fprintf(tw, "saved\t-\t%.1f (%.1f%%)\n", avgRowBytes.Float64-compactRowBytes,
+			(avgRowBytes.Float64-compactRowBytes)/avgRowBytes.Float64*100)
+	}
+	if row, compact := physical["time_series_data"], physical[compactTable]; row > 0 && compact > 0 {
+		fmt.Fprintf(tw, "physical saved\t-\t%.1f bytes/row\n", row-compact)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// streamHeartbeatInterval SSE 心跳间隔，避免代理断开空闲连接
+const streamHeartbeatInterval = 15 * time.Second
+
+// parseStreamFilter 解析订阅条件：prefix、metric（逗号分隔）、min_priority（1-3）、types（reading,alert）
+func parseStreamFilter(r *http.Request) (StreamFilter, error) {
+	query := r.URL.Query()
+	filter := StreamFilter{
+		DevicePrefix: query.Get("prefix"),
+		Metrics:      splitList(query.Get("metric")),
+		Types:        splitList(query.Get("types")),
+	}
+	if v := query.Get("min_priority"); v != "" {
+		priority, err := strconv.Atoi(v)
+		if err != nil || priority < 1 {
+			return filter, fmt.Errorf("invalid min_priority %q (expected 1, 2 or 3)", v)
+		}
+		filter.MinPriority = priority
+	}
+	return filter, filter.validate()
+}
+
+// writeSSE 按 SSE 格式写出一个事件
+func writeSSE(w http.ResponseWriter, id uint64, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+// streamHandler 以 SSE 推送新写入的数据和告警：GET /api/stream?prefix=&metric=&min_priority=&types=
+// 断线重连时携带 Last-Event-ID（或 last_event_id 参数）从缓冲区续传
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Tenants = s.requestTenants(r)
+
+	var lastEventID uint64
+	resume := false
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID != "" {
+		if lastEventID, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		resume = true
+	}
+
+	sub, backlog, gap, err := s.bus.Subscribe([]StreamFilter{filter}, lastEventID, resume)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.bus.Unsubscribe(sub)
+
+	// 长连接不受服务端写超时限制
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if gap {
+		// 请求续传的部分事件已不在缓冲区中
+		if err := writeSSE(w, 0, "gap", map[string]interface{}{"last_event_id": lastEventID}); err != nil {
+			return
+		}
+	}
+	for _, event := range backlog {
+		if err := writeSSE(w, event.ID, event.Type, event.Data); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				if sub.CloseReason() == closeReasonSlow {
+					fmt.Fprint(w, ": subscriber too slow, reconnect with Last-Event-ID\n\n")
+					rc.Flush()
+				}
+				return
+			}
+			if err := writeSSE(w, event.ID, event.Type, event.Data); err != nil {
+				return
+			}
+			// 合并已到达的事件后再刷新
+			for drained := false; !drained; {
+				select {
+				case event, ok := <-sub.Events():
+					if !ok {
+						drained = true
+						break
+					}
+					if err := writeSSE(w, event.ID, event.Type, event.Data); err != nil {
+						return
+					}
+				default:
+					drained = true
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
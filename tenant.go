@@ -0,0 +1,548 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 租户
+//
+// 租户即工厂：设备ID factory_XXX_device_YYY 属于租户 factory_XXX，不符合该模式的设备归入 default 租户。
+// 请求可访问的租户由认证身份决定（API Key 的工厂限制、签名设备、客户端证书前缀），未限制时可访问全部租户。
+const (
+	defaultTenant = "default"
+
+	// tenantUsageFlushInterval 用量计数写回 tenant_usage 表的间隔
+	tenantUsageFlushInterval = 5 * time.Second
+	// rowOverheadBytes 估算存储用量时每行的固定开销（时间戳、数值、索引等）
+	rowOverheadBytes = 64
+)
+
+// tenantOf 返回设备所属的租户
+func tenantOf(deviceID string) string {
+	if prefix := factoryPrefix(deviceID); prefix != "" {
+		return prefix
+	}
+	return defaultTenant
+}
+
+// tenantOfPrefix 将设备ID前缀（如客户端证书映射的前缀）转换为租户
+func tenantOfPrefix(prefix string) string {
+	if tenant := factoryPrefix(prefix); tenant != "" {
+		return tenant
+	}
+	return strings.TrimSuffix(prefix, "_")
+}
+
+// TenantQuota 租户配额，0 表示不限制
+type TenantQuota struct {
+	RowsPerDay   int64 `yaml:"rows_per_day"`
+	StorageBytes int64 `yaml:"storage_bytes"`
+}
+
+// initTenantStorage 创建 tenant_usage 表（按天累计写入行数和估算字节数）
+func initTenantStorage(db *sql.DB) error {
+	createTenantUsageTable := `
+	CREATE TABLE IF NOT EXISTS tenant_usage (
+		tenant VARCHAR(100) NOT NULL,
+		day DATE NOT NULL,
+		rows_written BIGINT NOT NULL DEFAULT 0,
+		bytes_written BIGINT NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (tenant, day)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+	if _, err := db.Exec(createTenantUsageTable); err != nil {
+		return fmt.Errorf("failed to create tenant_usage table: %w", err)
+	}
+	return nil
+}
+
+// tenantCounters 单个租户的用量
+// 当前用量 = 加载时 tenant_usage 中的值（不含本进程已写回的部分）+ 本进程记录的用量
+type tenantCounters struct {
+	loaded           bool
+	baseRowsToday    int64
+	baseBytes        int64
+	rowsToday        int64 // 本进程当天记录的行数
+	storageBytes     int64 // 本进程记录的估算存储字节数
+	flushedRowsToday int64 // 其中已写回 tenant_usage 的部分
+	flushedBytes     int64
+}
+
+// tenantDay 未写回用量的键
+type tenantDay struct {
+	tenant string
+	day    string
+}
+
+// tenantDelta 未写回的用量
+type tenantDelta struct {
+	rows  int64
+	bytes int64
+}
+
+// TenantUsage 维护各租户的用量计数并执行配额检查
+// 计数在内存中累加，定期批量写回 tenant_usage 表。
+// mutex 只保护内存计数，数据库读写在 mutex 之外进行（写回时先交换出未写回的计数），
+// ioMutex 串行化写回和加载，保证加载时已写回的部分不会被重复计算
+type TenantUsage struct {
+	db *sql.DB
+
+	ioMutex      sync.Mutex
+	mutex        sync.Mutex
+	day          string
+	counters     map[string]*tenantCounters
+	pending      map[tenantDay]*tenantDelta
+	defaultQuota TenantQuota
+	overrides    map[string]TenantQuota
+}
+
+func NewTenantUsage(db *sql.DB, defaultQuota TenantQuota, overrides map[string]TenantQuota) *TenantUsage {
+	return &TenantUsage{
+		db:           db,
+		day:          time.Now().Format("2006-01-02"),
+		counters:     make(map[string]*tenantCounters),
+		pending:      make(map[tenantDay]*tenantDelta),
+		defaultQuota: defaultQuota,
+		overrides:    overrides,
+	}
+}
+
+// SetQuotas 替换配额配置（配置重新加载时调用）
+func (tu *TenantUsage) SetQuotas(defaultQuota TenantQuota, overrides map[string]TenantQuota) {
+	tu.mutex.Lock()
+	defer tu.mutex.Unlock()
+	tu.defaultQuota = defaultQuota
+	tu.overrides = overrides
+}
+
+// Quota 返回租户的配额
+func (tu *TenantUsage) Quota(tenant string) TenantQuota {
+	tu.mutex.Lock()
+	defer tu.mutex.Unlock()
+	return tu.quotaFor(tenant)
+}
+
+// quotaFor 返回租户的配额，调用方需持有 mutex
+func (tu *TenantUsage) quotaFor(tenant string) TenantQuota {
+	if quota, ok := tu.overrides[tenant]; ok {
+		return quota
+	}
+	return tu.defaultQuota
+}
+
+// countersFor 返回租户的内存计数（可能尚未加载），调用方需持有 mutex
+func (tu *TenantUsage) countersFor(tenant string) *tenantCounters {
+	// 跨天时当天计数归零并重新加载（未写回的部分仍计入前一天）
+	if today := time.Now().Format("2006-01-02"); today != tu.day {
+		tu.day = today
+		for _, c := range tu.counters {
+			c.loaded = false
+			c.rowsToday = 0
+			c.flushedRowsToday = 0
+		}
+	}
+
+	c, ok := tu.counters[tenant]
+	if !ok {
+		c = &tenantCounters{}
+		tu.counters[tenant] = c
+	}
+	return c
+}
+
+// load 从 tenant_usage 表加载租户已有的用量（只在首次检查配额或跨天后执行）
+func (tu *TenantUsage) load(tenant string) error {
+	tu.mutex.Lock()
+	loaded := tu.countersFor(tenant).loaded
+	tu.mutex.Unlock()
+	if loaded {
+		return nil
+	}
+
+	tu.ioMutex.Lock()
+	defer tu.ioMutex.Unlock()
+
+	tu.mutex.Lock()
+	c := tu.countersFor(tenant)
+	day, flushedRows, flushedBytes := tu.day, c.flushedRowsToday, c.flushedBytes
+	loaded = c.loaded
+	tu.mutex.Unlock()
+	if loaded {
+		return nil
+	}
+
+	var rowsToday, storageBytes int64
+	err := tu.db.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN day = ? THEN rows_written END), 0), COALESCE(SUM(bytes_written), 0)
+		FROM tenant_usage WHERE tenant = ?
+	`, day, tenant).Scan(&rowsToday, &storageBytes)
+	if err != nil {
+		return fmt.Errorf("failed to load usage of tenant %s: %w", tenant, err)
+	}
+
+	tu.mutex.Lock()
+	defer tu.mutex.Unlock()
+	if tu.day == day && !c.loaded {
+		c.baseRowsToday = rowsToday - flushedRows
+		c.baseBytes = storageBytes - flushedBytes
+		c.loaded = true
+	}
+	return nil
+}
+
+// TenantQuotaError 租户超出配额
+type TenantQuotaError struct {
+	Tenant     string
+	Resource   string // rows_per_day / storage_bytes
+	Limit      int64
+	RetryAfter time.Duration // 按天的配额在次日零点重置；存储配额为0
+}
+
+func (e *TenantQuotaError) Error() string {
+	return fmt.Sprintf("tenant %s exceeded %s quota (%d)", e.Tenant, e.Resource, e.Limit)
+}
+
+// Check 检查本次写入（每个租户的行数）是否超出配额
+func (tu *TenantUsage) Check(rows map[string]int64) error {
+	for tenant, n := range rows {
+		quota := tu.Quota(tenant)
+		if quota.RowsPerDay <= 0 && quota.StorageBytes <= 0 {
+			continue
+		}
+		if err := tu.load(tenant); err != nil {
+			return err
+		}
+
+		tu.mutex.Lock()
+		c := tu.countersFor(tenant)
+		rowsToday := c.baseRowsToday + c.rowsToday
+		storageBytes := c.baseBytes + c.storageBytes
+		tu.mutex.Unlock()
+
+		if quota.RowsPerDay > 0 && rowsToday+n > quota.RowsPerDay {
+			now := time.Now()
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+			return &TenantQuotaError{Tenant: tenant, Resource: "rows_per_day", Limit: quota.RowsPerDay, RetryAfter: midnight.Sub(now)}
+		}
+		if quota.StorageBytes > 0 && storageBytes >= quota.StorageBytes {
+			return &TenantQuotaError{Tenant: tenant, Resource: "storage_bytes", Limit: quota.StorageBytes}
+		}
+	}
+	return nil
+}
+
+// Record 记录写入成功的数据
+func (tu *TenantUsage) Record(rows []*SensorData) {
+	tu.record(rows, true)
+}
+
+// RecordStorage 只记录存储用量，不计入当日写入行数：导入、恢复等批量写入不占用 rows_per_day 配额
+func (tu *TenantUsage) RecordStorage(rows []*SensorData) {
+	tu.record(rows, false)
+}
+
+func (tu *TenantUsage) record(rows []*SensorData, countRows bool) {
+	tu.mutex.Lock()
+	defer tu.mutex.Unlock()
+
+	for _, row := range rows {
+		tenant := tenantOf(row.DeviceID)
+		c := tu.countersFor(tenant)
+		bytes := int64(rowOverheadBytes + len(row.DeviceID) + len(row.MetricName) + len(row.Data))
+		c.storageBytes += bytes
+
+		key := tenantDay{tenant: tenant, day: tu.day}
+		delta, ok := tu.pending[key]
+		if !ok {
+			delta = &tenantDelta{}
+			tu.pending[key] = delta
+		}
+		delta.bytes += bytes
+		if countRows {
+			c.rowsToday++
+			delta.rows++
+		}
+	}
+}
+
+// Flush 将未写回的用量写入 tenant_usage 表；写回失败的计数保留到下次
+func (tu *TenantUsage) Flush() {
+	tu.ioMutex.Lock()
+	defer tu.ioMutex.Unlock()
+
+	tu.mutex.Lock()
+	pending := tu.pending
+	tu.pending = make(map[tenantDay]*tenantDelta)
+	tu.mutex.Unlock()
+
+	flushed := make(map[tenantDay]bool, len(pending))
+	for key, delta := range pending {
+		_, err := tu.db.Exec(`
+			INSERT INTO tenant_usage (tenant, day, rows_written, bytes_written) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE rows_written = rows_written + VALUES(rows_written), bytes_written = bytes_written + VALUES(bytes_written)
+		`, key.tenant, key.day, delta.rows, delta.bytes)
+		flushed[key] = err == nil
+	}
+
+	tu.mutex.Lock()
+	defer tu.mutex.Unlock()
+	for key, delta := range pending {
+		if !flushed[key] {
+			if current, ok := tu.pending[key]; ok {
+				current.rows += delta.rows
+				current.bytes += delta.bytes
+			} else {
+				tu.pending[key] = delta
+			}
+			continue
+		}
+		c := tu.countersFor(key.tenant)
+		c.flushedBytes += delta.bytes
+		if key.day == tu.day {
+			c.flushedRowsToday += delta.rows
+		}
+	}
+}
+
+// Run 定期写回用量，stop 关闭时做最后一次写回
+func (tu *TenantUsage) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tu.Flush()
+		case <-stop:
+			tu.Flush()
+			return
+		}
+	}
+}
+
+// requestTenants 返回请求可访问的租户，nil 表示不限制
+func (s *Server) requestTenants(r *http.Request) []string {
+	var tenants []string
+	if key := apiKeyFromContext(r.Context()); key != nil && len(key.Factories) > 0 {
+		tenants = append(tenants, key.Factories...)
+	}
+	if device := signedDeviceFromContext(r.Context()); device != "" {
+		tenants = append(tenants, tenantOf(device))
+	}
+	if prefixes := s.clientCertPrefixes(r); prefixes != nil {
+		for _, prefix := range prefixes {
+			tenants = append(tenants, tenantOfPrefix(prefix))
+		}
+		if len(tenants) == 0 {
+			// 证书没有映射任何前缀：不能访问任何租户
+			return []string{}
+		}
+	}
+	return tenants
+}
+
+// deviceAccess 租户之外更细的设备限制：签名请求只能访问签名设备，客户端证书只能访问映射的设备ID前缀
+type deviceAccess struct {
+	signedDevice string
+	certPrefixes []string // nil 表示不限制
+}
+
+// requestDeviceAccess 返回请求凭证的设备限制
+func (s *Server) requestDeviceAccess(r *http.Request) deviceAccess {
+	return deviceAccess{
+		signedDevice: signedDeviceFromContext(r.Context()),
+		certPrefixes: s.clientCertPrefixes(r),
+	}
+}
+
+// allows 判断是否允许访问设备
+func (a deviceAccess) allows(deviceID string) bool {
+	if a.signedDevice != "" && deviceID != a.signedDevice {
+		return false
+	}
+	return a.certPrefixes == nil || certAllowsDevice(a.certPrefixes, deviceID)
+}
+
+// filter 构造与 allows 一致的 SQL 条件，没有限制时返回空条件
+func (a deviceAccess) filter(column string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if a.signedDevice != "" {
+		conditions = append(conditions, column+" = ?")
+		args = append(args, a.signedDevice)
+	}
+	if clause, clauseArgs := certPrefixFilter(column, a.certPrefixes); clause != "" {
+		conditions = append(conditions, clause)
+		args = append(args, clauseArgs...)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// tenantFilter 构造按租户过滤设备ID列的 SQL 条件，tenants 为 nil 时返回空条件
+func tenantFilter(column string, tenants []string) (string, []interface{}) {
+	if tenants == nil {
+		return "", nil
+	}
+	if len(tenants) == 0 {
+		return "1 = 0", nil
+	}
+
+	// 与 tenantOf 一致：按第一个 _device_ 划分，位于开头或不存在时属于 default 租户
+	conditions := make([]string, 0, len(tenants))
+	args := make([]interface{}, 0, len(tenants))
+	for _, tenant := range tenants {
+		if tenant == defaultTenant {
+			conditions = append(conditions, column+` NOT LIKE '_%\_device\_%'`, column+` LIKE '\_device\_%'`)
+			continue
+		}
+		if tenant == "" || factoryPrefix(tenant+"_device_") != tenant {
+			// tenantOf 不会返回这样的租户（例如本身含有 _device_）
+			continue
+		}
+		conditions = append(conditions, column+" LIKE ?")
+		args = append(args, escapeLike(tenant)+`\_device\_%`)
+	}
+	if len(conditions) == 0 {
+		return "1 = 0", nil
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// escapeLike 转义 LIKE 模式中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// checkTenantQuota 检查写入是否超出租户配额，超出时写入错误响应并返回 false
+func (s *Server) checkTenantQuota(w http.ResponseWriter, deviceCounts map[string]int) bool {
+	if s.tenantUsage == nil {
+		return true
+	}
+
+	rows := make(map[string]int64)
+	for deviceID, n := range deviceCounts {
+		rows[tenantOf(deviceID)] += int64(n)
+	}
+
+	err := s.tenantUsage.Check(rows)
+	if err == nil {
+		return true
+	}
+	if quotaErr, ok := err.(*TenantQuotaError); ok {
+		if quotaErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quotaErr.RetryAfter.Seconds()))))
+			http.Error(w, quotaErr.Error(), http.StatusTooManyRequests)
+		} else {
+			http.Error(w, quotaErr.Error(), http.StatusInsufficientStorage)
+		}
+		return false
+	}
+	s.logger.WithError(err).Error("Failed to check tenant quota")
+	http.Error(w, "Database error", http.StatusInternalServerError)
+	return false
+}
+
+// tenantsHandler 管理员视图：各租户的用量与配额
+func (s *Server) tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.tenantUsage != nil {
+		s.tenantUsage.Flush()
+	}
+
+	type tenantView struct {
+		tenant               string
+		devices, alerts      int64
+		rowsToday, rowsTotal int64
+		storageBytes         int64
+	}
+	views := make(map[string]*tenantView)
+	view := func(tenant string) *tenantView {
+		v, ok := views[tenant]
+		if !ok {
+			v = &tenantView{tenant: tenant}
+			views[tenant] = v
+		}
+		return v
+	}
+
+	rows, err := s.db.Query(`
+		SELECT tenant,
+			   COALESCE(SUM(CASE WHEN day = CURDATE() THEN rows_written END), 0),
+			   SUM(rows_written), SUM(bytes_written)
+		FROM tenant_usage GROUP BY tenant
+	`)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to query tenant usage")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var tenant string
+		var today, total, bytes int64
+		if err := rows.Scan(&tenant, &today, &total, &bytes); err != nil {
+			rows.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		v := view(tenant)
+		v.rowsToday, v.rowsTotal, v.storageBytes = today, total, bytes
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT device_id, alert_count FROM device_status`)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to query device status")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var deviceID string
+		var alerts sql.NullInt64
+		if err := rows.Scan(&deviceID, &alerts); err != nil {
+			rows.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		v := view(tenantOf(deviceID))
+		v.devices++
+		v.alerts += alerts.Int64
+	}
+	rows.Close()
+
+	names := make([]string, 0, len(views))
+	for tenant := range views {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+
+	result := make([]map[string]interface{}, 0, len(names))
+	for _, tenant := range names {
+		v := views[tenant]
+		var quota TenantQuota
+		if s.tenantUsage != nil {
+			quota = s.tenantUsage.Quota(tenant)
+		}
+		result = append(result, map[string]interface{}{
+			"tenant":              v.tenant,
+			"devices":             v.devices,
+			"alerts":              v.alerts,
+			"rows_today":          v.rowsToday,
+			"rows_total":          v.rowsTotal,
+			"storage_bytes":       v.storageBytes,
+			"quota_rows_per_day":  quota.RowsPerDay,
+			"quota_storage_bytes": quota.StorageBytes,
+		})
+	}
+
+	s.writeResponse(w, r, map[string]interface{}{
+		"tenants": result,
+		"count":   len(result),
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// sqlLike 按 MySQL LIKE 的语义匹配（% 任意串，_ 单个字符，\ 转义）
+func sqlLike(value, pattern string) bool {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile("(?s)" + re.String()).MatchString(value)
+}
+
+var tenantConditionPattern = regexp.MustCompile(`^device_id (NOT )?LIKE (\?|'([^']*)')$`)
+
+// evalTenantFilter 对一个设备ID求值 tenantFilter 生成的条件
+func evalTenantFilter(t *testing.T, clause string, args []interface{}, deviceID string) bool {
+	t.Helper()
+	if clause == "1 = 0" {
+		return false
+	}
+	if !strings.HasPrefix(clause, "(") || !strings.HasSuffix(clause, ")") {
+		t.Fatalf("unexpected clause %q", clause)
+	}
+	matched := false
+	for _, condition := range strings.Split(clause[1:len(clause)-1], " OR ") {
+		m := tenantConditionPattern.FindStringSubmatch(condition)
+		if m == nil {
+			t.Fatalf("unexpected condition %q", condition)
+		}
+		pattern := m[3]
+		if m[2] == "?" {
+			pattern, args = args[0].(string), args[1:]
+		}
+		if sqlLike(deviceID, pattern) != (m[1] == "NOT ") {
+			matched = true
+		}
+	}
+	if len(args) != 0 {
+		t.Fatalf("clause %q left %d unused args", clause, len(args))
+	}
+	return matched
+}
+
+func TestTenantFilterAgreesWithTenantOf(t *testing.T) {
+	devices := []string{
+		"factory_001_device_0001",
+		"factory_0010_device_0001",
+		"factory_001_device_0001_device_2",
+		"factory%_device_1",
+		"factory\\_device_1",
+		"a_device",
+		"a_device_device_z",
+		"_device_x",
+		"__device_x",
+		"_device_x_device_y",
+		"device_1",
+		"sensor-42",
+		"",
+	}
+	tenants := []string{defaultTenant, "factory_001", "factory_0010", "factory%", "factory\\", "a", "_", "a_device", "x_device_y", ""}
+
+	for _, tenant := range tenants {
+		clause, args := tenantFilter("device_id", []string{tenant})
+		for _, deviceID := range devices {
+			want := tenantOf(deviceID) == tenant
+			if got := evalTenantFilter(t, clause, args, deviceID); got != want {
+				t.Errorf("tenant %q, device %q: filter %q %v matches = %v, tenantOf = %q",
+					tenant, deviceID, clause, args, got, tenantOf(deviceID))
+			}
+		}
+	}
+
+	// 多个租户的条件按 OR 组合
+	clause, args := tenantFilter("device_id", []string{"factory_001", defaultTenant})
+	for _, deviceID := range devices {
+		tenant := tenantOf(deviceID)
+		want := tenant == "factory_001" || tenant == defaultTenant
+		if got := evalTenantFilter(t, clause, args, deviceID); got != want {
+			t.Errorf("device %q: combined filter matches = %v, want %v", deviceID, got, want)
+		}
+	}
+
+	if clause, args := tenantFilter("device_id", nil); clause != "" || args != nil {
+		t.Errorf("tenantFilter(nil) = %q, %v", clause, args)
+	}
+	if clause, _ := tenantFilter("device_id", []string{}); clause != "1 = 0" {
+		t.Errorf("tenantFilter([]) = %q", clause)
+	}
+}
+
+func TestSeriesFilterAppliesDeviceAccess(t *testing.T) {
+	// 证书只映射到一个设备时，按工厂前缀选择也只能选到该设备
+	filter := seriesFilter{
+		devicePrefix: "factory_001_",
+		tenants:      []string{"factory_001"},
+		access:       deviceAccess{certPrefixes: []string{"factory_001_device_0001"}},
+	}
+	where, args := filter.where()
+	want := `1 = 1 AND device_id LIKE ? AND (device_id LIKE ?) AND (device_id LIKE ? OR device_id LIKE ?)`
+	if where != want {
+		t.Fatalf("where = %q, want %q", where, want)
+	}
+	wantArgs := []interface{}{`factory\_001\_%`, `factory\_001\_device\_%`, `factory\_001\_device\_0001`, `factory\_001\_device\_0001\_%`}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Fatalf("args = %q, want %q", args, wantArgs)
+	}
+
+	filter.access = deviceAccess{signedDevice: "factory_001_device_0002"}
+	if where, args := filter.where(); !strings.HasSuffix(where, " AND device_id = ?") || args[len(args)-1] != "factory_001_device_0002" {
+		t.Fatalf("signed device not applied: %q %q", where, args)
+	}
+}
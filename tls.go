@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tlsReloadInterval 检查证书文件变化的间隔
+const tlsReloadInterval = 10 * time.Second
+
+// TLS 客户端证书校验模式
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional" // 提供证书时校验
+	clientAuthRequire  = "require"  // 必须提供有效证书（mTLS）
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites 将套件名称转换为ID，只允许 Go 认为安全的套件
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// fileVersion 记录文件修改时间和大小，用于判断证书是否更新
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// CertReloader 持有当前的服务端证书和客户端CA，证书文件变化时自动重新加载
+type CertReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	logger       *logrus.Logger
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	versions map[string]fileVersion
+}
+
+func NewCertReloader(certFile, keyFile, clientCAFile string, logger *logrus.Logger) (*CertReloader, error) {
+	cr := &CertReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		logger:       logger,
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload 重新读取证书、私钥和客户端CA；失败时保留当前证书
+func (cr *CertReloader) Reload() error {
+	versions := make(map[string]fileVersion)
+	for _, path := range []string{cr.certFile, cr.keyFile, cr.clientCAFile} {
+		if path == "" {
+			continue
+		}
+		v, err := statFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		versions[path] = v
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+
+	var clientCA *x509.CertPool
+	if cr.clientCAFile != "" {
+		pem, err := os.ReadFile(cr.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", cr.clientCAFile)
+		}
+	}
+
+	cr.mutex.Lock()
+	cr.cert = &cert
+	cr.clientCA = clientCA
+	cr.versions = versions
+	cr.mutex.Unlock()
+	return nil
+}
+
+// changed 判断证书相关文件是否有变化
+func (cr *CertReloader) changed() bool {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	for path, old := range cr.versions {
+		v, err := statFile(path)
+		if err != nil {
+			// 证书轮换过程中文件可能暂时不存在，等下一轮再检查
+			return false
+		}
+		if v != old {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch 定期检查证书文件，变化时重新加载
+func (cr *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+			if err := cr.Reload(); err != nil {
+				cr.logger.WithError(err).Error("Failed to reload TLS certificates, keeping previous ones")
+				continue
+			}
+			cr.logger.Info("TLS certificates reloaded")
+		case <-stop:
+			return
+		}
+	}
+}
+
+// GetCertificate 供 tls.Config 使用，返回当前证书
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.cert, nil
+}
+
+// ClientCAs 返回当前的客户端CA
+func (cr *CertReloader) ClientCAs() *x509.CertPool {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.clientCA
+}
+
+// buildTLSConfig 根据配置构造 tls.Config
+// 通过 GetConfigForClient 在每次握手时读取最新的证书和客户端CA，实现不重启更新
+func buildTLSConfig(config *Config, reloader *CertReloader) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls min_version %q (expected 1.2 or 1.3)", config.TLSMinVersion)
+	}
+	cipherSuites, err := parseCipherSuites(config.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	var clientAuth tls.ClientAuthType
+	switch config.TLSClientAuth {
+	case clientAuthNone:
+		clientAuth = tls.NoClientCert
+	case clientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid tls client_auth %q (expected none, optional or require)", config.TLSClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && config.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("tls client_ca_file is required when client_auth is %s", config.TLSClientAuth)
+	}
+
+	base := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		ClientAuth:     clientAuth,
+		GetCertificate: reloader.GetCertificate,
+	}
+	return &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := base.Clone()
+			cfg.ClientCAs = reloader.ClientCAs()
+			return cfg, nil
+		},
+	}, nil
+}
+
+// clientCertPrefixes 返回客户端证书允许写入的设备ID前缀
+// 证书的 CN 和 DNS SAN 先按 tls.client_prefixes 映射，未配置映射时直接作为前缀；
+// 未提供已校验的客户端证书时返回 nil
+func (s *Server) clientCertPrefixes(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+
+	identities := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	prefixes := make([]string, 0, len(identities))
+	for _, identity := range identities {
+		if identity == "" {
+			continue
+		}
+		if prefix, ok := s.config.TLSClientPrefixes[identity]; ok {
+			prefixes = append(prefixes, prefix)
+		} else if len(s.config.TLSClientPrefixes) == 0 {
+			prefixes = append(prefixes, identity)
+		}
+	}
+	if len(prefixes) == 0 {
+		// 证书有效但没有任何映射：不允许访问任何设备
+		return []string{}
+	}
+	return prefixes
+}
+
+// certAllowsDevice 判断设备ID是否匹配客户端证书的任一前缀
+// 前缀须在 '_' 处结束（或与设备ID相同），factory_001 不匹配 factory_0010_device_001
+func certAllowsDevice(prefixes []string, deviceID string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			continue
+		}
+		if deviceID == prefix ||
+			(strings.HasSuffix(prefix, "_") && strings.HasPrefix(deviceID, prefix)) ||
+			strings.HasPrefix(deviceID, prefix+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// certPrefixFilter 构造与 certAllowsDevice 一致的 SQL 条件，prefixes 为 nil 时返回空条件
+func certPrefixFilter(column string, prefixes []string) (string, []interface{}) {
+	if prefixes == nil {
+		return "", nil
+	}
+	var conditions []string
+	var args []interface{}
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			continue
+		}
+		if strings.HasSuffix(prefix, "_") {
+			conditions = append(conditions, column+" LIKE ?")
+			args = append(args, escapeLike(prefix)+"%")
+			continue
+		}
+		conditions = append(conditions, column+" LIKE ?", column+" LIKE ?")
+		args = append(args, escapeLike(prefix), escapeLike(prefix)+`\_%`)
+	}
+	if len(conditions) == 0 {
+		return "1 = 0", nil
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCertAllowsDevice(t *testing.T) {
+	tests := []struct {
+		prefixes []string
+		deviceID string
+		want     bool
+	}{
+		// 前缀须在 '_' 处结束
+		{[]string{"factory_001"}, "factory_001_device_0001", true},
+		{[]string{"factory_001"}, "factory_0010_device_0001", false},
+		{[]string{"factory_001"}, "factory_001", true},
+		{[]string{"factory_001"}, "factory_0011", false},
+		{[]string{"factory_0010"}, "factory_001_device_0001", false},
+		// 以 '_' 结尾的前缀直接按前缀匹配
+		{[]string{"factory_001_"}, "factory_001_device_0001", true},
+		{[]string{"factory_001_"}, "factory_0010_device_0001", false},
+		{[]string{"factory_001_"}, "factory_001", false},
+		{[]string{"factory_001_device_"}, "factory_001_device_0001", true},
+		{[]string{"factory_001_device_"}, "factory_001_sensor_0001", false},
+		// 设备级前缀只匹配该设备（及其下级ID）
+		{[]string{"factory_001_device_0001"}, "factory_001_device_0001", true},
+		{[]string{"factory_001_device_0001"}, "factory_001_device_0002", false},
+		{[]string{"factory_001_device_0001"}, "factory_001_device_00010", false},
+		// 空前缀不匹配任何设备
+		{[]string{""}, "factory_001_device_0001", false},
+		{[]string{""}, "", false},
+		{[]string{}, "factory_001_device_0001", false},
+		{nil, "factory_001_device_0001", false},
+		// 任一前缀匹配即可
+		{[]string{"", "factory_002", "factory_001"}, "factory_001_device_0001", true},
+	}
+	for _, tt := range tests {
+		if got := certAllowsDevice(tt.prefixes, tt.deviceID); got != tt.want {
+			t.Errorf("certAllowsDevice(%q, %q) = %v, want %v", tt.prefixes, tt.deviceID, got, tt.want)
+		}
+	}
+}
+
+func TestClientCertPrefixes(t *testing.T) {
+	leaf := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "gateway-01"},
+		DNSNames: []string{"gateway-01.factory.local"},
+	}
+	tests := []struct {
+		name     string
+		mapping  map[string]string
+		verified bool
+		want     []string
+	}{
+		{"no certificate", nil, false, nil},
+		{"identities as prefixes", nil, true, []string{"gateway-01", "gateway-01.factory.local"}},
+		{"mapped identity", map[string]string{"gateway-01": "factory_001"}, true, []string{"factory_001"}},
+		{"unmapped identity", map[string]string{"gateway-02": "factory_002"}, true, []string{}},
+	}
+	for _, tt := range tests {
+		s := &Server{config: &Config{TLSClientPrefixes: tt.mapping}}
+		r := httptest.NewRequest("POST", "/api/sensor-data", nil)
+		if tt.verified {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+		}
+		if got := s.clientCertPrefixes(r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: clientCertPrefixes = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCertPrefixFilterAgreesWithCertAllowsDevice(t *testing.T) {
+	devices := []string{
+		"factory_001_device_0001",
+		"factory_001_device_0002",
+		"factory_001_device_00010",
+		"factory_0010_device_0001",
+		"factory_001",
+		"factory_0011",
+		"factory%_device_1",
+		"factoryX001_device_0001",
+		"",
+	}
+	prefixSets := [][]string{
+		{"factory_001"},
+		{"factory_001_"},
+		{"factory_001_device_0001"},
+		{"factory%"},
+		{"", "factory_0010"},
+		{""},
+		{},
+	}
+	for _, prefixes := range prefixSets {
+		clause, args := certPrefixFilter("device_id", prefixes)
+		for _, deviceID := range devices {
+			want := certAllowsDevice(prefixes, deviceID)
+			if got := evalTenantFilter(t, clause, args, deviceID); got != want {
+				t.Errorf("prefixes %q, device %q: filter %q %v matches = %v, certAllowsDevice = %v",
+					prefixes, deviceID, clause, args, got, want)
+			}
+		}
+	}
+	if clause, args := certPrefixFilter("device_id", nil); clause != "" || args != nil {
+		t.Errorf("certPrefixFilter(nil) = %q, %v", clause, args)
+	}
+}
@@ -235,3 +235,63 @@ func GetPayloadInfo(data string) map[string]interface{} {
 
 	return info
 }
+
+// truncateRunes 按字符截断字符串（与 MySQL SUBSTRING 语义一致）
+func truncateRunes(s string, n int) string {
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// factoryPrefix 从 factory_XXX_device_YYY 形式的设备ID中解析工厂前缀（factory_XXX）
+// 不符合该模式时返回空串
+func factoryPrefix(deviceID string) string {
+	if i := strings.Index(deviceID, "_device_"); i > 0 {
+		return deviceID[:i]
+	}
+	return ""
+}
+
+// containsString 判断切片中是否包含指定字符串
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCursor 将分页位置编码为不透明的游标
+func encodeCursor(position ...interface{}) string {
+	b, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor 解码 encodeCursor 生成的游标，dest 为各位置字段的指针
+func decodeCursor(cursor string, dest ...interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	var parts []json.RawMessage
+	if err := json.Unmarshal(b, &parts); err != nil || len(parts) != len(dest) {
+		return fmt.Errorf("invalid cursor")
+	}
+	for i, part := range parts {
+		if err := json.Unmarshal(part, dest[i]); err != nil {
+			return fmt.Errorf("invalid cursor")
+		}
+	}
+	return nil
+}
+
+// globToLike 将 glob 模式（* 匹配任意字符，? 匹配单个字符）转换为 LIKE 模式
+func globToLike(pattern string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(escapeLike(pattern))
+}
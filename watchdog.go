@@ -0,0 +1,429 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchdogForgetAfter 超过该时间未上报的序列不再跟踪（之后恢复上报视为新序列）
+	watchdogForgetAfter = 24 * time.Hour
+	// watchdogLearnWeight 学习上报间隔时新观测值的权重（指数移动平均）
+	watchdogLearnWeight = 0.25
+	// watchdogPersistChange 学习到的间隔变化超过该比例时才重新写回 watchdog_state
+	watchdogPersistChange = 0.1
+	// watchdogFlushChunkSize 每条 upsert 语句包含的序列数
+	watchdogFlushChunkSize = 500
+)
+
+// initWatchdogStorage 创建 watchdog_state 表，保存学习到的上报间隔和静默状态，重启后继续使用
+func initWatchdogStorage(db *sql.DB) error {
+	createWatchdogStateTable := `
+	CREATE TABLE IF NOT EXISTS watchdog_state (
+		device_id VARCHAR(100) NOT NULL,
+		metric_name VARCHAR(50) NOT NULL,
+		interval_ms BIGINT NOT NULL DEFAULT 0,
+		samples INT NOT NULL DEFAULT 0,
+		silent BOOLEAN NOT NULL DEFAULT FALSE,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (device_id, metric_name)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`
+	if _, err := db.Exec(createWatchdogStateTable); err != nil {
+		return fmt.Errorf("failed to create watchdog_state table: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval 配置的预期上报间隔，按顺序匹配，第一条匹配的生效
+// device_prefix / metric 为空表示不限制；interval 为 0 表示不监控匹配的序列
+type WatchdogInterval struct {
+	DevicePrefix string `yaml:"device_prefix"`
+	Metric       string `yaml:"metric"`
+	Interval     string `yaml:"interval"`
+}
+
+type watchdogRule struct {
+	devicePrefix string
+	metric       string
+	interval     time.Duration
+}
+
+// watchdogPolicy 静默检测配置，运行时重新加载时整体替换
+type watchdogPolicy struct {
+	enabled     bool
+	tolerance   float64       // 超过 预期间隔 × tolerance 未上报时告警
+	minSamples  int           // 学习到的间隔至少基于这么多次观测才生效
+	minInterval time.Duration // 学习到的间隔下限，避免高频序列稍有抖动就告警
+	rules       []watchdogRule
+}
+
+func newWatchdogPolicy(config *Config) (watchdogPolicy, error) {
+	policy := watchdogPolicy{
+		enabled:    config.WatchdogEnabled,
+		tolerance:  config.WatchdogTolerance,
+		minSamples: config.WatchdogMinSamples,
+	}
+	if policy.tolerance < 1 {
+		return policy, fmt.Errorf("invalid watchdog tolerance %g (must be at least 1)", policy.tolerance)
+	}
+	minInterval, err := time.ParseDuration(config.WatchdogMinInterval)
+	if err != nil {
+		return policy, fmt.Errorf("invalid watchdog min_interval %q: %w", config.WatchdogMinInterval, err)
+	}
+	policy.minInterval = minInterval
+
+	for i, rule := range config.WatchdogIntervals {
+		interval, err := time.ParseDuration(rule.Interval)
+		if err != nil || interval < 0 {
+			return policy, fmt.Errorf("watchdog intervals[%d]: invalid interval %q", i, rule.Interval)
+		}
+		policy.rules = append(policy.rules, watchdogRule{
+			devicePrefix: rule.DevicePrefix,
+			metric:       rule.Metric,
+			interval:     interval,
+		})
+	}
+	return policy, nil
+}
+
+// expected 返回序列的预期上报间隔，0 表示不监控（未配置且尚未学习到）
+func (p *watchdogPolicy) expected(key seriesKey, state *watchState) time.Duration {
+	for _, rule := range p.rules {
+		if strings.HasPrefix(key.deviceID, rule.devicePrefix) && (rule.metric == "" || rule.metric == key.metricName) {
+			return rule.interval
+		}
+	}
+	if state.samples < p.minSamples || state.interval <= 0 {
+		return 0
+	}
+	if state.interval < p.minInterval {
+		return p.minInterval
+	}
+	return state.interval
+}
+
+// watchState 单个序列的跟踪状态
+type watchState struct {
+	lastSeen time.Time
+	interval time.Duration // 学习到的上报间隔
+	samples  int           // 参与学习的间隔数
+	silent   bool
+
+	persisted time.Duration // 上次写回的间隔
+}
+
+// observe 记录一次上报，更新学习到的间隔
+func (ws *watchState) observe(now time.Time) {
+	if !ws.lastSeen.IsZero() {
+		if gap := now.Sub(ws.lastSeen); gap > 0 {
+			if ws.samples == 0 {
+				ws.interval = gap
+			} else {
+				ws.interval += time.Duration(float64(gap-ws.interval) * watchdogLearnWeight)
+			}
+			ws.samples++
+		}
+	}
+	ws.lastSeen = now
+}
+
+// Watchdog 设备静默检测：跟踪每个序列（设备+指标）的上报时间，超过预期间隔未上报时告警，恢复上报时解除
+// 学习到的间隔和静默状态写回 watchdog_state，重启后由 Seed 载入
+type Watchdog struct {
+	db *sql.DB
+
+	mutex   sync.Mutex
+	policy  watchdogPolicy
+	series  map[seriesKey]*watchState
+	dirty   map[seriesKey]bool // 间隔或静默状态有变化、尚未写回的序列
+	onAlert func([]*Alert)
+}
+
+func NewWatchdog(db *sql.DB, policy watchdogPolicy, metrics *Metrics, onAlert func([]*Alert)) *Watchdog {
+	wd := &Watchdog{
+		db:      db,
+		policy:  policy,
+		series:  make(map[seriesKey]*watchState),
+		dirty:   make(map[seriesKey]bool),
+		onAlert: onAlert,
+	}
+	metrics.RegisterCounter("bench_alerts_total", "Alerts raised and resolved, by kind.")
+	metrics.RegisterGauge("bench_silent_series", "Series currently considered silent by the watchdog.", func() float64 {
+		return float64(len(wd.Silent(nil)))
+	})
+	return wd
+}
+
+// SetPolicy 替换静默检测配置
+func (wd *Watchdog) SetPolicy(policy watchdogPolicy) {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	wd.policy = policy
+}
+
+// Seed 从 series_index 载入最近上报过的序列的最后上报时间，并从 watchdog_state 载入学习到的间隔和静默状态，
+// 使重启前已停止上报的设备也能被检测到，重启前已产生的静默告警在恢复上报时也能解除
+func (wd *Watchdog) Seed() error {
+	forgetBefore := time.Now().Add(-watchdogForgetAfter)
+	// 状态只在间隔明显变化时写回，updated_at 不代表最近上报时间，按 series_index 清理不再跟踪的序列
+	if _, err := wd.db.Exec(`
+		DELETE w FROM watchdog_state w
+		LEFT JOIN series_index i ON i.device_id = w.device_id AND i.metric_name = w.metric_name
+		WHERE i.device_id IS NULL OR i.last_timestamp < ?
+	`, forgetBefore); err != nil {
+		return fmt.Errorf("failed to prune watchdog_state: %w", err)
+	}
+	rows, err := wd.db.Query(`
+		SELECT i.device_id, i.metric_name, i.last_timestamp,
+			COALESCE(w.interval_ms, 0), COALESCE(w.samples, 0), COALESCE(w.silent, FALSE)
+		FROM series_index i
+		LEFT JOIN watchdog_state w ON w.device_id = i.device_id AND w.metric_name = i.metric_name
+		WHERE i.last_timestamp >= ?
+	`, forgetBefore)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	for rows.Next() {
+		var key seriesKey
+		var last time.Time
+		var intervalMs int64
+		state := &watchState{}
+		if err := rows.Scan(&key.deviceID, &key.metricName, &last, &intervalMs, &state.samples, &state.silent); err != nil {
+			return err
+		}
+		state.lastSeen = last
+		state.interval = time.Duration(intervalMs) * time.Millisecond
+		state.persisted = state.interval
+		wd.series[key] = state
+	}
+	return rows.Err()
+}
+
+// markLearned 学习到的间隔生效后，变化足够大时标记写回，调用方需持有 mutex
+func (wd *Watchdog) markLearned(key seriesKey, state *watchState) {
+	if state.samples < wd.policy.minSamples {
+		return
+	}
+	change := state.interval - state.persisted
+	if change < 0 {
+		change = -change
+	}
+	if state.persisted > 0 && float64(change) <= float64(state.persisted)*watchdogPersistChange {
+		return
+	}
+	state.persisted = state.interval
+	wd.dirty[key] = true
+}
+
+// watchdogRow 待写回的序列状态
+type watchdogRow struct {
+	key      seriesKey
+	interval time.Duration
+	samples  int
+	silent   bool
+}
+
+// Flush 将有变化的序列状态写入 watchdog_state，写回失败的部分保留到下次
+func (wd *Watchdog) Flush() {
+	wd.mutex.Lock()
+	pending := make([]watchdogRow, 0, len(wd.dirty))
+	for key := range wd.dirty {
+		if state, ok := wd.series[key]; ok {
+			pending = append(pending, watchdogRow{key: key, interval: state.interval, samples: state.samples, silent: state.silent})
+		}
+	}
+	wd.dirty = make(map[seriesKey]bool)
+	wd.mutex.Unlock()
+
+	for start := 0; start < len(pending); start += watchdogFlushChunkSize {
+		end := start + watchdogFlushChunkSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		chunk := pending[start:end]
+		if err := wd.upsert(chunk); err != nil {
+			wd.mutex.Lock()
+			for _, row := range chunk {
+				wd.dirty[row.key] = true
+			}
+			wd.mutex.Unlock()
+		}
+	}
+}
+
+// upsert 批量写回一组序列状态
+func (wd *Watchdog) upsert(rows []watchdogRow) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO watchdog_state (device_id, metric_name, interval_ms, samples, silent) VALUES ")
+	args := make([]interface{}, 0, len(rows)*5)
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString("(?, ?, ?, ?, ?)")
+		args = append(args, row.key.deviceID, row.key.metricName, row.interval.Milliseconds(), row.samples, row.silent)
+	}
+	query.WriteString(`
+		ON DUPLICATE KEY UPDATE
+			interval_ms = VALUES(interval_ms),
+			samples = VALUES(samples),
+			silent = VALUES(silent)
+	`)
+	_, err := wd.db.Exec(query.String(), args...)
+	return err
+}
+
+// Record 记录写入的数据，静默中的序列恢复上报时解除告警
+func (wd *Watchdog) Record(rows []*SensorData) {
+	now := time.Now()
+	var resolved []*Alert
+
+	wd.mutex.Lock()
+	if !wd.policy.enabled {
+		wd.mutex.Unlock()
+		return
+	}
+	seen := make(map[seriesKey]bool, len(rows))
+	for _, row := range rows {
+		key := seriesKey{deviceID: row.DeviceID, metricName: row.MetricName}
+		if seen[key] {
+			continue // 同一请求中的多条数据只算一次上报
+		}
+		seen[key] = true
+
+		state, ok := wd.series[key]
+		if !ok {
+			state = &watchState{}
+			wd.series[key] = state
+		}
+		if state.silent {
+			state.silent = false
+			wd.dirty[key] = true
+			resolved = append(resolved, &Alert{
+				Kind:       alertKindSilent,
+				DeviceID:   key.deviceID,
+				MetricName: key.metricName,
+				Message:    fmt.Sprintf("Device %s resumed reporting %s after %s", key.deviceID, key.metricName, now.Sub(state.lastSeen).Round(time.Second)),
+				Resolved:   true,
+				Timestamp:  now.Format(time.RFC3339),
+			})
+		}
+		state.observe(now)
+		wd.markLearned(key, state)
+	}
+	wd.mutex.Unlock()
+
+	if len(resolved) > 0 {
+		wd.onAlert(resolved)
+	}
+}
+
+// Check 检查所有序列，对超过预期间隔未上报的序列告警
+func (wd *Watchdog) Check(now time.Time) {
+	var raised []*Alert
+
+	wd.mutex.Lock()
+	if !wd.policy.enabled {
+		wd.mutex.Unlock()
+		return
+	}
+	for key, state := range wd.series {
+		age := now.Sub(state.lastSeen)
+		if age > watchdogForgetAfter {
+			delete(wd.series, key)
+			delete(wd.dirty, key)
+			continue
+		}
+		if state.silent {
+			continue
+		}
+		expected := wd.policy.expected(key, state)
+		if expected <= 0 || float64(age) <= float64(expected)*wd.policy.tolerance {
+			continue
+		}
+		state.silent = true
+		wd.dirty[key] = true
+		raised = append(raised, &Alert{
+			Kind:       alertKindSilent,
+			DeviceID:   key.deviceID,
+			MetricName: key.metricName,
+			Message:    fmt.Sprintf("Device %s silent: no %s data for %s (expected every %s)", key.deviceID, key.metricName, age.Round(time.Second), expected.Round(time.Second)),
+			Timestamp:  now.Format(time.RFC3339),
+		})
+	}
+	wd.mutex.Unlock()
+
+	if len(raised) > 0 {
+		wd.onAlert(raised)
+	}
+}
+
+// Run 定期检查并写回序列状态，stop 关闭时做最后一次写回
+func (wd *Watchdog) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			wd.Check(now)
+			wd.Flush()
+		case <-stop:
+			wd.Flush()
+			return
+		}
+	}
+}
+
+// silentSeries 静默中的序列
+type silentSeries struct {
+	DeviceID   string `json:"device_id" msgpack:"device_id"`
+	MetricName string `json:"metric_name" msgpack:"metric_name"`
+	LastSeen   string `json:"last_seen" msgpack:"last_seen"`
+	Expected   string `json:"expected_interval" msgpack:"expected_interval"`
+}
+
+// Silent 返回静默中的序列，按设备ID和指标名排序；tenants 为 nil 时不限制租户
+func (wd *Watchdog) Silent(tenants []string) []silentSeries {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+
+	result := make([]silentSeries, 0)
+	for key, state := range wd.series {
+		if !state.silent || (tenants != nil && !containsString(tenants, tenantOf(key.deviceID))) {
+			continue
+		}
+		result = append(result, silentSeries{
+			DeviceID:   key.deviceID,
+			MetricName: key.metricName,
+			LastSeen:   state.lastSeen.Format(time.RFC3339),
+			Expected:   wd.policy.expected(key, state).String(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].DeviceID != result[j].DeviceID {
+			return result[i].DeviceID < result[j].DeviceID
+		}
+		return result[i].MetricName < result[j].MetricName
+	})
+	return result
+}
+
+// silentSeriesHandler 当前静默的序列：GET /api/alerts/silent
+func (s *Server) silentSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	series := s.watchdog.Silent(s.requestTenants(r))
+	s.writeResponse(w, r, map[string]interface{}{
+		"status": "success",
+		"count":  len(series),
+		"series": series,
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdogSeededStateAlertsAndResolves(t *testing.T) {
+	var alerts []*Alert
+	policy := watchdogPolicy{enabled: true, tolerance: 3, minSamples: 5, minInterval: time.Second}
+	wd := NewWatchdog(nil, policy, NewMetrics(), func(a []*Alert) { alerts = append(alerts, a...) })
+
+	// 相当于 Seed 从 watchdog_state 载入：重启前学习到 10s 的间隔，之后停止上报
+	now := time.Now()
+	learned := seriesKey{deviceID: "factory_001_device_0001", metricName: "temperature"}
+	silent := seriesKey{deviceID: "factory_001_device_0002", metricName: "temperature"}
+	wd.series[learned] = &watchState{lastSeen: now.Add(-time.Minute), interval: 10 * time.Second, samples: 5, persisted: 10 * time.Second}
+	wd.series[silent] = &watchState{lastSeen: now.Add(-time.Hour), interval: 10 * time.Second, samples: 5, persisted: 10 * time.Second, silent: true}
+
+	wd.Check(now)
+	if len(alerts) != 1 || alerts[0].DeviceID != learned.deviceID || alerts[0].Resolved {
+		t.Fatalf("alerts after check = %+v, want one silent alert for %s", alerts, learned.deviceID)
+	}
+	if !wd.dirty[learned] {
+		t.Fatal("raised silent state not marked for persistence")
+	}
+
+	// 重启前已告警的序列恢复上报时解除
+	alerts = nil
+	wd.Record([]*SensorData{{DeviceID: silent.deviceID, MetricName: silent.metricName}})
+	if len(alerts) != 1 || alerts[0].DeviceID != silent.deviceID || !alerts[0].Resolved {
+		t.Fatalf("alerts after record = %+v, want resolved alert for %s", alerts, silent.deviceID)
+	}
+	if !wd.dirty[silent] || wd.series[silent].silent {
+		t.Fatal("resolved state not marked for persistence")
+	}
+}
+
+func TestWatchdogMarkLearned(t *testing.T) {
+	wd := NewWatchdog(nil, watchdogPolicy{enabled: true, tolerance: 3, minSamples: 5}, NewMetrics(), func([]*Alert) {})
+	key := seriesKey{deviceID: "factory_001_device_0001", metricName: "temperature"}
+	tests := []struct {
+		state *watchState
+		dirty bool
+	}{
+		{&watchState{interval: 10 * time.Second, samples: 4}, false},                                      // 尚未生效
+		{&watchState{interval: 10 * time.Second, samples: 5}, true},                                       // 首次生效
+		{&watchState{interval: 10500 * time.Millisecond, samples: 9, persisted: 10 * time.Second}, false}, // 变化不大
+		{&watchState{interval: 12 * time.Second, samples: 9, persisted: 10 * time.Second}, true},
+	}
+	for i, tt := range tests {
+		wd.dirty = make(map[seriesKey]bool)
+		wd.markLearned(key, tt.state)
+		if wd.dirty[key] != tt.dirty {
+			t.Errorf("case %d: dirty = %v, want %v", i, wd.dirty[key], tt.dirty)
+		}
+		if tt.dirty && tt.state.persisted != tt.state.interval {
+			t.Errorf("case %d: persisted = %s, want %s", i, tt.state.persisted, tt.state.interval)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait 单次写入 WebSocket 消息的超时
+	wsWriteWait = 10 * time.Second
+	// wsPongWait 超过该时间未收到客户端消息（含 pong）时断开
+	wsPongWait = 60 * time.Second
+	// wsPingInterval 服务端 ping 间隔，需小于 wsPongWait
+	wsPingInterval = 30 * time.Second
+	// wsMaxMessageBytes 客户端消息大小上限
+	wsMaxMessageBytes = 8 << 10
+	// wsMaxSubscriptions 每个连接的订阅条件数上限
+	wsMaxSubscriptions = 50
+	// wsMaxBatchEvents 单条批量消息的事件数上限，达到后立即发送
+	wsMaxBatchEvents = 1000
+)
+
+// wsClientMessage 客户端消息：subscribe（按 id 新增或替换订阅条件）/ unsubscribe
+type wsClientMessage struct {
+	Action      string   `json:"action"`
+	ID          string   `json:"id"`
+	Prefix      string   `json:"prefix,omitempty"`
+	Metrics     []string `json:"metrics,omitempty"`
+	MinPriority int      `json:"min_priority,omitempty"`
+	Types       []string `json:"types,omitempty"`
+}
+
+// wsServerMessage 服务端消息：subscribed / unsubscribed / error / events
+type wsServerMessage struct {
+	Type          string     `json:"type"`
+	ID            string     `json:"id,omitempty"`
+	Message       string     `json:"message,omitempty"`
+	Subscriptions []string   `json:"subscriptions,omitempty"`
+	Events        []*wsEvent `json:"events,omitempty"`
+}
+
+// wsEvent 推送的事件及其匹配的订阅 id
+type wsEvent struct {
+	*StreamEvent
+	Subscriptions []string `json:"subscriptions"`
+}
+
+// wsSession 一个 WebSocket 连接上的订阅条件，读协程修改，写协程读取
+type wsSession struct {
+	mutex   sync.Mutex
+	filters map[string]StreamFilter
+}
+
+// list 返回订阅条件列表（按 id 排序，用于更新总线上的订阅）
+func (ws *wsSession) list() ([]string, []StreamFilter) {
+	ids := make([]string, 0, len(ws.filters))
+	for id := range ws.filters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	filters := make([]StreamFilter, len(ids))
+	for i, id := range ids {
+		filters[i] = ws.filters[id]
+	}
+	return ids, filters
+}
+
+// matching 返回事件匹配的订阅 id；订阅条件变更前已缓冲、变更后不再匹配的事件返回空
+func (ws *wsSession) matching(event *StreamEvent) []string {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	var ids []string
+	for id, filter := range ws.filters {
+		if filter.match(event) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// wsUpgrader 按 stream.websocket_origins 校验跨域连接
+func (s *Server) wsUpgrader() *websocket.Upgrader {
+	origins := s.config.StreamWebSocketOrigins
+	upgrader := &websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 16384}
+	if len(origins) > 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || containsString(origins, "*") || containsString(origins, origin)
+		}
+	}
+	return upgrader
+}
+
+// websocketHandler WebSocket 订阅接口：GET /api/ws?flush_interval=250ms
+// 客户端发送 subscribe / unsubscribe 消息增减订阅条件，服务端按 flush_interval 批量推送匹配的数据和告警
+func (s *Server) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	flushInterval := parseDuration(s.config.StreamWebSocketFlushInterval)
+	if v := r.URL.Query().Get("flush_interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 50*time.Millisecond || d > time.Minute {
+			http.Error(w, "Invalid flush_interval (between 50ms and 1m)", http.StatusBadRequest)
+			return
+		}
+		flushInterval = d
+	}
+	tenants := s.requestTenants(r)
+
+	// 先不带订阅条件加入总线，收到 subscribe 后更新条件，连接期间始终是同一个订阅
+	sub, _, _, err := s.bus.Subscribe(nil, 0, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.bus.Unsubscribe(sub)
+
+	conn, err := s.wsUpgrader().Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade 已写入错误响应
+	}
+	defer conn.Close()
+
+	session := &wsSession{filters: make(map[string]StreamFilter)}
+	replies := make(chan *wsServerMessage, 16)
+	done := make(chan struct{})
+
+	// 读协程：处理订阅消息，连接断开时关闭 done
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(wsMaxMessageBytes)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					s.logger.WithError(err).Debug("WebSocket read failed")
+				}
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+			var reply *wsServerMessage
+			var message wsClientMessage
+			if err := json.Unmarshal(data, &message); err != nil {
+				reply = &wsServerMessage{Type: "error", Message: "Invalid JSON message"}
+			} else {
+				reply = s.handleWSMessage(session, sub, &message, tenants)
+			}
+			select {
+			case replies <- reply:
+			case <-time.After(wsWriteWait):
+				return // 写协程已退出或严重阻塞
+			}
+		}
+	}()
+
+	write := func(message interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(message)
+	}
+
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	var pending []*wsEvent
+	send := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		err := write(&wsServerMessage{Type: "events", Events: pending})
+		pending = nil
+		return err
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case reply := <-replies:
+			// 先发送已匹配的事件，保证订阅变更前后的顺序
+			if err := send(); err != nil {
+				return
+			}
+			if err := write(reply); err != nil {
+				return
+			}
+		case event, ok := <-sub.Events():
+			if !ok {
+				closeCode, reason := websocket.CloseGoingAway, "server shutting down"
+				if sub.CloseReason() == closeReasonSlow {
+					closeCode, reason = websocket.CloseTryAgainLater, "subscriber too slow"
+				}
+				send()
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason), time.Now().Add(wsWriteWait))
+				return
+			}
+			if ids := session.matching(event); len(ids) > 0 {
+				pending = append(pending, &wsEvent{StreamEvent: event, Subscriptions: ids})
+			}
+			if len(pending) >= wsMaxBatchEvents {
+				if err := send(); err != nil {
+					return
+				}
+			}
+		case <-flush.C:
+			if err := send(); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWSMessage 处理一条客户端消息，更新连接的订阅条件并返回应答
+func (s *Server) handleWSMessage(session *wsSession, sub *Subscription, message *wsClientMessage, tenants []string) *wsServerMessage {
+	if message.ID == "" {
+		return &wsServerMessage{Type: "error", Message: "id is required"}
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	var replyType string
+	switch message.Action {
+	case "subscribe":
+		filter := StreamFilter{
+			DevicePrefix: message.Prefix,
+			Metrics:      message.Metrics,
+			MinPriority:  message.MinPriority,
+			Types:        message.Types,
+			Tenants:      tenants,
+		}
+		if err := filter.validate(); err != nil {
+			return &wsServerMessage{Type: "error", ID: message.ID, Message: err.Error()}
+		}
+		if _, ok := session.filters[message.ID]; !ok && len(session.filters) >= wsMaxSubscriptions {
+			return &wsServerMessage{Type: "error", ID: message.ID, Message: "too many subscriptions on this connection"}
+		}
+		session.filters[message.ID] = filter
+		replyType = "subscribed"
+	case "unsubscribe":
+		if _, ok := session.filters[message.ID]; !ok {
+			return &wsServerMessage{Type: "error", ID: message.ID, Message: "unknown subscription"}
+		}
+		delete(session.filters, message.ID)
+		replyType = "unsubscribed"
+	default:
+		return &wsServerMessage{Type: "error", ID: message.ID, Message: "invalid action (expected subscribe or unsubscribe)"}
+	}
+
+	ids, filters := session.list()
+	s.bus.SetFilters(sub, filters)
+	return &wsServerMessage{Type: replyType, ID: message.ID, Subscriptions: ids}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -13,6 +11,12 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// defaultWriteTimeout 写入队列已满时 Write 的等待时间
+const defaultWriteTimeout = 100 * time.Millisecond
+
+// ErrWriteQueueFull 写入队列在超时时间内仍然已满，调用方应将其视为过载并退避重试
+var ErrWriteQueueFull = errors.New("write queue full")
+
 // BatchWriter 批量写入器
 type BatchWriter struct {
 	db           *sql.DB
@@ -24,6 +28,9 @@ type BatchWriter struct {
 	cancel       context.CancelFunc
 	logger       *logrus.Logger
 	writeChannel chan *SensorData
+
+	// prepareBatch 在批次写入数据库前对数据做变换（例如负载压缩），可为空
+	prepareBatch func(dataList []*SensorData) ([]*SensorData, error)
 }
 
 // NewBatchWriter 创建新的批量写入器
@@ -47,13 +54,22 @@ func NewBatchWriter(db *sql.DB, batchSize int, flushInterval time.Duration) *Bat
 	return bw
 }
 
-// Write 写入单条数据
+// Write 写入单条数据，队列已满且超时后返回 ErrWriteQueueFull
 func (bw *BatchWriter) Write(data *SensorData) error {
+	// 快速路径：队列未满时不创建定时器
 	select {
 	case bw.writeChannel <- data:
 		return nil
-	case <-time.After(100 * time.Millisecond):
-		return fmt.Errorf("write timeout")
+	default:
+	}
+	// 使用可停止的定时器，避免 time.After 在高并发下堆积未触发的定时器
+	timer := time.NewTimer(defaultWriteTimeout)
+	defer timer.Stop()
+	select {
+	case bw.writeChannel <- data:
+		return nil
+	case <-timer.C:
+		return ErrWriteQueueFull
 	}
 }
 
@@ -119,6 +135,15 @@ func (bw *BatchWriter) flushBatch(dataList []*SensorData) error {
 
 	start := time.Now()
 
+	if bw.prepareBatch != nil {
+		prepared, err := bw.prepareBatch(dataList)
+		if err != nil {
+			bw.logger.WithError(err).Error("Failed to prepare batch")
+			return err
+		}
+		dataList = prepared
+	}
+
 	// 使用事务批量插入
 	tx, err := bw.db.Begin()
 	if err != nil {
@@ -182,68 +207,31 @@ func (bw *BatchWriter) Close() error {
 	return nil
 }
 
-// CompressedWriter 压缩写入器
+// CompressedWriter 压缩写入器，data 列存储压缩后的负载（格式见 payload_codec.go）
+// 压缩在批次刷新时进行，batch_dictionary 模式下每个批次共用一个由该批负载构建的字典
 type CompressedWriter struct {
-	db          *sql.DB
 	batchWriter *BatchWriter
-	compression bool
-	logger      *logrus.Logger
+	compressor  *PayloadCompressor
 }
 
-// NewCompressedWriter 创建压缩写入器
-func NewCompressedWriter(db *sql.DB, batchSize int, flushInterval time.Duration, compression bool) *CompressedWriter {
-	return &CompressedWriter{
-		db:          db,
+// NewCompressedWriter 创建压缩写入器，compressor 为空时等同于 BatchWriter
+func NewCompressedWriter(db *sql.DB, batchSize int, flushInterval time.Duration, compressor *PayloadCompressor) *CompressedWriter {
+	cw := &CompressedWriter{
 		batchWriter: NewBatchWriter(db, batchSize, flushInterval),
-		compression: compression,
-		logger:      logrus.New(),
+		compressor:  compressor,
 	}
+	cw.batchWriter.prepareBatch = compressor.CompressBatch
+	return cw
 }
 
-// Write 写入数据（支持压缩）
+// Write 写入单条数据，负载在所在批次刷新时压缩
 func (cw *CompressedWriter) Write(data *SensorData) error {
-	if cw.compression {
-		// 压缩数据
-		compressedData := cw.compressData(data)
-		return cw.batchWriter.Write(compressedData)
-	}
-
 	return cw.batchWriter.Write(data)
 }
 
-// compressData 压缩数据
-func (cw *CompressedWriter) compressData(data *SensorData) *SensorData {
-	// 将数据序列化为JSON
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		cw.logger.WithError(err).Error("Failed to marshal data")
-		return data
-	}
-
-	// 压缩JSON数据
-	var buf bytes.Buffer
-	gw := gzip.NewWriter(&buf)
-
-	if _, err := gw.Write(jsonData); err != nil {
-		cw.logger.WithError(err).Error("Failed to compress data")
-		return data
-	}
-
-	if err := gw.Close(); err != nil {
-		cw.logger.WithError(err).Error("Failed to close gzip writer")
-		return data
-	}
-
-	// 创建压缩后的数据记录
-	compressedData := &SensorData{
-		Timestamp:  data.Timestamp,
-		DeviceID:   data.DeviceID,
-		MetricName: data.MetricName + "_compressed",
-		Value:      float64(buf.Len()), // 存储压缩后的大小
-		Priority:   data.Priority,
-	}
-
-	return compressedData
+// WriteBatch 批量写入数据，整批负载一起压缩
+func (cw *CompressedWriter) WriteBatch(dataList []*SensorData) error {
+	return cw.batchWriter.WriteBatch(dataList)
 }
 
 // Close 关闭压缩写入器